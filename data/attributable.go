@@ -1,59 +1,94 @@
 package data
 
+// An attributer is an object that embeds attributable.
+// Since methods of an embedded struct can not call methods of the struct that
+// embeds it, attributable calls back to its owner through this interface.
 type attributer interface {
     track(g *Graph)
+    
+    // Called before an attribute of the owner is added, changed, or removed.
+    // Old is nil when the attribute is being added, and new is nil when it is being removed.
+    // Returning an error stops the change.
+    attributeChanging(key string, old *Attribute, new *Attribute, g *Graph) *DataError
 }
 
 // Attributable provides functionality for objects that can have attributes.
 type attributable struct {
     firstAtt uint32
     aMap attributeMap // map stores the vertex's attributes by label
+    owner attributer  // the vertex or edge the attributes belong to
 }
 
-func (v *attributable) FirstAttribute(g *Graph) *Attribute {
+func (v *attributable) FirstAttribute(g *Graph) (*Attribute, *DataError) {
 	Assert(nilVertex, v != nil)
     Assert(nilGraph, g != nil)
 	Assert(nilAttributeStore, g.attributeStore != nil)
 	
+	if v.firstAtt == uint32(0) {
+	    return nil, nil
+	}
 	return g.attributeStore.Find(v.firstAtt)
 }
 
 // Returns a map of the attributes that belong to the object
 // Operations on the returned map will have no effect on persistence
-func (v *attributable) Attributes(g *Graph) attributeMap {
+func (v *attributable) Attributes(g *Graph) (attributeMap, *DataError) {
     Assert (nilVertex, v != nil)
     Assert (nilGraph, g != nil)
     
     if v.aMap == nil {
         m := make(attributeMap)
-        a := v.FirstAttribute(g)
+        a, err := v.FirstAttribute(g)
         for a != nil {
             m.add(a, g)
-            a = a.Next(g)
+            a, err = a.Next(g)
+        }
+        if err != nil {
+            return nil, err
         }
         
         v.aMap = m
     }
     
-    return v.aMap
+    return v.aMap, nil
 }
 
 // Updates or adds an attribute to the vertex.
 // This method takes care of tracking any changes to attributes or the vertex to the stores
-func (v *attributable) SetAttribute(a *Attribute, g *Graph) {
+func (v *attributable) SetAttribute(a *Attribute, g *Graph) *DataError {
     Assert (nilVertex, v != nil)
     Assert (nilGraph, g != nil)
     Assert (nilAttributeStore, g.attributeStore != nil)
     
-    m := v.Attributes(g)
-    key, _ := a.Key(g)
+    m, err := v.Attributes(g)
+    if err != nil {
+        return err
+    }
+    key, err := a.Key(g)
+    if err != nil {
+        return err
+    }
     
-    if m.hasKey(key) {
+    currentA, exists := m.get(key)
+    if err = v.owner.attributeChanging(key, currentA, a, g); err != nil {
+        return err
+    }
+    
+    if exists {
         // update the existing attribute
-        currentA, _ := m.get(key)
+        if currentA.t == text_t {
+            if t, _ := currentA.textObject(g); t != nil {
+                g.textStore.removeText(t)
+            }
+        }
         currentA.t = a.t
         currentA.data = a.data
         g.attributeStore.Track(currentA)
+        
+        // the existing attribute already holds a reference to the key
+        if err = g.labelStore.removeLabel(key, g); err != nil {
+            return err
+        }
     } else {
         // save the new attribute
         a.Id = g.attributeStore.nextId()
@@ -61,53 +96,121 @@ func (v *attributable) SetAttribute(a *Attribute, g *Graph) {
         v.firstAtt = a.Id
         m.add(a, g)
         g.attributeStore.Track(a)
+        g.statsStore.keyAdded(a.label)
         v.track(g)
     }
+    return nil
+}
+
+// Sets an attribute of the vertex by key and value.
+// This is a shortcut for creating the attribute with NewAttribute and calling SetAttribute.
+func (v *attributable) Set(key string, value Any, g *Graph) *DataError {
+    a, err := NewAttribute(key, value, g)
+    if err != nil {
+        return err
+    }
+    if err = v.SetAttribute(a, g); err != nil {
+        // give back the references the new attribute took
+        if a.t == text_t {
+            if t, _ := a.textObject(g); t != nil {
+                g.textStore.removeText(t)
+            }
+        }
+        // the error that stopped the attribute being set is the one to report
+        _ = g.labelStore.removeLabel(key, g)
+        return err
+    }
+    return nil
+}
+
+// Returns the value of an attribute by key, or nil if the attribute is not set.
+func (v *attributable) Get(key string, g *Graph) (Any, *DataError) {
+    m, err := v.Attributes(g)
+    if err != nil {
+        return nil, err
+    }
+    if a, ok := m.get(key); ok {
+        return a.Value(g)
+    }
+    return nil, nil
 }
 
-func (v *attributable) RemoveAttribute(a *Attribute, g *Graph) {
+func (v *attributable) RemoveAttribute(a *Attribute, g *Graph) *DataError {
     Assert(nilVertex, v != nil)
     Assert(nilGraph, g != nil)
     Assert(nilAttributeStore, g.attributeStore != nil)
     Assert(nilVertexStore, g.vertexStore != nil)
     
-    m := v.Attributes(g)
+    m, err := v.Attributes(g)
+    if err != nil {
+        return err
+    }
     
-    if ! m.has(a, g) {    // nothing to remove
-        return
+    key, err := a.Key(g)
+    if err != nil {
+        return err
+    }
+    a, ok := m.get(key)
+    if !ok {    // nothing to remove
+        return nil
+    }
+    
+    if err = v.owner.attributeChanging(key, a, nil, g); err != nil {
+        return err
     }
     
     if v.firstAtt == a.Id {
         v.firstAtt = a.next
         v.track(g)
-        g.attributeStore.Remove(a)
-        m.remove(a, g)
-        return
+    } else {
+        for _, attr := range m {
+            if attr.next == a.Id {
+                attr.next = a.next
+                g.attributeStore.Track(attr)
+                break
+            }
+        }
     }
     
-    for _, attr := range m {
-        if attr.next == a.Id {
-            attr.next = a.next
-            g.attributeStore.Track(attr)
-            g.attributeStore.Remove(a)
-            m.remove(a, g)
-            break
+    if a.t == text_t {
+        if t, _ := a.textObject(g); t != nil {
+            g.textStore.removeText(t)
         }
     }
+    m.remove(a, g)
+    g.statsStore.keyRemoved(a.label)
+    g.attributeStore.Remove(a)
+    return g.labelStore.removeLabel(key, g)
 }
 
-func (v *attributable) RemoveAttributeByKey(key string, g *Graph) {
+func (v *attributable) RemoveAttributeByKey(key string, g *Graph) *DataError {
     Assert(nilVertex, v != nil)
     
-    m := v.Attributes(g)
-    a, ok := m.get(key)
-    if ok {
-        v.RemoveAttribute(a, g)
+    m, err := v.Attributes(g)
+    if err != nil {
+        return err
     }
+    if a, ok := m.get(key); ok {
+        return v.RemoveAttribute(a, g)
+    }
+    return nil
 }
 
-func (v *attributable) track(g *Graph) {
-    panic("attributable.track() should be overwritten")
+// Removes every attribute of the vertex.
+func (v *attributable) removeAttributes(g *Graph) *DataError {
+    m, err := v.Attributes(g)
+    if err != nil {
+        return err
+    }
+    for _, a := range m {
+        if err = v.RemoveAttribute(a, g); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-
+func (v *attributable) track(g *Graph) {
+    Assert("attributable has no owner to track", v.owner != nil)
+    v.owner.track(g)
+}
@@ -1,6 +1,10 @@
 package data
 
 import (
+	"math"
+	"strconv"
+	"time"
+
 	"github.com/wardlem/graphlite/util"
 )
 
@@ -9,6 +13,10 @@ const (
     nilAttribute = "attempt to operate on nil attribute"
     keyRetrievalError = "error while retrieving attribute key"
     zeroAttributeId = "attribute had an id of 0 when it should not have"
+    unsupportedAttributeType = "unsupported attribute value type"
+    integerRangeError = "integer attribute value is too large for an int64: "
+    timeRangeError = "time attribute value is outside 1677-09-21 to 2262-04-11: "
+    textValueRetrievalError = "error while retrieving text attribute value"
 )
 
 const (
@@ -19,83 +27,262 @@ const (
     text_t = 0x04
     list_t = 0x05
     map_t = 0x06
+    time_t = 0x07
+)
+
+// An AttributeType is the type of the value of an attribute, for declaring attributes
+// in a class schema.
+type AttributeType byte
+
+const (
+    AnyType AttributeType = empty_t // any type of value is allowed
+    IntegerType AttributeType = integer_t
+    RealType AttributeType = real_t
+    BooleanType AttributeType = boolean_t
+    TextType AttributeType = text_t
+    ListType AttributeType = list_t
+    MapType AttributeType = map_t
+    TimeType AttributeType = time_t
 )
 
+func (t AttributeType) String() string {
+    switch t {
+    case AnyType:
+        return "any"
+    case IntegerType:
+        return "integer"
+    case RealType:
+        return "real"
+    case BooleanType:
+        return "boolean"
+    case TextType:
+        return "text"
+    case ListType:
+        return "list"
+    case MapType:
+        return "map"
+    case TimeType:
+        return "time"
+    }
+    return "unknown"
+}
+
 const attributeDataSize = 15
 
 type Attribute struct {
 	Id    uint32 // the id of the attribute
 	label uint16 // the id of the label for this attribute
 	t     byte   // the type of this label
-	data  []byte // the raw data for the value of this attribute; always 8 bytes
+	data  [8]byte // the raw data for the value of this attribute
 	next  uint32 // the id of the next attribute for the owner of this attribute
 }
 
-func constructAttribute(id uint32, bytes []byte) (*Attribute, *DataError) {
+// Creates an existing attribute from byte data.
+// The attribute does not keep a reference to the slice, so the caller may reuse it.
+func constructAttribute(id uint32, bytes []byte) *Attribute {
 	util.Assert(
 	    "An attribute can only be constructed with a slice of the proper length",
-		len(bytes) == 15)
+		len(bytes) == attributeDataSize)
 	
-	var e error
 	att := new(Attribute)
-	label := bytes[0:2]
-	t := bytes[2]
-	data := bytes[3:11]
-	next := bytes[11:15]
 	att.Id = id
-	att.label, e = util.BytesToUint16(label)
-	if e != nil {
-		return nil, dataError("Failed to construct attribute. Could not convert label.", e, nil)
+	att.decode(bytes)
+	return att
+}
+
+// Reads the stored fields of the attribute from b.
+func (a *Attribute) decode(b []byte) {
+	_ = b[attributeDataSize - 1] // bounds check once for the whole record
+	a.label = util.Uint16(b[0:2])
+	a.t = b[2]
+	copy(a.data[:], b[3:11])
+	a.next = util.Uint32(b[11:15])
+}
+
+// Encodes the attribute for storage into b, which must be at least attributeDataSize bytes long.
+func (a *Attribute) encode(b []byte) {
+	_ = b[attributeDataSize - 1]
+	util.PutUint16(b[0:2], a.label)
+	b[2] = a.t
+	copy(b[3:11], a.data[:])
+	util.PutUint32(b[11:15], a.next)
+}
+
+// NewAttribute creates an attribute with a key and value that can be set on a
+// vertex or an edge with SetAttribute.
+// Integers are stored as int64, reals as float64, times as nanoseconds since the
+// unix epoch, and strings in the text store.
+// Returns an error of type *DataError if the value has an unsupported type, is an
+// unsigned integer too large for an int64, or is a time before 1677-09-21 or after
+// 2262-04-11, which can not be counted in int64 nanoseconds since the unix epoch.
+func NewAttribute(key string, value Any, g *Graph) (*Attribute, *DataError) {
+	Assert(nilGraph, g != nil)
+	Assert(nilLabelStore, g.labelStore != nil)
+	Assert(nilTextStore, g.textStore != nil)
+
+	a := new(Attribute)
+	t, data, text, err := encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if a.label, err = g.labelStore.addLabel(key, g); err != nil {
+		return nil, err
+	}
+	a.t = t
+	a.data = data
+	if t == text_t {
+		util.PutUint64(a.data[:], g.textStore.addText(newText(text)))
+	}
+	return a, nil
+}
+
+// Converts a go value to the type and raw data of an attribute.
+// Text values are returned separately since their data is the id of the text object.
+// Integers of every size are stored as int64, so unsigned integers larger than that are
+// rejected, as are times too far from 1970 to count in int64 nanoseconds.
+func encodeValue(value Any) (t byte, data [8]byte, text string, err *DataError) {
+	switch v := value.(type) {
+	case int:
+		return encodeInteger(int64(v))
+	case int8:
+		return encodeInteger(int64(v))
+	case int16:
+		return encodeInteger(int64(v))
+	case int32:
+		return encodeInteger(int64(v))
+	case int64:
+		return encodeInteger(v)
+	case uint:
+		return encodeUnsigned(uint64(v))
+	case uint8:
+		return encodeInteger(int64(v))
+	case uint16:
+		return encodeInteger(int64(v))
+	case uint32:
+		return encodeInteger(int64(v))
+	case uint64:
+		return encodeUnsigned(v)
+	case float32:
+		t = real_t
+		util.PutFloat64(data[:], float64(v))
+	case float64:
+		t = real_t
+		util.PutFloat64(data[:], v)
+	case bool:
+		t = boolean_t
+		if v {
+			data[0] = 1
+		}
+	case string:
+		t = text_t
+		text = v
+	case time.Time:
+		if v.Before(minTimeValue) || v.After(maxTimeValue) {
+			err = dataError(timeRangeError + v.String(), nil, nil)
+			return
+		}
+		t = time_t
+		util.PutUint64(data[:], uint64(v.UnixNano()))
+	default:
+		err = dataError(unsupportedAttributeType, nil, nil)
 	}
-	att.t = t
-	att.data = data
-	att.next, e = util.BytesToUint32(next)
-	if e != nil {
-		return nil, dataError("Failed to construct attribute. Could not convert next.", e, nil)
+	return
+}
+
+// The earliest and latest times an attribute can hold.
+var (
+	minTimeValue = time.Unix(0, math.MinInt64)
+	maxTimeValue = time.Unix(0, math.MaxInt64)
+)
+
+// Converts an integer to the type and raw data of an attribute.
+func encodeInteger(n int64) (t byte, data [8]byte, text string, err *DataError) {
+	util.PutUint64(data[:], uint64(n))
+	return integer_t, data, "", nil
+}
+
+// Converts an unsigned integer to the type and raw data of an attribute.
+// Returns an error of type *DataError if it is too large for an int64.
+func encodeUnsigned(n uint64) (t byte, data [8]byte, text string, err *DataError) {
+	if n > math.MaxInt64 {
+		return empty_t, data, "", dataError(integerRangeError + strconv.FormatUint(n, 10), nil, nil)
 	}
-	return att, nil
+	return encodeInteger(int64(n))
 }
 
+// Returns a string that identifies the type and value of a go value, for looking
+// values up in attribute indexes.
+func indexKeyOf(value Any) (string, *DataError) {
+	t, data, text, err := encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+	if t == text_t {
+		return string(t) + text, nil
+	}
+	return string(t) + string(data[:]), nil
+}
+
+// Returns a string that identifies the type and value of the attribute, for
+// storing it in attribute indexes.
+// Equal values have equal keys no matter which attribute they belong to.
+func (a *Attribute) indexKey(g *Graph) (string, *DataError) {
+	Assert(nilAttribute, a != nil)
+
+	if a.t == text_t {
+		text, err := a.text(g)
+		if err != nil {
+			return "", err
+		}
+		return string(a.t) + text, nil
+	}
+	return string(a.t) + string(a.data[:]), nil
+}
+
+// Returns the text object holding the value of a text attribute.
+func (a *Attribute) textObject(g *Graph) (*Text, *DataError) {
+	Assert(nilAttribute, a != nil)
+	Assert(nilGraph, g != nil)
+	Assert(nilTextStore, g.textStore != nil)
+
+	t, err := g.textStore.find(util.Uint64(a.data[:]))
+	if err != nil {
+		return nil, dataError(textValueRetrievalError, nil, err)
+	}
+	return t, nil
+}
+
+// Returns the value of a text attribute.
+func (a *Attribute) text(g *Graph) (string, *DataError) {
+	t, err := a.textObject(g)
+	if err != nil {
+		return "", err
+	}
+	return t.Value(), nil
+}
+
+// Returns the value of the attribute.
+// Integers are returned as int64 whatever type they were set with. Earlier versions
+// returned them as uint64; the stored bits are the same, so they read back as the int64
+// with those bits.
 func (attr *Attribute) Value(g *Graph) (val Any, err *DataError) {
-	var e error
-	var id uint64
 	switch attr.t {
 	case empty_t:
 		return nil, dataError("Failure to convert attribute value. Unsupported type found.", nil, nil)
-		return
 	case integer_t:
-		val, e = util.BytesToUint64(attr.data)
-		if e != nil {
-			return nil, dataError("Failed to convert attribute value. Could not convert integer.", e, nil)
-		}
+		val = int64(util.Uint64(attr.data[:]))
 	case real_t:
-		val = util.BytesToFloat64(attr.data)
+		val = util.BytesToFloat64(attr.data[:])
 	case boolean_t:
-		val, e = util.BytesToUint64(attr.data)
-		if e != nil {
-			return nil, dataError("Failed to convert attribute value. Could not convert boolean.", e, nil)
-		}
-		if val == 0 {
-			val = false
-		} else {
-			val = true
-		}
+		val = util.Uint64(attr.data[:]) != 0
 	case text_t:
-		val = ""
-		// todo -> get from string store
+		val, err = attr.text(g)
 	case list_t:
-		id, e = util.BytesToUint64(attr.data)
-		if e != nil {
-			return nil, dataError("Failed to convert attribute value. Could not convert list.", e, nil)
-		}
-		val = constructList(uint32(id))
-
+		val = constructList(uint32(util.Uint64(attr.data[:])))
 	case map_t:
-		id, e = util.BytesToUint64(attr.data)
-		if e != nil {
-			return nil, dataError("Failed to convert attribute value. Could not convert map.", e, nil)
-		}
-		val = constructMap(uint32(id))
+		val = constructMap(uint32(util.Uint64(attr.data[:])))
+	case time_t:
+		val = time.Unix(0, int64(util.Uint64(attr.data[:])))
 	}
 	return
 }
@@ -120,6 +307,15 @@ func (a *Attribute) IsList() bool {
 	return a.t == list_t
 }
 
+func (a *Attribute) IsTime() bool {
+	return a.t == time_t
+}
+
+// Returns the type of the attribute's value.
+func (a *Attribute) Type() AttributeType {
+	return AttributeType(a.t)
+}
+
 func (a *Attribute) Label(g *Graph) (*Label, *DataError) {
 	Assert (nilAttribute, a != nil)
 	Assert (nilGraph, g != nil)
@@ -138,13 +334,13 @@ func (a *Attribute) Key(g *Graph) (string, *DataError) {
     return l.Value(g), nil
 }
 
-func (a *Attribute) Next(g *Graph) *Attribute {
+func (a *Attribute) Next(g *Graph) (*Attribute, *DataError) {
 	Assert(nilAttribute, a != nil)
 	Assert(nilGraph, g != nil)
 	Assert(nilAttributeStore, g.attributeStore != nil)
 	
 	if a.next == uint32(0) {
-	    return nil
+	    return nil, nil
 	}
 	
 	return g.attributeStore.Find(a.next)
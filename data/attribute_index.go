@@ -0,0 +1,192 @@
+package data
+
+import (
+    "os"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    nilAttributeIndex = "attempt to operate on a nil attribute index"
+    nilAttributeIndexFile = "attempt to operate on a nil attribute index file"
+)
+
+// An attribute index maps the values of one attribute key to the vertices of a
+// class that have that value.
+// Values are stored by index key (see Attribute.indexKey()), so values of different
+// types never match.
+// The file is an entry log (see entryLog) of the vertex id and value of each entry.
+// The whole index is read into memory when it is first used, so it is limited by the
+// memory available rather than by the size of the graph.
+type attributeIndex struct {
+    file *os.File
+    log *entryLog
+    values map[string]map[uint32]Empty
+}
+
+// Creates an existing attribute index.
+func constructAttributeIndex(fileName string) (*attributeIndex, *DataError) {
+
+    i := new(attributeIndex)
+
+    // load the file
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for attribute index: " + fileName + ".", e, nil)
+    }
+    i.file = file;
+    if _, de := checkFileHeader(i.file, attributeIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readValues(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates an attribute index that does not yet exist.
+func createAttributeIndex(fileName string) (*attributeIndex, *DataError) {
+
+    i := new(attributeIndex)
+
+    // create the file
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for attribute index: " + fileName + ".", e, nil)
+    }
+    i.file = file;
+    if de := writeFileHeader(i.file, attributeIndexFile, 0); de != nil {
+        return nil, de
+    }
+
+    i.log = &entryLog{file: file}
+    i.values = make(map[string]map[uint32]Empty)
+
+    return i, nil
+}
+
+// Encodes an entry of the index as the vertex id followed by the value.
+func encodeAttributeEntry(value string, id uint32) []byte {
+    b := make([]byte, 4 + len(value))
+    util.PutUint32(b, id)
+    copy(b[4:], value)
+    return b
+}
+
+// Reads the values from the file into the values map of the index.
+// Returns an error of type *DataError if the file can not be read.
+func (i *attributeIndex) readValues() *DataError {
+    Assert(nilAttributeIndex, i != nil)
+    Assert(nilAttributeIndexFile, i.file != nil)
+
+    i.values = make(map[string]map[uint32]Empty)
+    log, err := readEntryLog(i.file, func(added bool, entry []byte) bool {
+        if len(entry) < 4 {
+            return false
+        }
+        id, value := util.Uint32(entry), string(entry[4:])
+        if added {
+            i.addId(value, id)
+        } else {
+            i.removeId(value, id)
+        }
+        return true
+    })
+    i.log = log
+    return err
+}
+
+// Writes the changes to the values to the file.
+// Returns an error of type *DataError if it can not be written.
+func (i *attributeIndex) write() *DataError {
+    Assert(nilAttributeIndex, i != nil)
+    Assert(nilAttributeIndexFile, i.file != nil)
+
+    return i.log.write(func(fn func(entry []byte)) {
+        values := make([]string, 0, len(i.values))
+        for value := range i.values {
+            values = append(values, value)
+        }
+        sort.Strings(values)
+        for _, value := range values {
+            for _, id := range sortedIds(i.values[value]) {
+                fn(encodeAttributeEntry(value, id))
+            }
+        }
+    })
+}
+
+// Returns the set of vertex ids with a value.
+// The returned set should not be modified.
+func (i *attributeIndex) find(value string) map[uint32]Empty {
+    Assert(nilAttributeIndex, i != nil)
+    return i.values[value]
+}
+
+// Records that a vertex has a value.
+func (i *attributeIndex) add(value string, id uint32) {
+    Assert(nilAttributeIndex, i != nil)
+
+    if i.addId(value, id) {
+        i.log.add(encodeAttributeEntry(value, id))
+    }
+}
+
+// Records that a vertex no longer has a value.
+func (i *attributeIndex) remove(value string, id uint32) {
+    Assert(nilAttributeIndex, i != nil)
+
+    if i.removeId(value, id) {
+        i.log.remove(encodeAttributeEntry(value, id))
+    }
+}
+
+// Adds a vertex to the set of a value, returning false if it was already there.
+func (i *attributeIndex) addId(value string, id uint32) bool {
+    ids, ok := i.values[value]
+    if !ok {
+        ids = make(map[uint32]Empty)
+        i.values[value] = ids
+    } else if _, ok = ids[id]; ok {
+        return false
+    }
+    ids[id] = Empty{}
+    return true
+}
+
+// Removes a vertex from the set of a value, returning false if it was not there.
+func (i *attributeIndex) removeId(value string, id uint32) bool {
+    ids, ok := i.values[value]
+    if !ok {
+        return false
+    }
+    if _, ok = ids[id]; !ok {
+        return false
+    }
+    delete(ids, id)
+    if len(ids) == 0 {
+        delete(i.values, value)
+    }
+    return true
+}
+
+// Returns the ids in a set, in order.
+func sortedIds(set map[uint32]Empty) []uint32 {
+    ids := make([]uint32, 0, len(set))
+    for id := range set {
+        ids = append(ids, id)
+    }
+    sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+    return ids
+}
+
+// Cleans up the file for the index.
+func (i *attributeIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
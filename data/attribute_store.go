@@ -14,8 +14,10 @@ const (
 // The attribute store manages the persistence of vertex and edge attributes.
 type attributeStore struct {
     file *os.File
+    records *recordFile
     idStore *uint32IdStore
     tracking map[uint32]*Attribute
+    finds uint64 // the number of calls to Find, which query profiles count as reads
 }
 
 // Creates and prepares an existing attribute store
@@ -29,6 +31,11 @@ func constructAttributeStore (g *Graph) (*attributeStore, *DataError) {
     } else {
         s.file = file;
     }
+    if h, de := checkFileHeader(s.file, attributeFile); de != nil {
+        return nil, de
+    } else {
+        s.records = newRecordFile(s.file, "attribute", fileHeaderSize, attributeDataSize, h.flags)
+    }
 
     fileName = g.storePath("attribute.id")
     
@@ -53,6 +60,11 @@ func createAttributeStore (g *Graph) (*attributeStore, *DataError) {
     } else {
         s.file = file;
     }
+    flags := g.recordFlags()
+    if de := writeFileHeader(s.file, attributeFile, flags); de != nil {
+        return nil, de
+    }
+    s.records = newRecordFile(s.file, "attribute", fileHeaderSize, attributeDataSize, flags)
 
     
     fileName = g.storePath("attribute.id")
@@ -68,25 +80,25 @@ func createAttributeStore (g *Graph) (*attributeStore, *DataError) {
 }
 
 // Finds an attribute by id and returns it.
-func (s *attributeStore) Find(id uint32) *Attribute {
+// Returns nil if there is no such attribute, or an error of type *DataError if the
+// attribute could not be read or is corrupted.
+func (s *attributeStore) Find(id uint32) (*Attribute, *DataError) {
     Assert(nilAttributeStore, s != nil)
     Assert(zeroAttributeId, id != uint32(0))
     Assert(nilAttributeTrackingMap, s.tracking != nil)
 
+    s.finds++
     if a, ok := s.tracking[id]; ok {
-        return a
+        return a, nil
     }
     
-    // read the vertex from the file and return it
-    readAt := int64((id - 1) * attributeDataSize)
-    bytes := make([]byte, attributeDataSize)
-    _, e := s.file.ReadAt(bytes, readAt)
-    if (e != nil) {
-        return nil
+    // read the attribute from the file and return it
+    bytes, err := s.records.read(uint64(id))
+    if err != nil || bytes == nil {
+        return nil, err
     }
     
-    a, _ := constructAttribute(id, bytes) 
-    return a
+    return constructAttribute(id, bytes), nil
 }
 
 // Let's the store know that the attribute has changes that need to be written.
@@ -122,7 +134,28 @@ func (s *attributeStore) nextId() uint32 {
     return s.idStore.nextId()
 }
 
+// Writes tracked attributes to the file.
+func (s *attributeStore) write() *DataError {
+    Assert(nilAttributeStore, s != nil)
+    Assert(nilAttributeTrackingMap, s.tracking != nil)
+    
+    for id, a := range s.tracking {
+        if err := s.records.write(uint64(id), a); err != nil {
+            return err
+        }
+    }
+    
+    if err := s.idStore.write(); err != nil {
+        return err
+    }
+    s.tracking = make(map[uint32]*Attribute, 0)
+    return nil
+}
+
 func (store *attributeStore) shutdown () {
+    if (store == nil){
+        return
+    }
     if (store.idStore != nil){
         store.idStore.shutdown()
     }
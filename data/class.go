@@ -1,9 +1,12 @@
 package data
 
 import (
+	"math"
+	"os"
+	"sort"
+
 	"github.com/wardlem/graphlite/util"
 	//"fmt"
-	//"os"
 )
 
 // error messages
@@ -27,33 +30,36 @@ type Class struct {
 }
 
 func constructClass(id uint8, bytes []byte) (*Class, *DataError) {
-    if len(bytes) != 8 {
+    if len(bytes) != classDataSize {
         return nil, dataError("Attempt to construct class with slice of improper size", nil, nil)
     }
-    var e error
 	c := new(Class)
-	count := bytes[0:4]
-	label := bytes[4:6]
-	super := bytes[6]
-	sub := bytes[7]
-	nextSub := bytes[8]
-
 	c.Id = id
-	c.Count, e = util.BytesToUint32(count)
-	if (e != nil){
-	    return nil, dataError("Failed to construct class. Could not convert count.", e, nil)
-	}
-	c.label, e = util.BytesToUint16(label)
-	if (e != nil){
-	    return nil, dataError("Failed to construct class. Could not convert label.", e, nil)
-	}
-	c.super = super
-	c.sub = sub
-	c.nextSub = nextSub
+	c.decode(bytes)
 
 	return c, nil
 }
 
+// Reads the stored fields of the class from b.
+func (c *Class) decode(b []byte) {
+	_ = b[classDataSize - 1] // bounds check once for the whole record
+	c.Count = util.Uint32(b[0:4])
+	c.label = util.Uint16(b[4:6])
+	c.super = b[6]
+	c.sub = b[7]
+	c.nextSub = b[8]
+}
+
+// Encodes the class for storage into b, which must be at least classDataSize bytes long.
+func (c *Class) encode(b []byte) {
+	_ = b[classDataSize - 1]
+	util.PutUint32(b[0:4], c.Count)
+	util.PutUint16(b[4:6], c.label)
+	b[6] = c.super
+	b[7] = c.sub
+	b[8] = c.nextSub
+}
+
 func createClass(id uint8, label uint16, super *Class, g *Graph) *Class {
     
     var c = new(Class)
@@ -75,13 +81,8 @@ func createClass(id uint8, label uint16, super *Class, g *Graph) *Class {
 }
 
 func (c *Class) Data() []byte {
-    bytes := make([]byte, 0, classDataSize)
-    count, _ := util.Uint32ToBytes(c.Count)
-    label, _ := util.Uint16ToBytes(c.label)
-    
-    bytes = append(bytes, count...)
-    bytes = append(bytes, label...)
-    bytes = append(bytes, c.super, c.sub, c.nextSub)
+    bytes := make([]byte, classDataSize)
+    c.encode(bytes)
     return bytes;
 }
 
@@ -113,32 +114,652 @@ func (c *Class) NextSub (g *Graph) *Class {
     return g.classStore.Find(c.nextSub)
 }
 
-func (c *Class) hasId (id uint32, g *Graph) bool {
-    if (c.index == nil) {
-        c.openIdIndex(g)
+func (c *Class) hasId (id uint32, g *Graph) (bool, *DataError) {
+    index, err := c.idIndex(g)
+    if err != nil {
+        return false, err
     }
-    
-    if c.index.hasId(id) {
-        return true
+    if index.hasId(id) {
+        return true, nil
     }
     
     subClass := c.Sub(g)
     for subClass != nil {
-        if subClass.hasId(id, g) {
-            return true
+        if has, err := subClass.hasId(id, g); has || err != nil {
+            return has, err
         }
         subClass = subClass.NextSub(g)
     }
     
-    return false
+    return false, nil
 }
 
-func (c *Class) openIdIndex(g *Graph) {
-    className, _ := c.Name(g)
+// Returns true if a vertex found by an index of owner, which is the class or one of its
+// super classes, belongs to the class.
+func (c *Class) holds (owner *Class, id uint32, g *Graph) (bool, *DataError) {
+    if owner == c {
+        return true, nil
+    }
+    return c.hasId(id, g)
+}
+
+// Returns the number of vertices that belong to the class or one of its sub classes.
+func (c *Class) total(g *Graph) int {
+    count := int(c.Count)
+    for sub := c.Sub(g); sub != nil; sub = sub.NextSub(g) {
+        count += sub.total(g)
+    }
+    return count
+}
+
+// Calls fn with the id of every vertex that belongs to the class or one of its sub classes.
+// Iteration stops early if fn returns false, in which case false is returned.
+// Returns an error of type *DataError if the index of a class can not be opened.
+func (c *Class) eachId (fn func(id uint32) bool, g *Graph) (bool, *DataError) {
+    index, err := c.idIndex(g)
+    if err != nil {
+        return false, err
+    }
+    if !index.each(fn) {
+        return false, nil
+    }
+    
+    for subClass := c.Sub(g); subClass != nil; subClass = subClass.NextSub(g) {
+        if more, err := subClass.eachId(fn, g); !more || err != nil {
+            return false, err
+        }
+    }
+    
+    return true, nil
+}
+
+// Calls fn with every vertex of the class and its sub classes that has an attribute
+// with the key, along with the attribute.
+// Iteration stops early if fn returns false.
+func (c *Class) eachAttribute (key string, fn func(v *Vertex, a *Attribute) bool, g *Graph) *DataError {
+    var err *DataError
+    _, failed := c.eachId(func(id uint32) bool {
+        var v *Vertex
+        var m attributeMap
+        if v, err = g.vertexStore.Find(id); err != nil || v == nil {
+            return err == nil
+        }
+        if m, err = v.Attributes(g); err != nil {
+            return false
+        }
+        if a, ok := m.get(key); ok {
+            return fn(v, a)
+        }
+        return true
+    }, g)
+    if err == nil {
+        err = failed
+    }
+    return err
+}
+
+// Returns the index of a kind on a list of attribute keys that covers the class, which
+// is an index of the class itself or of one of its super classes, along with the class
+// the index belongs to.
+// Returns nil if there is no such index, or an error of type *DataError if the labels
+// of the keys can not be read.
+func (c *Class) findIndex (kind byte, keys []string, g *Graph) (*indexDef, *Class, *DataError) {
+    labels, ok, err := keyLabels(keys, g)
+    if !ok {
+        return nil, nil, err
+    }
+    for super := c; super != nil; super = super.Super(g) {
+        if def := g.indexStore.find(super.Id, kind, labels...); def != nil {
+            return def, super, nil
+        }
+    }
+    return nil, nil, nil
+}
+
+// Returns the ids of the labels of a list of attribute keys.
+// Returns false if one of the keys has no label, in which case nothing can be indexed on it,
+// along with an error of type *DataError if the label could not be read.
+func keyLabels(keys []string, g *Graph) ([]uint16, bool, *DataError) {
+    labels := make([]uint16, len(keys))
+    for n, key := range keys {
+        l, err := g.labelStore.findByValue(key, g)
+        if l == nil {
+            return nil, false, err
+        }
+        labels[n] = l.Id
+    }
+    return labels, true, nil
+}
+
+// CreateIndex creates an index on an attribute key for the vertices of the class
+// and its sub classes, and fills it with the values they already have.
+// Once created, the index is kept up to date as attributes are set and removed and
+// vertices are deleted.
+// The index is held in memory from when it is first used until the graph is shut down,
+// so the values it covers must fit in memory.
+// Creating an index that already exists does nothing.
+func (c *Class) CreateIndex (key string, g *Graph) *DataError {
+    return c.createIndex([]string{key}, valueIndex, 0, g)
+}
+
+// CreateUniqueIndex creates an index on an attribute key like CreateIndex, and also
+// makes the key unique: no two vertices of the class or its sub classes may have the
+// same value for it.
+// Setting an attribute to a value another vertex already has fails with an error
+// caused by a *ConstraintError, as does creating the index when the vertices already
+// have duplicate values.
+// An existing index on the key is made unique.
+func (c *Class) CreateUniqueIndex (key string, g *Graph) *DataError {
+    return c.createIndex([]string{key}, valueIndex, uniqueIndex, g)
+}
+
+// CreateRangeIndex creates an ordered index on an attribute key for the vertices of
+// the class and its sub classes.
+// Integer, real, and time values are indexed, and can then be scanned by range and in
+// order with Scan, Min, and Max. Values of other types are left out of the index.
+// Like the index of CreateIndex, the index is held in memory once it is first used.
+// Creating an index that already exists does nothing.
+func (c *Class) CreateRangeIndex (key string, g *Graph) *DataError {
+    return c.createIndex([]string{key}, orderedIndex, 0, g)
+}
+
+// CreateCompositeIndex creates an index over a list of attribute keys for the vertices of
+// the class and its sub classes that have every one of the keys.
+// Vertices can then be found with Lookup by equal values for the first keys and a range
+// of values for the key after them.
+// Like the index of CreateIndex, the index is held in memory once it is first used.
+// Creating an index that already exists does nothing.
+func (c *Class) CreateCompositeIndex (keys []string, g *Graph) *DataError {
+    Assert("a composite index needs at least one key", len(keys) > 0)
+    return c.createIndex(keys, multiKeyIndex, 0, g)
+}
+
+// TextIndexOptions control how text is broken into words by a full-text index.
+// The same options are applied to the text of the vertices and to search queries.
+type TextIndexOptions struct {
+    Lowercase bool // match words regardless of case
+    Stem bool      // match different forms of english words, like "index" and "indexing"
+}
+
+// CreateTextIndex creates a full-text index on a text attribute key for the vertices of
+// the class and its sub classes, so they can be searched with Search.
+// Like the index of CreateIndex, the index is held in memory once it is first used.
+// Creating an index that already exists does nothing, even if the options differ.
+func (c *Class) CreateTextIndex (key string, options TextIndexOptions, g *Graph) *DataError {
+    flags := byte(0)
+    if options.Lowercase {
+        flags |= foldCaseFlag
+    }
+    if options.Stem {
+        flags |= stemFlag
+    }
+    if def, owner, err := c.findIndex(fullTextIndex, []string{key}, g); err != nil || (def != nil && owner == c) {
+        return err
+    }
+    return c.createIndex([]string{key}, fullTextIndex, flags, g)
+}
+
+// Creates an index of a kind on a list of attribute keys with the given flags.
+func (c *Class) createIndex (keys []string, kind byte, flags byte, g *Graph) *DataError {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilIndexStore, g.indexStore != nil)
+    
+    key := keys[0]
+    def, owner, err := c.findIndex(kind, keys, g)
+    if err != nil {
+        return err
+    } else if def != nil && owner == c {
+        return c.updateIndex(def, key, flags, g)
+    }
+    
+    def = new(indexDef)
+    def.class = c.Id
+    def.kind = kind
+    def.flags = flags
+    for _, k := range keys {
+        var label uint16
+        if label, err = g.labelStore.addLabel(k, g); err != nil {
+            break
+        }
+        def.keys = append(def.keys, label)
+    }
+    
+    if err == nil {
+        err = def.create(g)
+    }
+    if err == nil {
+        // index the values the vertices already have
+        var failed *DataError
+        err = c.eachAttribute(key, func(v *Vertex, a *Attribute) bool {
+            if def.isUnique() {
+                var value string
+                if value, failed = a.indexKey(g); failed != nil {
+                    return false
+                }
+                for other := range def.index.find(value) {
+                    failed = constraintError(c, key, a, other, g)
+                    return false
+                }
+            }
+            failed = def.change(v, key, nil, a, g)
+            return failed == nil
+        }, g)
+        if err == nil {
+            err = failed
+        }
+    }
+    if err != nil {
+        def.destroy(g)
+        // give back the labels that were added; the error that stopped the index
+        // being created is the one to report
+        for _, k := range keys[:len(def.keys)] {
+            _ = g.labelStore.removeLabel(k, g)
+        }
+        return err
+    }
+    
+    g.indexStore.add(def)
+    return nil
+}
+
+// Adds flags to an existing index.
+// Making an index unique fails if the vertices it covers have duplicate values.
+func (c *Class) updateIndex (def *indexDef, key string, flags byte, g *Graph) *DataError {
+    if def.flags | flags == def.flags {
+        return nil
+    }
+    
+    index, err := def.open(g)
+    if err != nil {
+        return err
+    }
+    if flags & uniqueIndex != 0 {
+        for _, ids := range index.values {
+            if len(ids) < 2 {
+                continue
+            }
+            for id := range ids {
+                v, err := g.vertexStore.Find(id)
+                if err != nil {
+                    return err
+                }
+                m, err := v.Attributes(g)
+                if err != nil {
+                    return err
+                }
+                a, _ := m.get(key)
+                return constraintError(c, key, a, id, g)
+            }
+        }
+    }
+    
+    g.indexStore.update(def, def.flags | flags)
+    return nil
+}
+
+// FindBy returns the vertices of the class, including those of its sub classes,
+// whose attribute with the given key has the given value.
+// An index on the key for the class or one of its super classes is used if there is
+// one, otherwise every vertex of the class is checked.
+func (c *Class) FindBy (key string, value Any, g *Graph) ([]*Vertex, *DataError) {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilIndexStore, g.indexStore != nil)
+    
+    valueKey, err := indexKeyOf(value)
+    if err != nil {
+        return nil, err
+    }
+    
+    vertices := make([]*Vertex, 0)
+    
+    // look for an index that covers the class
+    def, owner, err := c.findIndex(valueIndex, []string{key}, g)
+    if err != nil {
+        return nil, err
+    } else if def != nil {
+        index, err := def.open(g)
+        if err != nil {
+            return nil, err
+        }
+        for id := range index.find(valueKey) {
+            if holds, err := c.holds(owner, id, g); err != nil {
+                return nil, err
+            } else if !holds {
+                continue // the vertex belongs to another branch of the super class
+            }
+            v, err := g.vertexStore.Find(id)
+            if err != nil {
+                return nil, err
+            }
+            if v != nil {
+                vertices = append(vertices, v)
+            }
+        }
+        return vertices, nil
+    }
+    
+    // no index, so check every vertex
+    var failed *DataError
+    err = c.eachAttribute(key, func(v *Vertex, a *Attribute) bool {
+        var k string
+        if k, failed = a.indexKey(g); failed != nil {
+            return false
+        }
+        if k == valueKey {
+            vertices = append(vertices, v)
+        }
+        return true
+    }, g)
+    if err == nil {
+        err = failed
+    }
+    if err != nil {
+        return nil, err
+    }
+    return vertices, nil
+}
+
+// A SearchResult is a vertex found by a full-text search and how well it matched.
+type SearchResult struct {
+    Vertex *Vertex
+    Score float64 // higher scores are better matches
+}
+
+// Search finds the vertices of the class, including those of its sub classes, whose
+// text attribute with the given key contains words of the query.
+// Results are ranked by score, best first. A vertex scores higher for each query word
+// it contains, for words that are rare among the vertices, and for words that make up
+// more of its text.
+// Returns an error of type *DataError if there is no full-text index on the key for
+// the class or one of its super classes.
+func (c *Class) Search (key string, query string, g *Graph) ([]SearchResult, *DataError) {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilIndexStore, g.indexStore != nil)
+    
+    def, owner, err := c.findIndex(fullTextIndex, []string{key}, g)
+    if err != nil {
+        return nil, err
+    } else if def == nil {
+        name, _ := c.Name(g)
+        return nil, dataError("No full-text index on " + name + "." + key + ".", nil, nil)
+    }
+    index, err := def.openText(g)
+    if err != nil {
+        return nil, err
+    }
+    
+    scores := make(map[uint32]float64)
+    total := float64(len(index.lengths))
+    for _, word := range tokenize(query, def.flags) {
+        ids := index.words[word]
+        idf := math.Log(1 + total / float64(len(ids) + 1))
+        for id, occurrences := range ids {
+            scores[id] += idf * float64(occurrences) / math.Sqrt(float64(index.lengths[id]))
+        }
+    }
+    
+    results := make([]SearchResult, 0, len(scores))
+    for id, score := range scores {
+        if holds, err := c.holds(owner, id, g); err != nil {
+            return nil, err
+        } else if !holds {
+            continue // the vertex belongs to another branch of the super class
+        }
+        v, err := g.vertexStore.Find(id)
+        if err != nil {
+            return nil, err
+        }
+        if v != nil {
+            results = append(results, SearchResult{v, score})
+        }
+    }
+    sort.Slice(results, func(a, b int) bool {
+        if results[a].Score != results[b].Score {
+            return results[a].Score > results[b].Score
+        }
+        return results[a].Vertex.Id < results[b].Vertex.Id
+    })
+    return results, nil
+}
+
+// A Range selects vertices by the value of an attribute for Class.Scan.
+// Only integer, real, and time values are in range; integers and reals are compared
+// by numeric value, and every number is less than every time.
+type Range struct {
+    Min Any          // the least value in the range, or nil for no lower bound
+    Max Any          // the greatest value in the range, or nil for no upper bound
+    ExcludeMin bool  // leave vertices with a value equal to Min out of the range
+    ExcludeMax bool  // leave vertices with a value equal to Max out of the range
+    Descending bool  // return vertices from the greatest value to the least
+    Limit int        // the most vertices to return, or 0 for no limit
+}
+
+// Returns the bound of a range as an index entry, or nil if the range is open at that end.
+func rangeBound(value Any) (*rangeEntry, *DataError) {
+    if value == nil {
+        return nil, nil
+    }
+    t, data, _, err := encodeValue(value)
+    if err != nil {
+        return nil, err
+    }
+    if !isRangeType(t) {
+        return nil, dataError(unsupportedAttributeType + " for a range", nil, nil)
+    }
+    return &rangeEntry{t: t, data: data}, nil
+}
+
+// Scan returns the vertices of the class, including those of its sub classes, whose
+// attribute with the given key has a value in the range, in order of that value.
+// A range index on the key for the class or one of its super classes is used if there
+// is one, otherwise every vertex of the class is checked and sorted.
+func (c *Class) Scan (key string, r Range, g *Graph) ([]*Vertex, *DataError) {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilIndexStore, g.indexStore != nil)
+    
+    min, err := rangeBound(r.Min)
+    if err != nil {
+        return nil, err
+    }
+    max, err := rangeBound(r.Max)
+    if err != nil {
+        return nil, err
+    }
+    
+    def, owner, err := c.findIndex(orderedIndex, []string{key}, g)
+    if err != nil {
+        return nil, err
+    }
+    var index *rangeIndex
+    if def != nil {
+        if index, err = def.openRange(g); err != nil {
+            return nil, err
+        }
+    } else {
+        // no index, so build a temporary one from every vertex
+        owner = c
+        if index, err = createRangeIndex(""); err != nil {
+            return nil, err
+        }
+        err = c.eachAttribute(key, func(v *Vertex, a *Attribute) bool {
+            if isRangeType(a.t) {
+                index.add(rangeEntry{a.t, a.data, v.Id})
+            }
+            return true
+        }, g)
+        if err != nil {
+            return nil, err
+        }
+    }
+    
+    vertices := make([]*Vertex, 0)
+    index.scan(min, max, &r, func(id uint32) bool {
+        var holds bool
+        if holds, err = c.holds(owner, id, g); err != nil {
+            return false
+        } else if !holds {
+            return true // the vertex belongs to another branch of the super class
+        }
+        var v *Vertex
+        if v, err = g.vertexStore.Find(id); err != nil {
+            return false
+        }
+        if v != nil {
+            vertices = append(vertices, v)
+        }
+        return r.Limit <= 0 || len(vertices) < r.Limit
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vertices, nil
+}
+
+// Min returns the vertex of the class, or of one of its sub classes, with the least
+// value for an attribute key, or nil if no vertex has a value in range for the key.
+func (c *Class) Min (key string, g *Graph) (*Vertex, *DataError) {
+    vertices, err := c.Scan(key, Range{Limit: 1}, g)
+    if err != nil || len(vertices) == 0 {
+        return nil, err
+    }
+    return vertices[0], nil
+}
+
+// Max returns the vertex of the class, or of one of its sub classes, with the greatest
+// value for an attribute key, or nil if no vertex has a value in range for the key.
+func (c *Class) Max (key string, g *Graph) (*Vertex, *DataError) {
+    vertices, err := c.Scan(key, Range{Descending: true, Limit: 1}, g)
+    if err != nil || len(vertices) == 0 {
+        return nil, err
+    }
+    return vertices[0], nil
+}
+
+// Lookup returns the vertices of the class, including those of its sub classes, whose
+// first attributes in a list of keys equal a list of values, and whose attribute for
+// the key after those is in the range, in order of their values for the keys.
+// The range may be left empty to find the vertices by the values alone.
+// Only vertices that have every key are found.
+// A composite index on the keys for the class or one of its super classes is used if
+// there is one, otherwise every vertex of the class is checked and sorted.
+func (c *Class) Lookup (keys []string, values []Any, r Range, g *Graph) ([]*Vertex, *DataError) {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilIndexStore, g.indexStore != nil)
+    Assert("more lookup values than keys", len(values) <= len(keys))
+    
+    vertices := make([]*Vertex, 0)
+    prefix := make([]compositeValue, len(values))
+    for n, value := range values {
+        var err *DataError
+        if prefix[n], err = compositeValueFrom(value); err != nil {
+            return nil, err
+        }
+    }
+    var bounds [2]*compositeValue
+    for n, value := range []Any{r.Min, r.Max} {
+        if value == nil {
+            continue
+        }
+        Assert("a lookup range needs a key after the values", len(values) < len(keys))
+        bound, err := compositeValueFrom(value)
+        if err != nil {
+            return nil, err
+        }
+        bounds[n] = &bound
+    }
+    
+    def, owner, err := c.findIndex(multiKeyIndex, keys, g)
+    if err != nil {
+        return nil, err
+    }
+    var index *compositeIndex
+    if def != nil {
+        if index, err = def.openComposite(g); err != nil {
+            return nil, err
+        }
+    } else {
+        labels, ok, err := keyLabels(keys, g)
+        if err != nil {
+            return nil, err
+        } else if !ok {
+            return vertices, nil // no vertex has every key
+        }
+        
+        // no index, so build a temporary one from every vertex
+        owner = c
+        if index, err = createCompositeIndex("", len(keys)); err != nil {
+            return nil, err
+        }
+        def = &indexDef{keys: labels}
+        var failed *DataError
+        err = c.eachAttribute(keys[0], func(v *Vertex, a *Attribute) bool {
+            var e *compositeEntry
+            if e, failed = def.entry(v, keys[0], a, g); e != nil {
+                index.add(*e)
+            }
+            return failed == nil
+        }, g)
+        if err == nil {
+            err = failed
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    
+    index.scan(prefix, bounds[0], bounds[1], &r, func(id uint32) bool {
+        var holds bool
+        if holds, err = c.holds(owner, id, g); err != nil {
+            return false
+        } else if !holds {
+            return true // the vertex belongs to another branch of the super class
+        }
+        var v *Vertex
+        if v, err = g.vertexStore.Find(id); err != nil {
+            return false
+        }
+        if v != nil {
+            vertices = append(vertices, v)
+        }
+        return r.Limit <= 0 || len(vertices) < r.Limit
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vertices, nil
+}
+
+// Returns the index of the vertices that belong to the class, opening it if needed.
+// Returns an error of type *DataError if the index can not be opened.
+func (c *Class) idIndex(g *Graph) (*classIdIndex, *DataError) {
+    if c.index == nil {
+        if err := c.openIdIndex(g); err != nil {
+            return nil, err
+        }
+    }
+    return c.index, nil
+}
+
+func (c *Class) openIdIndex(g *Graph) *DataError {
+    className, err := c.Name(g)
+    if err != nil {
+        return err
+    }
     idxFileName := className + ".idx"
     fileName := g.indexPath(idxFileName)
     
-    c.index, _ = constructClassIdIndex(fileName)
+    if _, e := os.Stat(fileName); os.IsNotExist(e) {
+        // graphs created before the index directory existed have no class id indexes
+        c.index, err = createClassIdIndex(fileName)
+    } else {
+        c.index, err = constructClassIdIndex(fileName)
+    }
+    return err
 }
 
 func (c *Class) createIdIndex(g *Graph) {
@@ -2,7 +2,10 @@ package data
 
 import (
     "os"
-    
+    "io"
+    "math/bits"
+    "sort"
+
     "github.com/wardlem/graphlite/util"
 )
 
@@ -10,109 +13,451 @@ import (
 const (
     nilClassIdIndex = "attempt to operate on a nil class id index"
     nilClassIdIndexFile = "attempt to operate on a nil class id index file"
+    classIdIndexWriteFail = "could not write class id index: "
+    classIdIndexReadFail = "could not read class id index: "
+    classIdIndexCorrupted = "class id index block could not be decoded"
+)
+
+// The kinds of id container
+const (
+    arrayContainer byte = iota + 1
+    bitmapContainer
+)
+
+const (
+    maxArrayContainerSize = 4096        // an array container that grows past this becomes a bitmap
+    minBitmapContainerSize = 3584       // a bitmap container that shrinks to this becomes an array
+                                        // the gap keeps ids added and removed at the limit from
+                                        // converting the container each time
+    bitmapContainerWords = 1024         // 65536 bits
+    containerHeaderSize = 8
+    containerBlockSize = containerHeaderSize + 8 * bitmapContainerWords
 )
 
-// A class id index is responsible for indexing the vertices that belong to a class
+// An id container holds the ids of a class that share their upper 16 bits, as a
+// sorted array of their lower 16 bits while there are few of them and as a bitmap
+// once there are many.
+type idContainer struct {
+    key uint16      // the upper 16 bits of the ids
+    slot uint32     // the position of the container's block in the file
+    array []uint16  // the lower 16 bits of the ids, in order, for an array container
+    bitmap []uint64 // a bit for each of the lower 16 bits, for a bitmap container
+    count int       // the number of ids in the container
+}
+
+// Returns the position of an id in an array container, or of where it would be inserted.
+func (c *idContainer) search(low uint16) int {
+    return sort.Search(len(c.array), func(n int) bool { return c.array[n] >= low })
+}
+
+// Determines if the container has an id.
+func (c *idContainer) has(low uint16) bool {
+    if c.bitmap != nil {
+        return c.bitmap[low >> 6] & (1 << (low & 63)) != 0
+    }
+    pos := c.search(low)
+    return pos < len(c.array) && c.array[pos] == low
+}
+
+// Adds an id to the container, returning false if it was already there.
+func (c *idContainer) add(low uint16) bool {
+    if c.bitmap != nil {
+        word, bit := low >> 6, uint64(1) << (low & 63)
+        if c.bitmap[word] & bit != 0 {
+            return false
+        }
+        c.bitmap[word] |= bit
+        c.count++
+        return true
+    }
+
+    pos := c.search(low)
+    if pos < len(c.array) && c.array[pos] == low {
+        return false
+    }
+    c.array = append(c.array, 0)
+    copy(c.array[pos + 1:], c.array[pos:])
+    c.array[pos] = low
+    c.count++
+    if c.count > maxArrayContainerSize {
+        c.toBitmap()
+    }
+    return true
+}
+
+// Removes an id from the container, returning false if it was not there.
+func (c *idContainer) remove(low uint16) bool {
+    if c.bitmap != nil {
+        word, bit := low >> 6, uint64(1) << (low & 63)
+        if c.bitmap[word] & bit == 0 {
+            return false
+        }
+        c.bitmap[word] &^= bit
+        c.count--
+        if c.count <= minBitmapContainerSize {
+            c.toArray()
+        }
+        return true
+    }
+
+    pos := c.search(low)
+    if pos == len(c.array) || c.array[pos] != low {
+        return false
+    }
+    c.array = append(c.array[:pos], c.array[pos + 1:]...)
+    c.count--
+    return true
+}
+
+// Converts an array container to a bitmap container.
+func (c *idContainer) toBitmap() {
+    c.bitmap = make([]uint64, bitmapContainerWords)
+    for _, low := range c.array {
+        c.bitmap[low >> 6] |= 1 << (low & 63)
+    }
+    c.array = nil
+}
+
+// Converts a bitmap container to an array container.
+func (c *idContainer) toArray() {
+    c.array = make([]uint16, 0, c.count)
+    c.each(func(low uint16) bool {
+        c.array = append(c.array, low)
+        return true
+    })
+    c.bitmap = nil
+}
+
+// Calls fn with the lower 16 bits of each id in the container, in order.
+// Iteration stops early if fn returns false, in which case false is returned.
+func (c *idContainer) each(fn func(low uint16) bool) bool {
+    if c.bitmap == nil {
+        for _, low := range c.array {
+            if !fn(low) {
+                return false
+            }
+        }
+        return true
+    }
+
+    for n, word := range c.bitmap {
+        for word != 0 {
+            bit := bits.TrailingZeros64(word)
+            if !fn(uint16(n << 6 + bit)) {
+                return false
+            }
+            word &= word - 1
+        }
+    }
+    return true
+}
+
+// Returns the lowest lower 16 bits in the container that are at least low, and false if
+// there are none.
+func (c *idContainer) next(low uint16) (uint16, bool) {
+    if c.bitmap == nil {
+        if pos := c.search(low); pos < len(c.array) {
+            return c.array[pos], true
+        }
+        return 0, false
+    }
+
+    n := int(low >> 6)
+    word := c.bitmap[n] &^ (1 << (low & 63) - 1)
+    for {
+        if word != 0 {
+            return uint16(n << 6 + bits.TrailingZeros64(word)), true
+        }
+        if n++; n == len(c.bitmap) {
+            return 0, false
+        }
+        word = c.bitmap[n]
+    }
+}
+
+// Encodes the container's block, returning the number of bytes that need to be written.
+// A block is the upper 16 bits of the ids, the kind of the container, an unused byte,
+// and the number of ids, followed by the array of lower bits or the bitmap.
+// A block with no ids marks a free slot.
+func (c *idContainer) encode(b []byte) int {
+    util.PutUint16(b[0:2], c.key)
+    b[3] = 0
+    util.PutUint32(b[4:8], uint32(c.count))
+    if c.count == 0 {
+        b[2] = 0
+        return containerHeaderSize
+    }
+    if c.bitmap != nil {
+        b[2] = bitmapContainer
+        for n, word := range c.bitmap {
+            util.PutUint64(b[containerHeaderSize + 8 * n:], word)
+        }
+        return containerBlockSize
+    }
+    b[2] = arrayContainer
+    for n, low := range c.array {
+        util.PutUint16(b[containerHeaderSize + 2 * n:], low)
+    }
+    return containerHeaderSize + 2 * len(c.array)
+}
+
+// Reads a container from its block, of which size bytes are in the file.
+// Returns nil if the block marks a free slot, and false if the block can not be decoded.
+func decodeIdContainer(slot uint32, b []byte, size int) (*idContainer, bool) {
+    if size < containerHeaderSize {
+        return nil, false
+    }
+    count := int(util.Uint32(b[4:8]))
+    if count == 0 {
+        return nil, true
+    }
+
+    c := &idContainer{key: util.Uint16(b[0:2]), slot: slot, count: count}
+    switch {
+    case b[2] == bitmapContainer && size == containerBlockSize && count <= 1 << 16:
+        c.bitmap = make([]uint64, bitmapContainerWords)
+        bitCount := 0
+        for n := range c.bitmap {
+            c.bitmap[n] = util.Uint64(b[containerHeaderSize + 8 * n:])
+            bitCount += bits.OnesCount64(c.bitmap[n])
+        }
+        return c, bitCount == count
+    case b[2] == arrayContainer && count <= maxArrayContainerSize && containerHeaderSize + 2 * count <= size:
+        c.array = make([]uint16, count)
+        for n := range c.array {
+            c.array[n] = util.Uint16(b[containerHeaderSize + 2 * n:])
+            if n > 0 && c.array[n] <= c.array[n - 1] {
+                return nil, false // the array must be in order
+            }
+        }
+        return c, true
+    }
+    return nil, false
+}
+
+// A class id index is responsible for indexing the vertices that belong to a class.
+// The ids are kept as a compressed bitmap: they are split into containers by their
+// upper 16 bits, and each container holds the lower bits as a sorted array while there
+// are few of them and as a bitmap once there are many.
+// Each container has a fixed size block in the file, so only the containers that
+// changed are written.
 type classIdIndex struct {
     file *os.File
-    ids map[uint32]Empty
+    containers []*idContainer       // in order of their keys
+    count int                       // the number of ids in the index
+    slots uint32                    // the number of blocks in the file
+    free []uint32                   // the slots of blocks that hold no container
+    dirty map[uint32]*idContainer   // the containers to write by slot, or nil to free the slot
 }
 
 // Creates an existing class id index.
 func constructClassIdIndex(fileName string) (*classIdIndex, *DataError) {
-    
+
     i := new(classIdIndex)
-    
+
     // load the file
     file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
     if e != nil {
         return nil, dataError("Could not open file for class id index: " + fileName + ".", e, nil)
     }
     i.file = file;
-    
-    i.readIds()
-    
+    if _, de := checkFileHeader(i.file, classIdIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readIds(); de != nil {
+        return nil, de
+    }
+
     return i, nil
 }
 
 // Creates a class id index that does not yet exist.
 func createClassIdIndex(fileName string) (*classIdIndex, *DataError) {
-    
+
     i := new(classIdIndex)
-    
+
     // create the file
     file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
     if e != nil {
         return nil, dataError("Could not create file for class id index: " + fileName + ".", e, nil)
     }
     i.file = file;
-    
-    i.readIds()
-    
+    if de := writeFileHeader(i.file, classIdIndexFile, 0); de != nil {
+        return nil, de
+    }
+
+    if de := i.readIds(); de != nil {
+        return nil, de
+    }
+
     return i, nil
 }
 
-// Reads the ids from the file and stores it in the ids map of the index
-// Has a secondary purpose of initializing the indexes id map
-func (i *classIdIndex) readIds () {
+// Reads the containers from the file.
+// Has a secondary purpose of initializing the index.
+// Returns an error of type *DataError if the file can not be read or a block can not be
+// decoded.
+func (i *classIdIndex) readIds () *DataError {
     Assert(nilClassIdIndex, i != nil)
     Assert(nilClassIdIndexFile, i.file != nil)
-    
-    ids := make(map[uint32]Empty)
-    
-    offset := int64(0)
-    info, _ := os.Stat(i.file.Name())
-    size := info.Size()
-    bytes := make([]byte, size)
-    _, _ = i.file.ReadAt(bytes, offset)
-    
-    pos := 0
-    for int64(pos) < size {
-        idBytes := bytes[pos : pos + 4]
-        id, _ := util.BytesToUint32(idBytes)
-        ids[id] = Empty{}
-        pos += 4
-    }
-    
-    i.ids = ids
-}
-
-// Writes the ids to the file.
-func (i *classIdIndex) write () {
+
+    i.containers = make([]*idContainer, 0)
+    i.count = 0
+    i.free = make([]uint32, 0)
+    i.dirty = make(map[uint32]*idContainer)
+
+    fileSize, e := fileSize(i.file)
+    if e != nil {
+        return dataError(classIdIndexReadFail + i.file.Name(), e, nil)
+    }
+    size := int(fileSize - fileHeaderSize)
+    i.slots = uint32((size + containerBlockSize - 1) / containerBlockSize)
+    // the last block is only as long as its array, so pad the buffer to a whole block
+    bytes := make([]byte, int(i.slots) * containerBlockSize)
+    if _, e := i.file.ReadAt(bytes[:size], int64(fileHeaderSize)); e != nil && e != io.EOF {
+        return dataError(classIdIndexReadFail + i.file.Name(), e, nil)
+    }
+
+    for slot := uint32(0); slot < i.slots; slot++ {
+        pos := int(slot) * containerBlockSize
+        length := containerBlockSize
+        if size - pos < length {
+            length = size - pos
+        }
+        c, ok := decodeIdContainer(slot, bytes[pos : pos + containerBlockSize], length)
+        if !ok || (c != nil && i.container(c.key) != nil) {
+            // blocks are numbered from 1 in corruption errors, like records
+            return dataError(classIdIndexCorrupted, &CorruptionError{i.file.Name(), uint64(slot) + 1}, nil)
+        }
+        if c == nil {
+            i.free = append(i.free, slot)
+            continue
+        }
+        pos = i.search(c.key)
+        i.containers = append(i.containers, nil)
+        copy(i.containers[pos + 1:], i.containers[pos:])
+        i.containers[pos] = c
+        i.count += c.count
+    }
+    return nil
+}
+
+// Writes the containers that have changed to the file.
+// Returns an error of type *DataError if they can not be written.
+func (i *classIdIndex) write () *DataError {
     Assert(nilClassIdIndex, i != nil)
     Assert(nilClassIdIndexFile, i.file != nil)
-    
-    i.file.Truncate(int64(0))
-    
-    ids := make([]byte,0 ,len(i.ids) * 4)
-    for id, _ := range i.ids {
-        bytes, _ := util.Uint32ToBytes(id)
-        ids = append(ids, bytes...)
+
+    bytes := make([]byte, containerBlockSize)
+    for slot, c := range i.dirty {
+        if c == nil {
+            c = &idContainer{}
+        }
+        size := c.encode(bytes)
+        writeAt := int64(fileHeaderSize) + int64(slot) * containerBlockSize
+        if _, e := i.file.WriteAt(bytes[:size], writeAt); e != nil {
+            return dataError(classIdIndexWriteFail + i.file.Name(), e, nil)
+        }
     }
-    
-    writeAt := int64(0)
-    _, _ = i.file.WriteAt(ids, writeAt) // TODO do not ignore the error
-    
+    i.dirty = make(map[uint32]*idContainer)
+    return nil
+}
+
+// Returns the position of the container for the upper 16 bits of an id, or of where
+// it would be inserted.
+func (i *classIdIndex) search(key uint16) int {
+    return sort.Search(len(i.containers), func(n int) bool { return i.containers[n].key >= key })
 }
 
+// Returns the container for the upper 16 bits of an id, or nil if there is none.
+func (i *classIdIndex) container(key uint16) *idContainer {
+    pos := i.search(key)
+    if pos < len(i.containers) && i.containers[pos].key == key {
+        return i.containers[pos]
+    }
+    return nil
+}
 
 // Determines if a particular id is present in the index.
 func (i *classIdIndex) hasId(id uint32) bool {
-    _, ok := i.ids[id]
-    return ok
+    c := i.container(uint16(id >> 16))
+    return c != nil && c.has(uint16(id))
+}
+
+// Returns the number of ids in the index.
+func (i *classIdIndex) size() int {
+    return i.count
 }
 
-// Returns a set of all the ids in the class.
-func (i *classIdIndex) allIds() map[uint32]Empty {
-    return i.ids
+// Calls fn with every id in the index, in order.
+// Iteration stops early if fn returns false, in which case false is returned.
+func (i *classIdIndex) each(fn func(id uint32) bool) bool {
+    for _, c := range i.containers {
+        high := uint32(c.key) << 16
+        if !c.each(func(low uint16) bool { return fn(high | uint32(low)) }) {
+            return false
+        }
+    }
+    return true
+}
+
+// Returns the lowest id in the index that is at least from, or 0 if there is none.
+func (i *classIdIndex) nextId(from uint32) uint32 {
+    for pos := i.search(uint16(from >> 16)); pos < len(i.containers); pos++ {
+        c := i.containers[pos]
+        low := uint16(0)
+        if c.key == uint16(from >> 16) {
+            low = uint16(from)
+        }
+        if next, ok := c.next(low); ok {
+            return uint32(c.key) << 16 | uint32(next)
+        }
+    }
+    return 0
 }
 
 func (i *classIdIndex) addId(id uint32) {
-    i.ids[id] = Empty{}
+    key := uint16(id >> 16)
+    pos := i.search(key)
+    if pos == len(i.containers) || i.containers[pos].key != key {
+        c := &idContainer{key: key, array: make([]uint16, 0, 1)}
+        if n := len(i.free); n > 0 {
+            c.slot = i.free[n - 1]
+            i.free = i.free[:n - 1]
+        } else {
+            c.slot = i.slots
+            i.slots++
+        }
+        i.containers = append(i.containers, nil)
+        copy(i.containers[pos + 1:], i.containers[pos:])
+        i.containers[pos] = c
+    }
+
+    c := i.containers[pos]
+    if c.add(uint16(id)) {
+        i.count++
+        i.dirty[c.slot] = c
+    }
 }
 
 func (i *classIdIndex) removeId(id uint32) {
-    delete(i.ids, id)
+    pos := i.search(uint16(id >> 16))
+    if pos == len(i.containers) || i.containers[pos].key != uint16(id >> 16) {
+        return
+    }
+
+    c := i.containers[pos]
+    if !c.remove(uint16(id)) {
+        return
+    }
+    i.count--
+    i.dirty[c.slot] = c
+    if c.count == 0 {
+        i.containers = append(i.containers[:pos], i.containers[pos + 1:]...)
+        i.free = append(i.free, c.slot)
+        i.dirty[c.slot] = nil
+    }
 }
 
 // Cleans up the file for the index.
@@ -121,5 +466,3 @@ func (i *classIdIndex) shutdown() {
         _ = i.file.Close()
     }
 }
-
-
@@ -2,7 +2,6 @@ package data
 
 import (
     "os"
-    "fmt"
 )
 
 // error messages
@@ -25,6 +24,9 @@ func constructClassStore(g *Graph) (*classStore, *DataError){
     } else {
         store.file = file;
     }
+    if _, de := checkFileHeader(store.file, classFile); de != nil {
+        return nil, de
+    }
     
     if classes, e := store.readClasses(); e != nil {
         return nil, dataError("Failure to construct class store.", nil, e)
@@ -46,6 +48,9 @@ func createClassStore(g *Graph) (*classStore, *DataError){
     } else {
         store.file = file;
     }
+    if de := writeFileHeader(store.file, classFile, 0); de != nil {
+        return nil, de
+    }
     
     if classes, e := store.readClasses(); e != nil {
         return nil, dataError("Failure to create class store.", nil, e)
@@ -58,13 +63,17 @@ func createClassStore(g *Graph) (*classStore, *DataError){
 
 func (s *classStore) initialize(g *Graph) {
     s.AddClass("Vertex", nil, g)
-    s.write()
 }
 
+// Adds a class and returns its id.
+// Returns 0 if the label for the name of the class can not be added.
 func (s *classStore) AddClass(name string, super *Class, g *Graph) uint8 {
     
+    label, err := g.labelStore.addLabel(name, g)
+    if err != nil {
+        return 0
+    }
     id := s.nextId()
-    label := g.labelStore.addLabel(name, g)
     c := createClass(id, label, super, g)
     
     if int(c.Id) > len(s.classes){
@@ -92,29 +101,42 @@ func (s *classStore) FindByName(name string, g *Graph) *Class {
     return nil
 }
 
-func (s *classStore) write () {
-    s.file.Truncate(int64(0))
+// Writes the classes to the file, along with the indexes of their vertices.
+// Returns an error of type *DataError if they can not be written.
+func (s *classStore) write () *DataError {
+    if e := s.file.Truncate(int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for class store: " + s.file.Name() + ".", e, nil)
+    }
+    bytes := make([]byte, classDataSize)
     for id, class := range s.classes {
-        s.file.WriteAt(class.Data(), int64(id * 8))
+        class.encode(bytes)
+        if _, e := s.file.WriteAt(bytes, int64(fileHeaderSize + id * classDataSize)); e != nil {
+            return dataError("Could not write file for class store: " + s.file.Name() + ".", e, nil)
+        }
     }
     for _, class := range s.classes {
         if class.index != nil {
-            class.index.write()
+            if err := class.index.write(); err != nil {
+                return err
+            }
         }
     }
+    return nil
 }
 
 func (s *classStore) readClasses() ([]*Class, *DataError ){
     
-    offset := int64(0)
+    offset := int64(fileHeaderSize)
     bytes := make([]byte, classDataSize)
-    info, _ := os.Stat(s.file.Name())
-    size := info.Size()
-    classes := make([]*Class, size/classDataSize)
+    size, e := fileSize(s.file)
+    if e != nil {
+        return nil, dataError("Unable to load classes from data file.", e, nil)
+    }
+    classes := make([]*Class, 0, (size - fileHeaderSize) / classDataSize)
     
     for offset < size {
         _, _ = s.file.ReadAt(bytes, offset)
-        if class, e := constructClass(uint8(offset / classDataSize + 1), bytes); e != nil {
+        if class, e := constructClass(uint8((offset - fileHeaderSize) / classDataSize + 1), bytes); e != nil {
             return nil, dataError("Unable to load classes from data file.", nil, e)
         } else {
             classes = append(classes, class)
@@ -131,8 +153,6 @@ func (s *classStore) readClasses() ([]*Class, *DataError ){
 func (s *classStore) nextId() uint8 {
     if (s.classes == nil){
         panic("Class store has a nil class store.")
-    } else {
-        fmt.Println("s.classes is NOT nil")
     }
     for _, val := range s.classes {
         
@@ -144,6 +164,12 @@ func (s *classStore) nextId() uint8 {
 }
 
 func (store *classStore) shutdown () {
+    if store == nil {
+        return
+    }
+    for _, class := range store.classes {
+        class.index.shutdown()
+    }
     if (store.file != nil){
         _ = store.file.Close()
     }
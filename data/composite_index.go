@@ -0,0 +1,360 @@
+package data
+
+import (
+    "os"
+    "sort"
+    "strings"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    nilCompositeIndex = "attempt to operate on a nil composite index"
+    nilCompositeIndexFile = "attempt to operate on a nil composite index file"
+)
+
+// One value of a composite index entry.
+// Text values are kept as text rather than as the id of a text object.
+type compositeValue struct {
+    t byte
+    data [8]byte
+    text string
+}
+
+// Returns the value of an attribute for a composite index.
+func compositeValueOf(a *Attribute, g *Graph) (compositeValue, *DataError) {
+    v := compositeValue{t: a.t, data: a.data}
+    if a.t == text_t {
+        text, err := a.text(g)
+        if err != nil {
+            return v, err
+        }
+        v.data = [8]byte{}
+        v.text = text
+    }
+    return v, nil
+}
+
+// Returns a go value as a value for a composite index.
+func compositeValueFrom(value Any) (compositeValue, *DataError) {
+    t, data, text, err := encodeValue(value)
+    return compositeValue{t, data, text}, err
+}
+
+// Returns where values of a type are ordered relative to values of other types.
+func compositeTypeOrder(t byte) int {
+    switch t {
+    case integer_t, real_t:
+        return 1
+    case time_t:
+        return 2
+    case boolean_t:
+        return 3
+    case text_t:
+        return 4
+    }
+    return 5
+}
+
+// Compares two composite values, returning a negative number, zero, or a positive
+// number if a is less than, equal to, or greater than b.
+// Numbers are ordered before times, then booleans, then text. Numbers and times are
+// compared as they are in range indexes and text is compared byte by byte.
+func compareCompositeValues(a, b *compositeValue) int {
+    if x, y := compositeTypeOrder(a.t), compositeTypeOrder(b.t); x != y {
+        return x - y
+    }
+    switch a.t {
+    case integer_t, real_t, time_t:
+        return compareRangeValues(&rangeEntry{t: a.t, data: a.data}, &rangeEntry{t: b.t, data: b.data})
+    case text_t:
+        return strings.Compare(a.text, b.text)
+    }
+    return int(a.data[0]) - int(b.data[0])
+}
+
+// An entry in a composite index: the values of the indexed keys of a vertex, in the
+// order of the keys, and the id of the vertex.
+type compositeEntry struct {
+    values []compositeValue
+    id uint32
+}
+
+// Compares two entries by their values in order, and then by vertex id.
+func compareCompositeEntries(a, b *compositeEntry) int {
+    for n := range a.values {
+        if c := compareCompositeValues(&a.values[n], &b.values[n]); c != 0 {
+            return c
+        }
+    }
+    return int(int64(a.id) - int64(b.id))
+}
+
+// A composite index keeps the values of several attribute keys of a class in order,
+// sorted by the first key, then the second, and so on.
+// Vertices can be found by equal values for a prefix of the keys and a range of values
+// for the key that follows the prefix.
+// Only vertices that have every key are in the index.
+// The entries are kept sorted in memory, and the file is an entry log (see entryLog)
+// of the encoded entries. As in a range index, a change takes time in proportion to the
+// size of the index.
+type compositeIndex struct {
+    file *os.File
+    log *entryLog
+    size int // the number of keys in each entry
+    entries []compositeEntry
+}
+
+// Creates an existing composite index over size keys.
+func constructCompositeIndex(fileName string, size int) (*compositeIndex, *DataError) {
+
+    i := new(compositeIndex)
+    i.size = size
+
+    // load the file
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for composite index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if _, de := checkFileHeader(i.file, compositeIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readEntries(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates a composite index over size keys that does not yet exist.
+// A composite index with an empty file name is kept in memory only.
+func createCompositeIndex(fileName string, size int) (*compositeIndex, *DataError) {
+
+    i := new(compositeIndex)
+    i.size = size
+    i.log = new(entryLog)
+    i.entries = make([]compositeEntry, 0)
+    if fileName == "" {
+        return i, nil
+    }
+
+    // create the file
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for composite index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if de := writeFileHeader(i.file, compositeIndexFile, 0); de != nil {
+        return nil, de
+    }
+    i.log.file = file
+
+    return i, nil
+}
+
+// Encodes an entry as the vertex id followed by each value as its type and either its
+// data, or the length of its text and the text.
+func (e *compositeEntry) encode() []byte {
+    b := make([]byte, 8)
+    util.PutUint32(b, e.id)
+    bytes := append([]byte{}, b[:4]...)
+    for _, v := range e.values {
+        bytes = append(bytes, v.t)
+        if v.t == text_t {
+            util.PutUint32(b, uint32(len(v.text)))
+            bytes = append(bytes, b[:4]...)
+            bytes = append(bytes, v.text...)
+        } else {
+            bytes = append(bytes, v.data[:]...)
+        }
+    }
+    return bytes
+}
+
+// Decodes an entry with a number of values.
+// Returns false if the entry is not exactly that many values.
+func decodeCompositeEntry(b []byte, size int) (compositeEntry, bool) {
+    if len(b) < 4 {
+        return compositeEntry{}, false
+    }
+    e := compositeEntry{make([]compositeValue, size), util.Uint32(b)}
+    pos := 4
+    for n := range e.values {
+        v := &e.values[n]
+        if pos == len(b) {
+            return e, false
+        }
+        v.t = b[pos]
+        pos++
+        if v.t == text_t {
+            if len(b) - pos < 4 {
+                return e, false
+            }
+            length := int(util.Uint32(b[pos:]))
+            pos += 4
+            if length > len(b) - pos {
+                return e, false
+            }
+            v.text = string(b[pos : pos + length])
+            pos += length
+        } else {
+            if len(b) - pos < 8 {
+                return e, false
+            }
+            copy(v.data[:], b[pos : pos + 8])
+            pos += 8
+        }
+    }
+    return e, pos == len(b)
+}
+
+// Reads the entries from the file.
+// Returns an error of type *DataError if the file can not be read.
+func (i *compositeIndex) readEntries() *DataError {
+    Assert(nilCompositeIndex, i != nil)
+    Assert(nilCompositeIndexFile, i.file != nil)
+
+    i.entries = make([]compositeEntry, 0)
+    log, err := readEntryLog(i.file, func(added bool, b []byte) bool {
+        e, ok := decodeCompositeEntry(b, i.size)
+        if !ok {
+            return false
+        }
+        if added {
+            i.insert(e)
+        } else {
+            i.erase(e)
+        }
+        return true
+    })
+    i.log = log
+    return err
+}
+
+// Writes the changes to the entries to the file.
+// Returns an error of type *DataError if they can not be written.
+func (i *compositeIndex) write() *DataError {
+    Assert(nilCompositeIndex, i != nil)
+
+    return i.log.write(func(fn func(entry []byte)) {
+        for n := range i.entries {
+            fn(i.entries[n].encode())
+        }
+    })
+}
+
+// Returns the position of an entry, or of where it would be inserted.
+func (i *compositeIndex) search(e *compositeEntry) int {
+    return sort.Search(len(i.entries), func(n int) bool {
+        return compareCompositeEntries(&i.entries[n], e) >= 0
+    })
+}
+
+// Returns true if the entry at a position has the same vertex and values as e.
+func (i *compositeIndex) matches(pos int, e *compositeEntry) bool {
+    return pos < len(i.entries) && compareCompositeEntries(&i.entries[pos], e) == 0
+}
+
+// Records that a vertex has a list of values.
+func (i *compositeIndex) add(e compositeEntry) {
+    Assert(nilCompositeIndex, i != nil)
+
+    if i.insert(e) {
+        i.log.add(e.encode())
+    }
+}
+
+// Records that a vertex no longer has a list of values.
+func (i *compositeIndex) remove(e compositeEntry) {
+    Assert(nilCompositeIndex, i != nil)
+
+    if i.erase(e) {
+        i.log.remove(e.encode())
+    }
+}
+
+// Puts an entry in its place, returning false if it was already there.
+func (i *compositeIndex) insert(e compositeEntry) bool {
+    pos := i.search(&e)
+    if i.matches(pos, &e) {
+        return false
+    }
+    i.entries = append(i.entries, compositeEntry{})
+    copy(i.entries[pos + 1:], i.entries[pos:])
+    i.entries[pos] = e
+    return true
+}
+
+// Takes an entry out, returning false if it was not there.
+func (i *compositeIndex) erase(e compositeEntry) bool {
+    pos := i.search(&e)
+    if !i.matches(pos, &e) {
+        return false
+    }
+    i.entries = append(i.entries[:pos], i.entries[pos + 1:]...)
+    return true
+}
+
+// Calls fn with the id of every vertex whose first values equal the prefix and whose
+// next value is within the bounds of the range, in order, until fn returns false.
+// A nil bound leaves that end of the range open.
+func (i *compositeIndex) scan(prefix []compositeValue, min, max *compositeValue, r *Range, fn func(id uint32) bool) {
+    Assert(nilCompositeIndex, i != nil)
+
+    comparePrefix := func(e *compositeEntry) int {
+        for n := range prefix {
+            if c := compareCompositeValues(&e.values[n], &prefix[n]); c != 0 {
+                return c
+            }
+        }
+        return 0
+    }
+    next := len(prefix)
+
+    lo := sort.Search(len(i.entries), func(n int) bool {
+        e := &i.entries[n]
+        if c := comparePrefix(e); c != 0 {
+            return c > 0
+        }
+        if min == nil {
+            return true
+        }
+        c := compareCompositeValues(&e.values[next], min)
+        return c > 0 || (c == 0 && !r.ExcludeMin)
+    })
+    hi := sort.Search(len(i.entries), func(n int) bool {
+        e := &i.entries[n]
+        if c := comparePrefix(e); c != 0 {
+            return c > 0
+        }
+        if max == nil {
+            return false
+        }
+        c := compareCompositeValues(&e.values[next], max)
+        return c > 0 || (c == 0 && r.ExcludeMax)
+    })
+
+    if r.Descending {
+        for n := hi - 1; n >= lo; n-- {
+            if !fn(i.entries[n].id) {
+                return
+            }
+        }
+        return
+    }
+    for n := lo; n < hi; n++ {
+        if !fn(i.entries[n].id) {
+            return
+        }
+    }
+}
+
+// Cleans up the file for the index.
+func (i *compositeIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
@@ -1,6 +1,9 @@
 package data
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/wardlem/graphlite/util"
 )
 
@@ -38,3 +41,132 @@ func (e *DataError) Next() util.Error {
 func Assert(message string, assertions ...bool){
     util.Assert(message, assertions...)
 }
+
+// A CorruptionError is the cause of a *DataError returned when a stored record
+// does not match its checksum or an index entry can not be decoded.
+type CorruptionError struct {
+    Store string // the name of the store or index file the record belongs to
+    Id uint64    // the id of the corrupted record, or the number of the index entry
+}
+
+func (e *CorruptionError) Error() string {
+    return "corrupted record " + strconv.FormatUint(e.Id, 10) + " in " + e.Store + " store"
+}
+
+// Returns the corruption error at the root of the error, or nil if the error was
+// not caused by corrupted data.
+func (e *DataError) Corruption() *CorruptionError {
+    c, _ := e.cause(func(err error) bool {
+        _, ok := err.(*CorruptionError)
+        return ok
+    }).(*CorruptionError)
+    return c
+}
+
+// A ConstraintError is the cause of a *DataError returned when a change would give
+// two vertices the same value for a unique attribute.
+type ConstraintError struct {
+    Class string // the name of the class the unique index belongs to
+    Key string   // the attribute key
+    Value Any    // the value that is already taken
+    Id uint32    // the id of the vertex that already has the value
+}
+
+func (e *ConstraintError) Error() string {
+    return fmt.Sprintf("%s.%s must be unique, but vertex %d already has the value %v", e.Class, e.Key, e.Id, e.Value)
+}
+
+// Returns the constraint error at the root of the error, or nil if the error was
+// not caused by a constraint violation.
+func (e *DataError) Constraint() *ConstraintError {
+    c, _ := e.cause(func(err error) bool {
+        _, ok := err.(*ConstraintError)
+        return ok
+    }).(*ConstraintError)
+    return c
+}
+
+// A SchemaError is the cause of a *DataError returned when a change would break the
+// schema of a class or of an edge label.
+type SchemaError struct {
+    Class string  // the name of the class whose schema would be broken
+    Key string    // the attribute key
+    Label string  // the edge label, when the schema of an edge label would be broken
+    Reason string // what is wrong, such as "is required"
+}
+
+func (e *SchemaError) Error() string {
+    if e.Label != "" {
+        return "edge " + e.Label + " " + e.Reason
+    }
+    return e.Class + "." + e.Key + " " + e.Reason
+}
+
+// Returns the schema error at the root of the error, or nil if the error was not
+// caused by breaking a class schema.
+func (e *DataError) Schema() *SchemaError {
+    s, _ := e.cause(func(err error) bool {
+        _, ok := err.(*SchemaError)
+        return ok
+    }).(*SchemaError)
+    return s
+}
+
+// A ModificationError is the cause of a *DataError returned by an iterator over the
+// edges of a vertex when edges are added to or removed from the graph while it runs.
+type ModificationError struct {
+    Vertex uint32 // the id of the vertex whose edges were being iterated over
+}
+
+func (e *ModificationError) Error() string {
+    return "edges were added or removed while iterating over the edges of vertex " + strconv.FormatUint(uint64(e.Vertex), 10)
+}
+
+// Returns the modification error at the root of the error, or nil if the error was
+// not caused by changing the edges of the graph while iterating over them.
+func (e *DataError) Modification() *ModificationError {
+    m, _ := e.cause(func(err error) bool {
+        _, ok := err.(*ModificationError)
+        return ok
+    }).(*ModificationError)
+    return m
+}
+
+// Walks the chain of errors and returns the first underlying error that matches.
+func (e *DataError) cause(match func(err error) bool) error {
+    for e != nil {
+        if e.err != nil && match(e.err) {
+            return e.err
+        }
+        next, _ := e.NextErr.(*DataError)
+        if next == e {
+            break
+        }
+        e = next
+    }
+    return nil
+}
+
+// Creates the error for setting an attribute to a value that another vertex already has.
+func constraintError(c *Class, key string, a *Attribute, id uint32, g *Graph) *DataError {
+    ce := new(ConstraintError)
+    ce.Class, _ = c.Name(g)
+    ce.Key = key
+    ce.Id = id
+    if a != nil {
+        ce.Value, _ = a.Value(g)
+    }
+    return dataError("Unique constraint violated.", ce, nil)
+}
+
+// Creates the error for a change that breaks the schema of a class.
+func schemaError(c *Class, key string, reason string, g *Graph) *DataError {
+    se := &SchemaError{Key: key, Reason: reason}
+    se.Class, _ = c.Name(g)
+    return dataError("Schema violated.", se, nil)
+}
+
+// Creates the error for an edge that breaks the schema of its label.
+func edgeSchemaError(label string, reason string) *DataError {
+    return dataError("Schema violated.", &SchemaError{Label: label, Reason: reason}, nil)
+}
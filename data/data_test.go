@@ -3,6 +3,13 @@ package data
 import(
 	"testing"
 	"fmt"
+	"math"
+	"os"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/wardlem/graphlite/util"
 )
 
 func TestDatabase (t *testing.T) {
@@ -33,32 +40,39 @@ func TestDatabase (t *testing.T) {
     } 
     
     ls := g.labelStore
+    byValue := func(value string) *Label {
+        l, err := ls.findByValue(value, g)
+        if err != nil {
+            t.Error(err.Trace())
+        }
+        return l
+    }
     
     ls.rootNode().printTree("", "r", g)
     
-    idb := ls.addLabel("b", g)
+    idb, _ := ls.addLabel("b", g)
     ls.rootNode().printTree("", "r", g)
-    ida := ls.addLabel("a", g)
+    ida, _ := ls.addLabel("a", g)
     ls.rootNode().printTree("", "r", g)
-    idc := ls.addLabel("c", g)
+    idc, _ := ls.addLabel("c", g)
     ls.rootNode().printTree("", "r", g)
-    idd := ls.addLabel("d", g)
+    idd, _ := ls.addLabel("d", g)
     ls.rootNode().printTree("", "r", g)
-    ide := ls.addLabel("e", g)
+    ide, _ := ls.addLabel("e", g)
     ls.rootNode().printTree("", "r", g)
-    idf := ls.addLabel("f", g)
+    idf, _ := ls.addLabel("f", g)
     ls.rootNode().printTree("", "r", g)
-    ida2 := ls.addLabel("a", g)
+    ida2, _ := ls.addLabel("a", g)
     ls.rootNode().printTree("", "r", g)
-    idx := ls.addLabel("x", g)
+    idx, _ := ls.addLabel("x", g)
     ls.rootNode().printTree("", "r", g)
-    idy := ls.addLabel("y", g)
+    idy, _ := ls.addLabel("y", g)
     ls.rootNode().printTree("", "r", g)
-    idz := ls.addLabel("z", g)
+    idz, _ := ls.addLabel("z", g)
     ls.rootNode().printTree("", "r", g)
-    idaa := ls.addLabel("aa", g)
+    idaa, _ := ls.addLabel("aa", g)
     ls.rootNode().printTree("", "r", g)
-    idbb := ls.addLabel("bb", g)
+    idbb, _ := ls.addLabel("bb", g)
     ls.rootNode().printTree("", "r", g)
     Assert("ids do not match", ida == ida2)
     
@@ -82,23 +96,23 @@ func TestDatabase (t *testing.T) {
     fmt.Printf("1 bytes: %+v, 1 value: %s\n", label1.data(), label1.Value(g))
     fmt.Printf("Vertex < A %+v\n", "Vertex" < "A")
     
-    if labelA != ls.findByValue("a", g) {
-        fmt.Printf("A: %+v != %+v \n", labelA, ls.findByValue("a", g))
+    if labelA != byValue("a") {
+        fmt.Printf("A: %+v != %+v \n", labelA, byValue("a"))
     }
-    if labelB != ls.findByValue("b", g) {
-        fmt.Printf("B: %+v != %+v \n", labelB, ls.findByValue("b", g))
+    if labelB != byValue("b") {
+        fmt.Printf("B: %+v != %+v \n", labelB, byValue("b"))
     }
-    if labelC != ls.findByValue("c", g){
-        fmt.Printf("C: %+v != %+v \n", labelC, ls.findByValue("c", g))
+    if labelC != byValue("c"){
+        fmt.Printf("C: %+v != %+v \n", labelC, byValue("c"))
     }
-    if labelD != ls.findByValue("d", g){
-        fmt.Printf("D: %+v != %+v \n", labelD, ls.findByValue("d", g))
+    if labelD != byValue("d"){
+        fmt.Printf("D: %+v != %+v \n", labelD, byValue("d"))
     }
-    if labelE != ls.findByValue("e", g){
-        fmt.Printf("E: %+v != %+v \n", labelE, ls.findByValue("e", g))
+    if labelE != byValue("e"){
+        fmt.Printf("E: %+v != %+v \n", labelE, byValue("e"))
     }
-    if labelF != ls.findByValue("f", g){
-        fmt.Printf("F: %+v != %+v \n", labelF, ls.findByValue("f", g))
+    if labelF != byValue("f"){
+        fmt.Printf("F: %+v != %+v \n", labelF, byValue("f"))
     }
     
     fmt.Printf("A bytes: %+v \n", labelA.data())
@@ -114,13 +128,13 @@ func TestDatabase (t *testing.T) {
     fmt.Printf("AA bytes: %+v \n", labelAA.data())
     fmt.Printf("BB bytes: %+v \n", labelBB.data())
     
-    fmt.Printf("A by value: %+v \n", ls.findByValue("a", g))
-    fmt.Printf("B by value: %+v \n", ls.findByValue("b", g))
-    fmt.Printf("C by value: %+v \n", ls.findByValue("c", g))
-    fmt.Printf("D by value: %+v \n", ls.findByValue("d", g))
-    fmt.Printf("E by value: %+v \n", ls.findByValue("e", g))
-    fmt.Printf("F by value: %+v \n", ls.findByValue("f", g))
-    fmt.Printf("G by value: %+v \n", ls.findByValue("g", g))
+    fmt.Printf("A by value: %+v \n", byValue("a"))
+    fmt.Printf("B by value: %+v \n", byValue("b"))
+    fmt.Printf("C by value: %+v \n", byValue("c"))
+    fmt.Printf("D by value: %+v \n", byValue("d"))
+    fmt.Printf("E by value: %+v \n", byValue("e"))
+    fmt.Printf("F by value: %+v \n", byValue("f"))
+    fmt.Printf("G by value: %+v \n", byValue("g"))
     
     fmt.Printf("Root: %+v \n", ls.rootNode())
     
@@ -170,4 +184,369 @@ func TestDatabase (t *testing.T) {
     
 }
 
+// Creates a database with a graph for a test.
+// The database is destroyed when the test ends.
+func newTestGraph(tb testing.TB, name string) (*DB, *Graph) {
+    db, err := CreateDB(tb.TempDir() + "/db")
+    if err != nil {
+        tb.Fatal(err.Trace())
+    }
+    tb.Cleanup(func() {
+        db.Destroy()
+    })
+    g, err := db.CreateGraph(name)
+    if err != nil {
+        tb.Fatal(err.Trace())
+    }
+    return db, g
+}
+
+// Returns the size of an open file.
+func sizeOf(t *testing.T, file *os.File) int64 {
+    size, e := fileSize(file)
+    if e != nil {
+        t.Fatal(e)
+    }
+    return size
+}
+
+func TestGraphVersion (t *testing.T) {
+    db, g := newTestGraph(t, "versioned")
+    var err *DataError
+    
+    // a fresh graph is at the current version
+    if version, err := readGraphVersion(g); err != nil || version != FormatVersion {
+        t.Errorf("expected version %d, got %d", FormatVersion, version)
+    }
+    db.Shutdown()
+    
+    // graphs without a meta file are from before versioning; TestBaselineMigration
+    // migrates one
+    os.Remove(g.metaPath())
+    if version, err := readGraphVersion(g); err != nil || version != 0 {
+        t.Errorf("expected a graph without a meta file to be version 0, got %d", version)
+    }
+    
+    // graphs written by a newer version are refused
+    writeGraphVersion(g, FormatVersion + 1)
+    if _, err = constructGraph(db, "versioned"); err == nil {
+        t.Error("expected an error opening a graph with a newer format version")
+    }
+    
+    // foreign files are refused
+    ioutil.WriteFile(g.storePath("label"), []byte("not a graphlite file"), 0777)
+    writeGraphVersion(g, FormatVersion)
+    if _, err = constructGraph(db, "versioned"); err == nil {
+        t.Error("expected an error opening a graph with a foreign store file")
+    }
+}
+
+// Copies a database from testdata so a test can open it without changing the original.
+func copyTestDB(t *testing.T, name string) string {
+    path := t.TempDir() + "/db"
+    e := filepath.Walk(filepath.Join("testdata", name), func(from string, info os.FileInfo, e error) error {
+        if e != nil {
+            return e
+        }
+        rel, _ := filepath.Rel(filepath.Join("testdata", name), from)
+        to := filepath.Join(path, rel)
+        if info.IsDir() {
+            return os.MkdirAll(to, 0777)
+        }
+        bytes, e := ioutil.ReadFile(from)
+        if e != nil {
+            return e
+        }
+        return ioutil.WriteFile(to, bytes, 0666)
+    })
+    if e != nil {
+        t.Fatal(e)
+    }
+    return path
+}
+
+// testdata/baseline holds a graph written by the code graphlite started from, before
+// any of its files had a format version: classes and labels written by that code's
+// stores, and vertices, edges and attributes laid out the way its stores read them.
+// Every migration runs against it, so a change that breaks upgrading an old graph fails
+// here rather than on a user's files.
+func TestBaselineMigration (t *testing.T) {
+    db, err := OpenDB(copyTestDB(t, "baseline"))
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer db.Shutdown()
+    g, err := db.G("old")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if version, _ := readGraphVersion(g); version != FormatVersion {
+        t.Errorf("expected migrated version %d, got %d", FormatVersion, version)
+    }
+    
+    check := func(g *Graph) {
+        // classes keep their names and hierarchy
+        person, employee, company := g.C("Person"), g.C("Employee"), g.C("Company")
+        if person == nil || employee == nil || company == nil {
+            t.Fatal("expected the classes of the old graph")
+        }
+        if employee.Super(g) != person || person.Super(g) != g.C("Vertex") || company.Super(g) != g.C("Vertex") {
+            t.Error("expected the old class hierarchy")
+        }
+        subs := make(map[string]bool)
+        for sub := g.C("Vertex").Sub(g); sub != nil; sub = sub.NextSub(g) {
+            name, _ := sub.Name(g)
+            subs[name] = true
+        }
+        if !subs["Person"] || !subs["Company"] || subs["Employee"] {
+            t.Errorf("expected Person and Company to be the sub classes of Vertex, got %v", subs)
+        }
+        
+        // vertices keep their classes and attributes
+        expected := map[string]string{"Person": "[Ann Cy]", "Employee": "[Bob]", "Company": "[Acme]"}
+        for className, names := range expected {
+            got := make([]Any, 0)
+            it := g.C(className).Vertices(g)
+            for it.Next() {
+                if it.Vertex().ClassName(g) == className {
+                    name, _ := it.Vertex().Get("name", g)
+                    got = append(got, name)
+                }
+            }
+            if fmt.Sprint(got) != names {
+                t.Errorf("expected %s to hold %s, got %v", className, names, got)
+            }
+        }
+        ann, _ := g.FindVertex(1)
+        if age, _ := ann.Get("age", g); age != int64(40) {
+            t.Errorf("expected Ann to be 40, got %v", age)
+        }
+        
+        // edges keep their labels, chains and attributes
+        labels := make(map[string]int)
+        for it := g.Edges(); it.Next(); {
+            labels[it.Edge().Key(g)]++
+        }
+        if labels["knows"] != 2 || labels["works_at"] != 1 {
+            t.Errorf("expected two knows edges and one works_at edge, got %v", labels)
+        }
+        knows := 0
+        for it := g.EdgesByLabel("knows"); it.Next(); {
+            knows++
+        }
+        if knows != 2 {
+            t.Errorf("expected the edge label index to find 2 knows edges, got %d", knows)
+        }
+        out := make([]uint32, 0)
+        for it := ann.OutEdges(g); it.Next(); {
+            out = append(out, it.Edge().ToId())
+        }
+        if fmt.Sprint(out) != "[2]" {
+            t.Errorf("expected Ann to know Bob, got %v", out)
+        }
+        worksAt, _ := g.FindEdge(1)
+        if since, _ := worksAt.Get("since", g); since != int64(2010) {
+            t.Errorf("expected the works_at edge to be since 2010, got %v", since)
+        }
+        
+        stats := g.Stats()
+        if stats.Classes["Person"].Total != 3 || stats.Classes["Company"].Vertices != 1 {
+            t.Errorf("expected migrated class counts, got %v", stats.Classes)
+        }
+        if stats.Keys["age"] != 1 || stats.Keys["since"] != 1 || stats.MaxOutDegree != 1 || stats.MaxInDegree != 1 {
+            t.Errorf("expected migrated key counts and degrees, got %v, %d, %d", stats.Keys, stats.MaxOutDegree, stats.MaxInDegree)
+        }
+    }
+    check(g)
+    if v, _ := g.FindVertex(5); v != nil {
+        t.Error("expected the removed vertex to stay removed")
+    }
+    
+    // new labels and vertices do not take the ids of old ones, but do take removed ones
+    city := g.AddClass("City", g.C("Vertex"))
+    if _, err = g.AddVertexWith(city, map[string]Any{"name": "Oslo", "founded": 1040}); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err = g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    if g, err = constructGraph(db, "old"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    check(g)
+    if found, _ := g.C("City").FindBy("name", "Oslo", g); len(found) != 1 || found[0].Id != 5 {
+        t.Errorf("expected the new city to take the id of the removed vertex, got %v", found)
+    }
+}
+
+func TestRecordChecksums (t *testing.T) {
+    // the setting only applies to graphs created after it
+    db, plain := newTestGraph(t, "plain")
+    var err *DataError
+    if err = db.Set(RecordChecksums, true); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err = db.Set("unsupported", []int{1}); err == nil {
+        t.Error("expected an error for a setting that can not be stored")
+    }
+    
+    // the settings are kept with the database
+    if reopened, err := OpenDB(db.Path); err != nil {
+        t.Fatal(err.Trace())
+    } else if checksums, ok := reopened.Setting(RecordChecksums).(bool); !ok || !checksums {
+        t.Errorf("expected the checksum setting to be read back, got %v", reopened.Setting(RecordChecksums))
+    }
+    if checksums, ok := ConstructDB(db.Path).Setting(RecordChecksums).(bool); !ok || !checksums {
+        t.Error("expected ConstructDB to read the settings as well")
+    }
+    broken := t.TempDir()
+    ioutil.WriteFile(broken + "/settings" + FileExtension, []byte("not a settings file"), 0777)
+    if _, err := OpenDB(broken); err == nil {
+        t.Error("expected an error for a settings file that can not be read")
+    }
+    if settings := ConstructDB(broken).Setting(RecordChecksums); settings != nil {
+        t.Errorf("expected settings that can not be read to be left unset, got %v", settings)
+    }
+    
+    g, err := db.CreateGraph("checked")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if plain.labelStore.records.checksums || !g.labelStore.records.checksums {
+        t.Error("expected checksums only in the graph created after the setting")
+    }
+    id, err := g.labelStore.addLabel("checked", g)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    g.labelStore.write()
+    
+    // an intact record reads back
+    g.labelStore.writes = make(map[uint16]*Label)
+    if _, err = g.labelStore.find(id); err != nil {
+        t.Error(err.Trace())
+    }
+    
+    // a damaged record is reported as corrupted
+    pos := g.labelStore.records.position(uint64(id))
+    g.labelStore.file.WriteAt([]byte{0xff}, pos + 3)
+    _, err = g.labelStore.find(id)
+    if err == nil || err.Corruption() == nil {
+        t.Fatal("expected a corruption error")
+    }
+    if c := err.Corruption(); c.Store != "label" || c.Id != uint64(id) {
+        t.Errorf("corruption reported for the wrong record: %s", c.Error())
+    }
+}
+
+func TestMigrationReaders (t *testing.T) {
+    _, g := newTestGraph(t, "readers")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    for _, name := range []string{"Ann", "Bob", "Cat"} {
+        g.AddVertexWith(person, map[string]Any{"name": name})
+    }
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // the labels read for a migration are the labels of the label store
+    labels, err := readLabelsV1(g)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    for id, value := range labels {
+        if name := g.labelStore.name(id, g); name != value {
+            t.Errorf("expected label %d to be %q, got %q", id, name, value)
+        }
+    }
+    if len(labels) != 3 {
+        t.Errorf("expected the labels Vertex, Person and name, got %v", labels)
+    }
+    
+    // a label tree that leads back to a label it has already reached is corruption
+    root := g.labelStore.root
+    b := make([]byte, 2)
+    util.PutUint16(b, root)
+    g.labelStore.file.WriteAt(b, g.labelStore.records.position(uint64(root)) + 16)
+    if _, err = readLabelsV1(g); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for a label tree with a loop")
+    }
+}
+
+func TestClassIdIndexMigration (t *testing.T) {
+    db, g := newTestGraph(t, "migrated")
+    var err *DataError
+    person := g.AddClass("Person", g.C("Vertex"))
+    for n := 0; n < 3; n++ {
+        g.AddVertex(person)
+    }
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    
+    // indexes from version 5 are an unordered list of ids
+    fileName := g.indexPath("Person.idx")
+    h := fileHeader{5, classIdIndexFile, 0}
+    bytes := h.data()
+    for _, id := range []uint32{3, 1, 2} {
+        b, _ := util.Uint32ToBytes(id)
+        bytes = append(bytes, b...)
+    }
+    ioutil.WriteFile(fileName, bytes, 0777)
+    writeGraphVersion(g, 5)
+    
+    if g, err = constructGraph(db, "migrated"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    ids := make([]uint32, 0)
+    g.C("Person").eachId(func(id uint32) bool {
+        ids = append(ids, id)
+        return true
+    }, g)
+    if fmt.Sprint(ids) != "[1 2 3]" {
+        t.Errorf("expected the migrated index to hold [1 2 3], got %v", ids)
+    }
+}
 
+func TestEncodeValue (t *testing.T) {
+    _, g := newTestGraph(t, "values")
+    v, err := g.AddVertex(g.C("Vertex"))
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // integers of every size read back as int64
+    for _, value := range []Any{int(-1), int8(-8), int16(-16), int32(-32), int64(-64), uint(1), uint8(8), uint16(16), uint32(32), uint64(math.MaxInt64)} {
+        if err := v.Set("n", value, g); err != nil {
+            t.Errorf("could not set %T: %s", value, err.Trace())
+            continue
+        }
+        if got, _ := v.Get("n", g); fmt.Sprint(got) != fmt.Sprint(value) || fmt.Sprintf("%T", got) != "int64" {
+            t.Errorf("%T %v read back as %T %v", value, value, got, got)
+        }
+    }
+    
+    // values that do not fit are refused rather than stored wrapped around
+    tooBig := []Any{
+        uint64(math.MaxInt64) + 1,
+        time.Date(1677, 1, 1, 0, 0, 0, 0, time.UTC),
+        time.Date(2263, 1, 1, 0, 0, 0, 0, time.UTC),
+    }
+    for _, value := range tooBig {
+        if err := v.Set("n", value, g); err == nil {
+            t.Errorf("set %v, which can not be stored", value)
+        }
+    }
+    for _, value := range []time.Time{time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)} {
+        if err := v.Set("at", value, g); err != nil {
+            t.Errorf("could not set %v: %s", value, err.Trace())
+        } else if got, _ := v.Get("at", g); !got.(time.Time).Equal(value) {
+            t.Errorf("%v read back as %v", value, got)
+        }
+    }
+}
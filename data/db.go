@@ -2,12 +2,32 @@ package data
 
 import(
     "os"
-    "fmt"
+    "io/ioutil"
+    "math"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
 )
 
 // error messages
 const (
     nilDB = "attempt to operate on a nil database"
+    settingsReadFail = "could not read the settings of database: "
+    settingsWriteFail = "could not write the settings of database: "
+    settingType = "unsupported type for setting: "
+)
+
+// settings
+const (
+    RecordChecksums = "record_checksums" // bool: new graphs store a checksum with every record
+)
+
+// The types of setting values in the settings file.
+const (
+    boolSetting byte = iota + 1
+    intSetting
+    floatSetting
+    stringSetting
 )
 
 type DB struct {
@@ -16,25 +36,44 @@ type DB struct {
     settings map[string]Any
 }
 
+// Opens an existing database.
+// Settings that can not be read are left unset; OpenDB reports why they could not be read.
 func ConstructDB(path string) *DB {
+    db, err := OpenDB(path)
+    if err != nil {
+        db = newDB(path)
+    }
+    return db
+}
+
+// Opens an existing database, reading its settings.
+// Returns an error of type *DataError if the settings file can not be read.
+func OpenDB(path string) (*DB, *DataError) {
+    db := newDB(path)
+    if err := db.readSettings(); err != nil {
+        return nil, err
+    }
+    
+    return db, nil
+}
+
+// Returns a database with no graphs open and no settings.
+func newDB(path string) *DB {
     db := new(DB)
     db.Path = path
     db.graphs = make(map[string]*Graph)
-    // TODO read settings file
-    
+    db.settings = make(map[string]Any)
     return db
 }
 
 func CreateDB(path string) (*DB, *DataError) {
-    db := new(DB)
-    db.Path = path
-    db.graphs = make(map[string]*Graph)
+    db := newDB(path)
     if e := os.MkdirAll(path, 0777); e != nil {
-        fmt.Println("Failure to create new database")
-        fmt.Println(e.Error())
         return nil, dataError("Failure to create new database: " + path, e, nil)
     }
-    // TODO write settings file
+    if err := db.writeSettings(); err != nil {
+        return nil, err
+    }
     return db, nil
 }
 
@@ -80,6 +119,163 @@ func (db *DB) G (name string) (*Graph, *DataError){
     return db.graphs[name], e
 }
 
+// Set changes a setting of the database and records it in the settings file.
+// Settings that affect the layout of files only apply to graphs created afterwards.
+// Settings are booleans, integers, floats, or strings; returns an error of type
+// *DataError for any other value or if the settings file can not be written.
+func (db *DB) Set(name string, value Any) *DataError {
+    Assert(nilDB, db != nil)
+    
+    switch value.(type) {
+    case bool, int, int64, float64, string:
+    default:
+        return dataError(settingType + name, nil, nil)
+    }
+    old, had := db.settings[name]
+    db.settings[name] = value
+    if err := db.writeSettings(); err != nil {
+        if had {
+            db.settings[name] = old
+        } else {
+            delete(db.settings, name)
+        }
+        return err
+    }
+    return nil
+}
+
+// Setting retrieves a setting of the database, or nil if it has not been set.
+func (db *DB) Setting(name string) Any {
+    Assert(nilDB, db != nil)
+    return db.settings[name]
+}
+
+// Returns the path of the file that holds the settings of the database.
+func (db *DB) settingsPath() string {
+    return db.Path + string(os.PathSeparator) + "settings" + FileExtension
+}
+
+// Reads the settings of the database from its settings file.
+// Databases created before settings were stored have no settings file and no settings.
+// Each setting is stored as the length of its name, its name, the type of its value,
+// and its value.
+func (db *DB) readSettings() *DataError {
+    fileName := db.settingsPath()
+    file, e := os.Open(fileName)
+    if os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return dataError(settingsReadFail + db.Path, e, nil)
+    }
+    defer file.Close()
+    if _, err := checkFileHeader(file, settingsFile); err != nil {
+        return dataError(settingsReadFail + db.Path, nil, err)
+    }
+    bytes, e := ioutil.ReadAll(file)
+    if e != nil {
+        return dataError(settingsReadFail + db.Path, e, nil)
+    }
+    bytes = bytes[fileHeaderSize:]
+    
+    corrupt := dataError(settingsReadFail + db.Path + " (truncated setting)", nil, nil)
+    for len(bytes) > 0 {
+        if len(bytes) < 3 {
+            return corrupt
+        }
+        size := int(util.Uint16(bytes))
+        if len(bytes) < 3 + size {
+            return corrupt
+        }
+        name := string(bytes[2 : 2 + size])
+        t := bytes[2 + size]
+        bytes = bytes[3 + size:]
+        
+        switch t {
+        case boolSetting:
+            if len(bytes) < 1 {
+                return corrupt
+            }
+            db.settings[name] = bytes[0] != 0
+            bytes = bytes[1:]
+        case intSetting, floatSetting:
+            if len(bytes) < 8 {
+                return corrupt
+            }
+            n := util.Uint64(bytes)
+            if t == intSetting {
+                db.settings[name] = int(int64(n))
+            } else {
+                db.settings[name] = math.Float64frombits(n)
+            }
+            bytes = bytes[8:]
+        case stringSetting:
+            if len(bytes) < 4 || len(bytes) < 4 + int(util.Uint32(bytes)) {
+                return corrupt
+            }
+            size = int(util.Uint32(bytes))
+            db.settings[name] = string(bytes[4 : 4 + size])
+            bytes = bytes[4 + size:]
+        default:
+            return dataError(settingsReadFail + db.Path + " (unknown type of setting " + name + ")", nil, nil)
+        }
+    }
+    return nil
+}
+
+// Writes the settings of the database to its settings file.
+// The file is written beside the old one and renamed over it, so a failed write
+// leaves the old settings in place.
+func (db *DB) writeSettings() *DataError {
+    names := make([]string, 0, len(db.settings))
+    for name := range db.settings {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    
+    h := fileHeader{FormatVersion, settingsFile, 0}
+    bytes := h.data()
+    for _, name := range names {
+        b := make([]byte, 2, 2 + len(name) + 1 + 8)
+        util.PutUint16(b, uint16(len(name)))
+        b = append(b, name...)
+        
+        n := make([]byte, 8)
+        switch value := db.settings[name].(type) {
+        case bool:
+            b = append(b, boolSetting, 0)
+            if value {
+                b[len(b) - 1] = 1
+            }
+        case int:
+            util.PutUint64(n, uint64(int64(value)))
+            b = append(append(b, intSetting), n...)
+        case int64:
+            util.PutUint64(n, uint64(value))
+            b = append(append(b, intSetting), n...)
+        case float64:
+            util.PutUint64(n, math.Float64bits(value))
+            b = append(append(b, floatSetting), n...)
+        case string:
+            util.PutUint32(n, uint32(len(value)))
+            b = append(append(append(b, stringSetting), n[:4]...), value...)
+        }
+        bytes = append(bytes, b...)
+    }
+    
+    fileName := db.settingsPath()
+    tmpName := fileName + ".tmp"
+    if e := ioutil.WriteFile(tmpName, bytes, util.FilePermission); e != nil {
+        return dataError(settingsWriteFail + db.Path, e, nil)
+    }
+    if e := os.Rename(tmpName, fileName); e != nil {
+        return dataError(settingsWriteFail + db.Path, e, nil)
+    }
+    return nil
+}
+
+// Shuts down every open graph of the database and closes its files.
+// Changes to a graph that have not been written with Graph.Write are discarded, so the
+// graph is as it was last written when the database is next opened.
 func (db *DB) Shutdown() {
     for _, graph := range db.graphs {
         graph.shutdown()
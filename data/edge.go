@@ -20,42 +20,36 @@ type Edge struct {
 	attributable
 }
 
-func constructEdge(id uint32, bytes []byte) (*Edge, *DataError){
-    var e error
+// Creates an existing edge from byte data.
+// The edge does not keep a reference to the slice, so the caller may reuse it.
+func constructEdge(id uint32, bytes []byte) *Edge {
 	edge := new(Edge)
-	label := bytes[0:2]
-	from := bytes[2:6]
-	to := bytes[6:10]
-	outNext := bytes[10:14]
-	inNext := bytes[14:18]
-	attributes := bytes[18:22]
-	
 	edge.Id = id
-	edge.label, e = util.BytesToUint16(label)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert label.", e, nil)
-	}
-	edge.from, e = util.BytesToUint32(from)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert from.", e, nil)
-	}
-	edge.to, e = util.BytesToUint32(to)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert to.", e, nil)
-	}
-	edge.outNext, e = util.BytesToUint32(outNext)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert outNext.", e, nil)
-	}
-	edge.inNext, e = util.BytesToUint32(inNext)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert inNext.", e, nil)
-	}
-	edge.firstAtt, e = util.BytesToUint32(attributes)
-	if (e != nil){
-	    return nil, dataError("Failed to construct edge. Could not convert attributes.", e, nil)
-	}
-    return edge, nil
+	edge.owner = edge
+	edge.decode(bytes)
+	return edge
+}
+
+// Reads the stored fields of the edge from b.
+func (e *Edge) decode(b []byte) {
+	_ = b[edgeDataSize - 1] // bounds check once for the whole record
+	e.label = util.Uint16(b[0:2])
+	e.from = util.Uint32(b[2:6])
+	e.to = util.Uint32(b[6:10])
+	e.outNext = util.Uint32(b[10:14])
+	e.inNext = util.Uint32(b[14:18])
+	e.firstAtt = util.Uint32(b[18:22])
+}
+
+// Encodes the edge for storage into b, which must be at least edgeDataSize bytes long.
+func (e *Edge) encode(b []byte) {
+	_ = b[edgeDataSize - 1]
+	util.PutUint16(b[0:2], e.label)
+	util.PutUint32(b[2:6], e.from)
+	util.PutUint32(b[6:10], e.to)
+	util.PutUint32(b[10:14], e.outNext)
+	util.PutUint32(b[14:18], e.inNext)
+	util.PutUint32(b[18:22], e.firstAtt)
 }
 
 func (e *Edge) Label(g *Graph) *Label {
@@ -73,7 +67,19 @@ func (e *Edge) Key(g *Graph) string {
     return l.Value(g)
 }
 
-func (e *Edge) From (g *Graph) *Vertex {
+// Returns the id of the vertex the edge goes from, without reading the vertex.
+func (e *Edge) FromId() uint32 {
+    Assert(nilEdge, e != nil)
+    return e.from
+}
+
+// Returns the id of the vertex the edge goes to, without reading the vertex.
+func (e *Edge) ToId() uint32 {
+    Assert(nilEdge, e != nil)
+    return e.to
+}
+
+func (e *Edge) From (g *Graph) (*Vertex, *DataError) {
     Assert(nilGraph, g != nil)
     Assert(nilEdge, e != nil)
     Assert(nilVertexStore, g.vertexStore != nil)
@@ -81,7 +87,7 @@ func (e *Edge) From (g *Graph) *Vertex {
     return g.vertexStore.Find(e.from)
 }
 
-func (e *Edge) To(g *Graph) *Vertex {
+func (e *Edge) To(g *Graph) (*Vertex, *DataError) {
     Assert(nilGraph, g != nil)
     Assert(nilEdge, e != nil)
     Assert(nilVertexStore, g.vertexStore != nil)
@@ -89,19 +95,25 @@ func (e *Edge) To(g *Graph) *Vertex {
     return g.vertexStore.Find(e.to)
 }
 
-func (e *Edge) OutNext(g *Graph) *Edge {
+func (e *Edge) OutNext(g *Graph) (*Edge, *DataError) {
     Assert(nilGraph, g != nil)
     Assert(nilEdge, e != nil)
     Assert(nilEdgeStore, g.edgeStore != nil)
     
+    if e.outNext == uint32(0) {
+        return nil, nil
+    }
     return g.edgeStore.Find(e.outNext)
 }
 
-func (e *Edge) InNext(g *Graph) *Edge {
+func (e *Edge) InNext(g *Graph) (*Edge, *DataError) {
     Assert(nilGraph, g != nil)
     Assert(nilEdge, e != nil)
     Assert(nilEdgeStore, g.edgeStore != nil)
     
+    if e.inNext == uint32(0) {
+        return nil, nil
+    }
     return g.edgeStore.Find(e.inNext)
 }
 
@@ -109,5 +121,10 @@ func (e *Edge) track(g *Graph) {
     g.edgeStore.Track(e)
 }
 
+// Edge attributes are not indexed, so there is nothing to do when they change.
+func (e *Edge) attributeChanging(key string, old *Attribute, new *Attribute, g *Graph) *DataError {
+    return nil
+}
+
 
 
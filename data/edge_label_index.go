@@ -0,0 +1,194 @@
+package data
+
+import (
+    "os"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    nilEdgeLabelIndex = "attempt to operate on a nil edge label index"
+    nilEdgeLabelIndexFile = "attempt to operate on a nil edge label index file"
+)
+
+// The edge label index keeps track of the edges with each label, so edges can be found
+// by label without walking the edges of every vertex.
+// The file is an entry log (see entryLog) of the label and id of each edge.
+type edgeLabelIndex struct {
+    file *os.File
+    log *entryLog
+    labels map[uint16][]uint32 // label id -> edge ids, in order
+}
+
+// Creates an existing edge label index.
+func constructEdgeLabelIndex(fileName string) (*edgeLabelIndex, *DataError) {
+
+    i := new(edgeLabelIndex)
+
+    // load the file
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for edge label index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if _, de := checkFileHeader(i.file, edgeLabelIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readLabels(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates an edge label index that does not yet exist.
+func createEdgeLabelIndex(fileName string) (*edgeLabelIndex, *DataError) {
+
+    i := new(edgeLabelIndex)
+
+    // create the file
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for edge label index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if de := writeFileHeader(i.file, edgeLabelIndexFile, 0); de != nil {
+        return nil, de
+    }
+
+    i.log = &entryLog{file: file}
+    i.labels = make(map[uint16][]uint32)
+
+    return i, nil
+}
+
+// Encodes an entry as the label id followed by the edge id.
+func encodeEdgeLabelEntry(label uint16, id uint32) []byte {
+    b := make([]byte, 6)
+    util.PutUint16(b, label)
+    util.PutUint32(b[2:], id)
+    return b
+}
+
+// Reads the edge ids of each label from the file.
+// Returns an error of type *DataError if the file can not be read.
+func (i *edgeLabelIndex) readLabels() *DataError {
+    Assert(nilEdgeLabelIndex, i != nil)
+    Assert(nilEdgeLabelIndexFile, i.file != nil)
+
+    i.labels = make(map[uint16][]uint32)
+    log, err := readEntryLog(i.file, func(added bool, entry []byte) bool {
+        if len(entry) != 6 {
+            return false
+        }
+        label, id := util.Uint16(entry), util.Uint32(entry[2:])
+        if added {
+            i.insert(label, id)
+        } else {
+            i.erase(label, id)
+        }
+        return true
+    })
+    i.log = log
+    return err
+}
+
+// Writes the changes to the index to the file.
+// Returns an error of type *DataError if they can not be written.
+func (i *edgeLabelIndex) write() *DataError {
+    Assert(nilEdgeLabelIndex, i != nil)
+    Assert(nilEdgeLabelIndexFile, i.file != nil)
+
+    return i.log.write(func(fn func(entry []byte)) {
+        labels := make([]int, 0, len(i.labels))
+        for label := range i.labels {
+            labels = append(labels, int(label))
+        }
+        sort.Ints(labels)
+        for _, label := range labels {
+            for _, id := range i.labels[uint16(label)] {
+                fn(encodeEdgeLabelEntry(uint16(label), id))
+            }
+        }
+    })
+}
+
+// Records that an edge has a label.
+func (i *edgeLabelIndex) add(label uint16, id uint32) {
+    Assert(nilEdgeLabelIndex, i != nil)
+
+    if i.insert(label, id) {
+        i.log.add(encodeEdgeLabelEntry(label, id))
+    }
+}
+
+// Records that an edge no longer exists.
+func (i *edgeLabelIndex) remove(label uint16, id uint32) {
+    Assert(nilEdgeLabelIndex, i != nil)
+
+    if i.erase(label, id) {
+        i.log.remove(encodeEdgeLabelEntry(label, id))
+    }
+}
+
+// Returns the position of an edge id among the ids of a label, or of where it would be
+// inserted.
+func (i *edgeLabelIndex) search(label uint16, id uint32) int {
+    ids := i.labels[label]
+    return sort.Search(len(ids), func(n int) bool { return ids[n] >= id })
+}
+
+// Puts an edge id in its place, returning false if it was already there.
+func (i *edgeLabelIndex) insert(label uint16, id uint32) bool {
+    ids, pos := i.labels[label], i.search(label, id)
+    if pos < len(ids) && ids[pos] == id {
+        return false
+    }
+    ids = append(ids, 0)
+    copy(ids[pos + 1:], ids[pos:])
+    ids[pos] = id
+    i.labels[label] = ids
+    return true
+}
+
+// Takes an edge id out, returning false if it was not there.
+func (i *edgeLabelIndex) erase(label uint16, id uint32) bool {
+    ids, pos := i.labels[label], i.search(label, id)
+    if pos == len(ids) || ids[pos] != id {
+        return false
+    }
+    if len(ids) == 1 {
+        delete(i.labels, label)
+    } else {
+        i.labels[label] = append(ids[:pos], ids[pos + 1:]...)
+    }
+    return true
+}
+
+// Returns the lowest id of an edge with a label that is at least from, or 0 if there
+// is none.
+func (i *edgeLabelIndex) nextId(label uint16, from uint32) uint32 {
+    Assert(nilEdgeLabelIndex, i != nil)
+
+    ids, pos := i.labels[label], i.search(label, from)
+    if pos < len(ids) {
+        return ids[pos]
+    }
+    return 0
+}
+
+// Returns the number of edges with a label.
+func (i *edgeLabelIndex) size(label uint16) int {
+    Assert(nilEdgeLabelIndex, i != nil)
+    return len(i.labels[label])
+}
+
+// Cleans up the file for the index.
+func (i *edgeLabelIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
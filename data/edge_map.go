@@ -40,6 +40,15 @@ func (m edgeMap) remove (e *Edge, g *Graph) {
     }
 }
 
+// Returns the number of edges in the map.
+func (m edgeMap) size () int {
+    size := 0
+    for _, l := range m {
+        size += len(l)
+    }
+    return size
+}
+
 func (m edgeMap) has (key string) bool {
     _, ok := m[key]
     return ok
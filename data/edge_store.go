@@ -2,6 +2,7 @@ package data
 
 import (
     "os"
+    "weak"
     "github.com/wardlem/graphlite/util"
 )
 
@@ -15,8 +16,14 @@ const (
 
 type edgeStore struct {
     file *os.File
+    records *recordFile
     idStore *uint32IdStore
+    labels *edgeLabelIndex
     tracking map[uint32]*Edge
+    loaded map[uint32]weak.Pointer[Edge] // the edges handed out, so each id has one copy
+    swept int // the size of loaded when it was last swept
+    finds uint64 // the number of calls to Find, which query profiles count as reads
+    mods uint64  // the number of edges added and removed, which iterators over chains of edges check
 }
 
 func constructEdgeStore(g *Graph) (*edgeStore, *DataError){
@@ -30,6 +37,11 @@ func constructEdgeStore(g *Graph) (*edgeStore, *DataError){
     } else {
         s.file = file;
     }
+    if h, de := checkFileHeader(s.file, edgeFile); de != nil {
+        return nil, de
+    } else {
+        s.records = newRecordFile(s.file, "edge", fileHeaderSize, edgeDataSize, h.flags)
+    }
 
     fileName = g.storePath("edge.id")
     
@@ -39,12 +51,17 @@ func constructEdgeStore(g *Graph) (*edgeStore, *DataError){
     }
     s.idStore = idStore
     
+    if s.labels, de = constructEdgeLabelIndex(g.storePath("edge.label")); de != nil {
+        return nil, de
+    }
+    
     s.tracking = make(map[uint32]*Edge, 0)
+    s.loaded = make(map[uint32]weak.Pointer[Edge])
     
     return s, nil;
 }
 
-func creatEdgeStore(g *Graph) (*edgeStore, *DataError){
+func createEdgeStore(g *Graph) (*edgeStore, *DataError){
     Assert(nilGraph, g != nil)
     s := new(edgeStore)
     fileName := g.storePath("edge")
@@ -53,6 +70,11 @@ func creatEdgeStore(g *Graph) (*edgeStore, *DataError){
     } else {
         s.file = file;
     }
+    flags := g.recordFlags()
+    if de := writeFileHeader(s.file, edgeFile, flags); de != nil {
+        return nil, de
+    }
+    s.records = newRecordFile(s.file, "edge", fileHeaderSize, edgeDataSize, flags)
 
     
     fileName = g.storePath("edge.id")
@@ -62,31 +84,94 @@ func creatEdgeStore(g *Graph) (*edgeStore, *DataError){
         s.idStore = idStore
     }
     
+    if labels, de := createEdgeLabelIndex(g.storePath("edge.label")); de != nil {
+        return nil, de
+    } else {
+        s.labels = labels
+    }
+    
     s.tracking = make(map[uint32]*Edge, 0)
+    s.loaded = make(map[uint32]weak.Pointer[Edge])
     
     return s, nil;
 }
 
 // Finds a edge by id and returns it.
-func (s *edgeStore) Find(id uint32) *Edge {
+// An edge that is still held somewhere is returned as it is held, and others are read
+// from the file.
+// Returns nil if there is no such edge, or an error of type *DataError if the
+// edge could not be read or is corrupted.
+func (s *edgeStore) Find(id uint32) (*Edge, *DataError) {
     Assert(nilEdgeStore, s != nil)
     Assert(zeroEdgeId, id != uint32(0))
     Assert(nilEdgeTrackingMap, s.tracking != nil)
 
+    s.finds++
     if e, ok := s.tracking[id]; ok {
-        return e
+        if e.label == uint16(0) {
+            return nil, nil // removed since the store was last written
+        }
+        return e, nil
+    }
+    if e := s.loaded[id].Value(); e != nil {
+        if e.label == uint16(0) {
+            return nil, nil
+        }
+        return e, nil
     }
     
     // read the edge from the file and return it
-    readAt := int64((id - 1) * edgeDataSize)
-    bytes := make([]byte, edgeDataSize)
-    _, err := s.file.ReadAt(bytes, readAt)
-    if (err != nil) {
-        return nil
+    bytes, err := s.records.read(uint64(id))
+    if err != nil || bytes == nil {
+        return nil, err
     }
     
-    e, _ := constructEdge(id, bytes) 
-    return e
+    e := constructEdge(id, bytes)
+    if e.label == uint16(0) {
+        return nil, nil // the edge has been removed
+    }
+    s.remember(e)
+    return e, nil
+}
+
+// Keeps an edge as the copy of it that Find returns, as vertexStore.remember does.
+func (s *edgeStore) remember(e *Edge) {
+    s.loaded[e.Id] = weak.Make(e)
+    if len(s.loaded) > 2 * s.swept + 64 {
+        for id, p := range s.loaded {
+            if p.Value() == nil {
+                delete(s.loaded, id)
+            }
+        }
+        s.swept = len(s.loaded)
+    }
+}
+
+// Puts an edge back to the state it has in the file, as vertexStore.reload does.
+// Returns an error of type *DataError if the edge could not be read or is corrupted.
+func (s *edgeStore) reload(e *Edge) *DataError {
+    Assert(nilEdgeStore, s != nil)
+    Assert(nilEdge, e != nil)
+
+    bytes, err := s.records.read(uint64(e.Id))
+    if err != nil {
+        return err
+    }
+    if bytes == nil {
+        e.label = uint16(0)
+    } else {
+        e.decode(bytes)
+    }
+    e.aMap = nil
+    s.remember(e)
+    return nil
+}
+
+// Returns the id to use for a new edge.
+func (s *edgeStore) nextId() uint32 {
+    Assert(nilEdgeStore, s != nil)
+    Assert(nilEdgeIdStore, s.idStore != nil)
+    return s.idStore.nextId()
 }
 
 // Let's the store know that the edge has changes that need to be written.
@@ -97,7 +182,23 @@ func (s *edgeStore) Track(e *Edge) {
     Assert(nilEdgeTrackingMap, s.tracking != nil)
     
     s.tracking[e.Id] = e
+    s.remember(e)
+}
+
+// Adds a new edge to the store.
+func (s *edgeStore) Add(e *Edge) {
+    Assert(nilEdgeStore, s != nil)
+    Assert(nilEdge, e != nil)
     
+    s.Track(e)
+    s.labels.add(e.label, e.Id)
+    s.mods++
+}
+
+// Returns a sequence of the ids of the edges with a label, in order.
+func (s *edgeStore) withLabel(label uint16) idSequence {
+    Assert(nilEdgeStore, s != nil)
+    return idSequence{labels: s.labels, label: label}
 }
 
 // Removes an edge from the store.
@@ -110,17 +211,41 @@ func (s *edgeStore) Remove(e *Edge) {
     
     id := e.Id
     s.idStore.addId(id)
+    s.labels.remove(e.label, id)
     e.label = uint16(0)
+    s.mods++
     
     s.tracking[e.Id] = e
     
 }
 
+// Writes tracked edges to the file.
+func (s *edgeStore) write() *DataError {
+    Assert(nilEdgeStore, s != nil)
+    Assert(nilEdgeTrackingMap, s.tracking != nil)
+    
+    for id, e := range s.tracking {
+        if err := s.records.write(uint64(id), e); err != nil {
+            return err
+        }
+    }
+    
+    if err := s.idStore.write(); err != nil {
+        return err
+    }
+    if err := s.labels.write(); err != nil {
+        return err
+    }
+    s.tracking = make(map[uint32]*Edge, 0)
+    return nil
+}
+
 func (store *edgeStore) shutdown () {
     if (store != nil){
         if (store.idStore != nil){
             store.idStore.shutdown()
         }
+        store.labels.shutdown()
         if (store.file != nil){
             _ = store.file.Close()
         }
@@ -0,0 +1,176 @@
+package data
+
+import(
+	"testing"
+	"bytes"
+	"encoding/binary"
+)
+
+// Decodes a uint32 the way records were decoded before they were read straight
+// from their buffers, to compare against.
+func reflectUint32(b []byte) uint32 {
+    var n uint32
+    binary.Read(bytes.NewReader(b), binary.LittleEndian, &n)
+    return n
+}
+
+func reflectUint16(b []byte) uint16 {
+    var n uint16
+    binary.Read(bytes.NewReader(b), binary.LittleEndian, &n)
+    return n
+}
+
+func TestRecordEncoding (t *testing.T) {
+    v := &Vertex{class: 3, out: 70000, in: 12}
+    v.firstAtt = 5
+    b := make([]byte, vertexDataSize)
+    v.encode(b)
+    if d := constructVertex(1, b); d.class != v.class || d.out != v.out || d.in != v.in || d.firstAtt != v.firstAtt {
+        t.Errorf("vertex did not survive encoding: %+v != %+v", d, v)
+    }
+
+    e := &Edge{label: 9, from: 1, to: 2, outNext: 3, inNext: 4}
+    e.firstAtt = 5
+    b = make([]byte, edgeDataSize)
+    e.encode(b)
+    if d := constructEdge(1, b); d.label != e.label || d.from != e.from || d.to != e.to ||
+        d.outNext != e.outNext || d.inNext != e.inNext || d.firstAtt != e.firstAtt {
+        t.Errorf("edge did not survive encoding: %+v != %+v", d, e)
+    }
+
+    a := &Attribute{label: 2, t: integer_t, data: [8]byte{1, 2, 3}, next: 8}
+    b = make([]byte, attributeDataSize)
+    a.encode(b)
+    if d := constructAttribute(1, b); *d != (Attribute{1, a.label, a.t, a.data, a.next}) {
+        t.Errorf("attribute did not survive encoding: %+v != %+v", d, a)
+    }
+
+    l := &Label{value: 1 << 40, refs: 7, l: 2, r: 3, h: 1}
+    if d := constructLabel(1, l.data()); *d != (Label{1, l.value, l.refs, l.l, l.r, l.h}) {
+        t.Errorf("label did not survive encoding: %+v != %+v", d, l)
+    }
+
+    c := &Class{Count: 100, label: 4, super: 1, sub: 2, nextSub: 3}
+    if d, _ := constructClass(1, c.Data()); d.Count != c.Count || d.label != c.label ||
+        d.super != c.super || d.sub != c.sub || d.nextSub != c.nextSub {
+        t.Errorf("class did not survive encoding: %+v != %+v", d, c)
+    }
+}
+
+func BenchmarkVertexDecode (b *testing.B) {
+    data := make([]byte, vertexDataSize)
+    (&Vertex{class: 1, out: 2, in: 3}).encode(data)
+    v := new(Vertex)
+    b.ReportAllocs()
+    for n := 0; n < b.N; n++ {
+        v.decode(data)
+    }
+}
+
+func BenchmarkVertexDecodeReflection (b *testing.B) {
+    data := make([]byte, vertexDataSize)
+    (&Vertex{class: 1, out: 2, in: 3}).encode(data)
+    v := new(Vertex)
+    b.ReportAllocs()
+    for n := 0; n < b.N; n++ {
+        v.class = data[0]
+        v.out = reflectUint32(data[1:5])
+        v.in = reflectUint32(data[5:9])
+        v.firstAtt = reflectUint32(data[9:13])
+    }
+}
+
+func BenchmarkEdgeDecode (b *testing.B) {
+    data := make([]byte, edgeDataSize)
+    (&Edge{label: 1, from: 2, to: 3}).encode(data)
+    e := new(Edge)
+    b.ReportAllocs()
+    for n := 0; n < b.N; n++ {
+        e.decode(data)
+    }
+}
+
+func BenchmarkEdgeDecodeReflection (b *testing.B) {
+    data := make([]byte, edgeDataSize)
+    (&Edge{label: 1, from: 2, to: 3}).encode(data)
+    e := new(Edge)
+    b.ReportAllocs()
+    for n := 0; n < b.N; n++ {
+        e.label = reflectUint16(data[0:2])
+        e.from = reflectUint32(data[2:6])
+        e.to = reflectUint32(data[6:10])
+        e.outNext = reflectUint32(data[10:14])
+        e.inNext = reflectUint32(data[14:18])
+        e.firstAtt = reflectUint32(data[18:22])
+    }
+}
+
+func BenchmarkVertexEncode (b *testing.B) {
+    data := make([]byte, vertexDataSize)
+    v := &Vertex{class: 1, out: 2, in: 3}
+    b.ReportAllocs()
+    for n := 0; n < b.N; n++ {
+        v.encode(data)
+    }
+}
+
+// Creates a graph with count vertices, writes it, and opens it again, so the vertex
+// store reads every vertex from disk.
+func createScanGraph (b *testing.B, count uint32) *Graph {
+    db, g := newTestGraph(b, "scan")
+    for id := uint32(1); id <= count; id++ {
+        g.vertexStore.Track(&Vertex{Id: id, class: 1, out: id, in: id})
+    }
+    if err := g.Write(); err != nil {
+        b.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err := constructGraph(db, "scan")
+    if err != nil {
+        b.Fatal(err.Trace())
+    }
+    b.Cleanup(g.shutdown)
+    return g
+}
+
+// Reads every vertex of a store from disk, as a full graph scan does.
+// Compare with BenchmarkVertexScanReflection, which reads the same file the way records
+// were read before they were decoded straight from the record file's buffer.
+func BenchmarkVertexScan (b *testing.B) {
+    const count = 10000
+    s := createScanGraph(b, count).vertexStore
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        for id := uint32(1); id <= count; id++ {
+            if v, _ := s.Find(id); v == nil {
+                b.Fatal("missing vertex")
+            }
+        }
+    }
+}
+
+func BenchmarkVertexScanReflection (b *testing.B) {
+    const count = 10000
+    s := createScanGraph(b, count).vertexStore
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        for id := uint32(1); id <= count; id++ {
+            data := make([]byte, vertexDataSize)
+            if _, e := s.file.ReadAt(data, s.records.position(uint64(id))); e != nil {
+                b.Fatal(e)
+            }
+            v := &Vertex{Id: id}
+            v.class = data[0]
+            v.out = reflectUint32(data[1:5])
+            v.in = reflectUint32(data[5:9])
+            v.firstAtt = reflectUint32(data[9:13])
+            if v.class == 0 {
+                b.Fatal("missing vertex")
+            }
+        }
+    }
+}
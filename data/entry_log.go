@@ -0,0 +1,143 @@
+package data
+
+import (
+    "os"
+    "io"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    entryLogReadFail = "could not read the entries of index: "
+    entryLogWriteFail = "could not write the entries of index: "
+    entryLogCorrupted = "index entry could not be decoded"
+    nilEntryLogFile = "attempt to read an entry log without a file"
+)
+
+// The changes recorded in an entry log.
+const (
+    entryAdded byte = iota + 1
+    entryRemoved
+)
+
+const (
+    entryHeaderSize = 5     // change (1) + length of the entry (4)
+    entryLogSlack = 4096    // the bytes of removed entries a log may hold before it is compacted
+)
+
+// An entry log keeps the entries of an index in its file as a log of the entries that
+// were added and removed, so writing the index only writes what changed.
+// Reading the index replays the log. Once removed entries take up more of the log than
+// the entries the index still has, the log is compacted by writing those entries over it.
+// A log without a file belongs to an index that is kept in memory only.
+// Since the log has to be replayed to find any entry, an index that uses one holds all
+// of its entries in memory once it is opened, and opening it reads the whole log. Such
+// an index can only be as large as the memory available.
+type entryLog struct {
+    file *os.File
+    changes []byte  // the changes that have not been written yet
+    live int64      // the bytes of the log taken up by the entries the index still has
+}
+
+// Reads the log in a file, calling fn with each change in order.
+// fn returns false if it can not decode the entry.
+// Returns an error of type *DataError if the file can not be read or the log is corrupted.
+func readEntryLog(file *os.File, fn func(added bool, entry []byte) bool) (*entryLog, *DataError) {
+    Assert(nilEntryLogFile, file != nil)
+
+    l := &entryLog{file: file}
+    fileSize, e := fileSize(file)
+    if e != nil {
+        return nil, dataError(entryLogReadFail + file.Name(), e, nil)
+    }
+    size := int(fileSize - fileHeaderSize)
+    if size <= 0 {
+        return l, nil
+    }
+    bytes := make([]byte, size)
+    if _, e := file.ReadAt(bytes, int64(fileHeaderSize)); e != nil && e != io.EOF {
+        return nil, dataError(entryLogReadFail + file.Name(), e, nil)
+    }
+
+    // entries are numbered from 1 in corruption errors, like records
+    for pos, n := 0, uint64(1); pos < size; n++ {
+        if size - pos < entryHeaderSize {
+            return nil, dataError(entryLogCorrupted, &CorruptionError{file.Name(), n}, nil)
+        }
+        change, length := bytes[pos], int(util.Uint32(bytes[pos + 1:]))
+        pos += entryHeaderSize
+        if (change != entryAdded && change != entryRemoved) || length > size - pos {
+            return nil, dataError(entryLogCorrupted, &CorruptionError{file.Name(), n}, nil)
+        }
+        if !fn(change == entryAdded, bytes[pos : pos + length]) {
+            return nil, dataError(entryLogCorrupted, &CorruptionError{file.Name(), n}, nil)
+        }
+        pos += length
+        l.count(change == entryAdded, length)
+    }
+    return l, nil
+}
+
+// Keeps track of the bytes of the log the entries of the index take up.
+func (l *entryLog) count(added bool, length int) {
+    if added {
+        l.live += int64(entryHeaderSize + length)
+    } else {
+        l.live -= int64(entryHeaderSize + length)
+    }
+}
+
+// Records that an entry was added to the index.
+func (l *entryLog) add(entry []byte) {
+    l.change(entryAdded, entry)
+}
+
+// Records that an entry was removed from the index.
+// The entry must be encoded exactly as it was when it was added.
+func (l *entryLog) remove(entry []byte) {
+    l.change(entryRemoved, entry)
+}
+
+func (l *entryLog) change(change byte, entry []byte) {
+    if l.file == nil {
+        return
+    }
+    head := make([]byte, entryHeaderSize)
+    head[0] = change
+    util.PutUint32(head[1:], uint32(len(entry)))
+    l.changes = append(l.changes, head...)
+    l.changes = append(l.changes, entry...)
+    l.count(change == entryAdded, len(entry))
+}
+
+// Writes the changes to the log.
+// When the log needs compacting, each is called to list the entries of the index, in
+// the order they are to be written.
+// Returns an error of type *DataError if the log can not be written.
+func (l *entryLog) write(each func(fn func(entry []byte))) *DataError {
+    if l.file == nil || len(l.changes) == 0 {
+        return nil
+    }
+
+    end, e := fileSize(l.file)
+    if e != nil {
+        return dataError(entryLogWriteFail + l.file.Name(), e, nil)
+    }
+    if end - fileHeaderSize + int64(len(l.changes)) > 2 * l.live + entryLogSlack {
+        l.changes = l.changes[:0]
+        l.live = 0
+        each(func(entry []byte) {
+            l.change(entryAdded, entry)
+        })
+        if e := l.file.Truncate(int64(fileHeaderSize)); e != nil {
+            return dataError(entryLogWriteFail + l.file.Name(), e, nil)
+        }
+        end = int64(fileHeaderSize)
+    }
+    if _, e := l.file.WriteAt(l.changes, end); e != nil {
+        return dataError(entryLogWriteFail + l.file.Name(), e, nil)
+    }
+    l.changes = l.changes[:0]
+    return nil
+}
@@ -0,0 +1,146 @@
+package data
+
+import (
+    "os"
+    "io"
+    "strconv"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilHeaderFile = "attempt to operate on a nil file when handling a file header"
+    headerReadFail = "could not read file header: "
+    headerWriteFail = "could not write file header: "
+    foreignFile = "file is not a graphlite data file: "
+    wrongFileKind = "file belongs to a different kind of store: "
+    unsupportedVersion = "unsupported data format version "
+)
+
+const (
+    fileMagic = "GLDF"  // identifies a file as a graphlite data file
+    fileHeaderSize = 8  // magic (4) + version (2) + kind (1) + flags (1)
+)
+
+// FormatVersion is the version of the on disk format written by this package.
+// Graphs with an older version are migrated when they are opened.
+const FormatVersion = uint16(7)
+
+// The kinds of files that make up a graph.
+// The kind is stored in the header so a file can not be mistaken for another store's file.
+const (
+    metaFile byte = iota + 1
+    textFile
+    textIdFile
+    labelFile
+    uint16IdFile
+    uint32IdFile
+    classFile
+    classIdIndexFile
+    vertexFile
+    edgeFile
+    attributeFile
+    mapFile
+    listFile
+    labelIndexFile
+    indexStoreFile
+    attributeIndexFile
+    rangeIndexFile
+    textIndexFile
+    compositeIndexFile
+    edgeLabelIndexFile
+    schemaFile
+    statsFile
+    settingsFile
+)
+
+// The header found at the beginning of every graphlite data file.
+type fileHeader struct {
+    version uint16 // the format version the file was written with
+    kind byte      // the kind of file
+    flags byte     // reserved for options that change the record layout
+}
+
+// Returns the byte representation of the header for storage.
+func (h *fileHeader) data() []byte {
+    bytes := make([]byte, 0, fileHeaderSize)
+    version, _ := util.Uint16ToBytes(h.version)
+
+    bytes = append(bytes, fileMagic...)
+    bytes = append(bytes, version...)
+    bytes = append(bytes, h.kind, h.flags)
+    return bytes
+}
+
+// Writes the header at the beginning of a file.
+// Returns an error of type *DataError if the header can not be written.
+func (h *fileHeader) write(file *os.File) *DataError {
+    Assert(nilHeaderFile, file != nil)
+
+    if _, e := file.WriteAt(h.data(), int64(0)); e != nil {
+        return dataError(headerWriteFail + file.Name(), e, nil)
+    }
+    return nil
+}
+
+// Writes a header for the current format version at the beginning of a file.
+// Returns an error of type *DataError if the header can not be written.
+func writeFileHeader(file *os.File, kind byte, flags byte) *DataError {
+    h := fileHeader{FormatVersion, kind, flags}
+    return h.write(file)
+}
+
+// Reads the header from the beginning of a file.
+// Returns an error of type *DataError if the file is too short or does not begin with the magic number.
+func readFileHeader(file *os.File) (*fileHeader, *DataError) {
+    Assert(nilHeaderFile, file != nil)
+
+    bytes := make([]byte, fileHeaderSize)
+    c, e := file.ReadAt(bytes, int64(0))
+    if e != nil && e != io.EOF {
+        return nil, dataError(headerReadFail + file.Name(), e, nil)
+    }
+    if c != fileHeaderSize || string(bytes[0:4]) != fileMagic {
+        return nil, dataError(foreignFile + file.Name(), nil, nil)
+    }
+
+    h := new(fileHeader)
+    h.version, _ = util.BytesToUint16(bytes[4:6])
+    h.kind = bytes[6]
+    h.flags = bytes[7]
+    return h, nil
+}
+
+// Verifies that a file can be read by this version of graphlite as the expected kind of store.
+// The version in a file's header is the version its layout last changed in, so files
+// from older versions that were left alone by migrations are accepted.
+// Returns the header, or an error of type *DataError describing the mismatch.
+func checkFileHeader(file *os.File, kind byte) (*fileHeader, *DataError) {
+    h, err := readFileHeader(file)
+    if err != nil {
+        return nil, err
+    }
+    if h.version == 0 || h.version > FormatVersion {
+        return nil, dataError(versionError(h.version) + ": " + file.Name(), nil, nil)
+    }
+    if h.kind != kind {
+        return nil, dataError(wrongFileKind + file.Name(), nil, nil)
+    }
+    return h, nil
+}
+
+// Builds the message used when a file or graph has a version this package can not read.
+func versionError(version uint16) string {
+    return unsupportedVersion + strconv.Itoa(int(version)) +
+        " (supported up to " + strconv.Itoa(int(FormatVersion)) + ")"
+}
+
+// Returns the size of an open file.
+func fileSize(file *os.File) (int64, error) {
+    info, e := file.Stat()
+    if e != nil {
+        return 0, e
+    }
+    return info.Size(), nil
+}
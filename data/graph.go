@@ -3,6 +3,7 @@ package data
 import (
     "github.com/wardlem/graphlite/util"
     "os"
+    "sort"
     //"fmt"
 )
 
@@ -26,6 +27,9 @@ type Graph struct {
 	textStore *textStore
 	mapStore *mapStore
 	listStore *listStore
+	indexStore *indexStore
+	schemaStore *schemaStore
+	statsStore *statsStore
 }
 
 func constructGraph(db *DB, name string) (g *Graph, err *DataError) {
@@ -34,28 +38,52 @@ func constructGraph(db *DB, name string) (g *Graph, err *DataError) {
 	g = new(Graph)
 	g.db = db
 	g.Name = name
-	if g.textStore, err = constructTextStore(g); err != nil {
+	if err = migrateGraph(g); err == nil {
+        err = g.openStores()
+    }
+	if err != nil {
+        g.shutdown()
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
+	return g, nil
+}
+
+// Opens the stores of the graph from its files.
+func (g *Graph) openStores() (err *DataError) {
+	if g.textStore, err = constructTextStore(g); err != nil {
+        return err
     }
 	if g.labelStore, err = constructLabelStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
     }
     if g.classStore, err = constructClassStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
+    }
+    if g.schemaStore, err = constructSchemaStore(g); err != nil {
+        return err
+    }
+    if g.statsStore, err = constructStatsStore(g); err != nil {
+        return err
     }
     if g.vertexStore, err = constructVertexStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
+    }
+    if g.edgeStore, err = constructEdgeStore(g); err != nil {
+        return err
     }
     if g.attributeStore, err = constructAttributeStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
     }
     if g.mapStore, err = constructMapStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
     }
     if g.listStore, err = constructListStore(g); err != nil {
-        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+        return err
     }
-	return g, nil
+    if g.indexStore, err = constructIndexStore(g); err != nil {
+        return err
+    }
+	return nil
 }
 
 func createGraph(db *DB, name string) (g *Graph, err *DataError) {
@@ -64,9 +92,12 @@ func createGraph(db *DB, name string) (g *Graph, err *DataError) {
     g = new(Graph)
     g.db = db
     g.Name = name
-    if e := os.MkdirAll(g.Path(), 0777); e != nil {
+    if e := os.MkdirAll(g.indexDir(), 0777); e != nil {
         return nil, dataError("Failure to create new graph: " + g.Path(), e, nil)
     }
+    if err = writeGraphVersion(g, FormatVersion); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
     if g.textStore, err = createTextStore(g); err != nil {
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
     }
@@ -77,9 +108,18 @@ func createGraph(db *DB, name string) (g *Graph, err *DataError) {
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
     }
     g.classStore.initialize(g)
+    if g.schemaStore, err = createSchemaStore(g); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
+    if g.statsStore, err = createStatsStore(g); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
     if g.vertexStore, err = createVertexStore(g); err != nil {
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
     }
+    if g.edgeStore, err = createEdgeStore(g); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
     if g.attributeStore, err = createAttributeStore(g); err != nil {
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
     }
@@ -88,6 +128,12 @@ func createGraph(db *DB, name string) (g *Graph, err *DataError) {
     }
     if g.listStore, err = createListStore(g); err != nil {
         return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
+    if g.indexStore, err = createIndexStore(g); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
+    }
+    if err = g.Write(); err != nil {
+        return nil, dataError("Failure to construct graph: " + name + ".", nil, err)
     }
 	return g, nil
 }
@@ -96,6 +142,301 @@ func (g *Graph) C (name string) *Class{
     return g.classStore.FindByName(name, g)
 }
 
+// Adds a class to the graph and returns it.
+// If the graph already has a class with the name, that class is returned instead.
+// Returns nil if the class can not be added because the labels of the graph can not be read.
+func (g *Graph) AddClass (name string, super *Class) *Class {
+    Assert(nilGraph, g != nil)
+    Assert(nilClassStore, g.classStore != nil)
+    
+    if c := g.C(name); c != nil {
+        return c
+    }
+    return g.classStore.Find(g.classStore.AddClass(name, super, g))
+}
+
+// Adds a new vertex of a class to the graph and returns it.
+// The vertex is given the default values declared in the schema of the class.
+// Returns an error caused by a *SchemaError if the schema requires an attribute that
+// has no default; use AddVertexWith to give the vertex its attributes.
+func (g *Graph) AddVertex (class *Class) (*Vertex, *DataError) {
+    return g.AddVertexWith(class, nil)
+}
+
+// Adds a new vertex of a class with a set of attributes to the graph and returns it.
+// Declared attributes that are not given are set to their default values.
+// Returns an error caused by a *SchemaError if the attributes do not fit the schema
+// of the class, in which case no vertex is added.
+func (g *Graph) AddVertexWith (class *Class, values map[string]Any) (*Vertex, *DataError) {
+    Assert(nilGraph, g != nil)
+    Assert(nilClass, class != nil)
+    
+    values, err := class.checkValues(values, g)
+    if err != nil {
+        return nil, err
+    }
+    
+    v, err := g.addVertex(class)
+    if err != nil {
+        return nil, err
+    }
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if err = v.Set(key, values[key], g); err != nil {
+            g.RemoveVertex(v)
+            return nil, err
+        }
+    }
+    return v, nil
+}
+
+// Adds a new vertex of a class without any attributes.
+// Returns an error of type *DataError if the index of the vertices of the class can not
+// be opened.
+func (g *Graph) addVertex (class *Class) (*Vertex, *DataError) {
+    Assert(nilVertexStore, g.vertexStore != nil)
+    
+    index, err := class.idIndex(g)
+    if err != nil {
+        return nil, err
+    }
+    v := newVertex(class)
+    v.Id = g.vertexStore.nextId()
+    
+    // a new vertex has nothing to load
+    v.aMap = make(attributeMap)
+    v.outMap = make(edgeMap)
+    v.inMap = make(edgeMap)
+    
+    g.vertexStore.Track(v)
+    index.addId(v.Id)
+    class.Count++
+    
+    return v, nil
+}
+
+// Adds a new edge with a label from one vertex to another and returns it.
+// Returns an error caused by a *SchemaError if the edge does not fit the declaration
+// of its label.
+func (g *Graph) AddEdge (from *Vertex, to *Vertex, label string) (*Edge, *DataError) {
+    Assert(nilGraph, g != nil)
+    Assert(nilVertex, from != nil, to != nil)
+    Assert(nilEdgeStore, g.edgeStore != nil)
+    
+    // load the edge maps before the edge is linked in, so it is only added to them once
+    outMap, err := from.Out(g)
+    if err != nil {
+        return nil, err
+    }
+    inMap, err := to.In(g)
+    if err != nil {
+        return nil, err
+    }
+    if err = g.schemaStore.checkEdge(from, to, label, outMap, inMap, g); err != nil {
+        return nil, err
+    }
+    
+    e := new(Edge)
+    if e.label, err = g.labelStore.addLabel(label, g); err != nil {
+        return nil, err
+    }
+    e.owner = e
+    e.aMap = make(attributeMap)
+    e.Id = g.edgeStore.nextId()
+    e.from = from.Id
+    e.to = to.Id
+    
+    e.outNext = from.out
+    from.out = e.Id
+    e.inNext = to.in
+    to.in = e.Id
+    outDegree, inDegree := outMap.size(), inMap.size()
+    outMap.add(e, g)
+    inMap.add(e, g)
+    g.statsStore.outDegreeChanged(outDegree, outMap.size())
+    g.statsStore.inDegreeChanged(inDegree, inMap.size())
+    
+    g.edgeStore.Add(e)
+    g.vertexStore.Track(from)
+    g.vertexStore.Track(to)
+    
+    return e, nil
+}
+
+// Returns the vertex with an id, or nil if there is no such vertex.
+func (g *Graph) FindVertex (id uint32) (*Vertex, *DataError) {
+    Assert(nilGraph, g != nil)
+    Assert(nilVertexStore, g.vertexStore != nil)
+    
+    if id == 0 {
+        return nil, nil
+    }
+    return g.vertexStore.Find(id)
+}
+
+// Returns the edge with an id, or nil if there is no such edge.
+func (g *Graph) FindEdge (id uint32) (*Edge, *DataError) {
+    Assert(nilGraph, g != nil)
+    Assert(nilEdgeStore, g.edgeStore != nil)
+    
+    if id == 0 {
+        return nil, nil
+    }
+    return g.edgeStore.Find(id)
+}
+
+// Returns an iterator over the edges of the graph with a label.
+func (g *Graph) EdgesByLabel (label string) *EdgeIterator {
+    Assert(nilGraph, g != nil)
+    Assert(nilEdgeStore, g.edgeStore != nil)
+    
+    l, err := g.labelStore.findByValue(label, g)
+    if err != nil {
+        return &EdgeIterator{g: g, err: err}
+    } else if l == nil {
+        return &EdgeIterator{g: g}
+    }
+    return &EdgeIterator{g: g, ids: g.edgeStore.withLabel(l.Id)}
+}
+
+// Removes a vertex from the graph, along with its edges and attributes.
+func (g *Graph) RemoveVertex (v *Vertex) *DataError {
+    Assert(nilGraph, g != nil)
+    Assert(nilVertex, v != nil)
+    Assert(nilVertexStore, g.vertexStore != nil)
+    
+    // open the index of the class first, so the vertex is not left half removed
+    class := v.Class(g)
+    var index *classIdIndex
+    if class != nil {
+        var err *DataError
+        if index, err = class.idIndex(g); err != nil {
+            return err
+        }
+    }
+    
+    // make sure the edges being removed update this copy of the vertex
+    g.vertexStore.Track(v)
+    
+    // collect the edges first since removing them changes the maps
+    edges := make([]*Edge, 0)
+    for _, m := range []func(*Graph) (edgeMap, *DataError){v.Out, v.In} {
+        edgeMap, err := m(g)
+        if err != nil {
+            return err
+        }
+        for _, list := range edgeMap {
+            for _, e := range list {
+                edges = append(edges, e)
+            }
+        }
+    }
+    for _, e := range edges {
+        if e.label == uint16(0) {
+            continue // a loop that has already been removed
+        }
+        if err := g.RemoveEdge(e); err != nil {
+            return err
+        }
+    }
+    
+    v.deleting = true // so the schema allows required attributes to be removed
+    if err := v.removeAttributes(g); err != nil {
+        return err
+    }
+    
+    if class != nil {
+        index.removeId(v.Id)
+        class.Count--
+    }
+    g.vertexStore.Remove(v, g)
+    
+    return nil
+}
+
+// Removes an edge from the graph, along with its attributes.
+func (g *Graph) RemoveEdge (e *Edge) *DataError {
+    Assert(nilGraph, g != nil)
+    Assert(nilEdge, e != nil)
+    Assert(nilEdgeStore, g.edgeStore != nil)
+    
+    from, err := e.From(g)
+    if err != nil {
+        return err
+    }
+    if from != nil {
+        if err = from.RemoveEdge(e, g); err != nil {
+            return err
+        }
+    }
+    if e.to != e.from {
+        to, err := e.To(g)
+        if err != nil {
+            return err
+        }
+        if to != nil {
+            if err = to.RemoveEdge(e, g); err != nil {
+                return err
+            }
+        }
+    }
+    
+    if err = e.removeAttributes(g); err != nil {
+        return err
+    }
+    if err = g.labelStore.removeLabel(e.Key(g), g); err != nil {
+        return err
+    }
+    g.edgeStore.Remove(e)
+    
+    return nil
+}
+
+// Writes all of the changes made to the graph to its files.
+// Changes that have not been written when the database is shut down are discarded.
+func (g *Graph) Write () *DataError {
+    Assert(nilGraph, g != nil)
+    
+    g.statsStore.fileSizes = nil
+    if err := g.textStore.write(); err != nil {
+        return err
+    }
+    if err := g.labelStore.write(); err != nil {
+        return err
+    }
+    if err := g.classStore.write(); err != nil {
+        return err
+    }
+    if err := g.vertexStore.write(); err != nil {
+        return err
+    }
+    if err := g.edgeStore.write(); err != nil {
+        return err
+    }
+    if err := g.attributeStore.write(); err != nil {
+        return err
+    }
+    if err := g.indexStore.write(); err != nil {
+        return err
+    }
+    if err := g.schemaStore.write(g); err != nil {
+        return err
+    }
+    return g.statsStore.write()
+}
+
+// Returns the header flags for the record stores of a new graph.
+func (g *Graph) recordFlags() byte {
+    if checksums, ok := g.db.Setting(RecordChecksums).(bool); ok && checksums {
+        return checksumFlag
+    }
+    return byte(0)
+}
+
 func (g *Graph) Destroy() *DataError{
     if e := os.RemoveAll(g.Path()); e != nil{
         return dataError("Error destroying graph.", e, nil)
@@ -109,36 +450,44 @@ func (g *Graph) storePath(storeName string) string {
 }
 
 func (g *Graph) indexPath(indexName string) string {
-    path := g.Path()
-    return path + string(os.PathSeparator) + "idx" + string(os.PathSeparator) + indexName + FileExtension
+    return g.indexDir() + string(os.PathSeparator) + indexName + FileExtension
+}
+
+// Returns the directory that holds the index files of the graph.
+func (g *Graph) indexDir() string {
+    return g.Path() + string(os.PathSeparator) + "idx"
 }
 
 func (g *Graph) Path() string {
 	return g.db.Path + "/" + g.Name
 }
 
+// Shuts down the stores of the graph and closes their files.
+// Changes that have not been written are discarded.
 func (g *Graph) shutdown() {
-    if (g != nil){
-    
-        stores := []storer{
-            g.classStore,
-            g.vertexStore,
-            g.edgeStore,
-            g.labelStore,
-            g.attributeStore,
-            g.textStore,
-            g.mapStore,
-            g.listStore,
-        }
+    if g == nil {
+        return
+    }
+    stores := []storer{
+        g.classStore,
+        g.vertexStore,
+        g.edgeStore,
+        g.labelStore,
+        g.attributeStore,
+        g.textStore,
+        g.mapStore,
+        g.listStore,
+        g.indexStore,
+        g.schemaStore,
+        g.statsStore,
+    }
     
-        for _, store := range stores {
-            if store != nil {
-                store.shutdown()
-            }
+    for _, store := range stores {
+        if store != nil {
+            store.shutdown()
         }
     }
-    //os.Exit(1)
-    
-         
+    g.classStore, g.vertexStore, g.edgeStore, g.labelStore = nil, nil, nil, nil
+    g.attributeStore, g.textStore, g.mapStore, g.listStore = nil, nil, nil, nil
+    g.indexStore, g.schemaStore, g.statsStore = nil, nil, nil
 }
-
@@ -0,0 +1,517 @@
+package data
+
+import (
+    "os"
+    "bytes"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilIndexStore = "attempt to operate on a nil index store"
+    nilIndexStoreFile = "attempt to operate on a nil index store file"
+    nilIndexDef = "attempt to operate on a nil index definition"
+)
+
+// The kinds of index
+const (
+    valueIndex byte = iota + 1 // maps attribute values to vertex ids
+    orderedIndex               // keeps numeric and time values in order
+    fullTextIndex              // maps the words of text values to vertex ids
+    multiKeyIndex              // keeps the values of several keys in order
+)
+
+// Index flags
+const (
+    uniqueIndex byte = 0x01 // no two vertices covered by the index may share a value
+    foldCaseFlag byte = 0x02 // full-text words are folded to lower case
+    stemFlag byte = 0x04     // full-text words are reduced to their stems
+)
+
+// An index definition describes an index on the attributes of a class.
+// The index covers the vertices of the class and all of its sub classes.
+type indexDef struct {
+    class uint8             // the id of the class the index belongs to
+    kind byte               // the kind of index
+    flags byte              // options for the index
+    keys []uint16           // the ids of the labels of the indexed attribute keys
+    index *attributeIndex   // the value index itself, once it has been opened
+    ordered *rangeIndex     // the ordered index itself, once it has been opened
+    words *textIndex        // the full-text index itself, once it has been opened
+    composite *compositeIndex // the composite index itself, once it has been opened
+}
+
+// Returns the name of the index file, without the directory or extension.
+func (def *indexDef) name(g *Graph) (string, *DataError) {
+    Assert(nilIndexDef, def != nil)
+
+    className, err := g.classStore.Find(def.class).Name(g)
+    if err != nil {
+        return "", err
+    }
+    name := className
+    for _, key := range def.keys {
+        l, err := g.labelStore.find(key)
+        if err != nil {
+            return "", err
+        }
+        name += "." + l.Value(g)
+    }
+    switch def.kind {
+    case orderedIndex:
+        return name + ".range", nil
+    case fullTextIndex:
+        return name + ".text", nil
+    case multiKeyIndex:
+        return name + ".comp", nil
+    }
+    return name + ".attr", nil
+}
+
+// Creates the file for a new index, replacing any file left behind by an index
+// that was never recorded.
+func (def *indexDef) create(g *Graph) *DataError {
+    Assert(nilIndexDef, def != nil)
+
+    name, err := def.name(g)
+    if err != nil {
+        return err
+    }
+    _ = os.Remove(g.indexPath(name))
+    switch def.kind {
+    case orderedIndex:
+        def.ordered, err = createRangeIndex(g.indexPath(name))
+    case fullTextIndex:
+        def.words, err = createTextIndex(g.indexPath(name), def.flags)
+    case multiKeyIndex:
+        def.composite, err = createCompositeIndex(g.indexPath(name), len(def.keys))
+    default:
+        def.index, err = createAttributeIndex(g.indexPath(name))
+    }
+    return err
+}
+
+// Closes the file of an index and deletes it when the graph is written.
+func (def *indexDef) destroy(g *Graph) {
+    def.index.shutdown()
+    def.ordered.shutdown()
+    def.words.shutdown()
+    def.composite.shutdown()
+    if name, err := def.name(g); err == nil {
+        _ = os.Remove(g.indexPath(name))
+    }
+}
+
+// Updates the index for an attribute of a vertex that is changing from old to new.
+// Old is nil when the attribute is being added, and new is nil when it is being removed.
+func (def *indexDef) change(v *Vertex, key string, old, new *Attribute, g *Graph) *DataError {
+    Assert(nilIndexDef, def != nil)
+
+    id := v.Id
+    switch def.kind {
+    case orderedIndex:
+        index, err := def.openRange(g)
+        if err != nil {
+            return err
+        }
+        if old != nil && isRangeType(old.t) {
+            index.remove(rangeEntry{old.t, old.data, id})
+        }
+        if new != nil && isRangeType(new.t) {
+            index.add(rangeEntry{new.t, new.data, id})
+        }
+        return nil
+    case fullTextIndex:
+        index, err := def.openText(g)
+        if err != nil {
+            return err
+        }
+        if old != nil && old.t == text_t {
+            text, err := old.text(g)
+            if err != nil {
+                return err
+            }
+            index.remove(text, id)
+        }
+        if new != nil && new.t == text_t {
+            text, err := new.text(g)
+            if err != nil {
+                return err
+            }
+            index.add(text, id)
+        }
+        return nil
+    case multiKeyIndex:
+        index, err := def.openComposite(g)
+        if err != nil {
+            return err
+        }
+        before, err := def.entry(v, key, old, g)
+        if err != nil {
+            return err
+        }
+        after, err := def.entry(v, key, new, g)
+        if err != nil {
+            return err
+        }
+        if before != nil {
+            index.remove(*before)
+        }
+        if after != nil {
+            index.add(*after)
+        }
+        return nil
+    }
+
+    index, err := def.open(g)
+    if err != nil {
+        return err
+    }
+    if old != nil {
+        value, err := old.indexKey(g)
+        if err != nil {
+            return err
+        }
+        index.remove(value, id)
+    }
+    if new != nil {
+        value, err := new.indexKey(g)
+        if err != nil {
+            return err
+        }
+        index.add(value, id)
+    }
+    return nil
+}
+
+// Returns the ordered index, opening its file if it has not been opened yet.
+func (def *indexDef) openRange(g *Graph) (*rangeIndex, *DataError) {
+    Assert(nilIndexDef, def != nil)
+
+    if def.ordered == nil {
+        name, err := def.name(g)
+        if err != nil {
+            return nil, err
+        }
+        if def.ordered, err = constructRangeIndex(g.indexPath(name)); err != nil {
+            return nil, err
+        }
+    }
+    return def.ordered, nil
+}
+
+// Returns the composite index entry of a vertex, with the attribute for one key
+// replaced by a, which may be nil.
+// Returns nil if the vertex would not have every key of the index.
+func (def *indexDef) entry(v *Vertex, key string, a *Attribute, g *Graph) (*compositeEntry, *DataError) {
+    m, err := v.Attributes(g)
+    if err != nil {
+        return nil, err
+    }
+    e := &compositeEntry{make([]compositeValue, len(def.keys)), v.Id}
+    for n, labelId := range def.keys {
+        l, err := g.labelStore.find(labelId)
+        if err != nil {
+            return nil, err
+        }
+        attr, ok := m.get(l.Value(g))
+        if l.Value(g) == key {
+            attr, ok = a, a != nil
+        }
+        if !ok {
+            return nil, nil
+        }
+        if e.values[n], err = compositeValueOf(attr, g); err != nil {
+            return nil, err
+        }
+    }
+    return e, nil
+}
+
+// Returns the composite index, opening its file if it has not been opened yet.
+func (def *indexDef) openComposite(g *Graph) (*compositeIndex, *DataError) {
+    Assert(nilIndexDef, def != nil)
+
+    if def.composite == nil {
+        name, err := def.name(g)
+        if err != nil {
+            return nil, err
+        }
+        if def.composite, err = constructCompositeIndex(g.indexPath(name), len(def.keys)); err != nil {
+            return nil, err
+        }
+    }
+    return def.composite, nil
+}
+
+// Returns the full-text index, opening its file if it has not been opened yet.
+func (def *indexDef) openText(g *Graph) (*textIndex, *DataError) {
+    Assert(nilIndexDef, def != nil)
+
+    if def.words == nil {
+        name, err := def.name(g)
+        if err != nil {
+            return nil, err
+        }
+        if def.words, err = constructTextIndex(g.indexPath(name), def.flags); err != nil {
+            return nil, err
+        }
+    }
+    return def.words, nil
+}
+
+// Returns the value index, opening its file if it has not been opened yet.
+func (def *indexDef) open(g *Graph) (*attributeIndex, *DataError) {
+    Assert(nilIndexDef, def != nil)
+
+    if def.index == nil {
+        name, err := def.name(g)
+        if err != nil {
+            return nil, err
+        }
+        if def.index, err = constructAttributeIndex(g.indexPath(name)); err != nil {
+            return nil, err
+        }
+    }
+    return def.index, nil
+}
+
+// Returns true if the index enforces unique values.
+func (def *indexDef) isUnique() bool {
+    return def.flags & uniqueIndex != 0
+}
+
+// Returns true if the index is over exactly the given attribute keys, in order.
+func (def *indexDef) hasKeys(keys []uint16) bool {
+    if len(def.keys) != len(keys) {
+        return false
+    }
+    for n, key := range keys {
+        if def.keys[n] != key {
+            return false
+        }
+    }
+    return true
+}
+
+// Returns true if one of the keys of the index is the given attribute key.
+func (def *indexDef) covers(key uint16) bool {
+    for _, k := range def.keys {
+        if k == key {
+            return true
+        }
+    }
+    return false
+}
+
+// The index store keeps track of the attribute indexes of every class in a graph.
+type indexStore struct {
+    file *os.File
+    log *entryLog
+    indexes []*indexDef
+}
+
+// Creates an existing index store.
+// Returns an error of type *DataError if the file can not be opened.
+func constructIndexStore(g *Graph) (*indexStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(indexStore)
+    fileName := g.storePath("index")
+    if file, e := os.OpenFile(fileName, os.O_RDWR, 0777); e != nil {
+        return nil, dataError("Could not open file for index store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if _, de := checkFileHeader(s.file, indexStoreFile); de != nil {
+        return nil, de
+    }
+
+    if de := s.readIndexes(); de != nil {
+        return nil, de
+    }
+
+    return s, nil
+}
+
+// Creates an index store that does not yet exist.
+// Returns an error of type *DataError if the file can not be created.
+func createIndexStore(g *Graph) (*indexStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(indexStore)
+    fileName := g.storePath("index")
+    if file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777); e != nil {
+        return nil, dataError("Could not create file for index store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if de := writeFileHeader(s.file, indexStoreFile, 0); de != nil {
+        return nil, de
+    }
+
+    s.log = &entryLog{file: s.file}
+    s.indexes = make([]*indexDef, 0)
+
+    return s, nil
+}
+
+// Encodes an index definition as the class id, kind, flags, the number of keys, and
+// the label id of each key.
+func (def *indexDef) encode() []byte {
+    b := make([]byte, 4 + 2 * len(def.keys))
+    b[0], b[1], b[2], b[3] = def.class, def.kind, def.flags, byte(len(def.keys))
+    for n, key := range def.keys {
+        util.PutUint16(b[4 + 2 * n:], key)
+    }
+    return b
+}
+
+// Reads the index definitions from the file.
+// The file is an entry log (see entryLog) of the encoded definitions.
+// Returns an error of type *DataError if the file can not be read.
+func (s *indexStore) readIndexes() *DataError {
+    Assert(nilIndexStore, s != nil)
+    Assert(nilIndexStoreFile, s.file != nil)
+
+    s.indexes = make([]*indexDef, 0)
+    log, err := readEntryLog(s.file, func(added bool, entry []byte) bool {
+        if len(entry) < 4 || len(entry) != 4 + 2 * int(entry[3]) {
+            return false
+        }
+        if !added {
+            // a definition is removed when it changes, and added again as it is now
+            for n, def := range s.indexes {
+                if bytes.Equal(def.encode(), entry) {
+                    s.indexes = append(s.indexes[:n], s.indexes[n + 1:]...)
+                    return true
+                }
+            }
+            return false
+        }
+        def := &indexDef{class: entry[0], kind: entry[1], flags: entry[2]}
+        for pos := 4; pos < len(entry); pos += 2 {
+            def.keys = append(def.keys, util.Uint16(entry[pos:]))
+        }
+        s.indexes = append(s.indexes, def)
+        return true
+    })
+    s.log = log
+    return err
+}
+
+// Writes the index definitions that were added or changed and any open indexes to their files.
+// Returns an error of type *DataError if they can not be written.
+func (s *indexStore) write() *DataError {
+    Assert(nilIndexStore, s != nil)
+    Assert(nilIndexStoreFile, s.file != nil)
+
+    err := s.log.write(func(fn func(entry []byte)) {
+        for _, def := range s.indexes {
+            fn(def.encode())
+        }
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, def := range s.indexes {
+        if def.index != nil {
+            if err := def.index.write(); err != nil {
+                return err
+            }
+        }
+        if def.ordered != nil {
+            if err := def.ordered.write(); err != nil {
+                return err
+            }
+        }
+        if def.words != nil {
+            if err := def.words.write(); err != nil {
+                return err
+            }
+        }
+        if def.composite != nil {
+            if err := def.composite.write(); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Adds an index definition to the store.
+func (s *indexStore) add(def *indexDef) {
+    Assert(nilIndexStore, s != nil)
+    Assert(nilIndexDef, def != nil)
+
+    s.indexes = append(s.indexes, def)
+    s.log.add(def.encode())
+}
+
+// Changes the flags of an index definition in the store.
+func (s *indexStore) update(def *indexDef, flags byte) {
+    Assert(nilIndexStore, s != nil)
+    Assert(nilIndexDef, def != nil)
+
+    s.log.remove(def.encode())
+    def.flags = flags
+    s.log.add(def.encode())
+}
+
+// Finds the index of a kind for a class and list of attribute keys.
+// Returns nil if the class does not have such an index.
+func (s *indexStore) find(class uint8, kind byte, keys ...uint16) *indexDef {
+    Assert(nilIndexStore, s != nil)
+
+    for _, def := range s.indexes {
+        if def.class == class && def.kind == kind && def.hasKeys(keys) {
+            return def
+        }
+    }
+    return nil
+}
+
+// Returns the indexes that include an attribute key and cover a vertex.
+// These are the indexes of the vertex's class and all of its super classes.
+// Returns an error of type *DataError if the label of the key can not be read.
+func (s *indexStore) forVertex(v *Vertex, key string, g *Graph) ([]*indexDef, *DataError) {
+    Assert(nilIndexStore, s != nil)
+    Assert(nilVertex, v != nil)
+
+    defs := make([]*indexDef, 0)
+    if len(s.indexes) == 0 {
+        return defs, nil
+    }
+    l, err := g.labelStore.findByValue(key, g)
+    if err != nil {
+        return nil, err
+    } else if l == nil {
+        return defs, nil // nothing can be indexed on a key that has no label
+    }
+
+    for c := v.Class(g); c != nil; c = c.Super(g) {
+        for _, def := range s.indexes {
+            if def.class == c.Id && def.covers(l.Id) {
+                defs = append(defs, def)
+            }
+        }
+    }
+    return defs, nil
+}
+
+// Shuts the index store down, making sure all files are closed.
+func (s *indexStore) shutdown() {
+    if s != nil {
+        for _, def := range s.indexes {
+            def.index.shutdown()
+            def.ordered.shutdown()
+            def.words.shutdown()
+            def.composite.shutdown()
+        }
+        if s.file != nil {
+            _ = s.file.Close()
+        }
+    }
+}
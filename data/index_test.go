@@ -0,0 +1,955 @@
+package data
+
+import(
+	"testing"
+	"time"
+	"fmt"
+	"math"
+	"os"
+	"io/ioutil"
+
+	"github.com/wardlem/graphlite/util"
+)
+
+func TestLabelIndex (t *testing.T) {
+    db, g := newTestGraph(t, "labels")
+    var err *DataError
+    
+    // enough labels to make the index grow a few times
+    ids := make(map[string]uint16)
+    for n := 0; n < 300; n++ {
+        value := fmt.Sprintf("label%d", n)
+        if ids[value], err = g.labelStore.addLabel(value, g); err != nil {
+            t.Fatal(err.Trace())
+        }
+    }
+    if err = g.labelStore.removeLabel("label7", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // the grown table is found before it is written
+    for value, id := range ids {
+        if l, _ := g.labelStore.findByValue(value, g); value != "label7" && (l == nil || l.Id != id) {
+            t.Errorf("could not find unwritten label %s", value)
+        }
+    }
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    
+    check := func(g *Graph) {
+        for value, id := range ids {
+            l, err := g.labelStore.findByValue(value, g)
+            if err != nil {
+                t.Error(err.Trace())
+            } else if value == "label7" {
+                if l != nil {
+                    t.Errorf("found removed label %s", value)
+                }
+            } else if l == nil || l.Id != id {
+                t.Errorf("could not find label %s", value)
+            }
+        }
+        
+        // ordered iteration is still available
+        last := ""
+        err := g.labelStore.each(func(l *Label) bool {
+            if l.Value(g) < last {
+                t.Errorf("labels out of order: %s after %s", l.Value(g), last)
+            }
+            last = l.Value(g)
+            return true
+        }, g)
+        if err != nil {
+            t.Error(err.Trace())
+        }
+    }
+    
+    g, err = constructGraph(db, "labels")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    check(g)
+    g.shutdown()
+    
+    // graphs from before the index have it built when they are opened
+    os.Remove(g.storePath("label.hash"))
+    writeGraphVersion(g, 1)
+    g, err = constructGraph(db, "labels")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    check(g)
+    
+    // a label the index points at but the store can not read is an error, not a missing label
+    g.labelStore.index.add(hashLabel("ghost"), 999)
+    if _, err = g.labelStore.findByValue("ghost", g); err == nil {
+        t.Error("expected an error for a label that can not be read")
+    }
+    if err = g.DeclareEdge(EdgeDef{Label: "ghost"}); err == nil {
+        t.Error("declared an edge with a label that can not be read")
+    }
+    g.shutdown()
+}
+
+func TestAttributeIndex (t *testing.T) {
+    db, g := newTestGraph(t, "people")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    admin := g.AddClass("Admin", person)
+    email := func(v *Vertex, value string) {
+        if err := v.Set("email", value, g); err != nil {
+            t.Fatal(err.Trace())
+        }
+    }
+    
+    alice, _ := g.AddVertex(person)
+    email(alice, "alice@example.com")
+    bob, _ := g.AddVertex(admin)
+    email(bob, "bob@example.com")
+    
+    // values set before the index is created are indexed
+    if err := person.CreateIndex("email", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    carol, _ := g.AddVertex(person)
+    email(carol, "carol@example.com")
+    
+    findOne := func(g *Graph, c *Class, value Any) *Vertex {
+        found, err := c.FindBy("email", value, g)
+        if err != nil {
+            t.Fatal(err.Trace())
+        }
+        if len(found) > 1 {
+            t.Errorf("found %d vertices for %v", len(found), value)
+        }
+        if len(found) == 0 {
+            return nil
+        }
+        return found[0]
+    }
+    
+    if v := findOne(g, person, "alice@example.com"); v == nil || v.Id != alice.Id {
+        t.Error("could not find vertex set before the index was created")
+    }
+    if v := findOne(g, person, "carol@example.com"); v == nil || v.Id != carol.Id {
+        t.Error("could not find vertex set after the index was created")
+    }
+    if v := findOne(g, admin, "bob@example.com"); v == nil || v.Id != bob.Id {
+        t.Error("could not find sub class vertex through the super class index")
+    }
+    if v := findOne(g, admin, "alice@example.com"); v != nil {
+        t.Error("found super class vertex through the sub class")
+    }
+    
+    // updates, removals, and deleted vertices are kept out of the index
+    email(alice, "alice@example.org")
+    if findOne(g, person, "alice@example.com") != nil || findOne(g, person, "alice@example.org") == nil {
+        t.Error("index was not updated when the attribute changed")
+    }
+    if err := carol.RemoveAttributeByKey("email", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if findOne(g, person, "carol@example.com") != nil {
+        t.Error("index was not updated when the attribute was removed")
+    }
+    if err := g.RemoveVertex(bob); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if findOne(g, person, "bob@example.com") != nil {
+        t.Error("index was not updated when the vertex was removed")
+    }
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    
+    g, err = constructGraph(db, "people")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    person = g.C("Person")
+    if v := findOne(g, person, "alice@example.org"); v == nil || v.Id != alice.Id {
+        t.Error("index did not survive reopening the graph")
+    } else if value, _ := v.Get("email", g); value != "alice@example.org" {
+        t.Errorf("attribute did not survive reopening the graph: %v", value)
+    }
+    if findOne(g, person, "bob@example.com") != nil {
+        t.Error("removed vertex found after reopening the graph")
+    }
+}
+
+func TestAttributeIndexLog (t *testing.T) {
+    _, g := newTestGraph(t, "logged")
+    fileName := g.indexPath("Vertex.email.attr")
+    i, err := createAttributeIndex(fileName)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    for id := uint32(1); id <= 100; id++ {
+        i.add(fmt.Sprintf("user%d@example.com", id), id)
+    }
+    if err = i.write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // only the changes are written, after what was already there
+    before := make([]byte, sizeOf(t, i.file))
+    i.file.ReadAt(before, 0)
+    i.remove("user7@example.com", 7)
+    i.add("user7@example.org", 7)
+    if err = i.write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    after := make([]byte, sizeOf(t, i.file))
+    i.file.ReadAt(after, 0)
+    if grown := len(after) - len(before); grown != 2 * (entryHeaderSize + 4) + len("user7@example.com") + len("user7@example.org") {
+        t.Errorf("expected the file to grow by the two changes, it grew by %d bytes", grown)
+    }
+    if string(after[:len(before)]) != string(before) {
+        t.Error("expected the entries already written to be left alone")
+    }
+    
+    // a log that is mostly removed entries is compacted
+    for n := 0; n < 500; n++ {
+        i.remove(fmt.Sprintf("user%d@example.com", n % 50 + 10), uint32(n % 50 + 10))
+        i.add(fmt.Sprintf("user%d@example.com", n % 50 + 10), uint32(n % 50 + 10))
+        if err = i.write(); err != nil {
+            t.Fatal(err.Trace())
+        }
+    }
+    if size := sizeOf(t, i.file); size > 2 * int64(len(after)) + entryLogSlack {
+        t.Errorf("expected the log to be compacted, it is %d bytes", size)
+    }
+    
+    check := func() {
+        i, err = constructAttributeIndex(fileName)
+        if err != nil {
+            t.Fatal(err.Trace())
+        }
+        if ids := i.find("user7@example.org"); len(ids) != 1 {
+            t.Error("could not find a changed value after reading the log")
+        }
+        if ids := i.find("user7@example.com"); len(ids) != 0 {
+            t.Error("found a removed value after reading the log")
+        }
+        for id := uint32(8); id <= 100; id++ {
+            if _, ok := i.find(fmt.Sprintf("user%d@example.com", id))[id]; !ok {
+                t.Errorf("could not find vertex %d after reading the log", id)
+            }
+        }
+    }
+    check()
+    
+    // entries that run past the end of the file or can not be decoded are corruption
+    size := sizeOf(t, i.file)
+    i.file.WriteAt([]byte{entryAdded, 0, 0, 0, 40, 1, 2}, size)
+    if _, err = constructAttributeIndex(fileName); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an entry that runs past the end of the file")
+    }
+    i.file.WriteAt([]byte{entryAdded, 0, 0, 0, 2, 1, 2}, size)
+    if _, err = constructAttributeIndex(fileName); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an entry that is too short")
+    }
+    i.file.WriteAt([]byte{9, 0, 0, 0, 0}, size)
+    i.file.Truncate(size + entryHeaderSize)
+    if _, err = constructAttributeIndex(fileName); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an unknown change")
+    }
+    i.file.Truncate(size)
+    check()
+    
+    // so is a definition in the index catalog that can not be decoded
+    g.indexStore.file.WriteAt([]byte{entryAdded, 0, 0, 0, 5, 1, 1, 0, 2, 0}, sizeOf(t, g.indexStore.file))
+    if _, err = constructIndexStore(g); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an index definition with missing keys")
+    }
+}
+
+func TestUniqueIndex (t *testing.T) {
+    db, g := newTestGraph(t, "accounts")
+    var err *DataError
+    
+    account := g.AddClass("Account", g.C("Vertex"))
+    admin := g.AddClass("Admin", account)
+    a, _ := g.AddVertex(account)
+    b, _ := g.AddVertex(admin)
+    a.Set("email", "same@example.com", g)
+    b.Set("email", "same@example.com", g)
+    
+    // existing duplicates prevent the constraint
+    if err := account.CreateUniqueIndex("email", g); err == nil || err.Constraint() == nil {
+        t.Fatal("created a unique index over duplicate values")
+    }
+    b.Set("email", "b@example.com", g)
+    if err := account.CreateUniqueIndex("email", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // the constraint covers sub classes
+    c, _ := g.AddVertex(admin)
+    err = c.Set("email", "same@example.com", g)
+    if err == nil {
+        t.Fatal("set a duplicate value on a unique attribute")
+    }
+    if ce := err.Constraint(); ce == nil || ce.Id != a.Id || ce.Class != "Account" || ce.Key != "email" {
+        t.Errorf("unexpected constraint error: %+v", ce)
+    }
+    if value, _ := c.Get("email", g); value != nil {
+        t.Errorf("failed set changed the attribute to %v", value)
+    }
+    
+    // setting a vertex's own value again is fine, and freed values can be reused
+    if err := a.Set("email", "same@example.com", g); err != nil {
+        t.Error(err.Trace())
+    }
+    a.RemoveAttributeByKey("email", g)
+    if err := c.Set("email", "same@example.com", g); err != nil {
+        t.Error(err.Trace())
+    }
+    
+    // an index made unique after it was created stays unique once the graph is reopened
+    if err := account.CreateIndex("handle", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    a.Set("handle", "ann", g)
+    if err := account.CreateUniqueIndex("handle", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "accounts")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    if n := len(g.indexStore.indexes); n != 2 {
+        t.Errorf("expected 2 index definitions after reopening, found %d", n)
+    }
+    b, _ = g.vertexStore.Find(b.Id)
+    if err = b.Set("handle", "ann", g); err == nil || err.Constraint() == nil {
+        t.Error("set a duplicate value on an index that was made unique before reopening")
+    }
+}
+
+func TestRangeIndex (t *testing.T) {
+    db, g := newTestGraph(t, "shop")
+    var err *DataError
+    
+    order := g.AddClass("Order", g.C("Vertex"))
+    rush := g.AddClass("RushOrder", order)
+    totals := []Any{50, 100, 250.5, 499, 500, 750}
+    orders := make([]*Vertex, len(totals))
+    for n, total := range totals {
+        class := order
+        if n % 2 == 1 {
+            class = rush
+        }
+        orders[n], _ = g.AddVertex(class)
+        orders[n].Set("total", total, g)
+    }
+    
+    ids := func(vertices []*Vertex) []uint32 {
+        result := make([]uint32, len(vertices))
+        for n, v := range vertices {
+            result[n] = v.Id
+        }
+        return result
+    }
+    expect := func(c *Class, r Range, want ...int) {
+        found, err := c.Scan("total", r, g)
+        if err != nil {
+            t.Fatal(err.Trace())
+        }
+        wantIds := make([]uint32, len(want))
+        for n, w := range want {
+            wantIds[n] = orders[w].Id
+        }
+        if fmt.Sprint(ids(found)) != fmt.Sprint(wantIds) {
+            t.Errorf("scan of %+v found %v, want %v", r, ids(found), wantIds)
+        }
+    }
+    check := func() {
+        expect(order, Range{Min: 100, Max: 500}, 1, 2, 3, 4)
+        expect(order, Range{Min: 100, Max: 500, ExcludeMin: true, ExcludeMax: true}, 2, 3)
+        expect(order, Range{Min: 250.5, Descending: true, Limit: 2}, 5, 4)
+        expect(rush, Range{Max: 499.0}, 1, 3)
+        if v, _ := order.Min("total", g); v == nil || v.Id != orders[0].Id {
+            t.Error("wrong minimum")
+        }
+        if v, _ := rush.Max("total", g); v == nil || v.Id != orders[5].Id {
+            t.Error("wrong maximum")
+        }
+    }
+    
+    // without an index the vertices are scanned
+    check()
+    if err := order.CreateRangeIndex("total", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    check()
+    
+    // the index follows changes
+    orders[0].Set("total", 1000, g)
+    expect(order, Range{Min: 900}, 0)
+    orders[0].Set("total", 50, g)
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "shop")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    order, rush = g.C("Order"), g.C("RushOrder")
+    check()
+    
+    // times are ordered after numbers
+    event := g.AddClass("Event", g.C("Vertex"))
+    event.CreateRangeIndex("at", g)
+    start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+    early, _ := g.AddVertex(event)
+    early.Set("at", start, g)
+    late, _ := g.AddVertex(event)
+    late.Set("at", start.Add(time.Hour), g)
+    if found, _ := event.Scan("at", Range{Min: start.Add(time.Minute)}, g); len(found) != 1 || found[0].Id != late.Id {
+        t.Errorf("wrong events after a time: %v", ids(found))
+    }
+    if value, _ := late.Get("at", g); !value.(time.Time).Equal(start.Add(time.Hour)) {
+        t.Errorf("time did not survive storage: %v", value)
+    }
+    
+    // only changes are added to the file, and an entry that is not a range value is corruption
+    def, _, _ := order.findIndex(orderedIndex, []string{"total"}, g)
+    index, err := def.openRange(g)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    size := sizeOf(t, index.file)
+    v, _ := g.FindVertex(orders[1].Id)
+    v.Set("total", 75, g)
+    if err = g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if grown := sizeOf(t, index.file) - size; grown != 2 * (entryHeaderSize + rangeEntrySize) {
+        t.Errorf("expected the file to grow by the two changes, it grew by %d bytes", grown)
+    }
+    index.file.WriteAt(append([]byte{entryAdded, 0, 0, 0, rangeEntrySize, text_t}, make([]byte, rangeEntrySize - 1)...), sizeOf(t, index.file))
+    if _, err = constructRangeIndex(index.file.Name()); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an entry that is not a range value")
+    }
+}
+
+func TestCompareRangeValues (t *testing.T) {
+    const big = int64(1) << 53
+    cases := []struct {
+        a, b Any
+        want int
+    }{
+        {2, 2.5, -1},
+        {3, 2.5, 1},
+        {-2, -2.5, 1},
+        {big, float64(big), 0},
+        {big + 1, float64(big), 1},     // rounds to float64(big) when converted
+        {int64(math.MaxInt64), math.Pow(2, 63), -1},
+        {int64(math.MinInt64), -math.Pow(2, 63), 0},
+        {int64(math.MinInt64), math.Inf(-1), 1},
+        {int64(math.MaxInt64), math.NaN(), -1},
+        {math.NaN(), math.Inf(1), 1},
+        {1.5, 1.5, 0},
+    }
+    for _, c := range cases {
+        a, _ := rangeBound(c.a)
+        b, _ := rangeBound(c.b)
+        if got := compareRangeValues(a, b); got != c.want {
+            t.Errorf("comparing %v to %v gave %d, want %d", c.a, c.b, got, c.want)
+        }
+        if got := compareRangeValues(b, a); got != -c.want {
+            t.Errorf("comparing %v to %v gave %d, want %d", c.b, c.a, got, -c.want)
+        }
+    }
+}
+
+func TestTextIndex (t *testing.T) {
+    db, g := newTestGraph(t, "notes")
+    var err *DataError
+    
+    note := g.AddClass("Note", g.C("Vertex"))
+    texts := []string{
+        "Indexing graphs is fun.",
+        "Graph databases store vertices and edges.",
+        "The index of a book lists its pages.",
+        "Cooking pasta.",
+    }
+    notes := make([]*Vertex, len(texts))
+    for n, text := range texts {
+        notes[n], _ = g.AddVertex(note)
+        notes[n].Set("body", text, g)
+    }
+    if _, err = note.Search("body", "graph", g); err == nil {
+        t.Error("searched without a full-text index")
+    }
+    if err := note.CreateTextIndex("body", TextIndexOptions{Lowercase: true, Stem: true}, g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    expect := func(query string, want ...int) {
+        results, err := note.Search("body", query, g)
+        if err != nil {
+            t.Fatal(err.Trace())
+        }
+        found := make([]uint32, len(results))
+        for n, r := range results {
+            found[n] = r.Vertex.Id
+        }
+        wantIds := make([]uint32, len(want))
+        for n, w := range want {
+            wantIds[n] = notes[w].Id
+        }
+        if fmt.Sprint(found) != fmt.Sprint(wantIds) {
+            t.Errorf("search for %q found %v, want %v", query, found, wantIds)
+        }
+    }
+    
+    expect("GRAPHS", 0, 1)
+    expect("indexes", 0, 2)
+    expect("index graph", 0, 1, 2) // the first note has both words, the second is shorter than the third
+    expect("pasta", 3)
+    expect("nothing")
+    
+    // the index follows changes to the text
+    notes[3].Set("body", "Cooking for graph people.", g)
+    expect("pasta")
+    notes[1].RemoveAttributeByKey("body", g)
+    expect("GRAPHS", 0, 3)
+    def, _, _ := note.findIndex(fullTextIndex, []string{"body"}, g)
+    written := fmt.Sprint(def.words.words, def.words.lengths)
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "notes")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    note = g.C("Note")
+    expect("GRAPHS", 0, 3)
+    
+    // the log reads back as the index it was written from, and a word entry without a
+    // word is corruption
+    def, _, _ = note.findIndex(fullTextIndex, []string{"body"}, g)
+    index, err := def.openText(g)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if read := fmt.Sprint(index.words, index.lengths); read != written {
+        t.Errorf("read %s from the log, want %s", read, written)
+    }
+    index.file.WriteAt(append([]byte{entryAdded, 0, 0, 0, 9, wordEntry}, make([]byte, 8)...), sizeOf(t, index.file))
+    if _, err = constructTextIndex(index.file.Name(), index.flags); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for a word entry without a word")
+    }
+}
+
+func TestCompositeIndex (t *testing.T) {
+    db, g := newTestGraph(t, "tenants")
+    var err *DataError
+    
+    doc := g.AddClass("Document", g.C("Vertex"))
+    rows := []struct{ tenant string; external int }{
+        {"acme", 3}, {"acme", 1}, {"globex", 1}, {"acme", 2}, {"globex", 7},
+    }
+    docs := make([]*Vertex, len(rows))
+    for n, row := range rows {
+        docs[n], _ = g.AddVertex(doc)
+        docs[n].Set("tenant", row.tenant, g)
+        docs[n].Set("external", row.external, g)
+    }
+    partial, _ := g.AddVertex(doc)
+    partial.Set("tenant", "acme", g)
+    
+    keys := []string{"tenant", "external"}
+    expect := func(values []Any, r Range, want ...int) {
+        found, err := doc.Lookup(keys, values, r, g)
+        if err != nil {
+            t.Fatal(err.Trace())
+        }
+        got := make([]uint32, len(found))
+        for n, v := range found {
+            got[n] = v.Id
+        }
+        wantIds := make([]uint32, len(want))
+        for n, w := range want {
+            wantIds[n] = docs[w].Id
+        }
+        if fmt.Sprint(got) != fmt.Sprint(wantIds) {
+            t.Errorf("lookup of %v %+v found %v, want %v", values, r, got, wantIds)
+        }
+    }
+    check := func() {
+        expect([]Any{"acme", 1}, Range{}, 1)
+        expect([]Any{"acme"}, Range{}, 1, 3, 0)
+        expect([]Any{"acme"}, Range{Min: 2}, 3, 0)
+        expect([]Any{"globex"}, Range{Max: 5, ExcludeMax: true}, 2)
+        expect([]Any{"acme"}, Range{Descending: true, Limit: 2}, 0, 3)
+        expect(nil, Range{Min: "b"}, 2, 4)
+    }
+    
+    check()
+    if err := doc.CreateCompositeIndex(keys, g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    check()
+    
+    // the index follows changes to any of its keys
+    docs[2].Set("tenant", "acme", g)
+    expect([]Any{"acme"}, Range{}, 1, 2, 3, 0)
+    docs[2].Set("tenant", "globex", g)
+    partial.Set("external", 9, g)
+    found, _ := doc.Lookup(keys, []Any{"acme", 9}, Range{}, g)
+    if len(found) != 1 || found[0].Id != partial.Id {
+        t.Error("vertex was not indexed once it had every key")
+    }
+    partial.RemoveAttributeByKey("tenant", g)
+    if found, _ = doc.Lookup(keys, []Any{"acme", 9}, Range{}, g); len(found) != 0 {
+        t.Error("vertex was still indexed after losing a key")
+    }
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "tenants")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    doc = g.C("Document")
+    check()
+    
+    // entries with the wrong number of values or text that runs past the entry are corruption
+    def, _, _ := doc.findIndex(multiKeyIndex, keys, g)
+    index, err := def.openComposite(g)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    size := sizeOf(t, index.file)
+    for _, entry := range [][]byte{
+        {0, 0, 0, 1, integer_t, 0, 0, 0, 0, 0, 0, 0, 1},
+        {0, 0, 0, 1, text_t, 0, 0, 0, 9, 'a'},
+    } {
+        head := []byte{entryAdded, 0, 0, 0, byte(len(entry))}
+        index.file.WriteAt(append(head, entry...), size)
+        index.file.Truncate(size + int64(len(head) + len(entry)))
+        if _, err = constructCompositeIndex(index.file.Name(), len(keys)); err == nil || err.Corruption() == nil {
+            t.Errorf("expected a corruption error for entry %v", entry)
+        }
+    }
+}
+
+func TestEdgeLabelIndex (t *testing.T) {
+    db, g := newTestGraph(t, "assets")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    asset := g.AddClass("Asset", g.C("Vertex"))
+    alice, _ := g.AddVertex(person)
+    bob, _ := g.AddVertex(person)
+    car, _ := g.AddVertex(asset)
+    house, _ := g.AddVertex(asset)
+    
+    owns1, _ := g.AddEdge(alice, car, "owns")
+    owns2, _ := g.AddEdge(bob, house, "owns")
+    g.AddEdge(alice, bob, "knows")
+    owns3, _ := g.AddEdge(bob, car, "owns")
+    
+    expect := func(g *Graph, label string, want ...*Edge) {
+        got := make([]uint32, 0)
+        it := g.EdgesByLabel(label)
+        for it.Next() {
+            got = append(got, it.Edge().Id)
+        }
+        if it.Err() != nil {
+            t.Fatal(it.Err().Trace())
+        }
+        wantIds := make([]uint32, len(want))
+        for n, e := range want {
+            wantIds[n] = e.Id
+        }
+        if fmt.Sprint(got) != fmt.Sprint(wantIds) {
+            t.Errorf("edges labelled %s were %v, want %v", label, got, wantIds)
+        }
+    }
+    
+    expect(g, "owns", owns1, owns2, owns3)
+    expect(g, "likes")
+    if out, _ := bob.Out(g); len(out.get("owns")) != 2 {
+        t.Errorf("bob has %d owns edges, want 2", len(out.get("owns")))
+    }
+    
+    if err := g.RemoveEdge(owns2); err != nil {
+        t.Fatal(err.Trace())
+    }
+    expect(g, "owns", owns1, owns3)
+    if err := g.RemoveVertex(alice); err != nil {
+        t.Fatal(err.Trace())
+    }
+    expect(g, "owns", owns3)
+    expect(g, "knows")
+    if in, _ := car.In(g); len(in.get("owns")) != 1 {
+        t.Error("removed edge is still linked to its vertex")
+    }
+    
+    // edges are looked up as the iterator reaches them, so edges added after it was
+    // created are found and edges removed are skipped
+    collect := func(it *EdgeIterator) map[uint32]bool {
+        seen := make(map[uint32]bool)
+        for it.Next() {
+            seen[it.Edge().Id] = true
+        }
+        return seen
+    }
+    it := g.EdgesByLabel("owns")
+    owns4, _ := g.AddEdge(bob, house, "owns")
+    if seen := collect(it); len(seen) != 2 || !seen[owns3.Id] || !seen[owns4.Id] {
+        t.Errorf("expected an edge added after the iterator was created to be found, saw %v", seen)
+    }
+    it = g.EdgesByLabel("owns")
+    g.RemoveEdge(owns4)
+    if seen := collect(it); len(seen) != 1 || !seen[owns3.Id] {
+        t.Errorf("expected an edge removed after the iterator was created to be skipped, saw %v", seen)
+    }
+    if g.edgeStore.labels.size(owns3.label) != 1 {
+        t.Error("removed edge is still in the index")
+    }
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "assets")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    expect(g, "owns", owns3)
+    
+    // an entry of the wrong size is corruption
+    file := g.edgeStore.labels.file
+    file.WriteAt([]byte{entryAdded, 0, 0, 0, 4, 0, 1, 0, 0}, sizeOf(t, file))
+    if _, err = constructEdgeLabelIndex(file.Name()); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an entry of the wrong size")
+    }
+    g.shutdown()
+    
+    // graphs from before the index have it built when they are opened
+    os.Remove(g.storePath("edge.label"))
+    writeGraphVersion(g, 3)
+    g, err = constructGraph(db, "assets")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    expect(g, "owns", owns3)
+    g.shutdown()
+}
+
+func TestClassIdIndex (t *testing.T) {
+    dir := t.TempDir()
+    fileName := dir + "/Person.idx" + FileExtension
+    
+    i, err := createClassIdIndex(fileName)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // enough ids in the first container to make it a bitmap, and a few in others
+    expected := make([]uint32, 0)
+    for id := uint32(1); id <= 5000; id++ {
+        expected = append(expected, id)
+    }
+    expected = append(expected, 70000, 70001, 1 << 30)
+    for n := len(expected) - 1; n >= 0; n-- {
+        i.addId(expected[n])
+    }
+    i.addId(70000)
+    
+    check := func(i *classIdIndex, expected []uint32, when string) {
+        ids := make([]uint32, 0)
+        i.each(func(id uint32) bool {
+            ids = append(ids, id)
+            return true
+        })
+        if fmt.Sprint(ids) != fmt.Sprint(expected) || i.size() != len(expected) {
+            t.Errorf("%s: expected %d ids in order, got %d", when, len(expected), len(ids))
+        }
+        stepped := make([]uint32, 0)
+        for id := i.nextId(1); id != 0; id = i.nextId(id + 1) {
+            stepped = append(stepped, id)
+        }
+        if fmt.Sprint(stepped) != fmt.Sprint(expected) {
+            t.Errorf("%s: expected %d ids stepping through the index, got %d", when, len(expected), len(stepped))
+        }
+        for _, id := range expected {
+            if !i.hasId(id) {
+                t.Errorf("%s: missing id %d", when, id)
+                return
+            }
+        }
+    }
+    check(i, expected, "after adding")
+    if c := i.container(0); c == nil || c.bitmap == nil {
+        t.Error("a full container was not converted to a bitmap")
+    }
+    
+    i.write()
+    i.shutdown()
+    if i, err = constructClassIdIndex(fileName); err != nil {
+        t.Fatal(err.Trace())
+    }
+    check(i, expected, "after reopening")
+    
+    // emptying a container frees its block, and removing ids turns a bitmap back into an array
+    for id := uint32(1); id <= 1500; id++ {
+        i.removeId(id)
+    }
+    i.removeId(1 << 30)
+    i.removeId(12345678)
+    expected = expected[1500 : len(expected) - 1]
+    check(i, expected, "after removing")
+    if c := i.container(0); c == nil || c.bitmap != nil {
+        t.Error("a container with few ids was not converted to an array")
+    }
+    i.write()
+    info, _ := os.Stat(fileName)
+    if i, err = constructClassIdIndex(fileName); err != nil {
+        t.Fatal(err.Trace())
+    }
+    i.addId(1 << 31)
+    i.write()
+    i.shutdown()
+    if after, _ := os.Stat(fileName); after.Size() > info.Size() {
+        t.Error("the block of an emptied container was not reused")
+    }
+    if i, err = constructClassIdIndex(fileName); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer i.shutdown()
+    check(i, append(expected, 1 << 31), "after reopening again")
+    
+    // blocks that are cut short, out of order, or that do not agree with their count are
+    // corruption
+    size := sizeOf(t, i.file)
+    block := func(kind byte, count uint32, data ...byte) []byte {
+        b := make([]byte, containerHeaderSize)
+        util.PutUint16(b, 9)
+        b[2] = kind
+        util.PutUint32(b[4:], count)
+        return append(b, data...)
+    }
+    for _, b := range [][]byte{
+        block(arrayContainer, 1)[:containerHeaderSize - 2],
+        block(arrayContainer, 2, 0, 1),
+        block(arrayContainer, 2, 0, 2, 0, 1),
+        block(bitmapContainer, 1, make([]byte, 8 * bitmapContainerWords)...),
+        block(9, 1, 0, 1),
+    } {
+        // the block goes in a new slot after the last one
+        slot := (size - fileHeaderSize + containerBlockSize - 1) / containerBlockSize
+        i.file.Truncate(size)
+        i.file.WriteAt(b, fileHeaderSize + slot * containerBlockSize)
+        if _, err = constructClassIdIndex(fileName); err == nil || err.Corruption() == nil {
+            t.Errorf("expected a corruption error for block %v", b[:containerHeaderSize])
+        }
+    }
+}
+
+// A container becomes a bitmap above maxArrayContainerSize ids but only becomes an array
+// again at minBitmapContainerSize, so an id added and removed at the limit does not
+// convert it each time.
+func TestIdContainerLimits (t *testing.T) {
+    c := &idContainer{}
+    for low := 0; low <= maxArrayContainerSize; low++ {
+        c.add(uint16(low))
+    }
+    if c.bitmap == nil {
+        t.Fatal("a full container was not converted to a bitmap")
+    }
+    for n := 0; n < 3; n++ {
+        c.remove(0)
+        if c.bitmap == nil {
+            t.Fatal("a container at the limit was converted back to an array")
+        }
+        c.add(0)
+    }
+    
+    low := uint16(0)
+    for ; c.count > minBitmapContainerSize + 1; low++ {
+        c.remove(low)
+    }
+    if c.bitmap == nil {
+        t.Error("a container above the lower limit was converted to an array")
+    }
+    c.remove(low)
+    if c.bitmap != nil || len(c.array) != minBitmapContainerSize {
+        t.Errorf("expected an array of %d ids at the lower limit", minBitmapContainerSize)
+    }
+    if c.has(low) || !c.has(low + 1) || !c.has(maxArrayContainerSize) {
+        t.Error("the ids changed when the container was converted to an array")
+    }
+}
+
+// A class id index that can not be read is reported rather than replaced or skipped.
+func TestClassIdIndexErrors (t *testing.T) {
+    db, g := newTestGraph(t, "broken")
+    person := g.AddClass("Person", g.C("Vertex"))
+    ann, err := g.AddVertex(person)
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err = g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    
+    fileName := g.indexPath("Person.idx")
+    ioutil.WriteFile(fileName, []byte("not a graphlite file"), 0666)
+    if g, err = constructGraph(db, "broken"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    person = g.C("Person")
+    
+    if _, err = g.AddVertex(person); err == nil {
+        t.Error("expected an error adding a vertex to a class with a broken index")
+    }
+    if v, _ := g.FindVertex(ann.Id); v == nil || g.RemoveVertex(v) == nil {
+        t.Error("expected an error removing a vertex of a class with a broken index")
+    }
+    it := g.C("Vertex").Vertices(g)
+    for it.Next() {
+    }
+    if it.Err() == nil {
+        t.Error("expected an error iterating over a class with a broken index")
+    }
+    r, e := g.Query(`p = Person; yield p`, nil)
+    if e == nil {
+        for r.Next() {
+        }
+        e = r.Err()
+    }
+    if e == nil {
+        t.Error("expected an error querying a class with a broken index")
+    }
+    if bytes, _ := ioutil.ReadFile(fileName); string(bytes) != "not a graphlite file" {
+        t.Error("expected the broken index to be left alone")
+    }
+}
@@ -0,0 +1,300 @@
+package data
+
+import (
+    "math"
+)
+
+// error messages
+const (
+    edgeChainModified = "the edges of a vertex changed while iterating over them"
+)
+
+// Iterators load records one at a time as they are reached, rather than reading them all
+// up front. Scans visit records in order of id, which is the order they are laid out in
+// their file, so a scan reads its file from start to end. Records that have been removed
+// are skipped, including those removed after the iterator was created. The edges of a
+// vertex are the exception: each leads to the next, so an iterator over them stops with
+// an error if edges are added or removed while it runs.
+
+// A sequence of record ids: a list of ids that may be refilled as it runs out, every id
+// up to the last one a store has given out, the ids of the vertices of some classes, or
+// the ids of the edges with a label.
+type idSequence struct {
+    ids []uint32 // the ids still to be visited, when the sequence is a list
+    more func() ([]uint32, bool, *DataError) // returns the next ids of a list, or false when there are no more
+    scan bool    // whether the sequence is every id up to last
+    id uint32    // the last id visited in a scan, in the classes, or with the label
+    last uint32
+    classes []*classIdIndex // the indexes of the classes, when the sequence is their vertices
+    labels *edgeLabelIndex  // the index of edges by label, when the sequence is the edges
+    label uint16            // with a label; each id is looked up as it is reached
+    err *DataError // the error that ended the sequence, if any
+}
+
+// Returns a sequence of the ids in a list, in the order given.
+func idList(ids []uint32) idSequence {
+    return idSequence{ids: ids}
+}
+
+// Returns a sequence of every id from 1 up to and including last.
+func idRange(last uint32) idSequence {
+    return idSequence{scan: true, last: last}
+}
+
+// Returns a sequence of the ids of the vertices that belong to a class or one of its sub
+// classes, in increasing order.
+// Each id is looked up in the class id indexes as it is reached, so vertices added or
+// removed while the sequence runs are included or skipped.
+// If the index of a class can not be opened, the sequence is empty and ended by the error.
+func classIds(c *Class, g *Graph) idSequence {
+    s := idSequence{classes: make([]*classIdIndex, 0, 1)}
+    var add func(c *Class) *DataError
+    add = func(c *Class) *DataError {
+        index, err := c.idIndex(g)
+        if err != nil {
+            return err
+        }
+        s.classes = append(s.classes, index)
+        for sub := c.Sub(g); sub != nil; sub = sub.NextSub(g) {
+            if err := add(sub); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if err := add(c); err != nil {
+        return idSequence{err: err}
+    }
+    return s
+}
+
+// Returns the next id, or 0 when there are no more.
+func (s *idSequence) next() uint32 {
+    switch {
+    case s.scan:
+        if s.id >= s.last {
+            return 0
+        }
+        s.id++
+        return s.id
+    case s.classes != nil:
+        if s.id == math.MaxUint32 {
+            return 0
+        }
+        next := uint32(0)
+        for _, index := range s.classes {
+            if id := index.nextId(s.id + 1); id != 0 && (next == 0 || id < next) {
+                next = id
+            }
+        }
+        if next == 0 {
+            s.classes = nil
+        }
+        s.id = next
+        return next
+    case s.labels != nil:
+        next := uint32(0)
+        if s.id < math.MaxUint32 {
+            next = s.labels.nextId(s.label, s.id + 1)
+        }
+        if next == 0 {
+            s.labels = nil
+        }
+        s.id = next
+        return next
+    }
+    for {
+        for len(s.ids) > 0 {
+            id := s.ids[0]
+            s.ids = s.ids[1:]
+            if id != 0 {
+                return id
+            }
+        }
+        if s.more == nil {
+            return 0
+        }
+        ids, ok, err := s.more()
+        if !ok || err != nil {
+            s.more, s.err = nil, err
+            return 0
+        }
+        s.ids = ids
+    }
+}
+
+// Adds an id to the end of a list.
+func (s *idSequence) push(id uint32) {
+    if id != 0 {
+        s.ids = append(s.ids, id)
+    }
+}
+
+// A VertexIterator steps through a sequence of vertices, loading each one as it is reached.
+//
+//    it := g.C("Person").Vertices(g)
+//    for it.Next() {
+//        v := it.Vertex()
+//        ...
+//    }
+//    if err := it.Err(); err != nil {
+//        ...
+//    }
+type VertexIterator struct {
+    input vertexIterator
+    vertex *Vertex // the current vertex
+    err *DataError
+}
+
+// Creates an iterator over the vertices with the ids in a sequence.
+func newVertexIterator(g *Graph, ids idSequence) *VertexIterator {
+    return &VertexIterator{input: &storedVertices{g: g, ids: ids}}
+}
+
+// Vertices returns an iterator over every vertex in the graph.
+func (g *Graph) Vertices() *VertexIterator {
+    Assert(nilGraph, g != nil)
+    Assert(nilVertexStore, g.vertexStore != nil)
+
+    return newVertexIterator(g, idRange(g.vertexStore.idStore.lastId))
+}
+
+// Vertices returns an iterator over the vertices that belong to the class or one of its
+// sub classes.
+func (c *Class) Vertices(g *Graph) *VertexIterator {
+    Assert(nilGraph, g != nil)
+
+    return newVertexIterator(g, classIds(c, g))
+}
+
+// Next advances the iterator to the next vertex, returning false when there are no more
+// vertices or a vertex could not be read.
+func (it *VertexIterator) Next() bool {
+    if it.err != nil || it.input == nil {
+        it.vertex = nil
+        return false
+    }
+    if it.vertex, it.err = it.input.next(); it.vertex == nil {
+        it.input = nil
+        return false
+    }
+    return true
+}
+
+// Vertex returns the current vertex.
+func (it *VertexIterator) Vertex() *Vertex {
+    return it.vertex
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *VertexIterator) Err() *DataError {
+    return it.err
+}
+
+// Finds the vertices with the ids in a sequence.
+type storedVertices struct {
+    g *Graph
+    ids idSequence
+}
+
+func (it *storedVertices) next() (*Vertex, *DataError) {
+    for id := it.ids.next(); id != 0; id = it.ids.next() {
+        v, err := it.g.vertexStore.Find(id)
+        if v != nil || err != nil {
+            return v, err
+        }
+    }
+    return nil, it.ids.err
+}
+
+// An EdgeIterator steps through a sequence of edges, loading each one as it is reached.
+//
+//    it := g.EdgesByLabel("owns")
+//    for it.Next() {
+//        e := it.Edge()
+//        ...
+//    }
+//    if err := it.Err(); err != nil {
+//        ...
+//    }
+type EdgeIterator struct {
+    g *Graph
+    ids idSequence
+    follow func(e *Edge) uint32 // returns the id of the edge after each one, for a chain of edges
+    vertex uint32               // the id of the vertex the chain belongs to
+    store *edgeStore            // the edge store and its count of changes when a chain was
+    mods uint64                 // started, so that changes to the chain can be reported
+    edge *Edge                  // the current edge
+    err *DataError
+}
+
+// Creates an iterator over a chain of edges of a vertex, starting from the edge with an id.
+func newEdgeChain(g *Graph, v *Vertex, first uint32, follow func(e *Edge) uint32) *EdgeIterator {
+    Assert(nilEdgeStore, g.edgeStore != nil)
+
+    it := &EdgeIterator{g: g, follow: follow, vertex: v.Id, store: g.edgeStore, mods: g.edgeStore.mods}
+    it.ids.push(first)
+    return it
+}
+
+// Edges returns an iterator over every edge in the graph.
+func (g *Graph) Edges() *EdgeIterator {
+    Assert(nilGraph, g != nil)
+    Assert(nilEdgeStore, g.edgeStore != nil)
+
+    return &EdgeIterator{g: g, ids: idRange(g.edgeStore.idStore.lastId)}
+}
+
+// OutEdges returns an iterator over the edges that go out from the vertex.
+// Each edge holds the id of the next, so they are read in the order they were added
+// to the vertex rather than in order of id.
+// If any edge of the graph is added or removed while the iterator runs, it stops and
+// Err returns an error caused by a *ModificationError.
+func (v *Vertex) OutEdges(g *Graph) *EdgeIterator {
+    Assert(nilVertex, v != nil)
+    Assert(nilGraph, g != nil)
+
+    return newEdgeChain(g, v, v.out, func(e *Edge) uint32 { return e.outNext })
+}
+
+// InEdges returns an iterator over the edges that come in to the vertex, in the same
+// way as OutEdges.
+func (v *Vertex) InEdges(g *Graph) *EdgeIterator {
+    Assert(nilVertex, v != nil)
+    Assert(nilGraph, g != nil)
+
+    return newEdgeChain(g, v, v.in, func(e *Edge) uint32 { return e.inNext })
+}
+
+// Next advances the iterator to the next edge, returning false when there are no more
+// edges or an edge could not be read.
+func (it *EdgeIterator) Next() bool {
+    if it.follow != nil && it.err == nil && (it.edge != nil || len(it.ids.ids) > 0) {
+        if it.g.edgeStore != it.store || it.store.mods != it.mods {
+            it.err = dataError(edgeChainModified, &ModificationError{it.vertex}, nil)
+        } else if it.edge != nil {
+            it.ids.push(it.follow(it.edge))
+        }
+    }
+    for it.err == nil {
+        id := it.ids.next()
+        if id == 0 {
+            break
+        }
+        if it.edge, it.err = it.g.edgeStore.Find(id); it.edge != nil {
+            return true
+        }
+    }
+    it.edge = nil
+    return false
+}
+
+// Edge returns the current edge.
+func (it *EdgeIterator) Edge() *Edge {
+    return it.edge
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *EdgeIterator) Err() *DataError {
+    return it.err
+}
@@ -29,39 +29,37 @@ type Label struct {
 
 // Creates an existing label from byte data.
 // Panics if the length of the bytes does not match labelDataSize.
-// Returns an error of type *DataError if there is a conversion error.
-func constructLabel (id uint16, bytes []byte) (*Label, *DataError) {
+// The label does not keep a reference to the slice, so the caller may reuse it.
+func constructLabel (id uint16, bytes []byte) *Label {
     Assert(labelWrongDataSize, len(bytes) == labelDataSize)
     
-    var e error
-    
     l := new(Label)
     l.Id = id
+    l.decode(bytes)
     
-    val := bytes[0:8]
-    refs := bytes[8:16]
-    left := bytes[16:18]
-    right := bytes[18:20]
-    height := bytes[20]
-    
+    return l
+}
 
-    l.value, e = util.BytesToUint64(val)
-    if e != nil {
-        return nil, dataError(labelCreationFailure, e, nil)
-    }
-    l.refs, e = util.BytesToUint64(refs) 
-    if e != nil {
-        return nil, dataError(labelCreationFailure, e, nil)
-    }
-    if l.l, e = util.BytesToUint16(left); e != nil {
-        return nil, dataError(labelCreationFailure, e, nil)
-    }
-    if l.r, e = util.BytesToUint16(right); e != nil {
-        return nil, dataError(labelCreationFailure, e, nil)
-    }
-    l.h = height
+// Reads the stored fields of the label from b.
+func (l *Label) decode(b []byte) {
+    _ = b[labelDataSize - 1] // bounds check once for the whole record
+    l.value = util.Uint64(b[0:8])
+    l.refs = util.Uint64(b[8:16])
+    l.l = util.Uint16(b[16:18])
+    l.r = util.Uint16(b[18:20])
+    l.h = b[20]
+}
+
+// Encodes the label for storage into b, which must be at least labelDataSize bytes long.
+func (l *Label) encode(b []byte) {
+    Assert(nilLabel, l != nil)
     
-    return l, nil
+    _ = b[labelDataSize - 1]
+    util.PutUint64(b[0:8], l.value)
+    util.PutUint64(b[8:16], l.refs)
+    util.PutUint16(b[16:18], l.l)
+    util.PutUint16(b[18:20], l.r)
+    b[20] = l.h
 }
 
 // Responsible for creating a new label.
@@ -91,16 +89,9 @@ func (l *Label) Value(g *Graph) string {
 
 // Returns the byte representation of the label for storage.
 func (l *Label) data() []byte {
-    Assert(nilLabel, l != nil)
-    
-    bytes, _ := util.Uint64ToBytes(l.value)
-    refs, _ := util.Uint64ToBytes(l.refs)
-    left, _ := util.Uint16ToBytes(l.l)
-    right, _ := util.Uint16ToBytes(l.r)
-    
-    bytes = append(bytes, append(refs, append(left, append(right, l.h)...)...)...) // TODO ??
+    bytes := make([]byte, labelDataSize)
+    l.encode(bytes)
     return bytes
-    
 }
 
 // Returns the height of a label for binary search operations.
@@ -230,7 +221,7 @@ func (currentLabel *Label) removeNode(removeLabel *Label, g *Graph) uint16 {
         } else {
             // get the left most node of the right branch
             lLabel := cr.leftmostNode(g)
-            lLabel.r = cl.removeNode(lLabel, g)
+            lLabel.r = cr.removeNode(lLabel, g)
             lLabel.l = currentLabel.l
             g.labelStore.writes[lLabel.Id] = lLabel
             return lLabel.balance(g)
@@ -350,6 +341,30 @@ func (l *Label) rotateLeft(g *Graph) uint16 {
     return right.Id
 }
 
+// Recursive function that visits a label and its descendents in order of value.
+// Returns false if fn stopped the iteration, or an error of type *DataError if a
+// descendent can not be read.
+func (l *Label) walk(fn func(l *Label) bool, g *Graph) (bool, *DataError) {
+    if l == nil {
+        return true, nil
+    }
+    left, err := l.left(g)
+    if err != nil {
+        return false, err
+    }
+    if more, err := left.walk(fn, g); !more || err != nil {
+        return false, err
+    }
+    if !fn(l) {
+        return false, nil
+    }
+    right, err := l.right(g)
+    if err != nil {
+        return false, err
+    }
+    return right.walk(fn, g)
+}
+
 // Recursive function that returns the leftmost node of a label
 func (l *Label) leftmostNode(g *Graph) *Label {
     left, _ := l.left(g) // TODO do not ignore error
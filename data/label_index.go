@@ -0,0 +1,325 @@
+package data
+
+import (
+    "os"
+    "io"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilLabelIndex = "attempt to operate on a nil label index"
+    nilLabelIndexFile = "attempt to operate on a nil label index file"
+    nilLabelIndexWriteMap = "attempt to operate on a nil label index write map"
+    zeroLabelIndexId = "attempt to index a label with an id of 0"
+    labelIndexReadFail = "could not read label index: "
+    labelIndexWriteFail = "could not write label index: "
+)
+
+const (
+    labelIndexHeaderSize = 12       // capacity (4) + count (4) + used (4), following the file header
+    labelIndexSlotSize = 6          // hash (4) + label id (2)
+    labelIndexMinCapacity = 64      // the number of slots in a new index
+    labelIndexTombstone = 0xffffffff // the hash of a slot whose label was removed
+)
+
+// A slot in the label index's hash table.
+// A slot with an id of 0 is empty, unless it has the tombstone hash, in which case
+// it used to hold a label and probing must continue past it.
+type labelIndexSlot struct {
+    hash uint32
+    id uint16
+}
+
+// The label index is a persistent hash table from label value to label id.
+// It lets the label store find a label with a single probe in the common case
+// instead of walking the avl tree, which is kept for ordered iteration.
+// Slots hold the hash of the value along with the id, so a probe only reads the
+// label and its text when the hashes match.
+type labelIndex struct {
+    file *os.File
+    capacity uint32 // the number of slots in the table
+    count uint32    // the number of labels in the table
+    used uint32     // the number of slots that are not empty, including tombstones
+    writes map[uint32]labelIndexSlot // slots that have changed since the last write
+    rebuilt bool    // the table was rebuilt since the last write, so the slots in the file are stale
+    buf []byte
+}
+
+// Creates an existing label index.
+// Returns an error of type *DataError if the file can not be opened.
+func constructLabelIndex(fileName string) (*labelIndex, *DataError) {
+    i := new(labelIndex)
+
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for label index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if _, de := checkFileHeader(i.file, labelIndexFile); de != nil {
+        return nil, de
+    }
+
+    i.writes = make(map[uint32]labelIndexSlot)
+    i.buf = make([]byte, labelIndexHeaderSize)
+    if de := i.readHeader(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates a label index that does not yet exist.
+// Returns an error of type *DataError if the file can not be created.
+func createLabelIndex(fileName string) (*labelIndex, *DataError) {
+    i := new(labelIndex)
+
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for label index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if de := writeFileHeader(i.file, labelIndexFile, 0); de != nil {
+        return nil, de
+    }
+
+    i.writes = make(map[uint32]labelIndexSlot)
+    i.buf = make([]byte, labelIndexHeaderSize)
+    i.capacity = labelIndexMinCapacity
+    if de := i.writeHeader(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Hashes a label value for the index using 32 bit FNV-1a.
+func hashLabel(value string) uint32 {
+    hash := uint32(2166136261)
+    for c := 0; c < len(value); c++ {
+        hash ^= uint32(value[c])
+        hash *= 16777619
+    }
+    if hash == labelIndexTombstone {
+        hash-- // keep the tombstone hash for removed slots
+    }
+    return hash
+}
+
+// Internal method used by the index to read its header.
+func (i *labelIndex) readHeader() *DataError {
+    Assert(nilLabelIndex, i != nil)
+    Assert(nilLabelIndexFile, i.file != nil)
+
+    b := i.buf[:labelIndexHeaderSize]
+    if _, e := i.file.ReadAt(b, int64(fileHeaderSize)); e != nil && e != io.EOF {
+        return dataError(labelIndexReadFail + i.file.Name(), e, nil)
+    }
+    i.capacity = util.Uint32(b[0:4])
+    i.count = util.Uint32(b[4:8])
+    i.used = util.Uint32(b[8:12])
+    if i.capacity == 0 {
+        i.capacity = labelIndexMinCapacity
+    }
+    return nil
+}
+
+// Internal method used by the index to write its header.
+func (i *labelIndex) writeHeader() *DataError {
+    Assert(nilLabelIndex, i != nil)
+    Assert(nilLabelIndexFile, i.file != nil)
+
+    b := i.buf[:labelIndexHeaderSize]
+    util.PutUint32(b[0:4], i.capacity)
+    util.PutUint32(b[4:8], i.count)
+    util.PutUint32(b[8:12], i.used)
+    if _, e := i.file.WriteAt(b, int64(fileHeaderSize)); e != nil {
+        return dataError(labelIndexWriteFail + i.file.Name(), e, nil)
+    }
+    return nil
+}
+
+// Returns the slot at a position in the table.
+// Slots that have not changed since the last write are read from the file.
+// Returns an error of type *DataError if the slot can not be read.
+func (i *labelIndex) slot(pos uint32) (labelIndexSlot, *DataError) {
+    Assert(nilLabelIndexWriteMap, i.writes != nil)
+
+    if s, ok := i.writes[pos]; ok {
+        return s, nil
+    }
+    if i.rebuilt {
+        return labelIndexSlot{}, nil   // the table in the file has a different capacity
+    }
+
+    b := i.buf[:labelIndexSlotSize]
+    readAt := int64(fileHeaderSize + labelIndexHeaderSize) + int64(pos) * labelIndexSlotSize
+    c, e := i.file.ReadAt(b, readAt)
+    if e != nil && e != io.EOF {
+        return labelIndexSlot{}, dataError(labelIndexReadFail + i.file.Name(), e, nil)
+    }
+    if c != labelIndexSlotSize {
+        return labelIndexSlot{}, nil   // slots past the end of the file are empty
+    }
+    return labelIndexSlot{util.Uint32(b[0:4]), util.Uint16(b[4:6])}, nil
+}
+
+// Searches the index for a value with the given hash.
+// The match function is called with the id of every label whose hash matches and
+// should return true if the label actually has the value being searched for.
+// Returns the id of the matching label, or 0 if there is none.
+// Returns an error of type *DataError if a slot can not be read.
+func (i *labelIndex) find(hash uint32, match func(id uint16) bool) (uint16, *DataError) {
+    Assert(nilLabelIndex, i != nil)
+
+    pos := hash % i.capacity
+    for n := uint32(0); n < i.capacity; n++ {
+        s, err := i.slot(pos)
+        if err != nil {
+            return 0, err
+        }
+        if s.id == 0 && s.hash != labelIndexTombstone {
+            return 0, nil // reached an empty slot, so the value is not in the index
+        }
+        if s.id != 0 && s.hash == hash && match(s.id) {
+            return s.id, nil
+        }
+        pos = (pos + 1) % i.capacity
+    }
+    return 0, nil
+}
+
+// Adds a label to the index.
+// Returns an error of type *DataError if a slot can not be read.
+func (i *labelIndex) add(hash uint32, id uint16) *DataError {
+    Assert(nilLabelIndex, i != nil)
+    Assert(zeroLabelIndexId, id != 0)
+
+    // keep the table at most three quarters full so probes stay short
+    if (i.used + 1) * 4 > i.capacity * 3 {
+        if err := i.grow(); err != nil {
+            return err
+        }
+    }
+
+    pos := hash % i.capacity
+    for {
+        s, err := i.slot(pos)
+        if err != nil {
+            return err
+        }
+        if s.id == 0 {
+            if s.hash != labelIndexTombstone {
+                i.used++
+            }
+            i.writes[pos] = labelIndexSlot{hash, id}
+            i.count++
+            return nil
+        }
+        pos = (pos + 1) % i.capacity
+    }
+}
+
+// Removes a label from the index.
+// Returns an error of type *DataError if a slot can not be read.
+func (i *labelIndex) remove(hash uint32, id uint16) *DataError {
+    Assert(nilLabelIndex, i != nil)
+
+    pos := hash % i.capacity
+    for n := uint32(0); n < i.capacity; n++ {
+        s, err := i.slot(pos)
+        if err != nil {
+            return err
+        }
+        if s.id == 0 && s.hash != labelIndexTombstone {
+            return nil // not in the index
+        }
+        if s.id == id {
+            i.writes[pos] = labelIndexSlot{labelIndexTombstone, 0}
+            i.count--
+            return nil
+        }
+        pos = (pos + 1) % i.capacity
+    }
+    return nil
+}
+
+// Rebuilds the table, doubling its capacity unless most of the used slots are tombstones.
+// The new table is kept in memory and replaces the one in the file when the index is written.
+// Returns an error of type *DataError if a slot can not be read, leaving the table as it was.
+func (i *labelIndex) grow() *DataError {
+    Assert(nilLabelIndex, i != nil)
+
+    slots := make([]labelIndexSlot, 0, i.count)
+    for pos := uint32(0); pos < i.capacity; pos++ {
+        s, err := i.slot(pos)
+        if err != nil {
+            return err
+        }
+        if s.id != 0 {
+            slots = append(slots, s)
+        }
+    }
+
+    if i.count * 2 > i.used {
+        i.capacity *= 2
+    }
+    i.count = 0
+    i.used = 0
+    i.writes = make(map[uint32]labelIndexSlot)
+    i.rebuilt = true
+
+    for _, s := range slots {
+        if err := i.add(s.hash, s.id); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Writes the changed slots and the header to the file.
+// A table that was rebuilt is written in full, replacing the old one.
+// Returns an error of type *DataError if the index can not be written.
+func (i *labelIndex) write() *DataError {
+    Assert(nilLabelIndex, i != nil)
+    Assert(nilLabelIndexFile, i.file != nil)
+
+    if i.rebuilt {
+        b := make([]byte, int(i.capacity) * labelIndexSlotSize)
+        for pos, s := range i.writes {
+            util.PutUint32(b[pos * labelIndexSlotSize:], s.hash)
+            util.PutUint16(b[pos * labelIndexSlotSize + 4:], s.id)
+        }
+        if e := i.file.Truncate(int64(fileHeaderSize + labelIndexHeaderSize)); e != nil {
+            return dataError(labelIndexWriteFail + i.file.Name(), e, nil)
+        }
+        if _, e := i.file.WriteAt(b, int64(fileHeaderSize + labelIndexHeaderSize)); e != nil {
+            return dataError(labelIndexWriteFail + i.file.Name(), e, nil)
+        }
+    } else {
+        b := make([]byte, labelIndexSlotSize)
+        for pos, s := range i.writes {
+            util.PutUint32(b[0:4], s.hash)
+            util.PutUint16(b[4:6], s.id)
+            writeAt := int64(fileHeaderSize + labelIndexHeaderSize) + int64(pos) * labelIndexSlotSize
+            if _, e := i.file.WriteAt(b, writeAt); e != nil {
+                return dataError(labelIndexWriteFail + i.file.Name(), e, nil)
+            }
+        }
+    }
+    if err := i.writeHeader(); err != nil {
+        return err
+    }
+
+    i.writes = make(map[uint32]labelIndexSlot)
+    i.rebuilt = false
+    return nil
+}
+
+// Cleans up the file for the index.
+func (i *labelIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
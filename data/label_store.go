@@ -2,8 +2,6 @@ package data
 
 import (
     "os"
-    "io"
-
     "github.com/wardlem/graphlite/util"
 )
 
@@ -17,12 +15,16 @@ const (
 )
 
 const labelStoreHeaderSize = 2 // The number of bytes the label store uses for storing information
+                               // this follows the file header
 
 // The label store is responsible for the management of all text labels in a graph.
 type labelStore struct {
     file *os.File
+    records *recordFile
+    index *labelIndex   // finds labels by value
     idStore *uint16IdStore
     writes map[uint16]*Label
+    names map[uint16]string // the values of labels that have been looked up by name()
     root uint16
 }
 
@@ -42,6 +44,11 @@ func constructLabelStore(g *Graph) (*labelStore, *DataError){
     } else {
         s.file = file;
     }
+    if h, de := checkFileHeader(s.file, labelFile); de != nil {
+        return nil, de
+    } else {
+        s.records = newRecordFile(s.file, "label", fileHeaderSize + labelStoreHeaderSize, labelDataSize, h.flags)
+    }
 
     // construct the id store for the label store
     fileName = g.storePath("label.id")    
@@ -51,8 +58,16 @@ func constructLabelStore(g *Graph) (*labelStore, *DataError){
     }
     s.idStore = idStore
     
+    // open the index used to find labels by value
+    if index, de := constructLabelIndex(g.storePath("label.hash")); de != nil {
+        return nil, de
+    } else {
+        s.index = index
+    }
+    
     // initialize the write map
     s.writes = make(map[uint16]*Label)
+    s.names = make(map[uint16]string)
     
     // retrieve any additional necessary information from the file
     s.readHeader()
@@ -76,6 +91,11 @@ func createLabelStore(g *Graph) (*labelStore, *DataError){
     } else {
         s.file = file;
     }
+    flags := g.recordFlags()
+    if de := writeFileHeader(s.file, labelFile, flags); de != nil {
+        return nil, de
+    }
+    s.records = newRecordFile(s.file, "label", fileHeaderSize + labelStoreHeaderSize, labelDataSize, flags)
 
     // create the id store for the label store
     fileName = g.storePath("label.id")
@@ -85,8 +105,16 @@ func createLabelStore(g *Graph) (*labelStore, *DataError){
         s.idStore = idStore
     }
     
+    // create the index used to find labels by value
+    if index, de := createLabelIndex(g.storePath("label.hash")); de != nil {
+        return nil, de
+    } else {
+        s.index = index
+    }
+    
     // initialize the write map
     s.writes = make(map[uint16]*Label)
+    s.names = make(map[uint16]string)
     
     // initialize any additional necessary values
     s.writeHeader()
@@ -94,7 +122,7 @@ func createLabelStore(g *Graph) (*labelStore, *DataError){
     return s, nil;
 }
 
-func (s *labelStore) write () {
+func (s *labelStore) write () *DataError {
     Assert(nilLabelStore, s != nil)
     Assert(nilLabelStoreFile, s.file != nil)
     Assert(nilLabelIdStore, s.idStore != nil)
@@ -102,16 +130,27 @@ func (s *labelStore) write () {
     
     // write values that need to be written
     for _, label := range s.writes {
-        data := label.data()
-        writeAt := int64(labelStoreHeaderSize + (label.Id - 1) * labelDataSize)
-        s.file.WriteAt(data, writeAt)
+        if err := s.records.write(uint64(label.Id), label); err != nil {
+            return err
+        }
     }
     
     // write the header
-    s.writeHeader()
+    if err := s.writeHeader(); err != nil {
+        return err
+    }
+    
+    // write the index
+    if err := s.index.write(); err != nil {
+        return err
+    }
+    if err := s.idStore.write(); err != nil {
+        return err
+    }
     
     // reset the write map
     s.writes = make(map[uint16]*Label)
+    return nil
 }
 
 // Internal method used by the label store to read its header.
@@ -120,21 +159,25 @@ func (s *labelStore) readHeader () {
     Assert (nilLabelStoreFile, s.file != nil)
     
     // Read the root id for the tree
-    readAt := int64(0)
+    readAt := int64(fileHeaderSize)
     root := make([]byte, 2)
     _, _ = s.file.ReadAt(root, readAt) // TODO don't ignore this error
     s.root, _ = util.BytesToUint16(root) // TODO don't ignore this error
 }
 
 // Internal method used by the label store to write its header.
-func (s *labelStore) writeHeader () {
+func (s *labelStore) writeHeader () *DataError {
     Assert (nilLabelStore, s != nil)
     Assert (nilLabelStoreFile, s.file != nil)
     
     // Write the root id for the tree
-    writeAt := int64(0)
-    bytes, _ := util.Uint16ToBytes(s.root) // TODO don't ignore this error
-    _, _ = s.file.WriteAt(bytes, writeAt) // TODO don't ignore this error
+    writeAt := int64(fileHeaderSize)
+    bytes := make([]byte, 2)
+    util.PutUint16(bytes, s.root)
+    if _, e := s.file.WriteAt(bytes, writeAt); e != nil {
+        return dataError("Could not write file for label store: " + s.file.Name() + ".", e, nil)
+    }
+    return nil
 }
 
 // Retrieves a label by id from the label store.
@@ -157,13 +200,13 @@ func (s *labelStore) find(id uint16) (*Label, *DataError) {
     // TODO implement internal caching of labels or read every time?
     
     // read the label from the file and return it
-    readAt := int64(labelStoreHeaderSize + (id - 1) * labelDataSize)
-    bytes := make([]byte, labelDataSize)
-    c, e := s.file.ReadAt(bytes, readAt)
-    if (e != nil && e != io.EOF) || c != labelDataSize {
-        return nil, dataError("could not find label", e, nil)
+    bytes, err := s.records.read(uint64(id))
+    if err != nil {
+        return nil, err
+    } else if bytes == nil {
+        return nil, dataError("could not find label", nil, nil)
     }
-    return constructLabel(id, bytes)
+    return constructLabel(id, bytes), nil
 }
 
 // Internal function used to bypass zero id error for label lookup.
@@ -178,57 +221,91 @@ func (s *labelStore) findAllowZero(id uint16) (*Label, *DataError) {
 
 // Performs a search for the label.
 // Returns the label if it is found, or nil if it is not found.
+// Returns an error of type *DataError if a label the hash index points to can not be
+// read, since the value being searched for may be that label's.
 // Parameter value is the value searched for.
 // Parameter g is the graph the label store belongs to.
-func (s *labelStore) findByValue(value string, g *Graph) *Label {
+func (s *labelStore) findByValue(value string, g *Graph) (*Label, *DataError) {
     Assert(nilLabelStore, s != nil)
     Assert(nilLabelStoreFile, s.file != nil)
     Assert(nilGraph, g != nil)
     
-    root, _ := s.findAllowZero(s.root) // TODO don't ignore this error
-    
-    // Search for the label using binary search
-    for root != nil {
-        rootVal := root.Value(g)
-        if rootVal == value {
-            return root     // this is the label we are looking for
-        } else if rootVal < value {  // the exact method of comparison does not matter, so long
-                                     // as it is consistent and deterministic
-            root, _ = root.right(g) // go right on the tree
-                                    // TODO do not ignore error
-        } else {
-            root, _ = root.left(g) // go left on the tree
-                                    // TODO do not ignore error
+    // Look the label up in the hash index, confirming the value of any label with
+    // a matching hash
+    var found *Label
+    var err *DataError
+    _, ierr := s.index.find(hashLabel(value), func(id uint16) bool {
+        var l *Label
+        if l, err = s.find(id); err != nil {
+            return true
         }
+        if l.Value(g) == value {
+            found = l
+            return true
+        }
+        return false
+    })
+    if ierr != nil {
+        return nil, ierr
+    } else if err != nil {
+        return nil, err
     }
     
-    // TODO create index and retrieve that way
-    return nil  // the value was not found
-                // TODO return a new label if the label wasn't found?
+    return found, nil   // nil if the value was not found
+}
+
+// Calls fn for every label in the store, in order of value.
+// Iteration stops early if fn returns false.
+// Returns an error of type *DataError if a label can not be read.
+func (s *labelStore) each(fn func(l *Label) bool, g *Graph) *DataError {
+    Assert(nilLabelStore, s != nil)
+    Assert(nilGraph, g != nil)
+    
+    root, err := s.findAllowZero(s.root)
+    if err != nil {
+        return err
+    }
+    _, err = root.walk(fn, g)
+    return err
 }
 
 // Adds a label to the store by string value.
 // Actually increments the refs value of the label if it already exists,
 // or creates it if it does not exist.
-// Returns the id of the label.
-func (s *labelStore) addLabel(value string, g *Graph) uint16 {
+// Returns the id of the label, or an error of type *DataError if the existing labels
+// can not be read.
+func (s *labelStore) addLabel(value string, g *Graph) (uint16, *DataError) {
     Assert(nilLabelStore, s != nil)
     Assert(nilLabelWriteMap, s.writes != nil)
     Assert(nilLabelIdStore, s.idStore != nil)
     
     // search for an existing label
-    l := s.findByValue(value, g);
+    l, err := s.findByValue(value, g)
+    if err != nil {
+        return 0, err
+    }
     
     if l == nil {
+        // find the root before anything changes, so a failure leaves the store alone
+        root, err := s.findAllowZero(s.root)
+        if err != nil {
+            return 0, err
+        }
+        
         // create a new label
         l = newLabel(value, g)
         l.Id = s.idStore.nextId()
         
+        // index the label by value
+        if err := s.index.add(hashLabel(value), l.Id); err != nil {
+            s.idStore.addId(l.Id)
+            return 0, err
+        }
+        
         // make sure we remember to write the label
         s.writes[l.Id] = l
         
         // restructure the tree
-        root, _ := s.findAllowZero(s.root) // TODO don't ignore this error
         s.root = root.addNode(l, g)
     } else {
         // make sure we remember to write the label
@@ -240,38 +317,70 @@ func (s *labelStore) addLabel(value string, g *Graph) uint16 {
     
     
     
-    return l.Id
+    return l.Id, nil
 }
 
-func (s *labelStore) removeLabel(value string, g *Graph) {
+// Removes a reference to a label by string value, deleting the label once nothing
+// refers to it.
+// Returns an error of type *DataError if the label can not be read.
+func (s *labelStore) removeLabel(value string, g *Graph) *DataError {
     Assert(nilLabelStore, s != nil)
     Assert(nilLabelIdStore, s.idStore != nil)
     Assert(nilGraph, g != nil)
     Assert(nilLabelWriteMap, s.writes != nil)
     
-    l := s.findByValue(value, g)
+    l, err := s.findByValue(value, g)
+    if err != nil {
+        return err
+    }
     if (l != nil && l.Id != 0) {
         l.refs -= uint64(1);
         if l.refs <= uint64(0) {    // no more references
-            s.deleteLabel(l, g)
+            if err := s.deleteLabel(l, g); err != nil {
+                l.refs += 1
+                return err
+            }
         }
         s.writes[l.Id] = l
     }
-    
+    return nil
+}
+
+// Returns the value of a label, or an empty string if there is no label with the id.
+// Values are cached, so looking up the same label again does not read the graph.
+func (s *labelStore) name(id uint16, g *Graph) string {
+    Assert(nilLabelStore, s != nil)
+
+    if value, ok := s.names[id]; ok {
+        return value
+    }
+    l, _ := s.findAllowZero(id)
+    if l == nil {
+        return ""
+    }
+    s.names[id] = l.Value(g)
+    return s.names[id]
 }
 
 // Internal function to make sure a label is deleted properly.
-func (s *labelStore) deleteLabel(l *Label, g *Graph) {
+// Returns an error of type *DataError if the label can not be removed from the index.
+func (s *labelStore) deleteLabel(l *Label, g *Graph) *DataError {
     Assert(nilLabelStore, s != nil)
     Assert(nilLabelIdStore, s.idStore != nil)
     Assert(nilGraph, g != nil)
     Assert(nilTextStore, g.textStore != nil)
     
     if (l.Id == 0){  // TODO should this be an error?
-        return
+        return nil
+    }
+    
+    // remove it from the index first, so a failure leaves the store alone
+    if err := s.index.remove(hashLabel(l.Value(g)), l.Id); err != nil {
+        return err
     }
     
     s.idStore.addId(l.Id)
+    delete(s.names, l.Id)
     root, _ := s.find(s.root) // TODO do not ignore error
     
     // remove it from the tree
@@ -280,7 +389,7 @@ func (s *labelStore) deleteLabel(l *Label, g *Graph) {
     // let the text store get rid of the text
     t, _ := g.textStore.find(l.value)   // TODO safe to ignore?
     g.textStore.removeText(t)
-
+    return nil
 }
 
 // Shuts the label store down, making sure all files are closed.
@@ -289,6 +398,9 @@ func (s *labelStore) shutdown () {
         if (s.idStore != nil){
             s.idStore.shutdown()
         }
+        if (s.index != nil){
+            s.index.shutdown()
+        }
         if (s.file != nil){
             _ = s.file.Close()
         }
@@ -20,6 +20,9 @@ func createListStore(g *Graph) (*listStore, *DataError){
 }
 
 func (store *listStore) shutdown () {
+    if (store == nil){
+        return
+    }
     if (store.idStore != nil){
         store.idStore.shutdown()
     }
@@ -20,6 +20,9 @@ func createMapStore(g *Graph) (*mapStore, *DataError){
 }
 
 func (store *mapStore) shutdown () {
+    if (store == nil){
+        return
+    }
     if (store.idStore != nil){
         store.idStore.shutdown()
     }
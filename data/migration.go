@@ -0,0 +1,434 @@
+package data
+
+import (
+    "os"
+    "io"
+    "io/ioutil"
+    "strconv"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    graphVersionReadFail = "could not read the format version of graph: "
+    graphVersionWriteFail = "could not write the format version of graph: "
+    migrationFail = "failed to migrate graph to format version "
+    migrationFileFail = "could not migrate file: "
+)
+
+// A migration upgrades the files of a graph from the previous format version to its version.
+// Migrations are run in order when a graph with an older format version is opened.
+// Migrations read the graph with the readers in migration_readers.go, which decode each
+// store as it was laid out at the version being migrated from, and create new files with
+// the constructors of the current version. TestBaselineMigration runs every migration
+// against a graph from before versioning in testdata/baseline.
+type migration struct {
+    version uint16                  // the format version the migration upgrades a graph to
+    description string              // a short description of what the migration changes
+    migrate func(g *Graph) *DataError
+}
+
+var migrations = []migration{
+    {1, "add a file header to every store and index file", addFileHeaders},
+    {2, "add a hash index for finding labels by value", addLabelIndex},
+    {3, "add the attribute index catalog, index directory, and edge store", addIndexStore},
+    {4, "add an index of edges by label", addEdgeLabelIndex},
+    {5, "add the class schema store", addSchemaStore},
+    {6, "store class id indexes as compressed bitmaps", compressClassIdIndexes},
+    {7, "add the graph statistics store and count the vertices of each class", addStatsStore},
+}
+
+// The kinds of the store files that make up a graph, keyed by store name.
+var storeFileKinds = map[string]byte{
+    "text": textFile,
+    "text.id": textIdFile,
+    "label": labelFile,
+    "label.id": uint16IdFile,
+    "class": classFile,
+    "vertex": vertexFile,
+    "vertex.id": uint32IdFile,
+    "edge": edgeFile,
+    "edge.id": uint32IdFile,
+    "attribute": attributeFile,
+    "attribute.id": uint32IdFile,
+}
+
+// Returns the path of the file that records the format version of the graph.
+func (g *Graph) metaPath() string {
+    return g.storePath("graph")
+}
+
+// Reads the format version of a graph.
+// Graphs created before versioning have no meta file and are reported as version 0.
+func readGraphVersion(g *Graph) (uint16, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    fileName := g.metaPath()
+    file, e := os.OpenFile(fileName, os.O_RDONLY, 0777)
+    if os.IsNotExist(e) {
+        return uint16(0), nil
+    } else if e != nil {
+        return uint16(0), dataError(graphVersionReadFail + g.Path(), e, nil)
+    }
+    defer file.Close()
+
+    h, err := readFileHeader(file)
+    if err != nil {
+        return uint16(0), dataError(graphVersionReadFail + g.Path(), nil, err)
+    }
+    if h.kind != metaFile {
+        return uint16(0), dataError(wrongFileKind + fileName, nil, nil)
+    }
+    return h.version, nil
+}
+
+// Records the format version of a graph in its meta file.
+func writeGraphVersion(g *Graph, version uint16) *DataError {
+    Assert(nilGraph, g != nil)
+
+    file, e := os.OpenFile(g.metaPath(), os.O_RDWR | os.O_CREATE, 0777)
+    if e != nil {
+        return dataError(graphVersionWriteFail + g.Path(), e, nil)
+    }
+    defer file.Close()
+
+    h := fileHeader{version, metaFile, 0}
+    return h.write(file)
+}
+
+// Brings the files of a graph up to the current format version.
+// Returns an error of type *DataError if the graph was written by a newer version of
+// graphlite or if any migration fails.
+// The recorded version is updated after each successful migration so an interrupted
+// upgrade resumes where it left off.
+func migrateGraph(g *Graph) *DataError {
+    Assert(nilGraph, g != nil)
+
+    version, err := readGraphVersion(g)
+    if err != nil {
+        return err
+    }
+    if version > FormatVersion {
+        return dataError(versionError(version) + ": " + g.Path(), nil, nil)
+    }
+
+    for _, m := range migrations {
+        if m.version <= version {
+            continue
+        }
+        if err = m.migrate(g); err != nil {
+            return dataError(migrationFail + strconv.Itoa(int(m.version)) + " (" + m.description + ").", nil, err)
+        }
+        if err = writeGraphVersion(g, m.version); err != nil {
+            return err
+        }
+        version = m.version
+    }
+
+    return nil
+}
+
+// Layouts that changed along with the file headers, by store name.
+// Each converts the contents of a headerless file to format version 1.
+var unversionedLayouts = map[string]func(bytes []byte) []byte{
+    "class": spreadClasses,
+}
+
+// Migration to version 1.
+// Prepends a file header to every store file and class id index of the graph, and
+// repairs what graphs without a format version were written with.
+func addFileHeaders(g *Graph) *DataError {
+    for name, kind := range storeFileKinds {
+        if err := prependFileHeader(g.storePath(name), kind, unversionedLayouts[name]); err != nil {
+            return err
+        }
+    }
+    if err := recountLabelIds(g); err != nil {
+        return err
+    }
+
+    indexDir := g.Path() + string(os.PathSeparator) + "idx"
+    infos, e := ioutil.ReadDir(indexDir)
+    if e != nil && !os.IsNotExist(e) {
+        return dataError(migrationFileFail + indexDir, e, nil)
+    }
+    for _, info := range infos {
+        if info.IsDir() {
+            continue
+        }
+        fileName := indexDir + string(os.PathSeparator) + info.Name()
+        if err := prependFileHeader(fileName, classIdIndexFile, nil); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Rewrites a headerless file with a header for format version 1 in front of its contents,
+// converting the contents first if convert is not nil.
+// Missing files and files that already have a header are left alone.
+func prependFileHeader(fileName string, kind byte, convert func([]byte) []byte) *DataError {
+    bytes, e := ioutil.ReadFile(fileName)
+    if os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return dataError(migrationFileFail + fileName, e, nil)
+    }
+    if len(bytes) >= fileHeaderSize && string(bytes[0:4]) == fileMagic {
+        return nil
+    }
+
+    if convert != nil {
+        bytes = convert(bytes)
+    }
+    h := fileHeader{uint16(1), kind, 0}
+    tmpName := fileName + ".migrate"
+    if e = ioutil.WriteFile(tmpName, append(h.data(), bytes...), 0777); e != nil {
+        return dataError(migrationFileFail + fileName, e, nil)
+    }
+    if e = os.Rename(tmpName, fileName); e != nil {
+        return dataError(migrationFileFail + fileName, e, nil)
+    }
+    return nil
+}
+
+// Spreads out classes written before format version 1, which were written 8 bytes apart
+// although each takes 9, so every class but the last lost its last byte, the id of its
+// next sibling, to the class after it.
+// Classes were linked to their super class newest first when they were added, so the
+// siblings are linked again in that order.
+func spreadClasses(bytes []byte) []byte {
+    if len(bytes) == 0 {
+        return bytes
+    }
+    const oldSize = 8
+    count := (len(bytes) - 1) / oldSize
+    spread := make([]byte, count * classDataSize)
+    newest := make(map[byte]byte) // the newest sub class of each super class so far
+    for n := 0; n < count; n++ {
+        class := spread[n * classDataSize : (n + 1) * classDataSize]
+        copy(class, bytes[n * oldSize : n * oldSize + oldSize])
+        id, super := byte(n + 1), class[6]
+        if super != 0 {
+            class[8] = newest[super]
+            newest[super] = id
+        }
+    }
+    return spread
+}
+
+// Makes sure the label id store does not hand out the ids of stored labels, which it
+// did for graphs without a format version, whose label id store was never written.
+func recountLabelIds(g *Graph) *DataError {
+    info, e := os.Stat(g.storePath("label"))
+    if os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return dataError(migrationFileFail + g.storePath("label"), e, nil)
+    }
+    ids, e := os.OpenFile(g.storePath("label.id"), os.O_RDWR, 0777)
+    if e != nil {
+        return dataError(migrationFileFail + g.storePath("label.id"), e, nil)
+    }
+    defer ids.Close()
+
+    count := (info.Size() - fileHeaderSize - labelStoreHeaderSizeV1) / labelDataSizeV1
+    bytes := make([]byte, 2)
+    if _, e = ids.ReadAt(bytes, fileHeaderSize); e != nil && e != io.EOF {
+        return dataError(migrationFileFail + ids.Name(), e, nil)
+    }
+    if count <= int64(util.Uint16(bytes)) {
+        return nil
+    }
+    util.PutUint16(bytes, uint16(count))
+    if _, e = ids.WriteAt(bytes, fileHeaderSize); e != nil {
+        return dataError(migrationFileFail + ids.Name(), e, nil)
+    }
+    return nil
+}
+
+// Migration to version 2.
+// Builds the hash index of the label store from the labels in its avl tree.
+func addLabelIndex(g *Graph) *DataError {
+    labels, err := readLabelsV1(g)
+    if err != nil {
+        return err
+    }
+
+    fileName := g.storePath("label.hash")
+    _ = os.Remove(fileName) // left behind by an interrupted migration
+    index, err := createLabelIndex(fileName)
+    if err != nil {
+        return err
+    }
+    defer index.shutdown()
+    for id, value := range labels {
+        if err := index.add(hashLabel(value), id); err != nil {
+            return err
+        }
+    }
+    return index.write()
+}
+
+// Migration to version 3.
+// Creates the index directory and the catalog of attribute indexes, along with the
+// edge store, which graphs used to be created without.
+func addIndexStore(g *Graph) *DataError {
+    if e := os.MkdirAll(g.indexDir(), 0777); e != nil {
+        return dataError(migrationFileFail + g.indexDir(), e, nil)
+    }
+
+    if _, e := os.Stat(g.storePath("index")); os.IsNotExist(e) {
+        s, err := createIndexStore(g)
+        if err != nil {
+            return err
+        }
+        s.shutdown()
+    }
+
+    if _, e := os.Stat(g.storePath("edge")); os.IsNotExist(e) {
+        _ = os.Remove(g.storePath("edge.id")) // useless without the edge file
+        s, err := createEdgeStore(g)
+        if err != nil {
+            return err
+        }
+        s.shutdown()
+    }
+
+    return nil
+}
+
+// Migration to version 4.
+// Builds the edge label index from the edges in the edge store.
+func addEdgeLabelIndex(g *Graph) *DataError {
+    edges, err := readEdgesV1(g)
+    if err != nil {
+        return err
+    }
+
+    fileName := g.storePath("edge.label")
+    _ = os.Remove(fileName) // left behind by an interrupted migration
+    index, err := createEdgeLabelIndex(fileName)
+    if err != nil {
+        return err
+    }
+    defer index.shutdown()
+    for id, e := range edges {
+        index.add(e.label, id)
+    }
+    return index.write()
+}
+
+// Migration to version 5.
+// Creates the store for class schemas, with every class lenient and without declarations.
+func addSchemaStore(g *Graph) *DataError {
+    if _, e := os.Stat(g.storePath("schema")); os.IsNotExist(e) {
+        s, err := createSchemaStore(g)
+        if err != nil {
+            return err
+        }
+        s.shutdown()
+    }
+    return nil
+}
+
+// Migration to version 6.
+// Rewrites the class id indexes, which used to be a list of ids, as compressed bitmaps.
+// The indexes are built again from the class of each vertex rather than from the lists,
+// since graphs without a format version had no index directory to write them to.
+func compressClassIdIndexes(g *Graph) *DataError {
+    labels, err := readLabelsV1(g)
+    if err != nil {
+        return err
+    }
+    classes, err := readClassesV1(g)
+    if err != nil {
+        return err
+    }
+
+    indexes := make([]*classIdIndex, len(classes))
+    for n, c := range classes {
+        name, ok := labels[c.label]
+        if !ok {
+            return dataError(migrationRecordCorrupted, &CorruptionError{"class", uint64(c.id)}, nil)
+        }
+        fileName := g.indexPath(name + ".idx")
+        _ = os.Remove(fileName)
+        if indexes[n], err = createClassIdIndex(fileName); err != nil {
+            return err
+        }
+        defer indexes[n].shutdown()
+    }
+
+    err = eachVertexV1(g, func(v vertexV1) *DataError {
+        if int(v.class) <= len(indexes) {
+            indexes[v.class - 1].addId(v.id)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, index := range indexes {
+        if err = index.write(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Migration to version 7.
+// Counts the vertices of each class, which used to be left at zero, and builds the
+// statistics store by counting the attributes and edges of the graph.
+func addStatsStore(g *Graph) *DataError {
+    classes, err := readClassesV1(g)
+    if err != nil {
+        return err
+    }
+    edges, err := readEdgesV1(g)
+    if err != nil {
+        return err
+    }
+    attributes, err := readRecordsV1(g, "attribute", attributeFile, fileHeaderSize, attributeDataSizeV1)
+    if err != nil {
+        return err
+    }
+
+    _ = os.Remove(g.storePath("stats")) // left behind by an interrupted migration
+    s, err := createStatsStore(g)
+    if err != nil {
+        return err
+    }
+    defer s.shutdown()
+
+    // a class counts the vertices in its class id index, which leaves out its sub classes
+    counts := make(map[uint8]uint32)
+    err = eachVertexV1(g, func(v vertexV1) *DataError {
+        counts[v.class]++
+        out, err := countChainV1(edges, v.out, func(e edgeV1) uint32 { return e.outNext })
+        if err != nil {
+            return err
+        }
+        in, err := countChainV1(edges, v.in, func(e edgeV1) uint32 { return e.inNext })
+        if err != nil {
+            return err
+        }
+        s.outDegreeChanged(0, out)
+        s.inDegreeChanged(0, in)
+        return eachAttributeLabelV1(attributes, v.firstAtt, s.keyAdded)
+    })
+    if err != nil {
+        return err
+    }
+    for _, e := range edges {
+        if err = eachAttributeLabelV1(attributes, e.firstAtt, s.keyAdded); err != nil {
+            return err
+        }
+    }
+    if err = writeClassCountsV1(g, classes, counts); err != nil {
+        return err
+    }
+    return s.write()
+}
@@ -0,0 +1,319 @@
+package data
+
+import (
+    "os"
+    "io/ioutil"
+    "hash/crc32"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    migrationRecordCorrupted = "record could not be read for a migration"
+)
+
+// Migrations read a graph through the readers in this file rather than through its stores,
+// which read the files as they are laid out by the current format version. Each reader
+// decodes a store as it was laid out from the version it is named for, and must not change
+// once that version has been released: a store whose layout changes gets a new reader,
+// for the migrations from the new version on.
+
+// Layouts from format version 1
+const (
+    labelStoreHeaderSizeV1 = 2  // the id of the root of the avl tree of labels
+    labelDataSizeV1 = 21        // text id (8) + refs (8) + left (2) + right (2) + height (1)
+    textRowSizeV1 = 16          // texts start on a row, with their length (4) before them
+    classDataSizeV1 = 9         // count (4) + label (2) + super (1) + sub (1) + next sub (1)
+    vertexDataSizeV1 = 13       // class (1) + first out (4) + first in (4) + first attribute (4)
+    edgeDataSizeV1 = 22         // label (2) + from (4) + to (4) + next out (4) + next in (4) + first attribute (4)
+    attributeDataSizeV1 = 15    // label (2) + type (1) + value (8) + next (4)
+)
+
+// The records of a store as they are laid out from version 1: the file header, the
+// header of the store, then a record for each id from 1, each followed by a crc32 of its
+// contents if the file header has the checksum flag.
+type recordsV1 struct {
+    name string
+    bytes []byte
+    offset int
+    dataSize int
+    size int // the size of a record in the file, with its checksum
+}
+
+// Reads the records of a store.
+// Returns an error of type *DataError if the file can not be opened or read, or is not
+// a file of the kind given.
+func readRecordsV1(g *Graph, store string, kind byte, offset int, dataSize int) (*recordsV1, *DataError) {
+    fileName := g.storePath(store)
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError(migrationFileFail + fileName, e, nil)
+    }
+    defer file.Close()
+    h, err := checkFileHeader(file, kind)
+    if err != nil {
+        return nil, err
+    }
+    bytes, e := ioutil.ReadFile(fileName)
+    if e != nil {
+        return nil, dataError(migrationFileFail + fileName, e, nil)
+    }
+
+    r := &recordsV1{store, bytes, offset, dataSize, dataSize}
+    if h.flags & checksumFlag != 0 {
+        r.size += checksumSize
+    }
+    return r, nil
+}
+
+// Returns the number of records in the file.
+func (r *recordsV1) count() uint32 {
+    if len(r.bytes) <= r.offset {
+        return 0
+    }
+    return uint32((len(r.bytes) - r.offset) / r.size)
+}
+
+// Returns the record with an id, or nil if it was never written.
+// Returns an error of type *DataError caused by a *CorruptionError if the record lies
+// past the end of the file or does not match its checksum.
+func (r *recordsV1) record(id uint32) ([]byte, *DataError) {
+    if id == 0 || id > r.count() {
+        return nil, dataError(migrationRecordCorrupted, &CorruptionError{r.name, uint64(id)}, nil)
+    }
+    pos := r.offset + int(id - 1) * r.size
+    b := r.bytes[pos : pos + r.size]
+    if isZero(b) {
+        return nil, nil
+    }
+    if r.size != r.dataSize && util.Uint32(b[r.dataSize:]) != crc32.ChecksumIEEE(b[:r.dataSize]) {
+        return nil, dataError(migrationRecordCorrupted, &CorruptionError{r.name, uint64(id)}, nil)
+    }
+    return b[:r.dataSize], nil
+}
+
+// Returns the values of the labels of a graph from version 1, by label id.
+// The labels are found by walking the avl tree of the label store, which holds every
+// label that has not been removed, and their values are read from the text store.
+// Returns an error of type *DataError if a store can not be read, or one caused by a
+// *CorruptionError if the tree or a text can not be decoded.
+func readLabelsV1(g *Graph) (map[uint16]string, *DataError) {
+    labels, err := readRecordsV1(g, "label", labelFile, fileHeaderSize + labelStoreHeaderSizeV1, labelDataSizeV1)
+    if err != nil {
+        return nil, err
+    }
+    texts, err := readRecordsV1(g, "text", textFile, fileHeaderSize, textRowSizeV1)
+    if err != nil {
+        return nil, err
+    }
+
+    values := make(map[uint16]string)
+    if len(labels.bytes) < fileHeaderSize + labelStoreHeaderSizeV1 {
+        return values, nil
+    }
+    var walk func(id uint16) *DataError
+    walk = func(id uint16) *DataError {
+        if id == 0 {
+            return nil
+        }
+        if _, ok := values[id]; ok {
+            // a label the tree has already reached
+            return dataError(migrationRecordCorrupted, &CorruptionError{labels.name, uint64(id)}, nil)
+        }
+        b, err := labels.record(uint32(id))
+        if err != nil {
+            return err
+        } else if b == nil {
+            return dataError(migrationRecordCorrupted, &CorruptionError{labels.name, uint64(id)}, nil)
+        }
+        left, right := util.Uint16(b[16:18]), util.Uint16(b[18:20])
+        value, ok := texts.text(util.Uint64(b[0:8]))
+        if !ok {
+            return dataError(migrationRecordCorrupted, &CorruptionError{texts.name, util.Uint64(b[0:8])}, nil)
+        }
+        values[id] = value
+        if err := walk(left); err != nil {
+            return err
+        }
+        return walk(right)
+    }
+    if err := walk(util.Uint16(labels.bytes[fileHeaderSize:])); err != nil {
+        return nil, err
+    }
+    return values, nil
+}
+
+// Returns the text that starts on a row of the text store, and false if it runs past
+// the end of the file.
+// Text files have no checksums, so the rows are read as they are.
+func (r *recordsV1) text(id uint64) (string, bool) {
+    if id == 0 || id > uint64(len(r.bytes)) {
+        return "", false
+    }
+    pos := uint64(r.offset) + (id - 1) * textRowSizeV1
+    if pos + 4 > uint64(len(r.bytes)) {
+        return "", false
+    }
+    end := pos + 4 + uint64(util.Uint32(r.bytes[pos:]))
+    if end > uint64(len(r.bytes)) {
+        return "", false
+    }
+    return string(r.bytes[pos + 4 : end]), true
+}
+
+// A class as it is stored from version 1.
+type classV1 struct {
+    id uint8
+    label uint16
+}
+
+// Returns the classes of a graph from version 1, in order of id.
+// The class store has no record checksums.
+// Returns an error of type *DataError if the store can not be read.
+func readClassesV1(g *Graph) ([]classV1, *DataError) {
+    fileName := g.storePath("class")
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError(migrationFileFail + fileName, e, nil)
+    }
+    defer file.Close()
+    if _, err := checkFileHeader(file, classFile); err != nil {
+        return nil, err
+    }
+    bytes, e := ioutil.ReadFile(fileName)
+    if e != nil {
+        return nil, dataError(migrationFileFail + fileName, e, nil)
+    }
+
+    classes := make([]classV1, 0)
+    for pos := fileHeaderSize; pos + classDataSizeV1 <= len(bytes); pos += classDataSizeV1 {
+        c := classV1{uint8(len(classes) + 1), util.Uint16(bytes[pos + 4:])}
+        classes = append(classes, c)
+    }
+    return classes, nil
+}
+
+// Sets the number of vertices of each class in the class store of a graph from version 1,
+// to its count by class id.
+// Returns an error of type *DataError if the store can not be written.
+func writeClassCountsV1(g *Graph, classes []classV1, counts map[uint8]uint32) *DataError {
+    fileName := g.storePath("class")
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return dataError(migrationFileFail + fileName, e, nil)
+    }
+    defer file.Close()
+    b := make([]byte, 4)
+    for _, c := range classes {
+        util.PutUint32(b, counts[c.id])
+        if _, e = file.WriteAt(b, int64(fileHeaderSize) + int64(c.id - 1) * classDataSizeV1); e != nil {
+            return dataError(migrationFileFail + fileName, e, nil)
+        }
+    }
+    return nil
+}
+
+// A vertex as it is stored from version 1.
+type vertexV1 struct {
+    id uint32
+    class uint8
+    out uint32
+    in uint32
+    firstAtt uint32
+}
+
+// Calls fn with each vertex of a graph from version 1 that has not been removed, in
+// order of id.
+// Returns an error of type *DataError if the store can not be read or a vertex is corrupted.
+func eachVertexV1(g *Graph, fn func(v vertexV1) *DataError) *DataError {
+    vertices, err := readRecordsV1(g, "vertex", vertexFile, fileHeaderSize, vertexDataSizeV1)
+    if err != nil {
+        return err
+    }
+    for id := uint32(1); id <= vertices.count(); id++ {
+        b, err := vertices.record(id)
+        if err != nil {
+            return err
+        }
+        if b == nil || b[0] == 0 {
+            continue // never written, or removed
+        }
+        v := vertexV1{id, b[0], util.Uint32(b[1:5]), util.Uint32(b[5:9]), util.Uint32(b[9:13])}
+        if err = fn(v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// An edge as it is stored from version 1.
+type edgeV1 struct {
+    id uint32
+    label uint16
+    outNext uint32
+    inNext uint32
+    firstAtt uint32
+}
+
+// Reads the edges of a graph from version 1 that have not been removed, by id.
+// Graphs from before version 3 may have no edge store, and so have no edges.
+// Returns an error of type *DataError if the store can not be read or an edge is corrupted.
+func readEdgesV1(g *Graph) (map[uint32]edgeV1, *DataError) {
+    edges := make(map[uint32]edgeV1)
+    if _, e := os.Stat(g.storePath("edge")); os.IsNotExist(e) {
+        return edges, nil
+    }
+    records, err := readRecordsV1(g, "edge", edgeFile, fileHeaderSize, edgeDataSizeV1)
+    if err != nil {
+        return nil, err
+    }
+    for id := uint32(1); id <= records.count(); id++ {
+        b, err := records.record(id)
+        if err != nil {
+            return nil, err
+        }
+        if b == nil || util.Uint16(b[0:2]) == 0 {
+            continue // never written, or removed
+        }
+        edges[id] = edgeV1{id, util.Uint16(b[0:2]), util.Uint32(b[10:14]), util.Uint32(b[14:18]), util.Uint32(b[18:22])}
+    }
+    return edges, nil
+}
+
+// Returns the number of edges in a chain of edges from version 1, starting from the
+// edge with an id and following next.
+// Returns an error of type *DataError caused by a *CorruptionError if the chain leads to
+// an edge that does not exist or runs longer than there are edges.
+func countChainV1(edges map[uint32]edgeV1, first uint32, next func(e edgeV1) uint32) (int, *DataError) {
+    n := 0
+    for id := first; id != 0; n++ {
+        e, ok := edges[id]
+        if !ok || n == len(edges) {
+            return 0, dataError(migrationRecordCorrupted, &CorruptionError{"edge", uint64(id)}, nil)
+        }
+        id = next(e)
+    }
+    return n, nil
+}
+
+// Calls fn with the label of each attribute in a chain of attributes from version 1,
+// starting from the attribute with an id.
+// Returns an error of type *DataError caused by a *CorruptionError if the chain leads to
+// an attribute that does not exist or runs longer than there are attributes.
+func eachAttributeLabelV1(attributes *recordsV1, first uint32, fn func(label uint16)) *DataError {
+    for id, n := first, uint32(0); id != 0; n++ {
+        if n == attributes.count() {
+            return dataError(migrationRecordCorrupted, &CorruptionError{attributes.name, uint64(id)}, nil)
+        }
+        b, err := attributes.record(id)
+        if err != nil {
+            return err
+        } else if b == nil {
+            return dataError(migrationRecordCorrupted, &CorruptionError{attributes.name, uint64(id)}, nil)
+        }
+        fn(util.Uint16(b[0:2]))
+        id = util.Uint32(b[11:15])
+    }
+    return nil
+}
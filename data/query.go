@@ -0,0 +1,1031 @@
+package data
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+
+    "github.com/wardlem/graphlite/query"
+)
+
+// A Result is the stream of rows yielded by a query.
+// Rows are produced as they are read, so a query over a large graph does not hold
+// its results in memory.
+//
+//    r, err := g.Query(`e = [owns] FROM Person{name: $name} TO Asset; yield e`, params)
+//    for r.Next() {
+//        e := r.Row()[0].(*Edge)
+//        ...
+//    }
+//    if err := r.Err(); err != nil {
+//        ...
+//    }
+type Result interface {
+    // Columns returns the names of the values in each row, as they are written in the
+    // yield statement.
+    Columns() []string
+    // Next advances to the next row, returning false when there are no more rows or
+    // the query failed.
+    Next() bool
+    // Row returns the values of the current row: a *Vertex or *Edge for a variable, and
+    // the value for an attribute, literal, or parameter. Missing attributes are nil.
+    Row() []Any
+    // Err returns the error that stopped the query, if any.
+    Err() error
+    // Cursor returns a token marking the place of the current row in the order of a
+    // query with an order by clause, which QueryAfter resumes the query from. Returns
+    // "" if the query has no order by clause or there is no current row.
+    Cursor() string
+}
+
+// The vertices and edges bound to the variables of a query for one match.
+type binding map[string]Any
+
+// Returns a copy of the binding with a variable bound to a value.
+func (b binding) with(name string, value Any) binding {
+    c := make(binding, len(b) + 1)
+    for k, v := range b {
+        c[k] = v
+    }
+    c[name] = value
+    return c
+}
+
+// An operator produces the bindings of a query one at a time.
+type operator interface {
+    // Returns the next binding, or nil when there are no more.
+    next() (binding, *DataError)
+}
+
+// Creates the error for a query that can not be run as written.
+func queryError(pos query.Position, message string) *DataError {
+    return dataError("Query error at " + pos.String() + ": " + message, nil, nil)
+}
+
+// Query parses and runs a query, returning the rows it yields.
+// Values for the parameters of the query, such as $name, are given in params.
+// Returns an error of type *query.SyntaxError if the query can not be parsed, or of
+// type *DataError if it names a class, variable, or parameter that does not exist.
+// Errors found while the rows are being read are returned by the result's Err.
+//
+// A query that creates, merges, sets, removes, or deletes runs as one transaction: its
+// rows are read and its changes written to the graph's files before Query returns. If
+// it fails, none of its changes are kept and the error is returned by Query. Changes
+// made to the graph before the query are written along with it. Vertices and edges held
+// by the caller are the ones the query changes, and are put back if it fails.
+//
+// A query that starts with explain is not run, and yields a row for each step of its
+// plan with the columns operator and details. A query that starts with profile is run,
+// and yields its plan with the rows each step produced and the vertices, edges and
+// attributes it read.
+func (g *Graph) Query(text string, params map[string]Any) (Result, error) {
+    return g.QueryAfter(text, params, "")
+}
+
+// QueryAfter runs a query, returning the rows that sort after the row a cursor was
+// taken from. The query must be the one the cursor came from, with the same parameters,
+// and have an order by clause. An empty cursor returns every row, as Query does.
+//
+//    r, err := g.Query(`p = Person; yield p order by p.name limit 10`, nil)
+//    ... read the page, keeping the last r.Cursor()
+//    r, err = g.QueryAfter(`p = Person; yield p order by p.name limit 10`, nil, cursor)
+func (g *Graph) QueryAfter(text string, params map[string]Any, cursor string) (Result, error) {
+    Assert(nilGraph, g != nil)
+
+    q, err := query.Parse(text)
+    if err != nil {
+        return nil, err
+    }
+    r, de := g.plan(q, params, cursor)
+    if de != nil {
+        return nil, de
+    }
+    switch q.Mode {
+    case query.ExplainMode:
+        return r.planResult(false), nil
+    case query.ProfileMode:
+        if de = g.profile(r); de != nil {
+            return nil, de
+        }
+        return r.planResult(true), nil
+    }
+    if r.mutates {
+        if de = g.transact(r); de != nil {
+            return nil, de
+        }
+    }
+    return r, nil
+}
+
+// The kinds of value a variable is bound to
+const (
+    vertexVariable byte = iota + 1
+    edgeVariable
+)
+
+// A planner turns a parsed query into a chain of operators, checking that the names
+// it uses exist.
+type planner struct {
+    g *Graph
+    params map[string]Any
+    variables map[string]byte // the variables bound so far and their kinds
+    profiling bool            // whether the operators count what they do
+    steps []*planStep         // the steps of the plan so far
+}
+
+// Plans a query, resuming it after a cursor if one is given.
+func (g *Graph) plan(q *query.Query, params map[string]Any, cursor string) (*queryResult, *DataError) {
+    p := &planner{g: g, params: params, variables: make(map[string]byte), profiling: q.Mode == query.ProfileMode}
+    var op operator = &startOperator{}
+    r := &queryResult{columns: make([]string, 0), hash: queryHash(q, params)}
+    var err *DataError
+    for n, s := range q.Statements {
+        switch s := s.(type) {
+        case *query.MatchStatement:
+            match, err := p.match(s, op)
+            if err != nil {
+                return nil, err
+            }
+            op = match
+        case *query.CreateStatement, *query.MergeStatement, *query.SetStatement, *query.RemoveStatement, *query.DeleteStatement:
+            if op, err = p.mutation(s, op); err != nil {
+                return nil, err
+            }
+            r.mutates = true
+        case *query.YieldStatement:
+            if n != len(q.Statements) - 1 {
+                return nil, queryError(s.Pos(), "yield must be the last statement")
+            }
+            rows, err := p.yield(s, op)
+            if err != nil {
+                return nil, err
+            }
+            if r.input, err = p.page(s, rows, r, cursor); err != nil {
+                return nil, err
+            }
+            for _, e := range s.Values {
+                r.columns = append(r.columns, fmt.Sprint(e))
+            }
+        }
+    }
+    if r.input == nil {
+        if cursor != "" {
+            return nil, cursorError("the query has no order by clause")
+        }
+        r.input = p.rowStep(&projection{g: g, input: op, identity: p.identity()}, "Project")
+    }
+    r.steps = p.steps
+    return r, nil
+}
+
+// Binds a variable to a kind of value.
+// The variable may already be bound, to the same kind of value, if bound is true.
+func (p *planner) bind(v *query.Ident, kind byte, bound bool) *DataError {
+    existing, ok := p.variables[v.Name]
+    switch {
+    case ok && !bound:
+        return queryError(v.Pos(), "variable " + v.Name + " is already bound")
+    case ok && existing != kind:
+        return queryError(v.Pos(), "variable " + v.Name + " is not bound to a " + map[byte]string{vertexVariable: "vertex", edgeVariable: "edge"}[kind])
+    }
+    p.variables[v.Name] = kind
+    return nil
+}
+
+// Plans a match statement.
+func (p *planner) match(s *query.MatchStatement, input operator) (operator, *DataError) {
+    switch pattern := s.Pattern.(type) {
+    case *query.VertexPattern:
+        m := &vertexMatch{g: p.g, input: input}
+        var err *DataError
+        if m.filter, err = p.vertexFilter(pattern); err != nil {
+            return nil, err
+        }
+        if s.Var != nil {
+            if err = p.bind(s.Var, vertexVariable, false); err != nil {
+                return nil, err
+            }
+            m.variable = s.Var.Name
+        }
+        return p.vertexStep(m, s), nil
+    case *query.EdgePattern:
+        if pattern.Length != nil {
+            if s.Var != nil {
+                return nil, queryError(s.Var.Pos(), "a sequence of edges can not be bound to a variable")
+            }
+            return p.sequence(pattern, input)
+        }
+        m := &edgeMatch{g: p.g, input: input}
+        var err *DataError
+        if m.filter, err = p.edgeFilter(pattern); err != nil {
+            return nil, err
+        }
+        if pattern.From != nil {
+            if m.filter.from, err = p.vertexFilter(pattern.From); err != nil {
+                return nil, err
+            }
+        }
+        if pattern.To != nil {
+            if m.filter.to, err = p.vertexFilter(pattern.To); err != nil {
+                return nil, err
+            }
+        }
+        if s.Var != nil {
+            if err = p.bind(s.Var, edgeVariable, false); err != nil {
+                return nil, err
+            }
+            m.variable = s.Var.Name
+        }
+        p.chooseStart(m.filter)
+        return p.edgeStep(m, s), nil
+    case *query.PathPattern:
+        return p.path(pattern, input)
+    }
+    return nil, queryError(s.Pos(), "unsupported pattern")
+}
+
+// Returns a name for a vertex that is not given a variable in a pattern but must be
+// bound for the statement to join on it. The name can not be written in a query.
+func (p *planner) hidden() string {
+    name := "#" + strconv.Itoa(len(p.variables))
+    p.variables[name] = vertexVariable
+    return name
+}
+
+// Plans the vertex a path or sequence of edges starts from, returning the operator
+// that binds it and the name of its variable.
+func (p *planner) pathStart(v *query.VertexPattern, input operator) (operator, string, *DataError) {
+    f, err := p.vertexFilter(v)
+    if err != nil {
+        return nil, "", err
+    }
+    if f.variable == "" {
+        f.variable = p.hidden()
+    }
+    return p.vertexStep(&vertexMatch{g: p.g, input: input, filter: f}, v), f.variable, nil
+}
+
+// Plans an edge of a path, from the vertex bound to a variable by the input to the
+// vertex on its other side, returning the operator that follows it and the name of the
+// variable the other vertex is bound to.
+func (p *planner) hop(input operator, from string, pattern *query.EdgePattern, next *query.VertexPattern) (operator, string, *DataError) {
+    if pattern.Var != nil && pattern.Length != nil {
+        return nil, "", queryError(pattern.Var.Pos(), "a sequence of edges can not be bound to a variable")
+    }
+    f, err := p.edgeFilter(pattern)
+    if err != nil {
+        return nil, "", err
+    }
+    target, err := p.vertexFilter(next)
+    if err != nil {
+        return nil, "", err
+    }
+    if target.variable == "" {
+        target.variable = p.hidden()
+    }
+
+    out := pattern.To == next
+    if pattern.Length != nil {
+        return p.expandStep(&expandMatch{
+            g: p.g,
+            input: input,
+            filter: f,
+            from: from,
+            out: out,
+            min: pattern.Length.Min,
+            max: pattern.Length.Max,
+            target: target,
+        }, pattern), target.variable, nil
+    }
+
+    start := &vertexFilter{variable: from, bound: true}
+    if out {
+        f.from, f.to = start, target
+    } else {
+        f.from, f.to = target, start
+    }
+    p.chooseStart(f)
+    return p.edgeStep(&edgeMatch{g: p.g, input: input, filter: f}, pattern), target.variable, nil
+}
+
+// Plans a sequence of edges outside of a path. The sequence is followed from the end
+// estimated to match fewer vertices, preferring the vertex it goes from.
+func (p *planner) sequence(pattern *query.EdgePattern, input operator) (operator, *DataError) {
+    if pattern.Var != nil {
+        return nil, queryError(pattern.Var.Pos(), "a sequence of edges can not be bound to a variable")
+    }
+    start, next := pattern.From, pattern.To
+    if p.estimatePattern(next) < p.estimatePattern(start) {
+        start, next = next, start
+    }
+    if start == nil {
+        start = &query.VertexPattern{Start: pattern.Start}
+    }
+    if next == nil {
+        next = &query.VertexPattern{Start: pattern.Start}
+    }
+    // the hop goes towards next in the direction of the edges
+    hop := *pattern
+    hop.From, hop.To = start, next
+    if start == pattern.To {
+        hop.From, hop.To = next, start
+    }
+    op, from, err := p.pathStart(start, input)
+    if err != nil {
+        return nil, err
+    }
+    op, _, err = p.hop(op, from, &hop, next)
+    return op, err
+}
+
+// An attribute a vertex or edge must have to match a pattern.
+type attributeFilter struct {
+    key string
+    value Any
+    indexKey string // the value as it is compared to attributes
+}
+
+// Plans the attributes of a pattern.
+func (p *planner) attributeFilters(m *query.AttributeMap) ([]attributeFilter, *DataError) {
+    filters := make([]attributeFilter, 0)
+    if m == nil {
+        return filters, nil
+    }
+    for _, entry := range m.Entries {
+        value, err := p.value(entry.Value)
+        if err != nil {
+            return nil, err
+        }
+        indexKey, err := indexKeyOf(value)
+        if err != nil {
+            return nil, queryError(entry.Value.Pos(), "the value of " + entry.Key.Name + " has an unsupported type")
+        }
+        filters = append(filters, attributeFilter{entry.Key.Name, value, indexKey})
+    }
+    return filters, nil
+}
+
+// Returns true if the vertex or edge has every attribute of the filters.
+func matchesAttributes(filters []attributeFilter, owner *attributable, g *Graph) (bool, *DataError) {
+    if len(filters) == 0 {
+        return true, nil
+    }
+    m, err := owner.Attributes(g)
+    if err != nil {
+        return false, err
+    }
+    for _, f := range filters {
+        a, ok := m.get(f.key)
+        if !ok {
+            return false, nil
+        }
+        key, err := a.indexKey(g)
+        if err != nil {
+            return false, err
+        }
+        if key != f.indexKey {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+// What a vertex must be to match a vertex pattern.
+type vertexFilter struct {
+    variable string  // the variable in the pattern, or ""
+    bound bool       // whether the variable was bound by an earlier statement
+    class *Class     // the class the vertex must belong to, or nil
+    attributes []attributeFilter
+}
+
+// Plans a vertex pattern.
+func (p *planner) vertexFilter(pattern *query.VertexPattern) (*vertexFilter, *DataError) {
+    f := new(vertexFilter)
+    var err *DataError
+    if pattern.Class != nil {
+        if f.class = p.g.C(pattern.Class.Name); f.class == nil {
+            return nil, queryError(pattern.Class.Pos(), "there is no class named " + pattern.Class.Name)
+        }
+    }
+    if f.attributes, err = p.attributeFilters(pattern.Attributes); err != nil {
+        return nil, err
+    }
+    p.orderAttributes(f)
+    if pattern.Var != nil {
+        _, f.bound = p.variables[pattern.Var.Name]
+        if err = p.bind(pattern.Var, vertexVariable, true); err != nil {
+            return nil, err
+        }
+        f.variable = pattern.Var.Name
+    }
+    return f, nil
+}
+
+// Returns the ids of the vertices that might match the filter for a binding.
+// Every vertex that matches is in the sequence, but not every vertex in the sequence
+// matches. Vertices of a class and scans of the whole graph are visited as they are
+// reached rather than listed up front.
+func (f *vertexFilter) candidates(b binding, g *Graph) (idSequence, *DataError) {
+    switch {
+    case f.bound:
+        return idList([]uint32{b[f.variable].(*Vertex).Id}), nil
+    case f.class != nil && len(f.attributes) > 0:
+        vertices, err := f.class.FindBy(f.attributes[0].key, f.attributes[0].value, g)
+        if err != nil {
+            return idSequence{}, err
+        }
+        ids := make([]uint32, len(vertices))
+        for n, v := range vertices {
+            ids[n] = v.Id
+        }
+        return idList(ids), nil
+    case f.class != nil:
+        return classIds(f.class, g), nil
+    }
+    return idRange(g.vertexStore.idStore.lastId), nil
+}
+
+// Returns true if a vertex matches the filter for a binding.
+func (f *vertexFilter) matches(v *Vertex, b binding, g *Graph) (bool, *DataError) {
+    if f.bound && b[f.variable].(*Vertex).Id != v.Id {
+        return false, nil
+    }
+    if f.class != nil {
+        if has, err := f.class.hasId(v.Id, g); !has || err != nil {
+            return false, err
+        }
+    }
+    return matchesAttributes(f.attributes, &v.attributable, g)
+}
+
+// Returns the binding with the filter's variable bound to a matching vertex.
+func (f *vertexFilter) bind(v *Vertex, b binding) binding {
+    if f.variable == "" || f.bound {
+        return b
+    }
+    return b.with(f.variable, v)
+}
+
+// What an edge must be to match an edge pattern.
+type edgeFilter struct {
+    variable string         // the variable in the pattern, or ""
+    bound bool              // whether the variable was bound by an earlier statement
+    label uint16            // the id of the label the edge must have, or 0 for any label
+    labelName string
+    missing bool            // whether the label does not exist, so no edge matches
+    attributes []attributeFilter
+    from *vertexFilter      // what the edge must go from, or nil
+    to *vertexFilter        // what the edge must go to, or nil
+    via *vertexFilter       // the end whose vertices the candidates are found from, or nil to scan the edges
+    out bool                // whether the edges go out of the vertices of via
+}
+
+// Plans the label, attributes and variable of an edge pattern.
+// The vertices it goes from and to are planned by the caller.
+func (p *planner) edgeFilter(pattern *query.EdgePattern) (*edgeFilter, *DataError) {
+    f := new(edgeFilter)
+    var err *DataError
+    if pattern.Label != nil {
+        f.labelName = pattern.Label.Name
+        l, err := p.g.labelStore.findByValue(f.labelName, p.g)
+        if err != nil {
+            return nil, err
+        } else if l != nil {
+            f.label = l.Id
+        } else {
+            f.missing = true
+        }
+    }
+    if f.attributes, err = p.attributeFilters(pattern.Attributes); err != nil {
+        return nil, err
+    }
+    if pattern.Var != nil {
+        _, f.bound = p.variables[pattern.Var.Name]
+        if err = p.bind(pattern.Var, edgeVariable, true); err != nil {
+            return nil, err
+        }
+        f.variable = pattern.Var.Name
+    }
+    return f, nil
+}
+
+// Returns true if a vertex filter constrains which vertices match it.
+func constrains(f *vertexFilter) bool {
+    return f != nil && (f.bound || f.class != nil || len(f.attributes) > 0)
+}
+
+// Returns the ids of the edges of a vertex in one direction that have the filter's label,
+// in order of id.
+func (f *edgeFilter) edgesOf(v *Vertex, out bool, g *Graph) ([]uint32, *DataError) {
+    edges, err := v.In(g)
+    if out {
+        edges, err = v.Out(g)
+    }
+    if err != nil {
+        return nil, err
+    }
+    ids := make([]uint32, 0)
+    for label, list := range edges {
+        if f.labelName != "" && label != f.labelName {
+            continue
+        }
+        for id := range list {
+            ids = append(ids, id)
+        }
+    }
+    sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+    return ids, nil
+}
+
+// Returns the ids of the edges that might match the filter for a binding.
+// Edges are found by following the edges of the vertices at the end the planner chose,
+// one vertex at a time, and otherwise by label, or every edge is a candidate.
+func (f *edgeFilter) candidates(b binding, g *Graph) (idSequence, *DataError) {
+    if f.missing {
+        return idSequence{}, nil
+    }
+    if f.bound {
+        return idList([]uint32{b[f.variable].(*Edge).Id}), nil
+    }
+
+    if end := f.via; end != nil {
+        vertices, err := end.candidates(b, g)
+        if err != nil {
+            return idSequence{}, err
+        }
+        return idSequence{more: func() ([]uint32, bool, *DataError) {
+            for id := vertices.next(); id != 0; id = vertices.next() {
+                v, err := g.vertexStore.Find(id)
+                if err != nil {
+                    return nil, false, err
+                }
+                if v == nil {
+                    continue
+                }
+                if ok, err := end.matches(v, b, g); err != nil || !ok {
+                    if err != nil {
+                        return nil, false, err
+                    }
+                    continue
+                }
+                edges, err := f.edgesOf(v, f.out, g)
+                if err != nil {
+                    return nil, false, err
+                }
+                return edges, true, nil
+            }
+            return nil, false, vertices.err
+        }}, nil
+    }
+
+    if f.label != 0 {
+        return g.edgeStore.withLabel(f.label), nil
+    }
+    return idRange(g.edgeStore.idStore.lastId), nil
+}
+
+// Returns true if an edge matches the filter for a binding, along with the binding
+// with the variables of the vertices it goes from and to bound.
+func (f *edgeFilter) matches(e *Edge, b binding, g *Graph) (bool, binding, *DataError) {
+    if ok, err := f.matchesEdge(e, b, g); err != nil || !ok {
+        return false, nil, err
+    }
+    if f.variable != "" && !f.bound {
+        b = b.with(f.variable, e)
+    }
+    for _, end := range []struct {
+        filter *vertexFilter
+        vertex func(*Graph) (*Vertex, *DataError)
+    }{{f.from, e.From}, {f.to, e.To}} {
+        if end.filter == nil {
+            continue
+        }
+        v, err := end.vertex(g)
+        if err != nil || v == nil {
+            return false, nil, err
+        }
+        if ok, err := end.filter.matches(v, b, g); err != nil || !ok {
+            return false, nil, err
+        }
+        b = end.filter.bind(v, b)
+    }
+    return true, b, nil
+}
+
+// Returns true if an edge has the filter's label and attributes, and is the edge bound
+// to its variable if that was bound by an earlier statement.
+func (f *edgeFilter) matchesEdge(e *Edge, b binding, g *Graph) (bool, *DataError) {
+    if f.missing || f.label != 0 && e.label != f.label {
+        return false, nil
+    }
+    if f.bound && b[f.variable].(*Edge).Id != e.Id {
+        return false, nil
+    }
+    return matchesAttributes(f.attributes, &e.attributable, g)
+}
+
+// The operator at the start of every query, which produces a single empty binding.
+type startOperator struct {
+    done bool
+}
+
+func (op *startOperator) next() (binding, *DataError) {
+    if op.done {
+        return nil, nil
+    }
+    op.done = true
+    return binding{}, nil
+}
+
+// An operator that extends each binding of its input with every vertex that matches
+// a vertex pattern.
+type vertexMatch struct {
+    g *Graph
+    input operator
+    filter *vertexFilter
+    variable string  // the variable the statement binds the vertex to, or ""
+    current binding  // the input binding being extended, or nil to take the next one
+    ids idSequence   // the candidates for the current binding still to be checked
+}
+
+func (m *vertexMatch) next() (binding, *DataError) {
+    for {
+        if m.current == nil {
+            b, err := m.input.next()
+            if b == nil || err != nil {
+                return nil, err
+            }
+            if m.ids, err = m.filter.candidates(b, m.g); err != nil {
+                return nil, err
+            }
+            m.current = b
+            continue
+        }
+
+        id := m.ids.next()
+        if id == 0 {
+            if m.ids.err != nil {
+                return nil, m.ids.err
+            }
+            m.current = nil
+            continue
+        }
+        v, err := m.g.vertexStore.Find(id)
+        if err != nil {
+            return nil, err
+        }
+        if v == nil {
+            continue
+        }
+        ok, err := m.filter.matches(v, m.current, m.g)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        b := m.filter.bind(v, m.current)
+        if m.variable != "" {
+            b = b.with(m.variable, v)
+        }
+        return b, nil
+    }
+}
+
+// An operator that extends each binding of its input with every edge that matches an
+// edge pattern, along with the vertices it goes from and to.
+type edgeMatch struct {
+    g *Graph
+    input operator
+    filter *edgeFilter
+    variable string  // the variable the statement binds the edge to, or ""
+    current binding  // the input binding being extended, or nil to take the next one
+    ids idSequence   // the candidates for the current binding still to be checked
+}
+
+func (m *edgeMatch) next() (binding, *DataError) {
+    for {
+        if m.current == nil {
+            b, err := m.input.next()
+            if b == nil || err != nil {
+                return nil, err
+            }
+            if m.ids, err = m.filter.candidates(b, m.g); err != nil {
+                return nil, err
+            }
+            m.current = b
+            continue
+        }
+
+        id := m.ids.next()
+        if id == 0 {
+            if m.ids.err != nil {
+                return nil, m.ids.err
+            }
+            m.current = nil
+            continue
+        }
+        e, err := m.g.edgeStore.Find(id)
+        if err != nil {
+            return nil, err
+        }
+        if e == nil {
+            continue
+        }
+        ok, b, err := m.filter.matches(e, m.current, m.g)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        if m.variable != "" {
+            b = b.with(m.variable, e)
+        }
+        return b, nil
+    }
+}
+
+// An operator that extends each binding of its input with every vertex that can be
+// reached from a bound vertex by a sequence of matching edges. Each sequence that
+// reaches a vertex produces a binding, and no sequence visits a vertex twice.
+type expandMatch struct {
+    g *Graph
+    input operator
+    filter *edgeFilter    // what each edge in a sequence must be
+    from string           // the variable of the vertex the sequences start from
+    out bool              // whether the sequences follow outbound edges
+    min, max int          // the number of edges in a sequence, with max -1 for no limit
+    target *vertexFilter  // what the vertex at the end of a sequence must be
+    pending []binding     // the bindings for the current input still to be returned
+}
+
+func (m *expandMatch) next() (binding, *DataError) {
+    for len(m.pending) == 0 {
+        b, err := m.input.next()
+        if b == nil || err != nil {
+            return nil, err
+        }
+        if m.pending, err = m.expand(b); err != nil {
+            return nil, err
+        }
+    }
+    b := m.pending[0]
+    m.pending = m.pending[1:]
+    return b, nil
+}
+
+// Follows the sequences of edges from the bound vertex of a binding, depth first,
+// returning a binding for each vertex at the end of one.
+func (m *expandMatch) expand(b binding) ([]binding, *DataError) {
+    g := m.g
+    found := make([]binding, 0)
+    visited := map[uint32]bool{}
+    var walk func(v *Vertex, depth int) *DataError
+    walk = func(v *Vertex, depth int) *DataError {
+        if depth >= m.min {
+            ok, err := m.target.matches(v, b, g)
+            if err != nil {
+                return err
+            }
+            if ok {
+                found = append(found, m.target.bind(v, b))
+            }
+        }
+        if depth == m.max {
+            return nil
+        }
+        visited[v.Id] = true
+        defer delete(visited, v.Id)
+        ids, err := m.filter.edgesOf(v, m.out, g)
+        if err != nil {
+            return err
+        }
+        for _, id := range ids {
+            e, err := g.edgeStore.Find(id)
+            if err != nil {
+                return err
+            }
+            if e == nil {
+                continue
+            }
+            if ok, err := m.filter.matchesEdge(e, b, g); err != nil || !ok {
+                if err != nil {
+                    return err
+                }
+                continue
+            }
+            next, err := e.From(g)
+            if m.out {
+                next, err = e.To(g)
+            }
+            if err != nil {
+                return err
+            }
+            if next == nil || visited[next.Id] {
+                continue
+            }
+            if err = walk(next, depth + 1); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
+    if err := walk(b[m.from].(*Vertex), 0); err != nil {
+        return nil, err
+    }
+    return found, nil
+}
+
+// A value in a yielded row, computed from a binding.
+type queryValue func(b binding, g *Graph) (Any, *DataError)
+
+// Plans a value given in an attribute map.
+func (p *planner) value(e query.Expr) (Any, *DataError) {
+    switch e := e.(type) {
+    case *query.Literal:
+        return e.Value, nil
+    case *query.Param:
+        value, ok := p.params[e.Name]
+        if !ok {
+            return nil, queryError(e.Pos(), "no value was given for parameter $" + e.Name)
+        }
+        return value, nil
+    }
+    return nil, queryError(e.Pos(), "expected a value")
+}
+
+// Plans an expression in a yield statement.
+func (p *planner) expression(e query.Expr) (queryValue, *DataError) {
+    switch e := e.(type) {
+    case *query.Ident:
+        if _, ok := p.variables[e.Name]; !ok {
+            return nil, queryError(e.Pos(), "variable " + e.Name + " is not bound")
+        }
+        return func(b binding, g *Graph) (Any, *DataError) {
+            return b[e.Name], nil
+        }, nil
+    case *query.Property:
+        kind, ok := p.variables[e.Var.Name]
+        if !ok {
+            return nil, queryError(e.Pos(), "variable " + e.Var.Name + " is not bound")
+        }
+        return func(b binding, g *Graph) (Any, *DataError) {
+            if kind == edgeVariable {
+                return b[e.Var.Name].(*Edge).Get(e.Key.Name, g)
+            }
+            return b[e.Var.Name].(*Vertex).Get(e.Key.Name, g)
+        }, nil
+    }
+    value, err := p.value(e)
+    if err != nil {
+        return nil, err
+    }
+    return func(b binding, g *Graph) (Any, *DataError) {
+        return value, nil
+    }, nil
+}
+
+// A row of values yielded by a query.
+type row struct {
+    values []Any
+    keys []Any       // the values the row is sorted by
+    identity string  // identifies the match or group the row was yielded for
+}
+
+// A rowOperator produces the rows of a query one at a time.
+type rowOperator interface {
+    // Returns the next row, or nil when there are no more.
+    next() (*row, *DataError)
+}
+
+// Plans a yield statement.
+// The values rows are sorted by are computed along with the yielded values, and follow
+// them in each row until the rows are sorted.
+func (p *planner) yield(s *query.YieldStatement, input operator) (rowOperator, *DataError) {
+    values := append([]query.Expr{}, s.Values...)
+    for _, k := range s.OrderBy {
+        values = append(values, k.Value)
+    }
+    aggregated := s.GroupBy != nil
+    for _, e := range values {
+        if _, ok := e.(*query.Call); ok {
+            aggregated = true
+        }
+    }
+    if aggregated {
+        r, err := p.aggregation(values, s.GroupBy, input)
+        if err != nil {
+            return nil, err
+        }
+        grouping := ""
+        if s.GroupBy != nil {
+            grouping = "group by " + listOf(s.GroupBy)
+        }
+        return p.rowStep(r, "Aggregate", listOf(s.Values), grouping), nil
+    }
+
+    r := &projection{g: p.g, input: input, identity: p.identity()}
+    for _, e := range values {
+        value, err := p.expression(e)
+        if err != nil {
+            return nil, err
+        }
+        r.values = append(r.values, value)
+    }
+    return p.rowStep(r, "Project", listOf(s.Values)), nil
+}
+
+// Returns the variables bound so far in order of name, which identify a match.
+func (p *planner) identity() []string {
+    names := make([]string, 0, len(p.variables))
+    for name := range p.variables {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// An operator that yields a row of values for each binding of its input.
+type projection struct {
+    g *Graph
+    input operator
+    values []queryValue
+    identity []string // the variables that identify a match
+}
+
+func (r *projection) next() (*row, *DataError) {
+    b, err := r.input.next()
+    if b == nil || err != nil {
+        return nil, err
+    }
+    values := make([]Any, len(r.values))
+    for n, value := range r.values {
+        if values[n], err = value(b, r.g); err != nil {
+            return nil, err
+        }
+    }
+    // the ids are written in fixed width hex so that identities sort in order of id
+    identity := ""
+    for _, name := range r.identity {
+        switch v := b[name].(type) {
+        case *Vertex:
+            identity += fmt.Sprintf("v%08x", v.Id)
+        case *Edge:
+            identity += fmt.Sprintf("e%08x", v.Id)
+        }
+    }
+    return &row{values: values, identity: identity}, nil
+}
+
+// The result of a query, which returns the rows of its last operator.
+type queryResult struct {
+    input rowOperator
+    columns []string
+    ordered bool    // whether the query has an order by clause
+    mutates bool    // whether the query changes the graph
+    hash uint64     // identifies the query in its cursors
+    steps []*planStep // the plan of the query
+    current *row
+    err *DataError
+}
+
+func (r *queryResult) Columns() []string {
+    return r.columns
+}
+
+func (r *queryResult) Next() bool {
+    r.current = nil
+    if r.err != nil {
+        return false
+    }
+    row, err := r.input.next()
+    if row == nil || err != nil {
+        r.err = err
+        return false
+    }
+    r.current = row
+    return true
+}
+
+func (r *queryResult) Row() []Any {
+    if r.current == nil {
+        return nil
+    }
+    return r.current.values
+}
+
+func (r *queryResult) Cursor() string {
+    if r.current == nil || !r.ordered {
+        return ""
+    }
+    return encodeCursor(r.hash, r.current)
+}
+
+func (r *queryResult) Err() error {
+    if r.err == nil {
+        return nil
+    }
+    return r.err
+}
@@ -0,0 +1,405 @@
+package data
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/wardlem/graphlite/query"
+)
+
+// An accumulator computes an aggregate function over the values of a group.
+type accumulator interface {
+    // Adds the value for one match. Missing values are nil.
+    add(value Any) *DataError
+    // Returns the value of the function over the values added.
+    result() Any
+}
+
+// A column of an aggregated row: either an aggregate function or a value that is
+// the same for every match of the group.
+type aggregateColumn struct {
+    call *query.Call  // the aggregate function, or nil
+    arg queryValue    // the argument of the function, or nil for count(*)
+    value queryValue  // the value when the column is not an aggregate function
+}
+
+// Creates an accumulator for the aggregate function of a column.
+func (c *aggregateColumn) accumulator() accumulator {
+    pos := c.call.Pos()
+    switch c.call.Func.Name {
+    case "count":
+        return &countAccumulator{}
+    case "sum":
+        return &sumAccumulator{pos: pos}
+    case "avg":
+        return &sumAccumulator{pos: pos, average: true}
+    case "min":
+        return &extremeAccumulator{pos: pos, name: "min"}
+    case "max":
+        return &extremeAccumulator{pos: pos, name: "max", greatest: true}
+    }
+    return &collectAccumulator{values: make([]Any, 0)}
+}
+
+// Plans a yield statement with aggregate functions or a group by clause.
+// Every value yielded outside of a function must be the same for all the matches of a
+// group: a value that is grouped by, an attribute of a variable that is grouped by, or a
+// literal or parameter.
+func (p *planner) aggregation(values []query.Expr, groupBy []query.Expr, input operator) (rowOperator, *DataError) {
+    r := &aggregation{g: p.g, input: input}
+    grouped := make(map[string]bool)   // the canonical forms of the values grouped by
+    variables := make(map[string]bool) // the variables grouped by
+    for _, e := range groupBy {
+        key, err := p.expression(e)
+        if err != nil {
+            return nil, err
+        }
+        r.keys = append(r.keys, key)
+        grouped[fmt.Sprint(e)] = true
+        if v, ok := e.(*query.Ident); ok {
+            variables[v.Name] = true
+        }
+    }
+
+    for _, e := range values {
+        c := new(aggregateColumn)
+        var err *DataError
+        switch e := e.(type) {
+        case *query.Call:
+            c.call = e
+            if e.Arg != nil {
+                if c.arg, err = p.expression(e.Arg); err != nil {
+                    return nil, err
+                }
+            }
+        case *query.Literal, *query.Param:
+            c.value, err = p.expression(e)
+        case *query.Property:
+            if !grouped[e.String()] && !variables[e.Var.Name] {
+                return nil, queryError(e.Pos(), e.String() + " must be grouped by or used in an aggregate function")
+            }
+            c.value, err = p.expression(e)
+        default:
+            if !grouped[fmt.Sprint(e)] {
+                return nil, queryError(e.Pos(), fmt.Sprint(e) + " must be grouped by or used in an aggregate function")
+            }
+            c.value, err = p.expression(e)
+        }
+        if err != nil {
+            return nil, err
+        }
+        r.columns = append(r.columns, c)
+    }
+    return r, nil
+}
+
+// A group of matches with the same values for the keys of an aggregation.
+type group struct {
+    key string    // the group key of the matches
+    first binding // the first match of the group
+    accumulators []accumulator
+}
+
+// An operator that groups the bindings of its input and yields a row for each group.
+// The input is read in full before the first row is returned. Groups are returned in
+// the order they are first matched.
+type aggregation struct {
+    g *Graph
+    input operator
+    keys []queryValue
+    columns []*aggregateColumn
+    rows []*row // the rows still to be returned, or nil if the input has not been read
+}
+
+func (r *aggregation) next() (*row, *DataError) {
+    if r.rows == nil {
+        rows, err := r.aggregate()
+        if err != nil {
+            return nil, err
+        }
+        r.rows = rows
+    }
+    if len(r.rows) == 0 {
+        return nil, nil
+    }
+    row := r.rows[0]
+    r.rows = r.rows[1:]
+    return row, nil
+}
+
+// Creates a group for a match, with an accumulator for each aggregate function.
+func (r *aggregation) newGroup(key string, first binding) *group {
+    grp := &group{key: key, first: first, accumulators: make([]accumulator, len(r.columns))}
+    for n, c := range r.columns {
+        if c.call != nil {
+            grp.accumulators[n] = c.accumulator()
+        }
+    }
+    return grp
+}
+
+// Reads the input and returns the row of each group.
+func (r *aggregation) aggregate() ([]*row, *DataError) {
+    groups := make(map[string]*group)
+    order := make([]*group, 0)
+    for {
+        b, err := r.input.next()
+        if err != nil {
+            return nil, err
+        }
+        if b == nil {
+            break
+        }
+
+        key, err := r.groupKey(b)
+        if err != nil {
+            return nil, err
+        }
+        grp, ok := groups[key]
+        if !ok {
+            grp = r.newGroup(key, b)
+            groups[key] = grp
+            order = append(order, grp)
+        }
+        for n, c := range r.columns {
+            if c.call == nil {
+                continue
+            }
+            var value Any = true // counted by count(*)
+            if c.arg != nil {
+                if value, err = c.arg(b, r.g); err != nil {
+                    return nil, err
+                }
+            }
+            if err = grp.accumulators[n].add(value); err != nil {
+                return nil, err
+            }
+        }
+    }
+    // without a group by clause all the matches are one group, even if there are none
+    if len(order) == 0 && len(r.keys) == 0 {
+        order = append(order, r.newGroup("", binding{}))
+    }
+
+    rows := make([]*row, len(order))
+    for n, grp := range order {
+        values := make([]Any, len(r.columns))
+        for m, c := range r.columns {
+            if c.call != nil {
+                values[m] = grp.accumulators[m].result()
+                continue
+            }
+            value, err := c.value(grp.first, r.g)
+            if err != nil {
+                return nil, err
+            }
+            values[m] = value
+        }
+        rows[n] = &row{values: values, identity: grp.key}
+    }
+    return rows, nil
+}
+
+// Returns a string that is the same for bindings in the same group.
+// Vertices and edges are grouped by id and other values as they are indexed.
+func (r *aggregation) groupKey(b binding) (string, *DataError) {
+    parts := make([]string, len(r.keys))
+    for n, key := range r.keys {
+        value, err := key(b, r.g)
+        if err != nil {
+            return "", err
+        }
+        switch v := value.(type) {
+        case nil:
+            parts[n] = "nil"
+        case *Vertex:
+            parts[n] = "vertex " + strconv.FormatUint(uint64(v.Id), 10)
+        case *Edge:
+            parts[n] = "edge " + strconv.FormatUint(uint64(v.Id), 10)
+        default:
+            k, err := indexKeyOf(v)
+            if err != nil {
+                return "", err
+            }
+            parts[n] = strconv.Quote(k)
+        }
+    }
+    return strings.Join(parts, ","), nil
+}
+
+// Counts the values that are not missing. For count(*) every value is true.
+type countAccumulator struct {
+    n int64
+}
+
+func (a *countAccumulator) add(value Any) *DataError {
+    if value != nil {
+        a.n++
+    }
+    return nil
+}
+
+func (a *countAccumulator) result() Any {
+    return a.n
+}
+
+// Converts a number to an int64 or float64, returning false if it is not a number.
+func toNumber(value Any) (Any, bool) {
+    switch v := value.(type) {
+    case int:
+        return int64(v), true
+    case int32:
+        return int64(v), true
+    case int64:
+        return v, true
+    case uint32:
+        return int64(v), true
+    case float32:
+        return float64(v), true
+    case float64:
+        return v, true
+    }
+    return nil, false
+}
+
+// Sums or averages numbers. A sum of integers is an int64, and any other sum or
+// average is a float64. The sum of no values is 0 and their average is nil.
+type sumAccumulator struct {
+    pos query.Position
+    average bool
+    integer int64 // the sum of the integers
+    real float64  // the sum of the real numbers
+    reals bool    // whether any of the numbers were real
+    n int64
+}
+
+func (a *sumAccumulator) add(value Any) *DataError {
+    if value == nil {
+        return nil
+    }
+    number, ok := toNumber(value)
+    if !ok {
+        name := "sum"
+        if a.average {
+            name = "avg"
+        }
+        return queryError(a.pos, fmt.Sprintf("%s can not be applied to %T values", name, value))
+    }
+    if i, ok := number.(int64); ok {
+        a.integer += i
+    } else {
+        a.real += number.(float64)
+        a.reals = true
+    }
+    a.n++
+    return nil
+}
+
+func (a *sumAccumulator) result() Any {
+    switch {
+    case a.average && a.n == 0:
+        return nil
+    case a.average:
+        return (a.real + float64(a.integer)) / float64(a.n)
+    case a.reals:
+        return a.real + float64(a.integer)
+    }
+    return a.integer
+}
+
+// Finds the least or greatest number, string, or time. The result of no values is nil.
+type extremeAccumulator struct {
+    pos query.Position
+    name string
+    greatest bool
+    value Any
+}
+
+func (a *extremeAccumulator) add(value Any) *DataError {
+    if value == nil {
+        return nil
+    }
+    if number, ok := toNumber(value); ok {
+        value = number
+    }
+    if a.value == nil {
+        switch value.(type) {
+        case int64, float64, string, time.Time:
+            a.value = value
+            return nil
+        }
+        return queryError(a.pos, fmt.Sprintf("%s can not be applied to %T values", a.name, value))
+    }
+    c, ok := compareValues(value, a.value)
+    if !ok {
+        return queryError(a.pos, fmt.Sprintf("%s can not compare %T and %T values", a.name, a.value, value))
+    }
+    if c != 0 && (c > 0) == a.greatest {
+        a.value = value
+    }
+    return nil
+}
+
+func (a *extremeAccumulator) result() Any {
+    return a.value
+}
+
+// Compares two numbers, strings, or times, returning -1, 0, or 1 as a is less than,
+// equal to, or greater than b, or false if they can not be compared.
+// Numbers must already be converted with toNumber.
+func compareValues(a Any, b Any) (int, bool) {
+    switch a := a.(type) {
+    case int64:
+        switch b := b.(type) {
+        case int64:
+            return order(a < b, a > b), true
+        case float64:
+            return order(float64(a) < b, float64(a) > b), true
+        }
+    case float64:
+        switch b := b.(type) {
+        case int64:
+            return order(a < float64(b), a > float64(b)), true
+        case float64:
+            return order(a < b, a > b), true
+        }
+    case string:
+        if b, ok := b.(string); ok {
+            return strings.Compare(a, b), true
+        }
+    case time.Time:
+        if b, ok := b.(time.Time); ok {
+            return order(a.Before(b), a.After(b)), true
+        }
+    }
+    return 0, false
+}
+
+// Returns the result of a comparison from whether a value is less or greater.
+func order(less bool, greater bool) int {
+    switch {
+    case less:
+        return -1
+    case greater:
+        return 1
+    }
+    return 0
+}
+
+// Collects the values that are not missing into a list.
+type collectAccumulator struct {
+    values []Any
+}
+
+func (a *collectAccumulator) add(value Any) *DataError {
+    if value != nil {
+        a.values = append(a.values, value)
+    }
+    return nil
+}
+
+func (a *collectAccumulator) result() Any {
+    return a.values
+}
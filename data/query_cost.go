@@ -0,0 +1,274 @@
+package data
+
+import (
+    "math"
+    "sort"
+
+    "github.com/wardlem/graphlite/query"
+)
+
+// The planner estimates how many vertices and edges each way of running a statement
+// reads, and picks the cheapest. The estimates come from the counts the graph keeps up
+// to date as it changes: the vertices of each class, the edges with each label, the
+// attributes with each key, and the entries of indexes. Planning does not read the
+// vertices or edges themselves.
+
+// The fraction of the vertices with an attribute key that are assumed to have the value a
+// pattern gives it, when there is no index to count them.
+const unknownSelectivity = 0.1
+
+// Returns the number of vertices in the graph.
+func (p *planner) vertexCount() float64 {
+    count := 0
+    for _, c := range p.g.classStore.classes {
+        count += int(c.Count)
+    }
+    return float64(count)
+}
+
+// Returns the number of edges with a label, or of all edges if the label is "".
+// A label that can not be read is estimated to have every edge; the error is returned
+// when the statement runs.
+func (p *planner) edgeCount(label string) float64 {
+    if label != "" {
+        l, err := p.g.labelStore.findByValue(label, p.g)
+        if err != nil {
+            return p.edgeCount("")
+        } else if l == nil {
+            return 0
+        }
+        return float64(p.g.edgeStore.labels.size(l.Id))
+    }
+    count := 0
+    for _, ids := range p.g.edgeStore.labels.labels {
+        count += len(ids)
+    }
+    return float64(count)
+}
+
+// Returns the average number of edges with a label, or with any label if it is "", that
+// a vertex has in one direction. The average is taken over the vertices that have edges
+// in that direction, so following edges that mostly go to a few vertices is estimated
+// to reach many edges from each of them.
+func (p *planner) degree(label string, out bool) float64 {
+    degrees := p.g.statsStore.inDegrees
+    if out {
+        degrees = p.g.statsStore.outDegrees
+    }
+    having := 0
+    for _, count := range degrees {
+        having += int(count)
+    }
+    return p.edgeCount(label) / math.Max(float64(having), 1)
+}
+
+// Returns the number of vertices of a class with an attribute value in an index, or
+// false if no index covers the attribute.
+func (p *planner) indexed(class *Class, a attributeFilter) (float64, bool) {
+    if class == nil {
+        return 0, false
+    }
+    def, _, err := class.findIndex(valueIndex, []string{a.key}, p.g)
+    if def == nil || err != nil {
+        return 0, false
+    }
+    index, err := def.open(p.g)
+    if err != nil {
+        return 0, false
+    }
+    return float64(len(index.find(a.indexKey))), true
+}
+
+// Returns the estimated number of vertices of a class, or of any class if it is nil,
+// with a set of attributes.
+func (p *planner) estimateVertices(class *Class, attributes []attributeFilter) float64 {
+    all := p.vertexCount()
+    n := all
+    if class != nil {
+        n = float64(class.total(p.g))
+    }
+    for _, a := range attributes {
+        if count, ok := p.indexed(class, a); ok {
+            n = math.Min(n, count)
+            continue
+        }
+        l, err := p.g.labelStore.findByValue(a.key, p.g)
+        if err != nil {
+            continue // estimated as if every vertex had the key; the error is returned when the statement runs
+        } else if l == nil {
+            return 0 // no vertex or edge has the key
+        }
+        having := float64(p.g.statsStore.keys[l.Id]) / math.Max(all, 1)
+        n *= math.Min(having, 1) * unknownSelectivity
+    }
+    return n
+}
+
+// Returns the estimated number of vertices that match a filter for one binding.
+func (p *planner) estimate(f *vertexFilter) float64 {
+    if f == nil {
+        return p.vertexCount()
+    }
+    if f.bound {
+        return 1
+    }
+    return p.estimateVertices(f.class, f.attributes)
+}
+
+// Returns the estimated number of vertices that match a pattern for one binding, without
+// binding its variable. A pattern that can not be planned is estimated to match every
+// vertex, and its error is returned when it is planned.
+func (p *planner) estimatePattern(v *query.VertexPattern) float64 {
+    if v == nil {
+        return p.vertexCount()
+    }
+    if v.Var != nil && p.variables[v.Var.Name] != 0 {
+        return 1
+    }
+    var class *Class
+    if v.Class != nil {
+        if class = p.g.C(v.Class.Name); class == nil {
+            return p.vertexCount()
+        }
+    }
+    attributes, err := p.attributeFilters(v.Attributes)
+    if err != nil {
+        return p.vertexCount()
+    }
+    return p.estimateVertices(class, attributes)
+}
+
+// Returns the estimated number of vertices and attributes read to find the candidates
+// of a filter.
+func (p *planner) scanCost(f *vertexFilter) float64 {
+    switch {
+    case f.bound:
+        return 1
+    case f.class != nil && len(f.attributes) > 0:
+        if count, ok := p.indexed(f.class, f.attributes[0]); ok {
+            return count
+        }
+        // every vertex of the class is read along with the attribute
+        return 2 * float64(f.class.total(p.g))
+    case f.class != nil:
+        return float64(f.class.total(p.g))
+    }
+    return p.vertexCount()
+}
+
+// Returns the estimated number of vertices and attributes read to check whether the
+// vertex at one end of an edge matches a filter, which may be nil.
+func checkCost(f *vertexFilter) float64 {
+    if f == nil {
+        return 0
+    }
+    return float64(1 + len(f.attributes))
+}
+
+// Puts the attribute of a filter with the most selective index first, since the
+// candidates of a filter are found by its first attribute.
+func (p *planner) orderAttributes(f *vertexFilter) {
+    if f.class == nil || len(f.attributes) < 2 {
+        return
+    }
+    costs := make(map[string]float64, len(f.attributes))
+    for _, a := range f.attributes {
+        costs[a.key] = math.Inf(1)
+        if count, ok := p.indexed(f.class, a); ok {
+            costs[a.key] = count
+        }
+    }
+    sort.SliceStable(f.attributes, func(a, b int) bool {
+        return costs[f.attributes[a].key] < costs[f.attributes[b].key]
+    })
+}
+
+// Chooses how the candidates of an edge filter are found for each binding: from the
+// vertices at one of its ends, or by scanning the edges with its label or every edge.
+// Of the choices estimated to read the fewest vertices and edges, bound ends are taken
+// first, then the end the edge goes from, and then a scan.
+func (p *planner) chooseStart(f *edgeFilter) {
+    ends := []struct {
+        filter *vertexFilter
+        out bool
+    }{{f.from, true}, {f.to, false}}
+    if f.to != nil && f.to.bound && (f.from == nil || !f.from.bound) {
+        ends[0], ends[1] = ends[1], ends[0]
+    }
+
+    f.via = nil
+    best := math.Inf(1)
+    for n, end := range ends {
+        if !constrains(end.filter) {
+            continue
+        }
+        // each edge followed is read, and the vertex at its other end checked
+        edges := p.estimate(end.filter) * p.degree(f.labelName, end.out)
+        if cost := p.scanCost(end.filter) + edges * (1 + checkCost(ends[1 - n].filter)); cost < best {
+            f.via, f.out, best = end.filter, end.out, cost
+        }
+    }
+    scan := p.edgeCount("")
+    if f.label != 0 || f.missing {
+        scan = p.edgeCount(f.labelName)
+    }
+    if scan * (1 + checkCost(f.from) + checkCost(f.to)) < best {
+        f.via = nil
+    }
+}
+
+// Returns the estimated number of vertices reached from each vertex by following an edge
+// of a path to a vertex pattern, as a fraction of the edges followed that match.
+func (p *planner) hopEstimate(e *query.EdgePattern, next *query.VertexPattern) float64 {
+    label := ""
+    if e.Label != nil {
+        label = e.Label.Name
+    }
+    edges := p.degree(label, e.To == next)
+    if e.Length != nil {
+        // assume a sequence is as long as its minimum, and at least one edge
+        edges = math.Pow(edges, math.Max(float64(e.Length.Min), 1))
+    }
+    return edges * p.estimatePattern(next) / math.Max(p.vertexCount(), 1)
+}
+
+// Plans a path, starting from the vertex that is estimated to match the fewest
+// vertices, and following the edges on either side of the vertices matched so far,
+// taking the edge estimated to reach fewer vertices first.
+func (p *planner) path(pattern *query.PathPattern, input operator) (operator, *DataError) {
+    start := 0
+    for n, v := range pattern.Vertices {
+        if p.estimatePattern(v) < p.estimatePattern(pattern.Vertices[start]) {
+            start = n
+        }
+    }
+    names := make([]string, len(pattern.Vertices))
+    op, name, err := p.pathStart(pattern.Vertices[start], input)
+    if err != nil {
+        return nil, err
+    }
+    names[start] = name
+
+    // the vertices matched so far are those from left to right
+    left, right := start, start
+    last := len(pattern.Vertices) - 1
+    for left > 0 || right < last {
+        forward := right < last
+        if forward && left > 0 {
+            forward = p.hopEstimate(pattern.Edges[right], pattern.Vertices[right + 1]) <=
+                p.hopEstimate(pattern.Edges[left - 1], pattern.Vertices[left - 1])
+        }
+        if forward {
+            if op, names[right + 1], err = p.hop(op, names[right], pattern.Edges[right], pattern.Vertices[right + 1]); err != nil {
+                return nil, err
+            }
+            right++
+        } else {
+            if op, names[left - 1], err = p.hop(op, names[left], pattern.Edges[left - 1], pattern.Vertices[left - 1]); err != nil {
+                return nil, err
+            }
+            left--
+        }
+    }
+    return op, nil
+}
@@ -0,0 +1,576 @@
+package data
+
+import (
+    "fmt"
+    "sort"
+
+    "github.com/wardlem/graphlite/query"
+)
+
+// A change made to the graph for one binding, returning the bindings it produces.
+type change func(b binding, g *Graph) ([]binding, *DataError)
+
+// An operator that changes the graph for each binding of its input. The input is read
+// in full before anything is changed, so a statement never matches what it changed.
+type mutation struct {
+    g *Graph
+    input operator
+    apply change
+    pending []binding // the bindings still to be returned, or nil if the input has not been read
+}
+
+func (m *mutation) next() (binding, *DataError) {
+    if m.pending == nil {
+        inputs := make([]binding, 0)
+        for {
+            b, err := m.input.next()
+            if err != nil {
+                return nil, err
+            }
+            if b == nil {
+                break
+            }
+            inputs = append(inputs, b)
+        }
+        m.pending = make([]binding, 0, len(inputs))
+        for _, b := range inputs {
+            results, err := m.apply(b, m.g)
+            if err != nil {
+                return nil, err
+            }
+            m.pending = append(m.pending, results...)
+        }
+    }
+    if len(m.pending) == 0 {
+        return nil, nil
+    }
+    b := m.pending[0]
+    m.pending = m.pending[1:]
+    return b, nil
+}
+
+// Returns the current copy of the vertex bound to a variable, which is tracked so that
+// every change made by a query is made to the same copy. Returns nil if the vertex has
+// been removed.
+func liveVertex(b binding, name string, g *Graph) (*Vertex, *DataError) {
+    v, err := g.vertexStore.Find(b[name].(*Vertex).Id)
+    if v == nil || err != nil {
+        return nil, err
+    }
+    g.vertexStore.Track(v)
+    return v, nil
+}
+
+// Returns the current copy of the edge bound to a variable, as liveVertex does.
+func liveEdge(b binding, name string, g *Graph) (*Edge, *DataError) {
+    e, err := g.edgeStore.Find(b[name].(*Edge).Id)
+    if e == nil || err != nil {
+        return nil, err
+    }
+    g.edgeStore.Track(e)
+    return e, nil
+}
+
+// Returns the current copy of the vertex or edge bound to a variable, or nil if it has
+// been removed.
+func liveAttributable(b binding, name string, g *Graph) (*attributable, *DataError) {
+    if _, ok := b[name].(*Edge); ok {
+        e, err := liveEdge(b, name, g)
+        if e == nil || err != nil {
+            return nil, err
+        }
+        return &e.attributable, nil
+    }
+    v, err := liveVertex(b, name, g)
+    if v == nil || err != nil {
+        return nil, err
+    }
+    return &v.attributable, nil
+}
+
+// Returns the values of attribute filters by key.
+func filterValues(filters []attributeFilter) map[string]Any {
+    values := make(map[string]Any, len(filters))
+    for _, f := range filters {
+        values[f.key] = f.value
+    }
+    return values
+}
+
+// Sets the attributes of a new edge in order of key.
+func setEdgeValues(e *Edge, values map[string]Any, g *Graph) *DataError {
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        if err := e.Set(key, values[key], g); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Plans a statement that changes the graph.
+func (p *planner) mutation(s query.Statement, input operator) (operator, *DataError) {
+    var op operator
+    var err *DataError
+    name := ""
+    switch s := s.(type) {
+    case *query.CreateStatement:
+        op, err = p.create(s, input)
+        name = "Create"
+    case *query.MergeStatement:
+        op, err = p.merge(s, input)
+        name = "Merge"
+    case *query.SetStatement:
+        op, err = p.set(s, input)
+        name = "SetAttributes"
+    case *query.RemoveStatement:
+        op, err = p.remove(s, input)
+        name = "RemoveAttributes"
+    case *query.DeleteStatement:
+        op, err = p.delete(s, input)
+        name = "Delete"
+    }
+    if err != nil {
+        return nil, err
+    }
+    return p.step(op, name, fmt.Sprint(s)), nil
+}
+
+// Plans a create statement.
+func (p *planner) create(s *query.CreateStatement, input operator) (operator, *DataError) {
+    switch pattern := s.Pattern.(type) {
+    case *query.VertexPattern:
+        class, values, err := p.newVertex(pattern)
+        if err != nil {
+            return nil, err
+        }
+        variable := ""
+        if pattern.Var != nil {
+            if err = p.bind(pattern.Var, vertexVariable, false); err != nil {
+                return nil, err
+            }
+            variable = pattern.Var.Name
+        }
+        return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+            v, err := g.AddVertexWith(class, values)
+            if err != nil {
+                return nil, err
+            }
+            if variable != "" {
+                b = b.with(variable, v)
+            }
+            return []binding{b}, nil
+        }}, nil
+    case *query.EdgePattern:
+        from, to, err := p.newEdgeEnds(pattern)
+        if err != nil {
+            return nil, err
+        }
+        attributes, err := p.attributeFilters(pattern.Attributes)
+        if err != nil {
+            return nil, err
+        }
+        values := filterValues(attributes)
+        variable := ""
+        if pattern.Var != nil {
+            if err = p.bind(pattern.Var, edgeVariable, false); err != nil {
+                return nil, err
+            }
+            variable = pattern.Var.Name
+        }
+        label := pattern.Label.Name
+        return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+            e, err := addEdgeBetween(b, from, to, label, values, g)
+            if err != nil {
+                return nil, err
+            }
+            if variable != "" {
+                b = b.with(variable, e)
+            }
+            return []binding{b}, nil
+        }}, nil
+    }
+    return nil, queryError(s.Pos(), "a path can not be created; create its vertices and edges one at a time")
+}
+
+// Plans the class and attributes of a vertex to be created. The class is Vertex if the
+// pattern does not name one.
+func (p *planner) newVertex(pattern *query.VertexPattern) (*Class, map[string]Any, *DataError) {
+    class := p.g.C("Vertex")
+    if pattern.Class != nil {
+        if class = p.g.C(pattern.Class.Name); class == nil {
+            return nil, nil, queryError(pattern.Class.Pos(), "there is no class named " + pattern.Class.Name)
+        }
+    }
+    attributes, err := p.attributeFilters(pattern.Attributes)
+    if err != nil {
+        return nil, nil, err
+    }
+    return class, filterValues(attributes), nil
+}
+
+// Checks that an edge to be created has a label and goes between bound vertices,
+// returning the variables of the vertices.
+func (p *planner) newEdgeEnds(pattern *query.EdgePattern) (string, string, *DataError) {
+    if pattern.Label == nil {
+        return "", "", queryError(pattern.Pos(), "a created edge must have a label")
+    }
+    if pattern.Length != nil {
+        return "", "", queryError(pattern.Pos(), "a sequence of edges can not be created")
+    }
+    ends := make([]string, 2)
+    for n, v := range []*query.VertexPattern{pattern.From, pattern.To} {
+        if v == nil || v.Var == nil || v.Class != nil || v.Attributes != nil || p.variables[v.Var.Name] != vertexVariable {
+            pos := pattern.Pos()
+            if v != nil {
+                pos = v.Pos()
+            }
+            return "", "", queryError(pos, "the vertices of a created edge must be bound variables")
+        }
+        ends[n] = v.Var.Name
+    }
+    return ends[0], ends[1], nil
+}
+
+// Adds an edge between the vertices bound to two variables.
+func addEdgeBetween(b binding, from string, to string, label string, values map[string]Any, g *Graph) (*Edge, *DataError) {
+    start, err := liveVertex(b, from, g)
+    if err != nil {
+        return nil, err
+    }
+    end, err := liveVertex(b, to, g)
+    if err != nil {
+        return nil, err
+    }
+    if start == nil || end == nil {
+        return nil, dataError("An edge can not be created for a vertex that was deleted.", nil, nil)
+    }
+    e, err := g.AddEdge(start, end, label)
+    if err != nil {
+        return nil, err
+    }
+    if err = setEdgeValues(e, values, g); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// Plans a merge statement, which matches its pattern and creates it for each binding
+// it does not match.
+func (p *planner) merge(s *query.MergeStatement, input operator) (operator, *DataError) {
+    switch pattern := s.Pattern.(type) {
+    case *query.VertexPattern:
+        class, values, err := p.newVertex(pattern)
+        if err != nil {
+            return nil, err
+        }
+        f, err := p.vertexFilter(pattern)
+        if err != nil {
+            return nil, err
+        }
+        return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+            ids, err := f.candidates(b, g)
+            if err != nil {
+                return nil, err
+            }
+            found := make([]binding, 0)
+            for id := ids.next(); id != 0; id = ids.next() {
+                v, err := g.vertexStore.Find(id)
+                if err != nil {
+                    return nil, err
+                }
+                if v == nil {
+                    continue
+                }
+                ok, err := f.matches(v, b, g)
+                if err != nil {
+                    return nil, err
+                }
+                if ok {
+                    found = append(found, f.bind(v, b))
+                }
+            }
+            if ids.err != nil {
+                return nil, ids.err
+            }
+            if len(found) > 0 || f.bound {
+                return found, nil
+            }
+            v, err := g.AddVertexWith(class, values)
+            if err != nil {
+                return nil, err
+            }
+            return []binding{f.bind(v, b)}, nil
+        }}, nil
+    case *query.EdgePattern:
+        from, to, err := p.newEdgeEnds(pattern)
+        if err != nil {
+            return nil, err
+        }
+        f, err := p.edgeFilter(pattern)
+        if err != nil {
+            return nil, err
+        }
+        f.from = &vertexFilter{variable: from, bound: true}
+        f.to = &vertexFilter{variable: to, bound: true}
+        p.chooseStart(f)
+        values := filterValues(f.attributes)
+        return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+            if f.missing {
+                // the label may have been added by an earlier binding
+                if l, err := g.labelStore.findByValue(f.labelName, g); err != nil {
+                    return nil, err
+                } else if l != nil {
+                    f.label, f.missing = l.Id, false
+                }
+            }
+            ids, err := f.candidates(b, g)
+            if err != nil {
+                return nil, err
+            }
+            found := make([]binding, 0)
+            for id := ids.next(); id != 0; id = ids.next() {
+                e, err := g.edgeStore.Find(id)
+                if err != nil {
+                    return nil, err
+                }
+                if e == nil {
+                    continue
+                }
+                ok, matched, err := f.matches(e, b, g)
+                if err != nil {
+                    return nil, err
+                }
+                if ok {
+                    found = append(found, matched)
+                }
+            }
+            if ids.err != nil {
+                return nil, ids.err
+            }
+            if len(found) > 0 || f.bound {
+                return found, nil
+            }
+            e, err := addEdgeBetween(b, from, to, f.labelName, values, g)
+            if err != nil {
+                return nil, err
+            }
+            if f.variable != "" {
+                b = b.with(f.variable, e)
+            }
+            return []binding{b}, nil
+        }}, nil
+    }
+    return nil, queryError(s.Pos(), "a path can not be merged; merge its vertices and edges one at a time")
+}
+
+// Checks that the variable of a property is bound.
+func (p *planner) boundProperty(property *query.Property) *DataError {
+    if _, ok := p.variables[property.Var.Name]; !ok {
+        return queryError(property.Var.Pos(), "variable " + property.Var.Name + " is not bound")
+    }
+    return nil
+}
+
+// Plans a set statement. Setting an attribute to a missing value removes it.
+func (p *planner) set(s *query.SetStatement, input operator) (operator, *DataError) {
+    targets := make([]*query.Property, len(s.Assignments))
+    values := make([]queryValue, len(s.Assignments))
+    for n, a := range s.Assignments {
+        if err := p.boundProperty(a.Target); err != nil {
+            return nil, err
+        }
+        value, err := p.expression(a.Value)
+        if err != nil {
+            return nil, err
+        }
+        targets[n], values[n] = a.Target, value
+    }
+    return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+        // every value is computed before any attribute is changed
+        computed := make([]Any, len(values))
+        for n, value := range values {
+            var err *DataError
+            if computed[n], err = value(b, g); err != nil {
+                return nil, err
+            }
+        }
+        for n, target := range targets {
+            owner, err := liveAttributable(b, target.Var.Name, g)
+            if err != nil {
+                return nil, err
+            }
+            if owner == nil {
+                continue
+            }
+            if computed[n] == nil {
+                err = owner.RemoveAttributeByKey(target.Key.Name, g)
+            } else {
+                err = owner.Set(target.Key.Name, computed[n], g)
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+        return []binding{refresh(b, g)}, nil
+    }}, nil
+}
+
+// Plans a remove statement.
+func (p *planner) remove(s *query.RemoveStatement, input operator) (operator, *DataError) {
+    for _, property := range s.Properties {
+        if err := p.boundProperty(property); err != nil {
+            return nil, err
+        }
+    }
+    return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+        for _, property := range s.Properties {
+            owner, err := liveAttributable(b, property.Var.Name, g)
+            if err != nil {
+                return nil, err
+            }
+            if owner == nil {
+                continue
+            }
+            if err = owner.RemoveAttributeByKey(property.Key.Name, g); err != nil {
+                return nil, err
+            }
+        }
+        return []binding{refresh(b, g)}, nil
+    }}, nil
+}
+
+// Plans a delete statement. Deleting a vertex also deletes its edges, and a vertex or
+// edge that was already deleted is skipped.
+func (p *planner) delete(s *query.DeleteStatement, input operator) (operator, *DataError) {
+    for _, v := range s.Vars {
+        if _, ok := p.variables[v.Name]; !ok {
+            return nil, queryError(v.Pos(), "variable " + v.Name + " is not bound")
+        }
+    }
+    return &mutation{g: p.g, input: input, apply: func(b binding, g *Graph) ([]binding, *DataError) {
+        for _, name := range s.Vars {
+            switch b[name.Name].(type) {
+            case *Vertex:
+                v, err := liveVertex(b, name.Name, g)
+                if err == nil && v != nil {
+                    err = g.RemoveVertex(v)
+                }
+                if err != nil {
+                    return nil, err
+                }
+            case *Edge:
+                e, err := liveEdge(b, name.Name, g)
+                if err == nil && e != nil {
+                    err = g.RemoveEdge(e)
+                }
+                if err != nil {
+                    return nil, err
+                }
+            }
+        }
+        return []binding{b}, nil
+    }}, nil
+}
+
+// Returns a binding with each variable bound to the current copy of its vertex or edge,
+// so that the values yielded for it include the changes made by the query.
+func refresh(b binding, g *Graph) binding {
+    c := make(binding, len(b))
+    for name, value := range b {
+        c[name] = value
+        switch value.(type) {
+        case *Vertex:
+            if v, _ := liveVertex(b, name, g); v != nil {
+                c[name] = v
+            }
+        case *Edge:
+            if e, _ := liveEdge(b, name, g); e != nil {
+                c[name] = e
+            }
+        }
+    }
+    return c
+}
+
+// Runs a query that changes the graph as one transaction. Every row is read before the
+// query returns, and the changes are written if it succeeds. If it fails, every change
+// it made is discarded by reading the graph again from its files.
+func (g *Graph) transact(r *queryResult) *DataError {
+    // changes made before the query are kept whether or not it succeeds
+    if err := g.Write(); err != nil {
+        return err
+    }
+    rows := make([]*row, 0)
+    for {
+        next, err := r.input.next()
+        if err == nil && next == nil {
+            break
+        }
+        if err != nil {
+            if rollbackErr := g.rollback(); rollbackErr != nil {
+                return rollbackErr
+            }
+            return err
+        }
+        rows = append(rows, next)
+    }
+    if err := g.Write(); err != nil {
+        return err
+    }
+    r.input = &bufferedRows{rows}
+    return nil
+}
+
+// Discards the changes made to the graph since it was last written, reading the graph
+// again from its files.
+// The classes keep their place in memory, taking the state read from the files, so the
+// classes a caller still holds go on being the classes of the graph. So do the vertices
+// and edges that are still held, which the query may have changed.
+func (g *Graph) rollback() *DataError {
+    classes := g.classStore.classes
+    vertices, edges := g.vertexStore.loaded, g.edgeStore.loaded
+    g.shutdown()
+    if err := g.openStores(); err != nil {
+        return err
+    }
+    for i, c := range g.classStore.classes {
+        if i < len(classes) {
+            *classes[i] = *c
+            g.classStore.classes[i] = classes[i]
+        }
+    }
+    for _, p := range vertices {
+        if v := p.Value(); v != nil {
+            if err := g.vertexStore.reload(v); err != nil {
+                return err
+            }
+        }
+    }
+    for _, p := range edges {
+        if e := p.Value(); e != nil {
+            if err := g.edgeStore.reload(e); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// An operator that returns rows that have already been read.
+type bufferedRows struct {
+    rows []*row
+}
+
+func (r *bufferedRows) next() (*row, *DataError) {
+    if len(r.rows) == 0 {
+        return nil, nil
+    }
+    next := r.rows[0]
+    r.rows = r.rows[1:]
+    return next, nil
+}
@@ -0,0 +1,350 @@
+package data
+
+import (
+    "encoding/base64"
+    "fmt"
+    "hash/fnv"
+    "math"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/wardlem/graphlite/query"
+    "github.com/wardlem/graphlite/util"
+)
+
+// Plans the order by, skip, and limit clauses of a yield statement, wrapping the
+// operator that yields its rows.
+func (p *planner) page(s *query.YieldStatement, input rowOperator, r *queryResult, cursor string) (rowOperator, *DataError) {
+    op := input
+    if s.OrderBy != nil {
+        sorted := &sortRows{input: input, width: len(s.Values)}
+        for _, k := range s.OrderBy {
+            sorted.descending = append(sorted.descending, k.Descending)
+            sorted.positions = append(sorted.positions, k.Pos())
+        }
+        if cursor != "" {
+            after, err := decodeCursor(cursor, r.hash, len(s.OrderBy))
+            if err != nil {
+                return nil, err
+            }
+            sorted.after = after
+        }
+        r.ordered = true
+        resumed := ""
+        if cursor != "" {
+            resumed = "after the cursor"
+        }
+        op = p.rowStep(sorted, "Sort", orderOf(s.OrderBy), resumed)
+    } else if cursor != "" {
+        return nil, cursorError("the query has no order by clause")
+    }
+
+    skip, limit := int64(0), int64(-1)
+    var err *DataError
+    if s.Skip != nil {
+        if skip, err = p.rowCount(s.Skip); err != nil {
+            return nil, err
+        }
+    }
+    if s.Limit != nil {
+        if limit, err = p.rowCount(s.Limit); err != nil {
+            return nil, err
+        }
+    }
+    if skip > 0 || limit >= 0 {
+        details := make([]string, 0, 2)
+        if s.Skip != nil {
+            details = append(details, "skip " + fmt.Sprint(s.Skip))
+        }
+        if s.Limit != nil {
+            details = append(details, "limit " + fmt.Sprint(s.Limit))
+        }
+        op = p.rowStep(&pageRows{input: op, skip: skip, limit: limit}, "Page", details...)
+    }
+    return op, nil
+}
+
+// Returns the details of a plan step for the keys rows are sorted by.
+func orderOf(keys []*query.OrderKey) string {
+    parts := make([]string, len(keys))
+    for n, k := range keys {
+        parts[n] = fmt.Sprint(k)
+    }
+    return strings.Join(parts, ", ")
+}
+
+// Returns the number of rows given to skip or limit.
+func (p *planner) rowCount(e query.Expr) (int64, *DataError) {
+    value, err := p.value(e)
+    if err != nil {
+        return 0, err
+    }
+    n, ok := toNumber(value)
+    if i, integer := n.(int64); ok && integer && i >= 0 {
+        return i, nil
+    }
+    return 0, queryError(e.Pos(), "the number of rows must be an integer that is not negative")
+}
+
+// An operator that sorts the rows of its input by the values that follow the yielded
+// values in each row. The input is read in full before the first row is returned.
+type sortRows struct {
+    input rowOperator
+    width int                   // the number of yielded values in each row
+    descending []bool           // whether each value is sorted in descending order
+    positions []query.Position  // where each value is in the query
+    after *row                  // the row a cursor was taken from, or nil
+    rows []*row                 // the rows still to be returned, or nil if the input has not been read
+}
+
+func (r *sortRows) next() (*row, *DataError) {
+    if r.rows == nil {
+        if err := r.sort(); err != nil {
+            return nil, err
+        }
+    }
+    if len(r.rows) == 0 {
+        return nil, nil
+    }
+    next := r.rows[0]
+    r.rows = r.rows[1:]
+    return next, nil
+}
+
+// Reads and sorts the input, leaving out the rows up to the cursor's.
+func (r *sortRows) sort() *DataError {
+    rows := make([]*row, 0)
+    for {
+        next, err := r.input.next()
+        if err != nil {
+            return err
+        }
+        if next == nil {
+            break
+        }
+        next.keys = next.values[r.width:]
+        next.values = next.values[:r.width]
+        for n, key := range next.keys {
+            if number, ok := toNumber(key); ok {
+                next.keys[n] = number
+            } else if _, ok := rankOf(key); !ok {
+                return queryError(r.positions[n], fmt.Sprintf("can not order by %T values", key))
+            }
+        }
+        if r.after == nil || r.compare(next, r.after) > 0 {
+            rows = append(rows, next)
+        }
+    }
+    sort.Slice(rows, func(a, b int) bool { return r.compare(rows[a], rows[b]) < 0 })
+    r.rows = rows
+    return nil
+}
+
+// Compares two rows by their keys, then by what they were yielded for.
+func (r *sortRows) compare(a *row, b *row) int {
+    for n := range a.keys {
+        c := compareKeys(a.keys[n], b.keys[n])
+        if r.descending[n] {
+            c = -c
+        }
+        if c != 0 {
+            return c
+        }
+    }
+    return strings.Compare(a.identity, b.identity)
+}
+
+// Returns the rank of the type of a value in the order of rows: missing values first,
+// then numbers, strings, booleans, times, vertices and edges. Returns false for a value
+// that can not be sorted.
+func rankOf(value Any) (int, bool) {
+    switch value.(type) {
+    case nil:
+        return 0, true
+    case int64, float64:
+        return 1, true
+    case string:
+        return 2, true
+    case bool:
+        return 3, true
+    case time.Time:
+        return 4, true
+    case *Vertex:
+        return 5, true
+    case *Edge:
+        return 6, true
+    }
+    return 0, false
+}
+
+// Compares two values a row can be sorted by.
+func compareKeys(a Any, b Any) int {
+    ra, _ := rankOf(a)
+    rb, _ := rankOf(b)
+    if ra != rb {
+        return order(ra < rb, ra > rb)
+    }
+    switch a := a.(type) {
+    case bool:
+        b := b.(bool)
+        return order(!a && b, a && !b)
+    case *Vertex:
+        b := b.(*Vertex)
+        return order(a.Id < b.Id, a.Id > b.Id)
+    case *Edge:
+        b := b.(*Edge)
+        return order(a.Id < b.Id, a.Id > b.Id)
+    }
+    c, _ := compareValues(a, b)
+    return c
+}
+
+// An operator that skips rows of its input and limits how many it returns.
+type pageRows struct {
+    input rowOperator
+    skip int64
+    limit int64 // -1 for no limit
+}
+
+func (r *pageRows) next() (*row, *DataError) {
+    for ; r.skip > 0; r.skip-- {
+        next, err := r.input.next()
+        if next == nil || err != nil {
+            return nil, err
+        }
+    }
+    if r.limit == 0 {
+        return nil, nil
+    }
+    if r.limit > 0 {
+        r.limit--
+    }
+    return r.input.next()
+}
+
+// Returns a hash of the canonical form of a query and the values of its parameters,
+// which a cursor is checked against.
+func queryHash(q *query.Query, params map[string]Any) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(q.String()))
+    names := make([]string, 0, len(params))
+    for name := range params {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        switch v := params[name].(type) {
+        case *Vertex:
+            fmt.Fprintf(h, "\x00%s\x00vertex\x00%d", name, v.Id)
+        case *Edge:
+            fmt.Fprintf(h, "\x00%s\x00edge\x00%d", name, v.Id)
+        case time.Time:
+            fmt.Fprintf(h, "\x00%s\x00time\x00%d", name, v.UnixNano())
+        default:
+            fmt.Fprintf(h, "\x00%s\x00%T\x00%v", name, v, v)
+        }
+    }
+    return h.Sum64()
+}
+
+// Creates the error for a cursor that can not be used.
+func cursorError(message string) *DataError {
+    return dataError("Invalid cursor: " + message, nil, nil)
+}
+
+// Encodes the place of a row in the order of a query as a cursor. The cursor holds the
+// hash of the query, the values the row is sorted by, and its identity.
+func encodeCursor(hash uint64, r *row) string {
+    b := make([]byte, 9, 64)
+    util.PutUint64(b[0:8], hash)
+    b[8] = byte(len(r.keys))
+    for _, key := range r.keys {
+        var data [8]byte
+        switch v := key.(type) {
+        case nil:
+            b = append(b, 'n')
+        case int64:
+            util.PutUint64(data[:], uint64(v))
+            b = append(append(b, 'i'), data[:]...)
+        case float64:
+            util.PutUint64(data[:], math.Float64bits(v))
+            b = append(append(b, 'f'), data[:]...)
+        case string:
+            util.PutUint32(data[:4], uint32(len(v)))
+            b = append(append(append(b, 's'), data[:4]...), v...)
+        case bool:
+            b = append(b, 'b', 0)
+            if v {
+                b[len(b) - 1] = 1
+            }
+        case time.Time:
+            util.PutUint64(data[:], uint64(v.UnixNano()))
+            b = append(append(b, 't'), data[:]...)
+        case *Vertex:
+            util.PutUint32(data[:4], v.Id)
+            b = append(append(b, 'v'), data[:4]...)
+        case *Edge:
+            util.PutUint32(data[:4], v.Id)
+            b = append(append(b, 'e'), data[:4]...)
+        }
+    }
+    var length [4]byte
+    util.PutUint32(length[:], uint32(len(r.identity)))
+    b = append(append(b, length[:]...), r.identity...)
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decodes a cursor into the row it was taken from, which has only its keys and
+// identity. The cursor must come from a query with the hash and number of keys.
+func decodeCursor(cursor string, hash uint64, keys int) (*row, *DataError) {
+    invalid := cursorError("the cursor is not valid")
+    b, e := base64.RawURLEncoding.DecodeString(cursor)
+    if e != nil || len(b) < 9 {
+        return nil, invalid
+    }
+    if util.Uint64(b[0:8]) != hash || int(b[8]) != keys {
+        return nil, cursorError("the cursor was not taken from this query")
+    }
+    r := &row{keys: make([]Any, keys)}
+    b = b[9:]
+    // the number of bytes each kind of value takes after its tag
+    sizes := map[byte]int{'n': 0, 'i': 8, 'f': 8, 's': 4, 'b': 1, 't': 8, 'v': 4, 'e': 4}
+    for n := range r.keys {
+        if len(b) == 0 {
+            return nil, invalid
+        }
+        size, ok := sizes[b[0]]
+        if !ok || len(b) < size + 1 {
+            return nil, invalid
+        }
+        tag, data := b[0], b[1:size + 1]
+        b = b[size + 1:]
+        switch tag {
+        case 'i':
+            r.keys[n] = int64(util.Uint64(data))
+        case 'f':
+            r.keys[n] = math.Float64frombits(util.Uint64(data))
+        case 's':
+            length := int(util.Uint32(data))
+            if len(b) < length {
+                return nil, invalid
+            }
+            r.keys[n] = string(b[:length])
+            b = b[length:]
+        case 'b':
+            r.keys[n] = data[0] != 0
+        case 't':
+            r.keys[n] = time.Unix(0, int64(util.Uint64(data)))
+        case 'v':
+            r.keys[n] = &Vertex{Id: util.Uint32(data)}
+        case 'e':
+            r.keys[n] = &Edge{Id: util.Uint32(data)}
+        }
+    }
+    if len(b) < 4 || int(util.Uint32(b[0:4])) != len(b) - 4 {
+        return nil, invalid
+    }
+    r.identity = string(b[4:])
+    return r, nil
+}
@@ -0,0 +1,231 @@
+package data
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/wardlem/graphlite/query"
+)
+
+// A step of a query plan: an operator and what it works on.
+// The steps of a plan form a chain, each reading the rows of the step before it.
+type planStep struct {
+    operator string  // how the step finds or changes what it does
+    details string
+    rows int64       // the rows the step produced, when profiled
+    reads uint64     // the reads made by the step and the steps before it, when profiled
+}
+
+// Adds a step to the plan for an operator, returning the operator to chain the next
+// step to.
+func (p *planner) step(op operator, name string, details ...string) operator {
+    s := p.addStep(name, details)
+    if !p.profiling {
+        return op
+    }
+    return &profiledOperator{g: p.g, input: op, step: s}
+}
+
+// Adds a step to the plan for an operator that yields rows, as step does.
+func (p *planner) rowStep(op rowOperator, name string, details ...string) rowOperator {
+    s := p.addStep(name, details)
+    if !p.profiling {
+        return op
+    }
+    return &profiledRows{g: p.g, input: op, step: s}
+}
+
+// Adds a step with the details that are not empty.
+func (p *planner) addStep(name string, details []string) *planStep {
+    parts := make([]string, 0, len(details))
+    for _, d := range details {
+        if d != "" {
+            parts = append(parts, d)
+        }
+    }
+    s := &planStep{operator: name, details: strings.Join(parts, "; ")}
+    p.steps = append(p.steps, s)
+    return s
+}
+
+// Returns the number of vertices, edges and attributes read from the stores of the graph.
+func (g *Graph) reads() uint64 {
+    return g.vertexStore.finds + g.edgeStore.finds + g.attributeStore.finds
+}
+
+// An operator that counts the bindings and reads of the operator it wraps.
+type profiledOperator struct {
+    g *Graph
+    input operator
+    step *planStep
+}
+
+func (o *profiledOperator) next() (binding, *DataError) {
+    before := o.g.reads()
+    b, err := o.input.next()
+    o.step.reads += o.g.reads() - before
+    if b != nil {
+        o.step.rows++
+    }
+    return b, err
+}
+
+// An operator that counts the rows and reads of the row operator it wraps.
+type profiledRows struct {
+    g *Graph
+    input rowOperator
+    step *planStep
+}
+
+func (o *profiledRows) next() (*row, *DataError) {
+    before := o.g.reads()
+    r, err := o.input.next()
+    o.step.reads += o.g.reads() - before
+    if r != nil {
+        o.step.rows++
+    }
+    return r, err
+}
+
+// Returns the result of explaining or profiling a query, with a row for each step of its
+// plan. The query must already have been run if it is profiled.
+func (r *queryResult) planResult(profiled bool) *queryResult {
+    plan := &queryResult{columns: []string{"operator", "details"}}
+    if profiled {
+        plan.columns = append(plan.columns, "rows", "reads")
+    }
+    rows := make([]*row, len(r.steps))
+    previous := uint64(0)
+    for n, s := range r.steps {
+        values := []Any{s.operator, s.details}
+        if profiled {
+            // each step's count includes the reads of the steps before it
+            values = append(values, s.rows, int64(s.reads - previous))
+            previous = s.reads
+        }
+        rows[n] = &row{values: values}
+    }
+    plan.input = &bufferedRows{rows}
+    return plan
+}
+
+// Runs a query that is being profiled, reading all of its rows.
+func (g *Graph) profile(r *queryResult) *DataError {
+    if r.mutates {
+        return g.transact(r)
+    }
+    for {
+        next, err := r.input.next()
+        if next == nil || err != nil {
+            return err
+        }
+    }
+}
+
+// Returns how a variable is shown in a plan. Vertices without a variable in a path are
+// bound to hidden names.
+func shown(variable string) string {
+    if strings.HasPrefix(variable, "#") {
+        return "the previous vertex"
+    }
+    return variable
+}
+
+// Returns the details of a plan step for the variables it joins on, which were bound by
+// the steps before it.
+func joins(variables ...string) string {
+    if len(variables) == 0 {
+        return ""
+    }
+    names := make([]string, len(variables))
+    for n, v := range variables {
+        names[n] = shown(v)
+    }
+    return "joins on " + strings.Join(names, ", ")
+}
+
+// Returns the operator that finds the vertices that match a filter, and how it finds them.
+func (f *vertexFilter) access(g *Graph) (string, string) {
+    switch {
+    case f.bound:
+        return "BoundVertex", ""
+    case f.class != nil && len(f.attributes) > 0:
+        if def, _, err := f.class.findIndex(valueIndex, []string{f.attributes[0].key}, g); err == nil && def != nil {
+            return "IndexLookup", "using the index on " + f.attributes[0].key
+        }
+        return "ClassScan", ""
+    case f.class != nil:
+        return "ClassScan", ""
+    }
+    return "VertexScan", ""
+}
+
+// Returns the variables a vertex filter joins on.
+func (f *vertexFilter) joins() []string {
+    if f != nil && f.bound {
+        return []string{f.variable}
+    }
+    return nil
+}
+
+// Adds the step for a match of a vertex pattern.
+func (p *planner) vertexStep(m *vertexMatch, pattern fmt.Stringer) operator {
+    name, how := m.filter.access(p.g)
+    return p.step(m, name, pattern.String(), how, joins(m.filter.joins()...))
+}
+
+// Adds the step for a match of an edge pattern, which says which end the edges are
+// found from.
+func (p *planner) edgeStep(m *edgeMatch, pattern fmt.Stringer) operator {
+    f := m.filter
+    variables := f.from.joins()
+    variables = append(variables, f.to.joins()...)
+    if f.bound {
+        variables = append([]string{f.variable}, variables...)
+    }
+    name, how := "EdgeScan", ""
+    end, out := f.via, f.out
+    switch {
+    case f.bound:
+        name = "BoundEdge"
+    case end != nil:
+        direction := "in to "
+        if out {
+            direction = "out from "
+        }
+        if end.bound {
+            name, how = "Expand", direction + shown(end.variable)
+        } else {
+            scan, index := end.access(p.g)
+            name, how = scan + "+Expand", direction + "each vertex found"
+            if index != "" {
+                how += " " + index
+            }
+        }
+    case f.label != 0 || f.missing:
+        name = "LabelScan"
+    }
+    return p.step(m, name, pattern.String(), how, joins(variables...))
+}
+
+// Adds the step for following sequences of edges from a vertex.
+func (p *planner) expandStep(m *expandMatch, pattern fmt.Stringer) operator {
+    direction := "in to "
+    if m.out {
+        direction = "out from "
+    }
+    length := fmt.Sprintf("%d or more edges", m.min)
+    if m.max >= 0 {
+        length = fmt.Sprintf("%d to %d edges", m.min, m.max)
+    }
+    return p.step(m, "VarLengthExpand", pattern.String(), direction + shown(m.from), length, joins(m.from))
+}
+
+// Returns the details of a plan step for a list of expressions.
+func listOf(values []query.Expr) string {
+    parts := make([]string, len(values))
+    for n, e := range values {
+        parts[n] = fmt.Sprint(e)
+    }
+    return strings.Join(parts, ", ")
+}
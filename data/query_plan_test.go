@@ -0,0 +1,338 @@
+package data
+
+import(
+	"testing"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func TestStats (t *testing.T) {
+    db, g := newTestGraph(t, "stats")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    employee := g.AddClass("Employee", person)
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann", "age": 40})
+    bob, _ := g.AddVertexWith(employee, map[string]Any{"name": "Bob"})
+    cat, _ := g.AddVertexWith(employee, map[string]Any{"name": "Cat"})
+    dan, _ := g.AddVertex(person)
+    g.AddEdge(ann, bob, "knows")
+    g.AddEdge(ann, cat, "knows")
+    g.AddEdge(ann, dan, "knows")
+    e, _ := g.AddEdge(bob, cat, "manages")
+    e.Set("since", 2010, g)
+    g.RemoveVertex(dan)
+    
+    check := func(stats Stats, when string) {
+        if stats.Vertices != 3 || stats.Edges != 3 {
+            t.Errorf("%s: expected 3 vertices and 3 edges, got %d and %d", when, stats.Vertices, stats.Edges)
+        }
+        if c := stats.Classes["Person"]; c.Vertices != 1 || c.Total != 3 {
+            t.Errorf("%s: wrong counts for Person: %+v", when, c)
+        }
+        if c := stats.Classes["Employee"]; c.Vertices != 2 || c.Total != 2 {
+            t.Errorf("%s: wrong counts for Employee: %+v", when, c)
+        }
+        if stats.Labels["knows"] != 2 || stats.Labels["manages"] != 1 {
+            t.Errorf("%s: wrong edge counts: %v", when, stats.Labels)
+        }
+        if stats.Keys["name"] != 3 || stats.Keys["age"] != 1 || stats.Keys["since"] != 1 {
+            t.Errorf("%s: wrong key counts: %v", when, stats.Keys)
+        }
+        if stats.AverageDegree != 2 || stats.MaxOutDegree != 2 || stats.MaxInDegree != 2 {
+            t.Errorf("%s: wrong degrees: %v, %d, %d", when, stats.AverageDegree, stats.MaxOutDegree, stats.MaxInDegree)
+        }
+        if stats.FileSizes["vertex"] == 0 || stats.FileSizes["idx"] == 0 {
+            t.Errorf("%s: missing file sizes: %v", when, stats.FileSizes)
+        }
+        if stats.FreeIds["vertex"] != 1 {
+            t.Errorf("%s: expected the removed vertex's id to be free, got %v", when, stats.FreeIds)
+        }
+    }
+    check(g.Stats(), "while open")
+    
+    // the sizes are read again once the graph is written
+    before := g.Stats().FileSizes["idx"]
+    if err := person.CreateRangeIndex("age", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if after := g.Stats().FileSizes["idx"]; after <= before {
+        t.Errorf("index size did not grow with a new index: %d, then %d", before, after)
+    }
+    
+    db.Shutdown()
+    if g, err = constructGraph(db, "stats"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    check(g.Stats(), "after reopening")
+    g.shutdown()
+    
+    // graphs from before the stats store are counted when they are migrated
+    os.Remove(g.storePath("stats"))
+    writeGraphVersion(g, 6)
+    if g, err = constructGraph(db, "stats"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    check(g.Stats(), "after migrating")
+}
+
+func TestStatsSlots (t *testing.T) {
+    _, g := newTestGraph(t, "statsslots")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann", "age": 40})
+    bob, _ := g.AddVertexWith(person, map[string]Any{"name": "Bob"})
+    g.AddEdge(ann, bob, "knows")
+    if err = g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // only the slots of the counters that changed are written
+    before := make([]byte, sizeOf(t, g.statsStore.file))
+    g.statsStore.file.ReadAt(before, 0)
+    g.AddVertexWith(person, map[string]Any{"name": "Cat"})
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    after := make([]byte, sizeOf(t, g.statsStore.file))
+    g.statsStore.file.ReadAt(after, 0)
+    changed := make(map[int]bool)
+    for i := range before {
+        if i < len(after) && before[i] != after[i] {
+            changed[(i - fileHeaderSize) / statsSlotSize] = true
+        }
+    }
+    if len(after) != len(before) || len(changed) != 1 {
+        t.Errorf("expected one slot to be rewritten in place, %d slots changed and the file grew by %d bytes", len(changed), len(after) - len(before))
+    }
+    if err = g.statsStore.readStats(); err != nil || g.Stats().Keys["name"] != 3 {
+        t.Errorf("the changed counter was not read back: %v", err)
+    }
+    
+    // slots that can not be decoded are corruption
+    size := sizeOf(t, g.statsStore.file)
+    g.statsStore.file.WriteAt([]byte{9, 0, 0, 0, 0, 0, 0, 0, 1}, size)
+    if err = g.statsStore.readStats(); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for an unknown counter")
+    }
+    g.statsStore.file.Truncate(size + 4)
+    if err = g.statsStore.readStats(); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for a slot that runs past the end of the file")
+    }
+    g.statsStore.file.Truncate(size)
+}
+
+func TestQueryPlans (t *testing.T) {
+    _, g := newTestGraph(t, "plans")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    asset := g.AddClass("Asset", g.C("Vertex"))
+    person.CreateIndex("name", g)
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann"})
+    bob, _ := g.AddVertexWith(person, map[string]Any{"name": "Bob"})
+    car, _ := g.AddVertexWith(asset, map[string]Any{"name": "car"})
+    g.AddEdge(ann, car, "owns")
+    g.AddEdge(bob, car, "owns")
+    g.AddEdge(ann, bob, "knows")
+    
+    // returns the rows of a query as text, one row to a line
+    run := func(text string) string {
+        r, err := g.Query(text, nil)
+        if err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        lines := make([]string, 0)
+        for r.Next() {
+            lines = append(lines, fmt.Sprint(r.Row()))
+        }
+        if err := r.Err(); err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        return strings.Join(lines, "\n")
+    }
+    
+    tests := []struct {
+        text string
+        expected string
+    }{
+        {`explain p = Person{name: "Ann"}; [owns] FROM (p) TO (a); yield a.name order by a.name limit 1`,
+            `[IndexLookup p = (<Person> {name: "Ann"}); using the index on name]` + "\n" +
+            `[Expand [owns] from (p) to (a); out from p; joins on p]` + "\n" +
+            `[Project a.name]` + "\n" +
+            `[Sort a.name]` + "\n" +
+            `[Page limit 1]`},
+        {`explain a = Asset; [owns] FROM Person TO (a); yield count(*) group by a`,
+            `[ClassScan a = (<Asset>)]` + "\n" +
+            `[Expand [owns] from (<Person>) to (a); in to a; joins on a]` + "\n" +
+            `[Aggregate count(*); group by a]`},
+        {`explain e = [owns] FROM Person; [knows]; ()`,
+            `[ClassScan+Expand e = [owns] from (<Person>); out from each vertex found]` + "\n" +
+            `[LabelScan [knows]]` + "\n" +
+            `[VertexScan ()]` + "\n" +
+            `[Project ]`},
+        {`explain (p <Person>)-[knows *1..2]->()-[owns]->(a); yield a`,
+            `[ClassScan (p <Person>)]` + "\n" +
+            `[VarLengthExpand [knows *1..2] from (p <Person>) to (); out from p; 1 to 2 edges; joins on p]` + "\n" +
+            `[Expand [owns] from () to (a); out from the previous vertex; joins on the previous vertex]` + "\n" +
+            `[Project a]`},
+        {`explain create (v <Asset> {name: "boat"}); set v.value = 3`,
+            `[Create create (v <Asset> {name: "boat"})]` + "\n" +
+            `[SetAttributes set v.value = 3]` + "\n" +
+            `[Project ]`},
+        
+        // profiles count the rows of each step and what it read
+        {`profile p = Person; [owns] FROM (p) TO (a); yield p.name`,
+            `[ClassScan p = (<Person>) 2 2]` + "\n" +
+            `[Expand [owns] from (p) to (a); out from p; joins on p 2 8]` + "\n" +
+            `[Project p.name 2 0]`},
+        {`profile create (v <Asset> {name: "boat"})`,
+            `[Create create (v <Asset> {name: "boat"}) 1 0]` + "\n" +
+            `[Project  1 0]`},
+    }
+    for _, test := range tests {
+        if rows := run(test.text); rows != test.expected {
+            t.Errorf("%s:\nexpected\n%s\ngot\n%s", test.text, test.expected, rows)
+        }
+    }
+    
+    // explained changes are not made, and profiled ones are
+    if rows := run(`a = Asset; yield count(a)`); rows != `[2]` {
+        t.Errorf("expected one asset to be created, got %s", rows)
+    }
+    r, _ := g.Query(`profile p = Person; yield p`, nil)
+    if columns := fmt.Sprint(r.Columns()); columns != `[operator details rows reads]` {
+        t.Errorf("wrong columns: %s", columns)
+    }
+}
+
+// The query of TestQueryPlanner and BenchmarkQueryPlanner, and the same match written
+// to start from every person.
+const (
+    plannedQuery = `(p <Person>)-[works_at]->(c <Company> {name: "Small"})-[located_in]->(<City>); yield p.name`
+    naiveQuery = `p = Person; [works_at] FROM (p) TO (c <Company> {name: "Small"}); [located_in] FROM (c) TO City; yield p.name`
+)
+
+// Creates a skewed graph for testing the planner, where most of the people work at a
+// big company and one in fifty at a small one in another city.
+func createPlannerGraph (tb testing.TB, people int) *Graph {
+    _, g := newTestGraph(tb, "planner")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    company := g.AddClass("Company", g.C("Vertex"))
+    city := g.AddClass("City", g.C("Vertex"))
+    company.CreateIndex("name", g)
+    big, _ := g.AddVertexWith(company, map[string]Any{"name": "Big"})
+    small, _ := g.AddVertexWith(company, map[string]Any{"name": "Small"})
+    paris, _ := g.AddVertexWith(city, map[string]Any{"name": "Paris"})
+    rome, _ := g.AddVertexWith(city, map[string]Any{"name": "Rome"})
+    g.AddEdge(big, paris, "located_in")
+    g.AddEdge(small, rome, "located_in")
+    for n := 0; n < people; n++ {
+        p, _ := g.AddVertexWith(person, map[string]Any{"name": fmt.Sprintf("p%03d", n)})
+        employer := big
+        if n % 50 == 0 {
+            employer = small
+        }
+        g.AddEdge(p, employer, "works_at")
+    }
+    return g
+}
+
+func TestQueryPlanner (t *testing.T) {
+    g := createPlannerGraph(t, 200)
+    
+    // returns the plan of a query and the total reads of its profile
+    profile := func(text string) ([]string, int64) {
+        r, err := g.Query("profile " + text, nil)
+        if err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        operators := make([]string, 0)
+        reads := int64(0)
+        for r.Next() {
+            operators = append(operators, r.Row()[0].(string))
+            reads += r.Row()[3].(int64)
+        }
+        return operators, reads
+    }
+    
+    // the path starts from the company found by its index, not from every person
+    text := plannedQuery
+    operators, reads := profile(text)
+    if s := fmt.Sprint(operators); s != `[IndexLookup Expand Expand Project]` {
+        t.Errorf("wrong plan: %s", s)
+    }
+    _, naive := profile(naiveQuery)
+    if reads * 10 > naive {
+        t.Errorf("expected the planned path to read far less than %d, read %d", naive, reads)
+    }
+    r, _ := g.Query(text + ` order by p.name`, nil)
+    rows := make([]Any, 0)
+    for r.Next() {
+        rows = append(rows, r.Row()[0])
+    }
+    if s := fmt.Sprint(rows); s != `[p000 p050 p100 p150]` {
+        t.Errorf("wrong rows: %s", s)
+    }
+    
+    // an edge is found from its cheaper end, and the most selective attribute is looked up
+    tests := []struct {
+        text string
+        expected string
+    }{
+        {`explain [works_at] FROM Person TO Company{name: "Small"}`,
+            `[[IndexLookup+Expand [works_at] from (<Person>) to (<Company> {name: "Small"}); in to each vertex found using the index on name] [Project ]]`},
+        {`explain [works_at] FROM Person{name: "p001"} TO (c)`,
+            `[[ClassScan+Expand [works_at] from (<Person> {name: "p001"}) to (c); out from each vertex found] [Project ]]`},
+        {`explain [located_in] FROM Company TO City{name: "Rome"}`,
+            `[[ClassScan+Expand [located_in] from (<Company>) to (<City> {name: "Rome"}); out from each vertex found] [Project ]]`},
+        {`explain c = Company{kind: "x", name: "Big"}`, `[[IndexLookup c = (<Company> {kind: "x", name: "Big"}); using the index on name] [Project ]]`},
+        {`explain [works_at *1..2] FROM (x) TO Company{name: "Small"}`,
+            `[[IndexLookup (<Company> {name: "Small"}); using the index on name] [VarLengthExpand [works_at *1..2] from (x) to (<Company> {name: "Small"}); in to the previous vertex; 1 to 2 edges; joins on the previous vertex] [Project ]]`},
+    }
+    for _, test := range tests {
+        r, err := g.Query(test.text, nil)
+        if err != nil {
+            t.Fatalf("%s: %s", test.text, err)
+        }
+        rows := make([][]Any, 0)
+        for r.Next() {
+            rows = append(rows, r.Row())
+        }
+        if s := fmt.Sprint(rows); s != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, s)
+        }
+    }
+}
+
+// Compares the planned query with the naive one on a skewed graph.
+func BenchmarkQueryPlanner (b *testing.B) {
+    g := createPlannerGraph(b, 5000)
+    
+    for _, bench := range []struct {
+        name string
+        text string
+    }{{"planned", plannedQuery}, {"naive", naiveQuery}} {
+        b.Run(bench.name, func(b *testing.B) {
+            for n := 0; n < b.N; n++ {
+                r, err := g.Query(bench.text, nil)
+                if err != nil {
+                    b.Fatal(err)
+                }
+                rows := 0
+                for r.Next() {
+                    rows++
+                }
+                if rows != 100 {
+                    b.Fatalf("expected 100 rows, got %d", rows)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,594 @@
+package data
+
+import(
+	"testing"
+	"fmt"
+)
+
+func TestQuery (t *testing.T) {
+    _, g := newTestGraph(t, "query")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    employee := g.AddClass("Employee", person)
+    asset := g.AddClass("Asset", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann", "age": 40})
+    bob, _ := g.AddVertexWith(employee, map[string]Any{"name": "Bob", "age": 30})
+    car, _ := g.AddVertexWith(asset, map[string]Any{"name": "car"})
+    boat, _ := g.AddVertexWith(asset, map[string]Any{"name": "boat"})
+    owns, _ := g.AddEdge(ann, car, "owns")
+    owns.Set("since", 2010, g)
+    g.AddEdge(bob, boat, "owns")
+    g.AddEdge(ann, bob, "knows")
+    
+    // the vertices of a class and its sub classes are visited in order of id
+    ids := classIds(g.C("Vertex"), g)
+    for _, v := range []*Vertex{ann, bob, car, boat} {
+        if id := ids.next(); id != v.Id {
+            t.Errorf("expected vertex %d of the classes, got %d", v.Id, id)
+        }
+    }
+    if id := ids.next(); id != 0 {
+        t.Errorf("expected the vertices of the classes to end, got %d", id)
+    }
+    
+    // runs a query and returns the names of the vertices in each row
+    run := func(text string, params map[string]Any) [][]Any {
+        r, err := g.Query(text, params)
+        if err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        rows := make([][]Any, 0)
+        for r.Next() {
+            row := r.Row()
+            for n, value := range row {
+                switch value := value.(type) {
+                case *Vertex:
+                    row[n], _ = value.Get("name", g)
+                case *Edge:
+                    row[n] = "edge " + fmt.Sprint(value.Id)
+                }
+            }
+            rows = append(rows, row)
+        }
+        if err := r.Err(); err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        return rows
+    }
+    
+    tests := []struct {
+        text string
+        params map[string]Any
+        expected string
+    }{
+        // sub classes match their super classes
+        {`p = Person; yield p`, nil, `[[Ann] [Bob]]`},
+        {`p = Employee; yield p.name, p.age`, nil, `[[Bob 30]]`},
+        {`(p <Person> {age: 40}); yield p`, nil, `[[Ann]]`},
+        {`p = Person{name: $name}; yield p, $name`, map[string]Any{"name": "Bob"}, `[[Bob Bob]]`},
+        {`v = (); yield v`, nil, `[[Ann] [Bob] [car] [boat]]`},
+        
+        // edges are matched by label, attributes, and the vertices at either end
+        {`e = [owns] FROM Person{name: "Ann"} TO Asset; yield e, e.since`, nil, `[[edge 1 2010]]`},
+        {`e = [owns] FROM Employee; yield e`, nil, `[[edge 2]]`},
+        {`[owns {since: 2010}] FROM (p) TO (a); yield p, a`, nil, `[[Ann car]]`},
+        {`[] FROM (p <Person>) TO (q <Person>); yield p, q`, nil, `[[Ann Bob]]`},
+        {`[missing] FROM (p); yield p`, nil, `[]`},
+        
+        // variables bound by one statement constrain the next
+        {`p = Employee; [owns] FROM (p) TO (a); yield p, a`, nil, `[[Bob boat]]`},
+        {`a = Asset{name: "car"}; [] FROM (p) TO (a); yield p.name, p.age, p.missing, "literal"`, nil,
+            `[[Ann 40 <nil> literal]]`},
+    }
+    for _, test := range tests {
+        if rows := fmt.Sprint(run(test.text, test.params)); rows != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.text, test.expected, rows)
+        }
+    }
+    
+    r, _ := g.Query(`e = [owns]; yield e, e.since`, nil)
+    if columns := fmt.Sprint(r.Columns()); columns != `[e e.since]` {
+        t.Errorf("wrong columns: %s", columns)
+    }
+    
+    errors := []struct {
+        text string
+        expected string
+    }{
+        {`p = Persn; yield p`, `Data Error: Query error at 1:5: there is no class named Persn`},
+        {`p = Person; yield q`, `Data Error: Query error at 1:19: variable q is not bound`},
+        {`p = Person; p = Asset`, `Data Error: Query error at 1:13: variable p is already bound`},
+        {`e = [owns]; [] FROM (e)`, `Data Error: Query error at 1:22: variable e is not bound to a vertex`},
+        {`Person{name: $name}`, `Data Error: Query error at 1:14: no value was given for parameter $name`},
+        {`yield 1; p = Person`, `Data Error: Query error at 1:1: yield must be the last statement`},
+    }
+    for _, test := range errors {
+        _, err := g.Query(test.text, nil)
+        if err == nil {
+            t.Errorf("%s: expected an error", test.text)
+            continue
+        }
+        if err.Error() != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+    if _, err := g.Query(`Person{`, nil); err == nil {
+        t.Errorf("expected a syntax error")
+    }
+    if _, err := g.Query(`Person{name: $name}`, map[string]Any{"name": []int{}}); err == nil {
+        t.Errorf("expected an error for an unsupported parameter")
+    }
+}
+
+func TestQueryPaths (t *testing.T) {
+    _, g := newTestGraph(t, "paths")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    company := g.AddClass("Company", g.C("Vertex"))
+    city := g.AddClass("City", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann"})
+    bob, _ := g.AddVertexWith(person, map[string]Any{"name": "Bob"})
+    cat, _ := g.AddVertexWith(person, map[string]Any{"name": "Cat"})
+    acme, _ := g.AddVertexWith(company, map[string]Any{"name": "Acme"})
+    globex, _ := g.AddVertexWith(company, map[string]Any{"name": "Globex"})
+    paris, _ := g.AddVertexWith(city, map[string]Any{"name": "Paris"})
+    rome, _ := g.AddVertexWith(city, map[string]Any{"name": "Rome"})
+    g.AddEdge(ann, acme, "works_at")
+    e, _ := g.AddEdge(bob, globex, "works_at")
+    e.Set("since", 2015, g)
+    g.AddEdge(cat, acme, "works_at")
+    g.AddEdge(acme, paris, "located_in")
+    g.AddEdge(globex, rome, "located_in")
+    g.AddEdge(ann, bob, "knows")
+    g.AddEdge(bob, cat, "knows")
+    g.AddEdge(cat, ann, "knows")
+    
+    tests := []struct {
+        text string
+        expected string
+    }{
+        // chained hops join on the vertices they share
+        {`(p <Person>)-[works_at]->(c <Company>)-[located_in]->(city <City>); yield p.name, c.name, city.name order by p.name`,
+            `[[Ann Acme Paris] [Bob Globex Rome] [Cat Acme Paris]]`},
+        {`(city <City> {name: "Paris"})<-[located_in]-(c)<-[works_at]-(p); yield p.name order by p.name`, `[[Ann] [Cat]]`},
+        {`(p)-[r <works_at>]->(<Company> {name: "Globex"}); yield p.name, r.since`, `[[Bob 2015]]`},
+        {`(a)-[knows]->(b)-[knows]->(c)-[knows]->(a); yield a.name, c.name order by a.name`, `[[Ann Cat] [Bob Ann] [Cat Bob]]`},
+        {`a = Person{name: "Ann"}; (a)-[works_at]->(c)<-[works_at]-(other); yield other.name order by other.name`, `[[Ann] [Cat]]`},
+        {`Person{name: "Bob"}-[works_at]->(c)-[located_in]->(<City> {name: "Paris"}); yield c`, `[]`},
+        
+        // variable-length hops never revisit a vertex
+        {`Person{name: "Ann"}-[knows *1..2]->(f); yield f.name order by f.name`, `[[Bob] [Cat]]`},
+        {`Person{name: "Ann"}-[knows *]->(f); yield f.name order by f.name`, `[[Bob] [Cat]]`},
+        {`Person{name: "Ann"}-[knows *0..1]->(f); yield f.name order by f.name`, `[[Ann] [Bob]]`},
+        {`Person{name: "Ann"}-[knows *3]->(f); yield f.name`, `[]`},
+        {`(p <Person> {name: "Ann"})-[knows *1..]->(f)-[works_at]->(<Company> {name: "Acme"}); yield f.name`, `[[Cat]]`},
+        {`[knows *2] FROM Person{name: "Ann"} TO (x); yield x.name`, `[[Cat]]`},
+        {`[knows *1..2] FROM (x) TO Person{name: "Ann"}; yield x.name order by x.name`, `[[Bob] [Cat]]`},
+    }
+    for _, test := range tests {
+        r, err := g.Query(test.text, nil)
+        if err != nil {
+            t.Errorf("%s: %s", test.text, err)
+            continue
+        }
+        rows := make([][]Any, 0)
+        for r.Next() {
+            rows = append(rows, r.Row())
+        }
+        if err := r.Err(); err != nil {
+            t.Errorf("%s: %s", test.text, err)
+        } else if s := fmt.Sprint(rows); s != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.text, test.expected, s)
+        }
+    }
+    
+    errors := []struct {
+        text string
+        expected string
+    }{
+        {`[e <knows> *2]`, `Data Error: Query error at 1:2: a sequence of edges can not be bound to a variable`},
+        {`e = [knows *2]`, `Data Error: Query error at 1:1: a sequence of edges can not be bound to a variable`},
+        {`(a)-[r <knows> *2]->(b)`, `Data Error: Query error at 1:6: a sequence of edges can not be bound to a variable`},
+        {`(a)-[r <knows>]->(r)`, `Data Error: Query error at 1:19: variable r is not bound to a vertex`},
+        {`(a)-[knows]->(b <Planet>)`, `Data Error: Query error at 1:18: there is no class named Planet`},
+    }
+    for _, test := range errors {
+        _, err := g.Query(test.text, nil)
+        if err == nil {
+            t.Errorf("%s: expected an error", test.text)
+        } else if err.Error() != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+}
+
+func TestQueryAggregates (t *testing.T) {
+    _, g := newTestGraph(t, "aggregates")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    asset := g.AddClass("Asset", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann"})
+    bob, _ := g.AddVertexWith(person, map[string]Any{"name": "Bob"})
+    g.AddVertexWith(person, map[string]Any{"name": "Cat"})
+    car, _ := g.AddVertexWith(asset, map[string]Any{"name": "car", "kind": "vehicle", "value": 20000})
+    boat, _ := g.AddVertexWith(asset, map[string]Any{"name": "boat", "kind": "vehicle", "value": 55000.5})
+    house, _ := g.AddVertexWith(asset, map[string]Any{"name": "house", "kind": "property", "value": 300000})
+    shed, _ := g.AddVertexWith(asset, map[string]Any{"name": "shed", "kind": "property"})
+    g.AddEdge(ann, car, "owns")
+    g.AddEdge(ann, house, "owns")
+    g.AddEdge(ann, shed, "owns")
+    g.AddEdge(bob, boat, "owns")
+    g.AddEdge(bob, house, "owns")
+    
+    tests := []struct {
+        text string
+        expected string
+    }{
+        // the number of owned assets per person
+        {`[owns] FROM (p) TO (a); yield p.name, count(a) group by p`, `[[Ann 3] [Bob 2]]`},
+        {`[owns] FROM (p) TO (a); yield p.name, count(a.value), sum(a.value), min(a.value), max(a.value) group by p.name`,
+            `[[Ann 2 320000 20000 300000] [Bob 2 355000.5 55000.5 300000]]`},
+        {`[owns] FROM (p) TO (a); yield a.kind, collect(p.name), avg(a.value) group by a.kind`,
+            `[[vehicle [Ann Bob] 37500.25] [property [Ann Ann Bob] 300000]]`},
+        {`[owns] FROM (p) TO (a); yield p, a.kind, count(*) group by p, a.kind`,
+            `[[Ann vehicle 1] [Ann property 2] [Bob vehicle 1] [Bob property 1]]`},
+        {`[owns] FROM (p) TO (a); yield p.name group by p`, `[[Ann] [Bob]]`},
+        {`a = Asset; yield min(a.name), max(a.name), count(*), "assets", $n`, `[[boat shed 4 assets 7]]`},
+        
+        // without a group by clause there is one row even if nothing matches
+        {`p = Person{name: "Dan"}; yield count(p), sum(p.age), avg(p.age), max(p.age), collect(p)`, `[[0 0 <nil> <nil> []]]`},
+        {`p = Person{name: "Dan"}; yield p group by p`, `[]`},
+    }
+    for _, test := range tests {
+        r, err := g.Query(test.text, map[string]Any{"n": 7})
+        if err != nil {
+            t.Errorf("%s: %s", test.text, err)
+            continue
+        }
+        rows := make([][]Any, 0)
+        for r.Next() {
+            row := r.Row()
+            for n, value := range row {
+                if v, ok := value.(*Vertex); ok {
+                    row[n], _ = v.Get("name", g)
+                }
+            }
+            rows = append(rows, row)
+        }
+        if err := r.Err(); err != nil {
+            t.Errorf("%s: %s", test.text, err)
+        } else if s := fmt.Sprint(rows); s != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.text, test.expected, s)
+        }
+    }
+    
+    errors := []struct {
+        text string
+        expected string
+    }{
+        {`[owns] FROM (p) TO (a); yield a.name, count(p) group by p`, `Data Error: Query error at 1:31: a.name must be grouped by or used in an aggregate function`},
+        {`[owns] FROM (p) TO (a); yield a, count(p)`, `Data Error: Query error at 1:31: a must be grouped by or used in an aggregate function`},
+        {`[owns] FROM (p) TO (a); yield count(q)`, `Data Error: Query error at 1:37: variable q is not bound`},
+        {`[owns] FROM (p) TO (a); yield p group by q`, `Data Error: Query error at 1:42: variable q is not bound`},
+    }
+    for _, test := range errors {
+        _, err := g.Query(test.text, nil)
+        if err == nil {
+            t.Errorf("%s: expected an error", test.text)
+        } else if err.Error() != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+    
+    // type errors are found while the rows are read
+    r, _ := g.Query(`a = Asset; yield sum(a.name)`, nil)
+    if r.Next() || r.Err() == nil || r.Err().Error() != `Data Error: Query error at 1:18: sum can not be applied to string values` {
+        t.Errorf("expected an error summing strings, got %v", r.Err())
+    }
+    r, _ = g.Query(`a = Asset; yield max(a.kind), max(a)`, nil)
+    if r.Next() || r.Err() == nil {
+        t.Errorf("expected an error comparing vertices")
+    }
+}
+
+func TestQueryPaging (t *testing.T) {
+    _, g := newTestGraph(t, "paging")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann", "age": 40})
+    bob, _ := g.AddVertexWith(person, map[string]Any{"name": "Bob", "age": 30})
+    cat, _ := g.AddVertexWith(person, map[string]Any{"name": "Cat", "age": 40})
+    g.AddVertexWith(person, map[string]Any{"name": "Dan"})
+    g.AddVertexWith(person, map[string]Any{"name": "Eve", "age": 25.5})
+    g.AddEdge(ann, bob, "knows")
+    g.AddEdge(cat, bob, "knows")
+    g.AddEdge(cat, ann, "knows")
+    
+    // reads the rows of a query, returning them and the cursor after the last one
+    read := func(text string, params map[string]Any, cursor string) (string, string) {
+        r, err := g.QueryAfter(text, params, cursor)
+        if err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        rows := make([][]Any, 0)
+        last := ""
+        for r.Next() {
+            rows = append(rows, r.Row())
+            last = r.Cursor()
+        }
+        if err := r.Err(); err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        return fmt.Sprint(rows), last
+    }
+    
+    tests := []struct {
+        text string
+        expected string
+    }{
+        // missing values sort first, and ties are broken by the vertices matched
+        {`p = Person; yield p.name order by p.age`, `[[Dan] [Eve] [Bob] [Ann] [Cat]]`},
+        {`p = Person; yield p.name, p.age order by p.age desc, p.name`, `[[Ann 40] [Cat 40] [Bob 30] [Eve 25.5] [Dan <nil>]]`},
+        {`p = Person; yield p.name order by p.name desc skip 1 limit 2`, `[[Dan] [Cat]]`},
+        {`p = Person; yield p.name order by p.name limit $n`, `[[Ann] [Bob] [Cat]]`},
+        {`p = Person; yield p.name skip 3`, `[[Dan] [Eve]]`},
+        {`p = Person; yield p.name limit 0`, `[]`},
+        {`p = Person; yield p.name order by p`, `[[Ann] [Bob] [Cat] [Dan] [Eve]]`},
+        {`[knows] FROM (p) TO (q); yield q.name, count(p) group by q order by count(p) desc, q.name`, `[[Bob 2] [Ann 1]]`},
+        {`[knows] FROM (p) TO (q); yield p.name, q.name order by q.name, p.name desc`, `[[Cat Ann] [Cat Bob] [Ann Bob]]`},
+    }
+    for _, test := range tests {
+        if rows, _ := read(test.text, map[string]Any{"n": 3}, ""); rows != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.text, test.expected, rows)
+        }
+    }
+    
+    // pages resume after the last row even when other vertices change in between
+    text := `p = Person; yield p.name order by p.age desc, p.name limit 2`
+    rows, cursor := read(text, nil, "")
+    if rows != `[[Ann] [Cat]]` || cursor == "" {
+        t.Fatalf("wrong first page: %s", rows)
+    }
+    g.AddVertexWith(person, map[string]Any{"name": "Fay", "age": 50})
+    g.RemoveVertex(ann)
+    if rows, cursor = read(text, nil, cursor); rows != `[[Bob] [Eve]]` {
+        t.Errorf("wrong second page: %s", rows)
+    }
+    if rows, cursor = read(text, nil, cursor); rows != `[[Dan]]` {
+        t.Errorf("wrong third page: %s", rows)
+    }
+    if rows, _ = read(text, nil, cursor); rows != `[]` {
+        t.Errorf("expected no more rows, got %s", rows)
+    }
+    
+    // a cursor only resumes the query with the parameters it was taken with
+    byAge := `p = Person{age: $age}; yield p.name order by p.name limit 1`
+    rows, ageCursor := read(byAge, map[string]Any{"age": 40}, "")
+    if rows != `[[Cat]]` {
+        t.Errorf("wrong first page: %s", rows)
+    }
+    if _, err := g.QueryAfter(byAge, map[string]Any{"age": 30}, ageCursor); err == nil {
+        t.Error("resumed a query with different parameters")
+    }
+    if rows, _ = read(byAge, map[string]Any{"age": 40}, ageCursor); rows != `[]` {
+        t.Errorf("wrong second page: %s", rows)
+    }
+    
+    // queries without an order by clause can not be resumed
+    r, _ := g.Query(`p = Person; yield p limit 1`, nil)
+    if r.Next(); r.Cursor() != "" {
+        t.Errorf("expected no cursor without an order by clause")
+    }
+    
+    errors := []struct {
+        text string
+        cursor string
+        expected string
+    }{
+        {`p = Person; yield p.name order by p.name`, cursor, `Data Error: Invalid cursor: the cursor was not taken from this query`},
+        {text, "not a cursor", `Data Error: Invalid cursor: the cursor is not valid`},
+        {text, cursor[:len(cursor) - 8], `Data Error: Invalid cursor: the cursor is not valid`},
+        {`p = Person; yield p`, cursor, `Data Error: Invalid cursor: the query has no order by clause`},
+        {`p = Person`, cursor, `Data Error: Invalid cursor: the query has no order by clause`},
+        {`p = Person; yield p limit $n`, "", `Data Error: Query error at 1:27: the number of rows must be an integer that is not negative`},
+        {`p = Person; yield p order by q`, "", `Data Error: Query error at 1:30: variable q is not bound`},
+    }
+    for _, test := range errors {
+        params := map[string]Any{"n": -1}
+        if test.cursor != "" {
+            params = nil // the cursor was taken without parameters
+        }
+        _, err := g.QueryAfter(test.text, params, test.cursor)
+        if err == nil {
+            t.Errorf("%s: expected an error", test.text)
+        } else if err.Error() != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+    r, _ = g.Query(`p = Person; yield count(p) order by collect(p)`, nil)
+    if r.Next() || r.Err() == nil {
+        t.Errorf("expected an error ordering by a list")
+    }
+}
+
+func TestQueryMutations (t *testing.T) {
+    db, g := newTestGraph(t, "mutations")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    g.AddClass("Asset", g.C("Vertex"))
+    person.Declare(AttributeDef{Key: "age", Type: IntegerType}, g)
+    
+    // runs a query and returns its rows, with vertices and edges replaced by their names
+    run := func(text string) string {
+        r, err := g.Query(text, map[string]Any{"name": "Cat"})
+        if err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        rows := make([][]Any, 0)
+        for r.Next() {
+            row := r.Row()
+            for n, value := range row {
+                switch value := value.(type) {
+                case *Vertex:
+                    row[n], _ = value.Get("name", g)
+                case *Edge:
+                    row[n] = value.Key(g)
+                }
+            }
+            rows = append(rows, row)
+        }
+        if err := r.Err(); err != nil {
+            t.Fatalf("%s: %s", text, err)
+        }
+        return fmt.Sprint(rows)
+    }
+    
+    tests := []struct {
+        text string
+        expected string
+    }{
+        {`create (p <Person> {name: "Ann", age: 40}); create (q <Person> {name: "Bob"}); yield p, q`, `[[Ann Bob]]`},
+        {`create (v {name: $name}); yield v, v.name`, `[[Cat Cat]]`},
+        {`v = Vertex{name: "Cat"}; yield count(v)`, `[[1]]`},
+        {`p = Person{name: "Ann"}; q = Person{name: "Bob"}; create [e <knows> {since: 2010}] FROM (p) TO (q); yield e, e.since`,
+            `[[knows 2010]]`},
+        
+        // merge only creates what it does not match
+        {`merge (a <Asset> {name: "car"}); merge (b <Asset> {name: "car"}); yield a, b`, `[[car car]]`},
+        {`a = Asset; yield count(a)`, `[[1]]`},
+        {`p = Person; a = Asset; merge [<owns>] FROM (p) TO (a); yield count(p)`, `[[2]]`},
+        {`p = Person; a = Asset; merge [e <owns>] FROM (p) TO (a); yield p, e`, `[[Ann owns] [Bob owns]]`},
+        {`e = [owns]; yield count(e)`, `[[2]]`},
+        
+        // changes are seen by the statements after them
+        {`p = Person{name: "Bob"}; set p.age = 30, p.name = "Rob"; yield p, p.age`, `[[Rob 30]]`},
+        {`p = Person{name: "Ann"}; set p.age = p.missing; yield p.age`, `[[<nil>]]`},
+        {`e = [knows]; remove e.since; yield e.since`, `[[<nil>]]`},
+        {`p = Person{name: "Rob"}; delete p; q = Person; yield q`, `[[Ann]]`},
+        {`e = [owns]; yield count(e)`, `[[1]]`},
+        {`a = Asset; [owns] FROM (p) TO (a); delete a, p; v = (); yield v`, `[[Cat]]`},
+    }
+    for _, test := range tests {
+        if rows := run(test.text); rows != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.text, test.expected, rows)
+        }
+    }
+    
+    errors := []struct {
+        text string
+        expected string
+    }{
+        {`create (p <Persn>)`, `Data Error: Query error at 1:12: there is no class named Persn`},
+        {`create [<owns>] FROM (p) TO (q)`, `Data Error: Query error at 1:22: the vertices of a created edge must be bound variables`},
+        {`v = (); create [] FROM (v) TO (v)`, `Data Error: Query error at 1:16: a created edge must have a label`},
+        {`set p.name = "Ann"`, `Data Error: Query error at 1:5: variable p is not bound`},
+        {`delete p`, `Data Error: Query error at 1:8: variable p is not bound`},
+    }
+    for _, test := range errors {
+        _, err := g.Query(test.text, nil)
+        if err == nil {
+            t.Errorf("%s: expected an error", test.text)
+        } else if err.Error() != test.expected {
+            t.Errorf("%s:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+    
+    // a query that fails keeps none of its changes, and keeps the changes made before it
+    eve, err := g.AddVertexWith(g.C("Vertex"), map[string]Any{"name": "Eve"})
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if _, err := g.Query(`create (p <Person> {name: "Dan"}); v = Vertex{name: "Cat"}; set v.name = "Kit"; set p.age = "old"`, nil); err == nil {
+        t.Errorf("expected an error setting an attribute that does not fit the schema")
+    }
+    if rows := run(`v = (); yield v.name order by v.name`); rows != `[[Cat] [Eve]]` {
+        t.Errorf("expected the failed query to change nothing, got %s", rows)
+    }
+    
+    // a vertex or edge held over a failed query keeps its state from before the query,
+    // and can still be changed
+    likes, err := g.AddEdge(eve, eve, "likes")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err = likes.Set("since", 1, g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if _, err := g.Query(`v = Vertex{name: "Eve"}; set v.name = "Liv"; e = [likes]; set e.since = 2; delete e; create [<knows>] FROM (v) TO (v); create (p <Person> {name: "Dan"}); set p.age = "old"`, nil); err == nil {
+        t.Errorf("expected an error setting an attribute that does not fit the schema")
+    }
+    if name, _ := eve.Get("name", g); name != "Eve" {
+        t.Errorf("expected a vertex held over a failed query to keep its name, got %v", name)
+    }
+    if e, _ := eve.FirstOut(g); e == nil || e.Id != likes.Id {
+        t.Errorf("expected a vertex held over a failed query to keep its edges, got %v", e)
+    }
+    if since, _ := likes.Get("since", g); since != int64(1) {
+        t.Errorf("expected an edge held over a failed query to keep its attributes, got %v", since)
+    }
+    if err = eve.Set("age", 4, g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if err = likes.Set("since", 3, g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if rows := run(`v = (); yield v.name, v.age order by v.name`); rows != `[[Cat <nil>] [Eve 4]]` {
+        t.Errorf("expected a change to a vertex held over a failed query to be kept, got %s", rows)
+    }
+    if rows := run(`e = [likes]; yield e.since`); rows != `[[3]]` {
+        t.Errorf("expected a change to an edge held over a failed query to be kept, got %s", rows)
+    }
+    
+    // a vertex held over a query that changes it is the vertex the query changed, so
+    // the changes made through it afterwards keep the query's
+    if _, err := g.Query(`v = Vertex{name: "Eve"}; create [<knows>] FROM (v) TO (v)`, nil); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = g.AddEdge(eve, eve, "trusts"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if rows := run(`v = Vertex{name: "Eve"}; e = [] FROM (v); yield e order by e`); rows != `[[knows] [trusts] [likes]]` {
+        t.Errorf("expected the edges of a vertex held over a query to be kept, got %s", rows)
+    }
+    
+    // a class taken before a failed query goes on being the class of the graph
+    if err = person.CreateUniqueIndex("email", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if _, err = g.AddVertexWith(person, map[string]Any{"name": "Fay", "email": "a"}); err != nil {
+        t.Fatal(err.Trace())
+    }
+    if _, err := g.Query(`create (p <Person> {name: "Gus", email: "b"}); create (q <Person> {name: "Hal", email: "a"})`, nil); err == nil {
+        t.Errorf("expected an error creating a vertex with an email that is taken")
+    }
+    if _, err = g.AddVertexWith(person, map[string]Any{"name": "Ivy", "email": "c"}); err != nil {
+        t.Fatal(err.Trace())
+    }
+    
+    // the changes of a query are written to the graph's files with the graph
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    if g, err = constructGraph(db, "mutations"); err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    if rows := run(`v = (); yield v.name order by v.name`); rows != `[[Cat] [Eve] [Fay] [Ivy]]` {
+        t.Errorf("expected the changes to be written, got %s", rows)
+    }
+    if rows := run(`p = Person; yield p.name order by p.name`); rows != `[[Fay] [Ivy]]` {
+        t.Errorf("expected the vertices added to a class held over a failed query, got %s", rows)
+    }
+    if count := g.C("Person").Count; count != 2 {
+        t.Errorf("expected 2 people, got %d", count)
+    }
+    if found, err := g.C("Person").FindBy("email", "c", g); err != nil {
+        t.Error(err.Trace())
+    } else if len(found) != 1 {
+        t.Errorf("expected to find Ivy by email, got %d vertices", len(found))
+    } else if name, _ := found[0].Get("name", g); name != "Ivy" {
+        t.Errorf("expected to find Ivy by email, got %v", name)
+    }
+}
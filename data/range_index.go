@@ -0,0 +1,318 @@
+package data
+
+import (
+    "os"
+    "math"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    nilRangeIndex = "attempt to operate on a nil range index"
+    nilRangeIndexFile = "attempt to operate on a nil range index file"
+)
+
+const rangeEntrySize = 13 // type (1) + value (8) + vertex id (4)
+
+// An entry in a range index: the value of an attribute and the vertex that has it.
+type rangeEntry struct {
+    t byte
+    data [8]byte
+    id uint32
+}
+
+// Returns true if values of a type can be stored in a range index.
+func isRangeType(t byte) bool {
+    return t == integer_t || t == real_t || t == time_t
+}
+
+// Compares the values of two entries, returning a negative number, zero, or a
+// positive number if a is less than, equal to, or greater than b.
+// Integers and reals are compared by their exact numeric value, NaN is greater
+// than every other number, and all numbers are less than all times.
+func compareRangeValues(a, b *rangeEntry) int {
+    if (a.t == time_t) != (b.t == time_t) {
+        if a.t == time_t {
+            return 1
+        }
+        return -1
+    }
+    switch {
+    case a.t == real_t && b.t == real_t:
+        return compareFloats(a.real(), b.real())
+    case a.t == real_t:
+        return -compareIntFloat(b.integer(), a.real())
+    case b.t == real_t:
+        return compareIntFloat(a.integer(), b.real())
+    }
+    x, y := a.integer(), b.integer()
+    switch {
+    case x < y:
+        return -1
+    case x > y:
+        return 1
+    }
+    return 0
+}
+
+// Returns the value of an integer or time entry.
+func (e *rangeEntry) integer() int64 {
+    return int64(util.Uint64(e.data[:]))
+}
+
+// Returns the value of a real entry.
+func (e *rangeEntry) real() float64 {
+    return util.BytesToFloat64(e.data[:])
+}
+
+// Compares two reals, ordering NaN after every other value.
+func compareFloats(x, y float64) int {
+    switch {
+    case x < y:
+        return -1
+    case x > y:
+        return 1
+    case x == y:
+        return 0
+    case math.IsNaN(x) && math.IsNaN(y):
+        return 0
+    case math.IsNaN(x):
+        return 1
+    }
+    return -1
+}
+
+// Compares an integer to a real without converting either, since not every int64
+// is a float64 and the other way around.
+func compareIntFloat(x int64, y float64) int {
+    switch {
+    case math.IsNaN(y) || y >= 1 << 63:
+        return -1
+    case y < -(1 << 63):
+        return 1
+    }
+    // y is now within the range of an int64, so its whole part converts exactly
+    whole := math.Trunc(y)
+    switch n := int64(whole); {
+    case x < n:
+        return -1
+    case x > n:
+        return 1
+    }
+    switch fraction := y - whole; {
+    case fraction > 0:
+        return -1
+    case fraction < 0:
+        return 1
+    }
+    return 0
+}
+
+// Compares two entries by value and then by vertex id, which is how entries are ordered.
+func compareRangeEntries(a, b *rangeEntry) int {
+    if c := compareRangeValues(a, b); c != 0 {
+        return c
+    }
+    switch {
+    case a.id < b.id:
+        return -1
+    case a.id > b.id:
+        return 1
+    }
+    return 0
+}
+
+// A range index keeps the numeric and time values of one attribute key of a class in
+// order, so vertices can be found by a range of values and iterated in value order.
+// Attributes of other types are not indexed.
+// The entries are kept sorted in memory, and the file is an entry log (see entryLog)
+// of the encoded entries. Adding or removing an entry moves the entries after it, so
+// a change takes time in proportion to the size of the index.
+type rangeIndex struct {
+    file *os.File
+    log *entryLog
+    entries []rangeEntry
+}
+
+// Creates an existing range index.
+func constructRangeIndex(fileName string) (*rangeIndex, *DataError) {
+
+    i := new(rangeIndex)
+
+    // load the file
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for range index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if _, de := checkFileHeader(i.file, rangeIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readEntries(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates a range index that does not yet exist.
+// A range index with an empty file name is kept in memory only.
+func createRangeIndex(fileName string) (*rangeIndex, *DataError) {
+
+    i := new(rangeIndex)
+    i.log = new(entryLog)
+    i.entries = make([]rangeEntry, 0)
+    if fileName == "" {
+        return i, nil
+    }
+
+    // create the file
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for range index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if de := writeFileHeader(i.file, rangeIndexFile, 0); de != nil {
+        return nil, de
+    }
+    i.log.file = file
+
+    return i, nil
+}
+
+// Encodes an entry as its type, value, and vertex id.
+func (e *rangeEntry) encode() []byte {
+    b := make([]byte, rangeEntrySize)
+    b[0] = e.t
+    copy(b[1:9], e.data[:])
+    util.PutUint32(b[9:13], e.id)
+    return b
+}
+
+// Reads the entries from the file.
+// Returns an error of type *DataError if the file can not be read.
+func (i *rangeIndex) readEntries() *DataError {
+    Assert(nilRangeIndex, i != nil)
+    Assert(nilRangeIndexFile, i.file != nil)
+
+    i.entries = make([]rangeEntry, 0)
+    log, err := readEntryLog(i.file, func(added bool, b []byte) bool {
+        if len(b) != rangeEntrySize || !isRangeType(b[0]) {
+            return false
+        }
+        e := rangeEntry{t: b[0], id: util.Uint32(b[9:13])}
+        copy(e.data[:], b[1:9])
+        if added {
+            i.insert(e)
+        } else {
+            i.erase(e)
+        }
+        return true
+    })
+    i.log = log
+    return err
+}
+
+// Writes the changes to the entries to the file.
+// Returns an error of type *DataError if they can not be written.
+func (i *rangeIndex) write() *DataError {
+    Assert(nilRangeIndex, i != nil)
+
+    return i.log.write(func(fn func(entry []byte)) {
+        for n := range i.entries {
+            fn(i.entries[n].encode())
+        }
+    })
+}
+
+// Returns the position of an entry, or of where it would be inserted.
+func (i *rangeIndex) search(e *rangeEntry) int {
+    return sort.Search(len(i.entries), func(n int) bool {
+        return compareRangeEntries(&i.entries[n], e) >= 0
+    })
+}
+
+// Records that a vertex has a value.
+func (i *rangeIndex) add(e rangeEntry) {
+    Assert(nilRangeIndex, i != nil)
+
+    if i.insert(e) {
+        i.log.add(e.encode())
+    }
+}
+
+// Records that a vertex no longer has a value.
+func (i *rangeIndex) remove(e rangeEntry) {
+    Assert(nilRangeIndex, i != nil)
+
+    if i.erase(e) {
+        i.log.remove(e.encode())
+    }
+}
+
+// Puts an entry in its place, returning false if it was already there.
+func (i *rangeIndex) insert(e rangeEntry) bool {
+    pos := i.search(&e)
+    if pos < len(i.entries) && i.entries[pos] == e {
+        return false
+    }
+    i.entries = append(i.entries, rangeEntry{})
+    copy(i.entries[pos + 1:], i.entries[pos:])
+    i.entries[pos] = e
+    return true
+}
+
+// Takes an entry out, returning false if it was not there.
+func (i *rangeIndex) erase(e rangeEntry) bool {
+    pos := i.search(&e)
+    if pos == len(i.entries) || i.entries[pos] != e {
+        return false
+    }
+    i.entries = append(i.entries[:pos], i.entries[pos + 1:]...)
+    return true
+}
+
+// Calls fn with the id of every vertex whose value is within the bounds, in order of
+// value, until fn returns false.
+// A nil bound leaves that end of the range open.
+func (i *rangeIndex) scan(min, max *rangeEntry, r *Range, fn func(id uint32) bool) {
+    Assert(nilRangeIndex, i != nil)
+
+    lo, hi := 0, len(i.entries)
+    if min != nil {
+        lo = sort.Search(len(i.entries), func(n int) bool {
+            c := compareRangeValues(&i.entries[n], min)
+            return c > 0 || (c == 0 && !r.ExcludeMin)
+        })
+    }
+    if max != nil {
+        hi = sort.Search(len(i.entries), func(n int) bool {
+            c := compareRangeValues(&i.entries[n], max)
+            return c > 0 || (c == 0 && r.ExcludeMax)
+        })
+    }
+
+    if r.Descending {
+        for n := hi - 1; n >= lo; n-- {
+            if !fn(i.entries[n].id) {
+                return
+            }
+        }
+        return
+    }
+    for n := lo; n < hi; n++ {
+        if !fn(i.entries[n].id) {
+            return
+        }
+    }
+}
+
+// Cleans up the file for the index.
+func (i *rangeIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
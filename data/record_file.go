@@ -0,0 +1,133 @@
+package data
+
+import (
+    "os"
+    "io"
+    "hash/crc32"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilRecordFile = "attempt to operate on a nil record file"
+    zeroRecordId = "attempt to operate on a record with an id of 0"
+    recordReadFail = "could not read record from store: "
+    recordWriteFail = "could not write record to store: "
+    recordCorrupted = "record failed its checksum"
+)
+
+// Header flags
+const (
+    checksumFlag byte = 0x01 // every record is followed by a checksum of its contents
+)
+
+const checksumSize = 4 // the number of bytes a record checksum takes up in the file
+
+// A record file reads and writes the fixed size records of a store.
+// Records are addressed by id, starting at 1, and follow the file header and
+// any header the store keeps for itself.
+// When the file was created with checksums, each record is followed by a crc32
+// checksum of its contents that is verified whenever the record is read.
+// Like the rest of a graph, a record file must only be used by one goroutine at a time:
+// every read and write goes through the same buffer.
+type recordFile struct {
+    file *os.File
+    store string      // the name of the store, used when reporting corruption
+    offset int64      // the number of bytes before the first record
+    dataSize int64    // the size of a record, not including its checksum
+    checksums bool    // whether or not records carry a checksum
+    buf []byte        // reused for every read and write so records do not allocate
+}
+
+// A record that can encode itself into the buffer of a record file.
+type recordEncoder interface {
+    encode(b []byte)
+}
+
+// Creates a record file for a store file that has already been opened.
+// The flags should come from the file header.
+func newRecordFile(file *os.File, store string, offset int64, dataSize int64, flags byte) *recordFile {
+    Assert(nilHeaderFile, file != nil)
+
+    r := new(recordFile)
+    r.file = file
+    r.store = store
+    r.offset = offset
+    r.dataSize = dataSize
+    r.checksums = flags & checksumFlag != 0
+    r.buf = make([]byte, r.recordSize())
+    return r
+}
+
+// Returns the number of bytes a record takes up in the file.
+func (r *recordFile) recordSize() int64 {
+    if r.checksums {
+        return r.dataSize + checksumSize
+    }
+    return r.dataSize
+}
+
+// Returns the position in the file of the record with the given id.
+func (r *recordFile) position(id uint64) int64 {
+    return r.offset + int64(id - 1) * r.recordSize()
+}
+
+// Reads the record with the given id.
+// The returned slice is the record file's buffer, so it is only valid until the next
+// read or write on the record file; callers decode it before doing anything else.
+// Returns nil if the record lies beyond the end of the file.
+// Returns an error of type *DataError caused by a *CorruptionError if the record
+// does not match its checksum.
+func (r *recordFile) read(id uint64) ([]byte, *DataError) {
+    Assert(nilRecordFile, r != nil)
+    Assert(zeroRecordId, id != 0)
+
+    bytes := r.buf
+    c, e := r.file.ReadAt(bytes, r.position(id))
+    if e == io.EOF && c == 0 {
+        return nil, nil
+    } else if e != nil && e != io.EOF {
+        return nil, dataError(recordReadFail + r.store, e, nil)
+    } else if int64(c) != r.recordSize() {
+        return nil, dataError(recordCorrupted, &CorruptionError{r.store, id}, nil)
+    }
+
+    if !r.checksums {
+        return bytes, nil
+    }
+
+    data := bytes[:r.dataSize]
+    sum := util.Uint32(bytes[r.dataSize:])
+    if sum != crc32.ChecksumIEEE(data) && !isZero(bytes) {
+        // records that were never written are all zeros and have no checksum
+        return nil, dataError(recordCorrupted, &CorruptionError{r.store, id}, nil)
+    }
+    return data, nil
+}
+
+// Writes the record with the given id, followed by its checksum if the file has checksums.
+func (r *recordFile) write(id uint64, record recordEncoder) *DataError {
+    Assert(nilRecordFile, r != nil)
+    Assert(zeroRecordId, id != 0)
+
+    data := r.buf[:r.dataSize]
+    record.encode(data)
+    if r.checksums {
+        util.PutUint32(r.buf[r.dataSize:], crc32.ChecksumIEEE(data))
+    }
+    if _, e := r.file.WriteAt(r.buf, r.position(id)); e != nil {
+        return dataError(recordWriteFail + r.store, e, nil)
+    }
+    return nil
+}
+
+// Returns true if every byte in the slice is 0.
+func isZero(bytes []byte) bool {
+    for _, b := range bytes {
+        if b != 0 {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,585 @@
+package data
+
+import (
+    "os"
+    "io"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilSchemaStore = "attempt to operate on a nil schema store"
+    nilSchemaStoreFile = "attempt to operate on a nil schema store file"
+    schemaWriteFail = "could not write the schema store: "
+    schemaReadFail = "could not read the schema store: "
+    schemaCorrupted = "schema record could not be decoded"
+)
+
+// The kinds of record in the schema store file
+const (
+    classSchemaRecord byte = iota + 1
+    attributeSchemaRecord
+    edgeSchemaRecord
+)
+
+// Schema flags
+const (
+    strictSchema byte = 0x01    // a class only allows declared attributes
+    requiredAttribute byte = 0x01 // an attribute must be set on every vertex of a class
+)
+
+// An AttributeDef declares an attribute key that the vertices of a class may have.
+// Declarations are inherited by sub classes, which may declare the key again to
+// override them.
+type AttributeDef struct {
+    Key string
+    Type AttributeType // the type values must have, or AnyType to allow any type
+    Required bool      // whether every vertex of the class must have the attribute
+    Default Any        // the value given to new vertices that are not given one, or nil
+}
+
+// The schema of a single class, without what it inherits.
+type classSchema struct {
+    strict bool
+    attributes []AttributeDef
+}
+
+// Returns the declaration of a key in the schema, or nil if it is not declared.
+func (s *classSchema) find(key string) *AttributeDef {
+    for n := range s.attributes {
+        if s.attributes[n].Key == key {
+            return &s.attributes[n]
+        }
+    }
+    return nil
+}
+
+// A Cardinality limits how many edges with a label a vertex may have.
+type Cardinality byte
+
+const (
+    ManyToMany Cardinality = iota // vertices may have any number of edges with the label
+    OneToMany                     // a vertex may have at most one inbound edge with the label
+    ManyToOne                     // a vertex may have at most one outbound edge with the label
+    OneToOne                      // a vertex may have at most one inbound and one outbound edge with the label
+)
+
+func (c Cardinality) String() string {
+    switch c {
+    case ManyToMany:
+        return "many-to-many"
+    case OneToMany:
+        return "one-to-many"
+    case ManyToOne:
+        return "many-to-one"
+    case OneToOne:
+        return "one-to-one"
+    }
+    return "unknown"
+}
+
+// An EdgeDef declares the classes that the edges with a label may connect and how
+// many of them a vertex may have.
+// Vertices of sub classes of From and To are allowed too.
+type EdgeDef struct {
+    Label string
+    From string              // the name of the class edges may go from, or "" for any class
+    To string                // the name of the class edges may go to, or "" for any class
+    Cardinality Cardinality
+}
+
+// The schema of an edge label, with classes by id.
+type edgeSchema struct {
+    from, to uint8 // 0 for any class
+    cardinality Cardinality
+}
+
+// The schema store keeps the schemas of the classes and edge labels of a graph.
+type schemaStore struct {
+    file *os.File
+    classes map[uint8]*classSchema
+    edges map[uint16]*edgeSchema // label id -> schema
+    changed bool                 // whether or not the schemas need to be written
+}
+
+// Creates an existing schema store.
+// Returns an error of type *DataError if the file can not be opened.
+func constructSchemaStore(g *Graph) (*schemaStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(schemaStore)
+    fileName := g.storePath("schema")
+    if file, e := os.OpenFile(fileName, os.O_RDWR, 0777); e != nil {
+        return nil, dataError("Could not open file for schema store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if _, de := checkFileHeader(s.file, schemaFile); de != nil {
+        return nil, de
+    }
+
+    if de := s.readSchemas(g); de != nil {
+        return nil, dataError("Failure to construct schema store.", nil, de)
+    }
+
+    return s, nil
+}
+
+// Creates a schema store that does not yet exist.
+// Returns an error of type *DataError if the file can not be created.
+func createSchemaStore(g *Graph) (*schemaStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(schemaStore)
+    fileName := g.storePath("schema")
+    if file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777); e != nil {
+        return nil, dataError("Could not create file for schema store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if de := writeFileHeader(s.file, schemaFile, 0); de != nil {
+        return nil, de
+    }
+
+    s.classes = make(map[uint8]*classSchema)
+    s.edges = make(map[uint16]*edgeSchema)
+
+    return s, nil
+}
+
+// Returns the schema of a class, creating an empty one if it has none.
+func (s *schemaStore) schema(class uint8) *classSchema {
+    Assert(nilSchemaStore, s != nil)
+
+    cs, ok := s.classes[class]
+    if !ok {
+        cs = new(classSchema)
+        s.classes[class] = cs
+    }
+    return cs
+}
+
+// Reads the schemas from the file.
+// Each record starts with its kind. A class record follows that with the id of the
+// class and its flags. An attribute record follows it with the id of the class, the
+// label id of the key, the type, the flags, and whether there is a default value,
+// followed by the default value's type and either its data or the length of its text
+// and the text. An edge record follows it with the label id, the ids of the from and
+// to classes, and the cardinality.
+func (s *schemaStore) readSchemas(g *Graph) *DataError {
+    Assert(nilSchemaStore, s != nil)
+    Assert(nilSchemaStoreFile, s.file != nil)
+
+    s.classes = make(map[uint8]*classSchema)
+    s.edges = make(map[uint16]*edgeSchema)
+
+    fileSize, e := fileSize(s.file)
+    if e != nil {
+        return dataError(schemaReadFail + s.file.Name(), e, nil)
+    }
+    size := int(fileSize - fileHeaderSize)
+    bytes := make([]byte, size)
+    if _, e := s.file.ReadAt(bytes, int64(fileHeaderSize)); e != nil && e != io.EOF {
+        return dataError(schemaReadFail + s.file.Name(), e, nil)
+    }
+
+    // records are numbered from 1 in corruption errors, like the records of other stores
+    pos := 0
+    for n := uint64(1); pos < size; n++ {
+        corrupted := dataError(schemaCorrupted, &CorruptionError{s.file.Name(), n}, nil)
+        kind := bytes[pos]
+        pos++
+        switch kind {
+        case classSchemaRecord:
+            if size - pos < 2 {
+                return corrupted
+            }
+            s.schema(bytes[pos]).strict = bytes[pos + 1] & strictSchema != 0
+            pos += 2
+            continue
+        case edgeSchemaRecord:
+            if size - pos < 5 {
+                return corrupted
+            }
+            s.edges[util.Uint16(bytes[pos:])] = &edgeSchema{bytes[pos + 2], bytes[pos + 3], Cardinality(bytes[pos + 4])}
+            pos += 5
+            continue
+        case attributeSchemaRecord:
+            if size - pos < 5 {
+                return corrupted
+            }
+        default:
+            return corrupted
+        }
+
+        cs := s.schema(bytes[pos])
+        pos++
+        l, err := g.labelStore.find(util.Uint16(bytes[pos:]))
+        if err != nil {
+            return err
+        }
+        def := AttributeDef{Key: l.Value(g), Type: AttributeType(bytes[pos + 2])}
+        def.Required = bytes[pos + 3] & requiredAttribute != 0
+        hasDefault := bytes[pos + 4] != 0
+        pos += 5
+        if hasDefault {
+            if pos == size {
+                return corrupted
+            }
+            a := &Attribute{t: bytes[pos]}
+            pos++
+            if a.t == text_t {
+                if size - pos < 4 {
+                    return corrupted
+                }
+                length := int(util.Uint32(bytes[pos:]))
+                if length > size - pos - 4 {
+                    return corrupted
+                }
+                def.Default = string(bytes[pos + 4 : pos + 4 + length])
+                pos += 4 + length
+            } else {
+                if size - pos < 8 {
+                    return corrupted
+                }
+                copy(a.data[:], bytes[pos : pos + 8])
+                pos += 8
+                if def.Default, err = a.Value(g); err != nil {
+                    return err
+                }
+            }
+        }
+        cs.attributes = append(cs.attributes, def)
+    }
+    return nil
+}
+
+// Writes the schemas to the file if they have changed, in order of class and label.
+// Returns an error of type *DataError if they can not be written.
+func (s *schemaStore) write(g *Graph) *DataError {
+    Assert(nilSchemaStore, s != nil)
+    Assert(nilSchemaStoreFile, s.file != nil)
+
+    if !s.changed {
+        return nil
+    }
+
+    classes := make([]int, 0, len(s.classes))
+    for class := range s.classes {
+        classes = append(classes, int(class))
+    }
+    sort.Ints(classes)
+    labels := make([]int, 0, len(s.edges))
+    for label := range s.edges {
+        labels = append(labels, int(label))
+    }
+    sort.Ints(labels)
+
+    bytes := make([]byte, 0)
+    b := make([]byte, 4)
+    for _, id := range classes {
+        class, cs := uint8(id), s.classes[uint8(id)]
+        flags := byte(0)
+        if cs.strict {
+            flags |= strictSchema
+        }
+        bytes = append(bytes, classSchemaRecord, class, flags)
+
+        for _, def := range cs.attributes {
+            l, err := g.labelStore.findByValue(def.Key, g)
+            if err != nil {
+                return err
+            }
+            util.PutUint16(b, l.Id)
+            flags = byte(0)
+            if def.Required {
+                flags |= requiredAttribute
+            }
+            bytes = append(bytes, attributeSchemaRecord, class, b[0], b[1], byte(def.Type), flags)
+            if def.Default == nil {
+                bytes = append(bytes, 0)
+                continue
+            }
+            t, data, text, _ := encodeValue(def.Default) // checked when declared
+            bytes = append(bytes, 1, t)
+            if t == text_t {
+                util.PutUint32(b, uint32(len(text)))
+                bytes = append(bytes, b...)
+                bytes = append(bytes, text...)
+            } else {
+                bytes = append(bytes, data[:]...)
+            }
+        }
+    }
+    for _, label := range labels {
+        es := s.edges[uint16(label)]
+        util.PutUint16(b, uint16(label))
+        bytes = append(bytes, edgeSchemaRecord, b[0], b[1], es.from, es.to, byte(es.cardinality))
+    }
+
+    if e := s.file.Truncate(int64(fileHeaderSize)); e != nil {
+        return dataError(schemaWriteFail + s.file.Name(), e, nil)
+    }
+    if _, e := s.file.WriteAt(bytes, int64(fileHeaderSize)); e != nil {
+        return dataError(schemaWriteFail + s.file.Name(), e, nil)
+    }
+    s.changed = false
+    return nil
+}
+
+// Shuts the schema store down, making sure all files are closed.
+func (s *schemaStore) shutdown() {
+    if s != nil && s.file != nil {
+        _ = s.file.Close()
+    }
+}
+
+// Declare adds an attribute to the schema of the class, replacing any declaration of the
+// same key the class already has.
+// The declaration only applies to attributes set from then on; vertices that already
+// exist are not checked. It is kept until the graph is written.
+// Returns an error of type *DataError if the default value does not have the declared type.
+func (c *Class) Declare (def AttributeDef, g *Graph) *DataError {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilSchemaStore, g.schemaStore != nil)
+
+    if def.Default != nil {
+        t, _, _, err := encodeValue(def.Default)
+        if err != nil {
+            return err
+        }
+        if def.Type != AnyType && AttributeType(t) != def.Type {
+            return schemaError(c, def.Key, "must have a default of type " + def.Type.String(), g)
+        }
+    }
+
+    cs := g.schemaStore.schema(c.Id)
+    if existing := cs.find(def.Key); existing != nil {
+        *existing = def
+    } else {
+        if _, err := g.labelStore.addLabel(def.Key, g); err != nil {
+            return err
+        }
+        cs.attributes = append(cs.attributes, def)
+    }
+    g.schemaStore.changed = true
+    return nil
+}
+
+// SetStrict sets whether the class only allows the attributes declared in its schema
+// and the schemas of its super classes.
+// Classes are lenient by default, allowing attributes that are not declared.
+// Strictness is not inherited by sub classes.
+func (c *Class) SetStrict (strict bool, g *Graph) {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilSchemaStore, g.schemaStore != nil)
+
+    g.schemaStore.schema(c.Id).strict = strict
+    g.schemaStore.changed = true
+}
+
+// IsStrict returns whether the class only allows the attributes in its schema.
+func (c *Class) IsStrict (g *Graph) bool {
+    cs, ok := g.schemaStore.classes[c.Id]
+    return ok && cs.strict
+}
+
+// Schema returns the attributes declared for the class, including those it inherits
+// from its super classes, sorted by key.
+func (c *Class) Schema (g *Graph) []AttributeDef {
+    Assert(nilClass, c != nil)
+    Assert(nilGraph, g != nil)
+    Assert(nilSchemaStore, g.schemaStore != nil)
+
+    seen := make(map[string]Empty)
+    defs := make([]AttributeDef, 0)
+    for class := c; class != nil; class = class.Super(g) {
+        cs, ok := g.schemaStore.classes[class.Id]
+        if !ok {
+            continue
+        }
+        for _, def := range cs.attributes {
+            if _, ok := seen[def.Key]; !ok {
+                seen[def.Key] = Empty{}
+                defs = append(defs, def)
+            }
+        }
+    }
+    sort.Slice(defs, func(a, b int) bool { return defs[a].Key < defs[b].Key })
+    return defs
+}
+
+// Returns the declaration of an attribute key for the class, which may be inherited,
+// or nil if the key is not declared.
+func (c *Class) declaration (key string, g *Graph) *AttributeDef {
+    for class := c; class != nil; class = class.Super(g) {
+        if cs, ok := g.schemaStore.classes[class.Id]; ok {
+            if def := cs.find(key); def != nil {
+                return def
+            }
+        }
+    }
+    return nil
+}
+
+// Checks that a vertex of the class may have an attribute with a key and type.
+// A type of 0 means the attribute is being removed.
+func (c *Class) checkAttribute (key string, t byte, g *Graph) *DataError {
+    def := c.declaration(key, g)
+    switch {
+    case def == nil && t != 0 && c.IsStrict(g):
+        return schemaError(c, key, "is not declared", g)
+    case def == nil:
+        return nil
+    case t == 0 && def.Required:
+        return schemaError(c, key, "is required", g)
+    case t != 0 && def.Type != AnyType && AttributeType(t) != def.Type:
+        return schemaError(c, key, "must be " + def.Type.String() + ", not " + AttributeType(t).String(), g)
+    }
+    return nil
+}
+
+// Checks that a new vertex of the class may have a set of values, and adds the
+// default values of declared keys that are missing.
+func (c *Class) checkValues (values map[string]Any, g *Graph) (map[string]Any, *DataError) {
+    checked := make(map[string]Any, len(values))
+    for key, value := range values {
+        t, _, _, err := encodeValue(value)
+        if err != nil {
+            return nil, err
+        }
+        if err = c.checkAttribute(key, t, g); err != nil {
+            return nil, err
+        }
+        checked[key] = value
+    }
+    for _, def := range c.Schema(g) {
+        if _, ok := checked[def.Key]; ok {
+            continue
+        }
+        if def.Default != nil {
+            checked[def.Key] = def.Default
+        } else if def.Required {
+            return nil, schemaError(c, def.Key, "is required", g)
+        }
+    }
+    return checked, nil
+}
+
+// Returns true if the class is c or one of its sub classes.
+func (c *Class) isA (other *Class, g *Graph) bool {
+    for class := c; class != nil; class = class.Super(g) {
+        if class.Id == other.Id {
+            return true
+        }
+    }
+    return false
+}
+
+// DeclareEdge restricts the edges with a label to the classes and cardinality of the
+// declaration, replacing any declaration the label already has.
+// The declaration only applies to edges added from then on; edges that already exist
+// are not checked. It is kept until the graph is written.
+// Returns an error of type *DataError if either class does not exist or if the label
+// can not be read.
+func (g *Graph) DeclareEdge (def EdgeDef) *DataError {
+    Assert(nilGraph, g != nil)
+    Assert(nilSchemaStore, g.schemaStore != nil)
+
+    es := &edgeSchema{cardinality: def.Cardinality}
+    for _, end := range []struct {
+        name string
+        id *uint8
+    }{{def.From, &es.from}, {def.To, &es.to}} {
+        if end.name == "" {
+            continue
+        }
+        c := g.C(end.name)
+        if c == nil {
+            return dataError("Could not declare edge " + def.Label + ". There is no class named " + end.name + ".", nil, nil)
+        }
+        *end.id = c.Id
+    }
+
+    // a label that is already declared keeps the reference it took the first time
+    if l, err := g.labelStore.findByValue(def.Label, g); err != nil {
+        return err
+    } else if l != nil {
+        if _, ok := g.schemaStore.edges[l.Id]; ok {
+            g.schemaStore.edges[l.Id] = es
+            g.schemaStore.changed = true
+            return nil
+        }
+    }
+    label, err := g.labelStore.addLabel(def.Label, g)
+    if err != nil {
+        return err
+    }
+    g.schemaStore.edges[label] = es
+    g.schemaStore.changed = true
+    return nil
+}
+
+// EdgeSchema returns the declarations of the edge labels of the graph, sorted by label.
+func (g *Graph) EdgeSchema () []EdgeDef {
+    Assert(nilGraph, g != nil)
+    Assert(nilSchemaStore, g.schemaStore != nil)
+
+    defs := make([]EdgeDef, 0, len(g.schemaStore.edges))
+    for label, es := range g.schemaStore.edges {
+        l, err := g.labelStore.find(label)
+        if err != nil {
+            continue
+        }
+        def := EdgeDef{Label: l.Value(g), Cardinality: es.cardinality}
+        if c := g.classStore.Find(es.from); c != nil {
+            def.From, _ = c.Name(g)
+        }
+        if c := g.classStore.Find(es.to); c != nil {
+            def.To, _ = c.Name(g)
+        }
+        defs = append(defs, def)
+    }
+    sort.Slice(defs, func(a, b int) bool { return defs[a].Label < defs[b].Label })
+    return defs
+}
+
+// Checks that an edge with a label may go from one vertex to another, given the
+// edges with the label the vertices already have.
+func (s *schemaStore) checkEdge (from, to *Vertex, label string, out, in edgeMap, g *Graph) *DataError {
+    l, err := g.labelStore.findByValue(label, g)
+    if l == nil {
+        return err
+    }
+    es, ok := s.edges[l.Id]
+    if !ok {
+        return nil
+    }
+
+    for _, end := range []struct {
+        class uint8
+        v *Vertex
+        direction string
+    }{{es.from, from, "from"}, {es.to, to, "to"}} {
+        if end.class == 0 {
+            continue
+        }
+        allowed := g.classStore.Find(end.class)
+        if allowed != nil && !end.v.Class(g).isA(allowed, g) {
+            name, _ := allowed.Name(g)
+            return edgeSchemaError(label, "may only go " + end.direction + " vertices of class " + name + ", not " + end.v.ClassName(g))
+        }
+    }
+
+    if (es.cardinality == ManyToOne || es.cardinality == OneToOne) && len(out.get(label)) > 0 {
+        return edgeSchemaError(label, "is " + es.cardinality.String() + ", and the vertex it goes from already has one")
+    }
+    if (es.cardinality == OneToMany || es.cardinality == OneToOne) && len(in.get(label)) > 0 {
+        return edgeSchemaError(label, "is " + es.cardinality.String() + ", and the vertex it goes to already has one")
+    }
+    return nil
+}
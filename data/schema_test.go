@@ -0,0 +1,165 @@
+package data
+
+import(
+	"testing"
+	"fmt"
+)
+
+func TestClassSchema (t *testing.T) {
+    db, g := newTestGraph(t, "schema")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    employee := g.AddClass("Employee", person)
+    person.Declare(AttributeDef{Key: "name", Type: TextType, Required: true}, g)
+    person.Declare(AttributeDef{Key: "age", Type: IntegerType}, g)
+    employee.Declare(AttributeDef{Key: "active", Type: BooleanType, Default: true}, g)
+    if err := employee.Declare(AttributeDef{Key: "level", Type: IntegerType, Default: "high"}, g); err == nil {
+        t.Error("declared a default of the wrong type")
+    }
+    employee.SetStrict(true, g)
+    
+    violation := func(err *DataError, key string) {
+        if err == nil {
+            t.Errorf("%s: schema was not enforced", key)
+        } else if se := err.Schema(); se == nil || se.Key != key {
+            t.Errorf("%s: unexpected error %s", key, err.Trace())
+        }
+    }
+    
+    // required attributes must be given when the vertex is created
+    _, err = g.AddVertex(person)
+    violation(err, "name")
+    ann, err := g.AddVertexWith(person, map[string]Any{"name": "Ann", "nickname": "annie"})
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    violation(ann.Set("age", "old", g), "age")
+    violation(ann.RemoveAttributeByKey("name", g), "name")
+    if err := ann.Set("age", 40, g); err != nil {
+        t.Error(err.Trace())
+    }
+    
+    // sub classes inherit declarations, and strict classes refuse undeclared keys
+    _, err = g.AddVertexWith(employee, map[string]Any{"name": "Bob", "nickname": "bobby"})
+    violation(err, "nickname")
+    bob, err := g.AddVertexWith(employee, map[string]Any{"name": "Bob"})
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    if active, _ := bob.Get("active", g); active != true {
+        t.Errorf("default value was not set: %v", active)
+    }
+    violation(bob.Set("age", 1.5, g), "age")
+    
+    // removing a vertex removes its required attributes
+    if err := g.RemoveVertex(ann); err != nil {
+        t.Error(err.Trace())
+    }
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "schema")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    employee = g.C("Employee")
+    if !employee.IsStrict(g) || g.C("Person").IsStrict(g) {
+        t.Error("strictness did not survive reopening the graph")
+    }
+    schema := employee.Schema(g)
+    if fmt.Sprint(schema) != fmt.Sprint([]AttributeDef{
+        {"active", BooleanType, false, true},
+        {"age", IntegerType, false, nil},
+        {"name", TextType, true, nil},
+    }) {
+        t.Errorf("schema did not survive reopening the graph: %v", schema)
+    }
+    
+    // a record cut short is corruption
+    file := g.schemaStore.file
+    file.WriteAt([]byte{edgeSchemaRecord, 1, 0}, sizeOf(t, file))
+    if _, err = constructSchemaStore(g); err == nil || err.Corruption() == nil {
+        t.Error("expected a corruption error for a schema record that was cut short")
+    }
+}
+
+func TestEdgeSchema (t *testing.T) {
+    db, g := newTestGraph(t, "edges")
+    var err *DataError
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    asset := g.AddClass("Asset", g.C("Vertex"))
+    house := g.AddClass("House", asset)
+    if err := g.DeclareEdge(EdgeDef{"owns", "Person", "Nobody", OneToMany}); err == nil {
+        t.Error("declared an edge to a class that does not exist")
+    }
+    if err := g.DeclareEdge(EdgeDef{"owns", "Person", "Asset", OneToMany}); err != nil {
+        t.Fatal(err.Trace())
+    }
+    g.DeclareEdge(EdgeDef{Label: "married", From: "Person", To: "Person", Cardinality: OneToMany})
+    married, _ := g.labelStore.findByValue("married", g)
+    refs := married.refs
+    g.DeclareEdge(EdgeDef{Label: "married", From: "Person", To: "Person", Cardinality: OneToOne})
+    if l, _ := g.labelStore.findByValue("married", g); l.refs != refs {
+        t.Errorf("redeclaring an edge changed the references to its label from %d to %d", refs, l.refs)
+    }
+    
+    ann, _ := g.AddVertex(person)
+    bob, _ := g.AddVertex(person)
+    home, _ := g.AddVertex(house)
+    car, _ := g.AddVertex(asset)
+    
+    violation := func(err *DataError, what string) {
+        if err == nil {
+            t.Errorf("%s: schema was not enforced", what)
+        } else if se := err.Schema(); se == nil || se.Label == "" {
+            t.Errorf("%s: unexpected error %s", what, err.Trace())
+        }
+    }
+    
+    // sub classes of the declared classes are allowed
+    if _, err = g.AddEdge(ann, home, "owns"); err != nil {
+        t.Error(err.Trace())
+    }
+    if _, err = g.AddEdge(ann, car, "owns"); err != nil {
+        t.Error(err.Trace())
+    }
+    _, err = g.AddEdge(car, home, "owns")
+    violation(err, "wrong from class")
+    _, err = g.AddEdge(bob, ann, "owns")
+    violation(err, "wrong to class")
+    _, err = g.AddEdge(bob, home, "owns")
+    violation(err, "second owner")
+    
+    if _, err = g.AddEdge(ann, bob, "married"); err != nil {
+        t.Error(err.Trace())
+    }
+    _, err = g.AddEdge(ann, ann, "married")
+    violation(err, "second marriage")
+    
+    // labels without a declaration are not restricted
+    if _, err = g.AddEdge(car, home, "near"); err != nil {
+        t.Error(err.Trace())
+    }
+    
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    db.Shutdown()
+    g, err = constructGraph(db, "edges")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    defer g.shutdown()
+    schema := g.EdgeSchema()
+    if fmt.Sprint(schema) != fmt.Sprint([]EdgeDef{
+        {"married", "Person", "Person", OneToOne},
+        {"owns", "Person", "Asset", OneToMany},
+    }) {
+        t.Errorf("edge schema did not survive reopening the graph: %v", schema)
+    }
+}
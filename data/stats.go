@@ -0,0 +1,379 @@
+package data
+
+import (
+    "io"
+    "io/ioutil"
+    "math"
+    "os"
+    "sort"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// error messages
+const (
+    nilStatsStore = "attempt to operate on a nil stats store"
+    nilStatsStoreFile = "attempt to operate on a nil stats store file"
+    statsWriteFail = "could not write the stats store: "
+    statsReadFail = "could not read the stats store: "
+    statsCorrupted = "stats counter could not be decoded"
+)
+
+// The store files of a graph that are reported by Stats, other than the index directory.
+var statsStoreNames = []string{
+    "text", "text.id", "label", "label.id", "label.hash", "class", "vertex", "vertex.id",
+    "edge", "edge.id", "edge.label", "attribute", "attribute.id", "index", "schema", "stats",
+}
+
+// Stats describes the size and shape of a graph.
+type Stats struct {
+    Vertices int                    // the number of vertices in the graph
+    Edges int                       // the number of edges in the graph
+    Classes map[string]ClassStats   // the vertices of each class, by class name
+    Labels map[string]int           // the number of edges with each label
+    Keys map[string]int             // the number of vertices and edges with each attribute key
+    AverageDegree float64           // the average number of edges a vertex has, inbound and outbound
+    MaxOutDegree int                // the most outbound edges any vertex has
+    MaxInDegree int                 // the most inbound edges any vertex has
+    FileSizes map[string]int64      // the size in bytes of each store file, and "idx" for all indexes
+    FreeIds map[string]int          // the number of ids waiting to be reused by each store
+}
+
+// ClassStats counts the vertices of a class.
+type ClassStats struct {
+    Vertices int // the vertices that belong to the class itself
+    Total int    // the vertices that belong to the class or one of its sub classes
+}
+
+// The kinds of counter in the stats store
+const (
+    keyCounter byte = iota + 1  // the attributes with a key, by the label id of the key
+    outDegreeCounter            // the vertices with a number of outbound edges
+    inDegreeCounter             // the vertices with a number of inbound edges
+)
+
+const statsSlotSize = 9 // kind (1) + what is counted (4) + count (4)
+
+// A counter in the stats store: its kind and what it counts.
+type statsCounter struct {
+    kind byte
+    key uint32
+}
+
+// The stats store keeps the statistics of a graph that are not already kept by
+// other stores, up to date as the graph changes, so that Stats costs nothing to call.
+// Vertex counts are kept by classes, and edge counts by the edge label index.
+// Each counter has a fixed size slot in the file, so only the counters that changed
+// are written.
+type statsStore struct {
+    file *os.File
+    keys map[uint16]uint32          // label id of an attribute key -> number of attributes
+    outDegrees map[uint32]uint32    // outbound edges -> number of vertices with that many
+    inDegrees map[uint32]uint32     // inbound edges -> number of vertices with that many
+    slots map[statsCounter]uint32   // the slot of each counter in the file
+    size uint32                     // the number of slots in the file
+    free []uint32                   // the slots that hold no counter
+    dirty map[statsCounter]Empty    // the counters that changed since they were written
+    fileSizes map[string]int64      // the sizes of the files, as reported by Stats, once read
+}
+
+// Creates an existing stats store.
+// Returns an error of type *DataError if the file can not be opened or read.
+func constructStatsStore(g *Graph) (*statsStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(statsStore)
+    fileName := g.storePath("stats")
+    if file, e := os.OpenFile(fileName, os.O_RDWR, 0777); e != nil {
+        return nil, dataError("Could not open file for stats store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if _, de := checkFileHeader(s.file, statsFile); de != nil {
+        return nil, de
+    }
+
+    if de := s.readStats(); de != nil {
+        return nil, de
+    }
+
+    return s, nil
+}
+
+// Creates a stats store that does not yet exist.
+// Returns an error of type *DataError if the file can not be created.
+func createStatsStore(g *Graph) (*statsStore, *DataError) {
+    Assert(nilGraph, g != nil)
+
+    s := new(statsStore)
+    fileName := g.storePath("stats")
+    if file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777); e != nil {
+        return nil, dataError("Could not create file for stats store: " + fileName + ".", e, nil)
+    } else {
+        s.file = file
+    }
+    if de := writeFileHeader(s.file, statsFile, 0); de != nil {
+        return nil, de
+    }
+
+    if de := s.readStats(); de != nil {
+        return nil, de
+    }
+
+    return s, nil
+}
+
+// Returns the map that holds the counters of a kind.
+func (s *statsStore) counters(kind byte) map[uint32]uint32 {
+    if kind == outDegreeCounter {
+        return s.outDegrees
+    }
+    return s.inDegrees
+}
+
+// Returns the value of a counter.
+func (s *statsStore) value(c statsCounter) uint32 {
+    if c.kind == keyCounter {
+        return s.keys[uint16(c.key)]
+    }
+    return s.counters(c.kind)[c.key]
+}
+
+// Reads the counters from their slots in the file.
+// Has a secondary purpose of initializing the store.
+// Each slot holds the kind of the counter, what it counts, and the count. A slot with
+// no kind holds no counter.
+// Returns an error of type *DataError if the file can not be read or a slot can not be
+// decoded.
+func (s *statsStore) readStats() *DataError {
+    Assert(nilStatsStore, s != nil)
+    Assert(nilStatsStoreFile, s.file != nil)
+
+    s.keys = make(map[uint16]uint32)
+    s.outDegrees = make(map[uint32]uint32)
+    s.inDegrees = make(map[uint32]uint32)
+    s.slots = make(map[statsCounter]uint32)
+    s.free = make([]uint32, 0)
+    s.dirty = make(map[statsCounter]Empty)
+
+    fileSize, e := fileSize(s.file)
+    if e != nil {
+        return dataError(statsReadFail + s.file.Name(), e, nil)
+    }
+    size := int(fileSize - fileHeaderSize)
+    s.size = uint32((size + statsSlotSize - 1) / statsSlotSize)
+    bytes := make([]byte, size)
+    if _, e := s.file.ReadAt(bytes, int64(fileHeaderSize)); e != nil && e != io.EOF {
+        return dataError(statsReadFail + s.file.Name(), e, nil)
+    }
+
+    // slots are numbered from 1 in corruption errors, like records
+    if size % statsSlotSize != 0 {
+        return dataError(statsCorrupted, &CorruptionError{s.file.Name(), uint64(s.size)}, nil)
+    }
+    for slot := uint32(0); slot < s.size; slot++ {
+        b := bytes[int(slot) * statsSlotSize:]
+        c, count := statsCounter{b[0], util.Uint32(b[1:5])}, util.Uint32(b[5:9])
+        if c.kind == 0 {
+            s.free = append(s.free, slot)
+            continue
+        }
+        _, taken := s.slots[c]
+        if c.kind > inDegreeCounter || count == 0 || taken || (c.kind == keyCounter && c.key > math.MaxUint16) {
+            return dataError(statsCorrupted, &CorruptionError{s.file.Name(), uint64(slot) + 1}, nil)
+        }
+        if c.kind == keyCounter {
+            s.keys[uint16(c.key)] = count
+        } else {
+            s.counters(c.kind)[c.key] = count
+        }
+        s.slots[c] = slot
+    }
+    return nil
+}
+
+// Writes the counters that have changed to their slots, giving slots to new counters
+// and freeing the slots of counters that reached zero.
+// Returns an error of type *DataError if they can not be written.
+func (s *statsStore) write() *DataError {
+    Assert(nilStatsStore, s != nil)
+    Assert(nilStatsStoreFile, s.file != nil)
+
+    // in order, so the same changes always give counters the same slots
+    changed := make([]statsCounter, 0, len(s.dirty))
+    for c := range s.dirty {
+        changed = append(changed, c)
+    }
+    sort.Slice(changed, func(a, b int) bool {
+        return changed[a].kind < changed[b].kind || changed[a].kind == changed[b].kind && changed[a].key < changed[b].key
+    })
+
+    b := make([]byte, statsSlotSize)
+    for _, c := range changed {
+        count := s.value(c)
+        slot, ok := s.slots[c]
+        switch {
+        case count == 0 && !ok:
+            continue
+        case count == 0:
+            delete(s.slots, c)
+            s.free = append(s.free, slot)
+            b[0] = 0
+        case !ok:
+            if n := len(s.free); n > 0 {
+                slot = s.free[n - 1]
+                s.free = s.free[:n - 1]
+            } else {
+                slot = s.size
+                s.size++
+            }
+            s.slots[c] = slot
+            fallthrough
+        default:
+            b[0] = c.kind
+        }
+        util.PutUint32(b[1:5], c.key)
+        util.PutUint32(b[5:9], count)
+        if count == 0 {
+            util.PutUint32(b[1:5], 0)
+        }
+        if _, e := s.file.WriteAt(b, int64(fileHeaderSize) + int64(slot) * statsSlotSize); e != nil {
+            return dataError(statsWriteFail + s.file.Name(), e, nil)
+        }
+    }
+    s.dirty = make(map[statsCounter]Empty)
+    return nil
+}
+
+// Records that an attribute with a key was added to a vertex or edge.
+func (s *statsStore) keyAdded(label uint16) {
+    s.keys[label]++
+    s.dirty[statsCounter{keyCounter, uint32(label)}] = Empty{}
+}
+
+// Records that an attribute with a key was removed from a vertex or edge.
+func (s *statsStore) keyRemoved(label uint16) {
+    if s.keys[label] <= 1 {
+        delete(s.keys, label)
+    } else {
+        s.keys[label]--
+    }
+    s.dirty[statsCounter{keyCounter, uint32(label)}] = Empty{}
+}
+
+// Records that a vertex that had old edges in one direction now has new edges.
+func (s *statsStore) changeDegree(kind byte, old, new int) {
+    degrees := s.counters(kind)
+    if old > 0 {
+        if degrees[uint32(old)] <= 1 {
+            delete(degrees, uint32(old))
+        } else {
+            degrees[uint32(old)]--
+        }
+        s.dirty[statsCounter{kind, uint32(old)}] = Empty{}
+    }
+    if new > 0 {
+        degrees[uint32(new)]++
+        s.dirty[statsCounter{kind, uint32(new)}] = Empty{}
+    }
+}
+
+// Records that the number of outbound edges of a vertex changed.
+func (s *statsStore) outDegreeChanged(old, new int) {
+    s.changeDegree(outDegreeCounter, old, new)
+}
+
+// Records that the number of inbound edges of a vertex changed.
+func (s *statsStore) inDegreeChanged(old, new int) {
+    s.changeDegree(inDegreeCounter, old, new)
+}
+
+// Shuts the stats store down, making sure all files are closed.
+func (s *statsStore) shutdown() {
+    if s != nil && s.file != nil {
+        _ = s.file.Close()
+    }
+}
+
+// Stats returns the statistics of the graph.
+// Everything is kept up to date as the graph changes, except the names of labels and
+// the sizes of files, which are read the first time they are needed and then cached.
+// The files only change when the graph is written, which drops the cached sizes.
+func (g *Graph) Stats() Stats {
+    Assert(nilGraph, g != nil)
+    Assert(nilStatsStore, g.statsStore != nil)
+
+    stats := Stats{
+        Classes: make(map[string]ClassStats),
+        Labels: make(map[string]int),
+        Keys: make(map[string]int),
+        FileSizes: make(map[string]int64),
+        FreeIds: make(map[string]int),
+    }
+
+    for _, c := range g.classStore.classes {
+        name := g.labelStore.name(c.label, g)
+        stats.Classes[name] = ClassStats{int(c.Count), c.total(g)}
+        stats.Vertices += int(c.Count)
+    }
+
+    for label, ids := range g.edgeStore.labels.labels {
+        if name := g.labelStore.name(label, g); name != "" {
+            stats.Labels[name] = len(ids)
+        }
+        stats.Edges += len(ids)
+    }
+    for label, count := range g.statsStore.keys {
+        if name := g.labelStore.name(label, g); name != "" {
+            stats.Keys[name] = int(count)
+        }
+    }
+
+    if stats.Vertices > 0 {
+        stats.AverageDegree = float64(2 * stats.Edges) / float64(stats.Vertices)
+    }
+    for degree := range g.statsStore.outDegrees {
+        if int(degree) > stats.MaxOutDegree {
+            stats.MaxOutDegree = int(degree)
+        }
+    }
+    for degree := range g.statsStore.inDegrees {
+        if int(degree) > stats.MaxInDegree {
+            stats.MaxInDegree = int(degree)
+        }
+    }
+
+    for name, size := range g.statsStore.sizes(g) {
+        stats.FileSizes[name] = size
+    }
+
+    stats.FreeIds["text"] = len(g.textStore.idStore.ids)
+    stats.FreeIds["label"] = len(g.labelStore.idStore.ids)
+    stats.FreeIds["vertex"] = len(g.vertexStore.idStore.ids)
+    stats.FreeIds["edge"] = len(g.edgeStore.idStore.ids)
+    stats.FreeIds["attribute"] = len(g.attributeStore.idStore.ids)
+
+    return stats
+}
+
+// Returns the size of each store file, and "idx" for the total size of the index files,
+// reading them from disk if they are not cached.
+func (s *statsStore) sizes(g *Graph) map[string]int64 {
+    Assert(nilStatsStore, s != nil)
+
+    if s.fileSizes == nil {
+        s.fileSizes = make(map[string]int64)
+        for _, name := range statsStoreNames {
+            if info, e := os.Stat(g.storePath(name)); e == nil {
+                s.fileSizes[name] = info.Size()
+            }
+        }
+        s.fileSizes["idx"] = 0
+        if infos, e := ioutil.ReadDir(g.indexDir()); e == nil {
+            for _, info := range infos {
+                s.fileSizes["idx"] += info.Size()
+            }
+        }
+    }
+    return s.fileSizes
+}
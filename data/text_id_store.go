@@ -33,6 +33,9 @@ func constructTextIdStore(fileName string) (*textIdStore, *DataError) {
     } else {
         s.file = file
     }
+    if _, de := checkFileHeader(s.file, textIdFile); de != nil {
+        return nil, de
+    }
 
     s.next, _ = s.readNextId()
     s.ids = s.readIds()
@@ -49,9 +52,14 @@ func createTextIdStore(fileName string) (*textIdStore, *DataError) {
     } else {
         s.file = file
     }
+    if de := writeFileHeader(s.file, textIdFile, 0); de != nil {
+        return nil, de
+    }
 
     s.next = uint64(1)    // ids start at 1
-    s.writeNextId()
+    if err := s.writeNextId(); err != nil {
+        return nil, err
+    }
     s.ids = s.readIds()
     
     return s, nil
@@ -65,13 +73,18 @@ func (s *textIdStore) addId(id *textId) {
 }
 
 // Writes the data for the store to the file.
-func (s *textIdStore) write() {
+// Returns an error of type *DataError if it can not be written.
+func (s *textIdStore) write() *DataError {
     Assert(nilTextIdStore, s != nil)
     Assert(nilTextIdStoreFile, s.file != nil)
     
-    s.file.Truncate(int64(0))
-    s.writeNextId()
-    s.writeIds()
+    if e := s.file.Truncate(int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for text id store: " + s.file.Name() + ".", e, nil)
+    }
+    if err := s.writeNextId(); err != nil {
+        return err
+    }
+    return s.writeIds()
 }
 
 // Reads the final available id (used when no other ids can be used) from the data file.
@@ -80,7 +93,7 @@ func (s *textIdStore) readNextId() (uint64, *DataError) {
     Assert(nilTextIdStore, s != nil)
     Assert(nilTextIdStoreFile, s.file != nil)
     
-    readAt := int64(0)
+    readAt := int64(fileHeaderSize)
     b := make([]byte, 8)
     s.file.ReadAt(b, readAt)
     val, e := util.BytesToUint64(b)
@@ -91,10 +104,14 @@ func (s *textIdStore) readNextId() (uint64, *DataError) {
 }
 
 // Writes the final available id (used when no other ids can be used) to the data file.
-func (s *textIdStore) writeNextId() {
-    writeAt := int64(0)
-    bytes, _ := util.Uint64ToBytes(s.next)
-    _, _ = s.file.WriteAt(bytes, writeAt) // TODO ignore the return?
+func (s *textIdStore) writeNextId() *DataError {
+    writeAt := int64(fileHeaderSize)
+    bytes := make([]byte, 8)
+    util.PutUint64(bytes, s.next)
+    if _, e := s.file.WriteAt(bytes, writeAt); e != nil {
+        return dataError("Could not write file for text id store: " + s.file.Name() + ".", e, nil)
+    }
+    return nil
 }
 
 // Reads the available ids from the data file and returns them.
@@ -102,7 +119,7 @@ func (s *textIdStore) readIds() []*textId {
     Assert(nilTextIdStore, s != nil)
     Assert(nilTextIdStoreFile, s.file != nil)
     
-    readAt := int64(8)
+    readAt := int64(fileHeaderSize + 8)
     b := make([]byte, textIdDataSize)
     res := make([]*textId, 0)
     for _, e := s.file.ReadAt(b, readAt); e != io.EOF ; _, e = s.file.ReadAt(b, readAt){
@@ -114,7 +131,7 @@ func (s *textIdStore) readIds() []*textId {
 }
 
 // Writes the available ids to the data file.
-func (s *textIdStore) writeIds() {
+func (s *textIdStore) writeIds() *DataError {
     Assert(nilTextStore, s != nil)
     Assert(nilTextStoreFile, s.file != nil)
     
@@ -123,12 +140,15 @@ func (s *textIdStore) writeIds() {
     for idx, val := range s.ids {
         if val != nil && val.rows > 0 {     // ensure the value should/can be written
                                             // should nil cause a panic?
-            writeAt = int64(8 + textIdDataSize * idx)
+            writeAt = int64(fileHeaderSize + 8 + textIdDataSize * idx)
             b = val.data()
-            _, _ = s.file.WriteAt(b, writeAt)   // TODO probably shouldn't ignore this
+            if _, e := s.file.WriteAt(b, writeAt); e != nil {
+                return dataError("Could not write file for text id store: " + s.file.Name() + ".", e, nil)
+            }
         }
         
     }
+    return nil
 }
 
 // Returns the next available id from the text id store.
@@ -147,14 +167,17 @@ func (s *textIdStore) nextId(size uint32) (val uint64) {
     rows := calculateTextRows(size)
     
     // search for an existing id that is usable
-    for _, id := range s.ids {
-        if id.rows <= rows {
+    for idx, id := range s.ids {
+        if id.rows >= rows {
             val = id.value
             idRows := id.rows
             
             // update the id to reflect the space available
             id.rows = idRows - rows
             id.value = val + uint64(rows)
+            if id.rows == 0 {
+                s.ids = append(s.ids[:idx], s.ids[idx + 1:]...)
+            }
             
             return val
         }
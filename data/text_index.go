@@ -0,0 +1,309 @@
+package data
+
+import (
+    "os"
+    "sort"
+    "strings"
+    "unicode"
+
+    "github.com/wardlem/graphlite/util"
+)
+
+// Error messages
+const (
+    nilTextIndex = "attempt to operate on a nil text index"
+    nilTextIndexFile = "attempt to operate on a nil text index file"
+)
+
+// A text index is an inverted index over the words of one text attribute key of a
+// class, for full-text search.
+// For each word it keeps the vertices whose text contains the word and how many times,
+// along with the number of words in each vertex's text for ranking.
+// The file is an entry log (see entryLog) of the occurrences of each word in the text
+// of each vertex and the number of words in each vertex's text.
+// The whole index is read into memory when it is first used.
+type textIndex struct {
+    file *os.File
+    log *entryLog
+    flags byte                          // the options for breaking text into words
+    words map[string]map[uint32]uint32  // word -> vertex id -> occurrences
+    lengths map[uint32]uint32           // vertex id -> number of words
+}
+
+// The kinds of text index entry
+const (
+    wordEntry byte = iota + 1   // the occurrences of a word in the text of a vertex
+    lengthEntry                 // the number of words in the text of a vertex
+)
+
+// Creates an existing text index.
+func constructTextIndex(fileName string, flags byte) (*textIndex, *DataError) {
+
+    i := new(textIndex)
+    i.flags = flags
+
+    // load the file
+    file, e := os.OpenFile(fileName, os.O_RDWR, 0777)
+    if e != nil {
+        return nil, dataError("Could not open file for text index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if _, de := checkFileHeader(i.file, textIndexFile); de != nil {
+        return nil, de
+    }
+
+    if de := i.readWords(); de != nil {
+        return nil, de
+    }
+
+    return i, nil
+}
+
+// Creates a text index that does not yet exist.
+func createTextIndex(fileName string, flags byte) (*textIndex, *DataError) {
+
+    i := new(textIndex)
+    i.flags = flags
+
+    // create the file
+    file, e := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0777)
+    if e != nil {
+        return nil, dataError("Could not create file for text index: " + fileName + ".", e, nil)
+    }
+    i.file = file
+    if de := writeFileHeader(i.file, textIndexFile, 0); de != nil {
+        return nil, de
+    }
+
+    i.log = &entryLog{file: file}
+    i.words = make(map[string]map[uint32]uint32)
+    i.lengths = make(map[uint32]uint32)
+
+    return i, nil
+}
+
+// Encodes an entry as its kind, the vertex id, the number, and the word of a word entry.
+func encodeTextEntry(kind byte, id uint32, n uint32, word string) []byte {
+    b := make([]byte, 9 + len(word))
+    b[0] = kind
+    util.PutUint32(b[1:5], id)
+    util.PutUint32(b[5:9], n)
+    copy(b[9:], word)
+    return b
+}
+
+// Reads the index from the file.
+// Returns an error of type *DataError if the file can not be read.
+func (i *textIndex) readWords() *DataError {
+    Assert(nilTextIndex, i != nil)
+    Assert(nilTextIndexFile, i.file != nil)
+
+    i.words = make(map[string]map[uint32]uint32)
+    i.lengths = make(map[uint32]uint32)
+    log, err := readEntryLog(i.file, func(added bool, entry []byte) bool {
+        if len(entry) < 9 {
+            return false
+        }
+        id, n := util.Uint32(entry[1:5]), util.Uint32(entry[5:9])
+        switch {
+        case entry[0] == wordEntry && len(entry) > 9:
+            i.putWord(string(entry[9:]), id, n, added)
+        case entry[0] == lengthEntry && len(entry) == 9:
+            i.putLength(id, n, added)
+        default:
+            return false
+        }
+        return true
+    })
+    i.log = log
+    return err
+}
+
+// Writes the changes to the index to the file.
+// Returns an error of type *DataError if they can not be written.
+func (i *textIndex) write() *DataError {
+    Assert(nilTextIndex, i != nil)
+    Assert(nilTextIndexFile, i.file != nil)
+
+    return i.log.write(func(fn func(entry []byte)) {
+        words := make([]string, 0, len(i.words))
+        for word := range i.words {
+            words = append(words, word)
+        }
+        sort.Strings(words)
+        for _, word := range words {
+            for _, id := range sortedKeys(i.words[word]) {
+                fn(encodeTextEntry(wordEntry, id, i.words[word][id], word))
+            }
+        }
+        for _, id := range sortedKeys(i.lengths) {
+            fn(encodeTextEntry(lengthEntry, id, i.lengths[id], ""))
+        }
+    })
+}
+
+// Adds the words of a vertex's text to the index.
+func (i *textIndex) add(text string, id uint32) {
+    Assert(nilTextIndex, i != nil)
+
+    words := tokenize(text, i.flags)
+    if len(words) == 0 {
+        return
+    }
+    counts := make(map[string]uint32)
+    for _, word := range words {
+        counts[word]++
+    }
+    for word, n := range counts {
+        i.setWord(word, id, i.words[word][id] + n)
+    }
+    i.setLength(id, i.lengths[id] + uint32(len(words)))
+}
+
+// Removes the words of a vertex's text from the index.
+func (i *textIndex) remove(text string, id uint32) {
+    Assert(nilTextIndex, i != nil)
+
+    for _, word := range tokenize(text, i.flags) {
+        i.setWord(word, id, 0)
+    }
+    i.setLength(id, 0)
+}
+
+// Changes the occurrences of a word in the text of a vertex, logging the change.
+func (i *textIndex) setWord(word string, id uint32, n uint32) {
+    if old := i.words[word][id]; old != 0 {
+        i.putWord(word, id, old, false)
+        i.log.remove(encodeTextEntry(wordEntry, id, old, word))
+    }
+    if n != 0 {
+        i.putWord(word, id, n, true)
+        i.log.add(encodeTextEntry(wordEntry, id, n, word))
+    }
+}
+
+// Changes the number of words in the text of a vertex, logging the change.
+func (i *textIndex) setLength(id uint32, n uint32) {
+    if old := i.lengths[id]; old != 0 {
+        i.putLength(id, old, false)
+        i.log.remove(encodeTextEntry(lengthEntry, id, old, ""))
+    }
+    if n != 0 {
+        i.putLength(id, n, true)
+        i.log.add(encodeTextEntry(lengthEntry, id, n, ""))
+    }
+}
+
+// Adds or removes the occurrences of a word in the text of a vertex.
+func (i *textIndex) putWord(word string, id uint32, n uint32, added bool) {
+    ids, ok := i.words[word]
+    if added {
+        if !ok {
+            ids = make(map[uint32]uint32)
+            i.words[word] = ids
+        }
+        ids[id] = n
+        return
+    }
+    delete(ids, id)
+    if ok && len(ids) == 0 {
+        delete(i.words, word)
+    }
+}
+
+// Adds or removes the number of words in the text of a vertex.
+func (i *textIndex) putLength(id uint32, n uint32, added bool) {
+    if added {
+        i.lengths[id] = n
+    } else {
+        delete(i.lengths, id)
+    }
+}
+
+// Returns the keys of a map of vertex ids, in order.
+func sortedKeys(m map[uint32]uint32) []uint32 {
+    ids := make([]uint32, 0, len(m))
+    for id := range m {
+        ids = append(ids, id)
+    }
+    sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+    return ids
+}
+
+// Cleans up the file for the index.
+func (i *textIndex) shutdown() {
+    if i != nil && i.file != nil {
+        _ = i.file.Close()
+    }
+}
+
+// Breaks text into the words that are indexed and searched for.
+// Words are runs of letters and digits. Depending on the flags they are folded to
+// lower case and reduced to their stems.
+func tokenize(text string, flags byte) []string {
+    words := strings.FieldsFunc(text, func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+    for n, word := range words {
+        if flags & foldCaseFlag != 0 {
+            word = strings.ToLower(word)
+        }
+        if flags & stemFlag != 0 {
+            word = stem(word)
+        }
+        words[n] = word
+    }
+    return words
+}
+
+// Suffixes removed by stem, longest first, with what replaces them.
+var stemSuffixes = []struct {
+    suffix, replacement string
+}{
+    {"ational", "ate"},
+    {"fulness", "ful"},
+    {"iveness", "ive"},
+    {"ization", "ize"},
+    {"ations", "ate"},
+    {"nesses", ""},
+    {"ation", "ate"},
+    {"ement", ""},
+    {"ments", ""},
+    {"ingly", ""},
+    {"edly", ""},
+    {"ness", ""},
+    {"ment", ""},
+    {"sses", "ss"},
+    {"ies", "y"},
+    {"ing", ""},
+    {"ers", ""},
+    {"ed", ""},
+    {"er", ""},
+    {"ly", ""},
+    {"s", ""},
+}
+
+// Reduces an english word to its stem by removing common suffixes, so that forms
+// like "index", "indexes", and "indexing" match each other.
+// This is a deliberately light stemmer: it never leaves a stem shorter than three
+// letters and only removes one suffix.
+func stem(word string) string {
+    // "es" is only a suffix after a sibilant, as in "boxes" or "matches"
+    if strings.HasSuffix(word, "es") && len(word) >= 5 {
+        base := word[:len(word) - 2]
+        for _, sibilant := range []string{"s", "x", "z", "ch", "sh"} {
+            if strings.HasSuffix(base, sibilant) && !strings.HasSuffix(base, "ss") {
+                return base
+            }
+        }
+    }
+    for _, s := range stemSuffixes {
+        if strings.HasSuffix(word, s.suffix) && len(word) - len(s.suffix) + len(s.replacement) >= 3 {
+            if s.suffix == "s" && strings.HasSuffix(word, "ss") {
+                return word // "class" is not the plural of "clas"
+            }
+            return word[:len(word) - len(s.suffix)] + s.replacement
+        }
+    }
+    return word
+}
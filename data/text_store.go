@@ -44,6 +44,9 @@ func constructTextStore(g *Graph) (*textStore, *DataError){
     } else {
         s.file = file;
     }
+    if _, de := checkFileHeader(s.file, textFile); de != nil {
+        return nil, de
+    }
 
     // create the id store
     fileName = g.storePath("text.id")
@@ -74,6 +77,9 @@ func createTextStore(g *Graph) (*textStore, *DataError){
     } else {
         s.file = file;
     }
+    if de := writeFileHeader(s.file, textFile, 0); de != nil {
+        return nil, de
+    }
 
     // create the id store
     fileName = g.storePath("text.id")
@@ -105,7 +111,7 @@ func (s *textStore) find (id uint64) (*Text, *DataError) {
     
     // search for it in the file
     // first, get the size of the text
-    readAt := int64((id - 1) * textStoreRowSize)
+    readAt := int64(fileHeaderSize + (id - 1) * textStoreRowSize)
     sizeBytes := make([]byte, 4)
     _, _ = s.file.ReadAt(sizeBytes, readAt) // TODO this should NOT be ignored
     length, _ := util.BytesToUint32(sizeBytes) // TODO do not ignore error
@@ -152,6 +158,14 @@ func (s *textStore) removeText (t *Text) {
         id := newTextId(t.Id, rows)
         s.idStore.addId(id)
         
+        // forget any pending write for the text, since its id is no longer valid
+        for idx, w := range s.writes {
+            if w == t {
+                s.writes = append(s.writes[:idx], s.writes[idx + 1:]...)
+                break
+            }
+        }
+        
         t.Id = 0
         
         // TODO do we need to write it or do we just wait for it to be overwritten ??
@@ -196,7 +210,7 @@ func (s *textStore) saveText(t *Text) uint64 {
 }
 
 // Writes updates to the text store.
-func (s *textStore) write() {
+func (s *textStore) write() *DataError {
     Assert(nilTextStore, s != nil)
     Assert(nilTextIdStore, s.idStore != nil)
     Assert(nilTextStoreWriteSlice, s.writes != nil)
@@ -205,16 +219,19 @@ func (s *textStore) write() {
     // write any new or updated values
     for _, t := range s.writes {
         Assert("can not write a text object with an id of 0", t.Id != 0)
-        pos := int64(t.Id * textStoreRowSize - textStoreRowSize)
-        // note: subtract textStoreRowSize is subtracted because ids begin at one, but writing starts at 0
-        _, _ = s.file.WriteAt(t.data(), pos) // TODO probably shouldn't ignore this
+        pos := int64(fileHeaderSize + t.Id * textStoreRowSize - textStoreRowSize)
+        // note: subtract textStoreRowSize is subtracted because ids begin at one, but writing starts
+        // just after the file header
+        if _, e := s.file.WriteAt(t.data(), pos); e != nil {
+            return dataError("Could not write file for text store: " + s.file.Name() + ".", e, nil)
+        }
     }
     
     // reset the write slice
     s.writes = make([]*Text, 0)
     
     // write the ids
-    s.idStore.write()
+    return s.idStore.write()
 }
 
 func (s *textStore) shutdown () {
@@ -0,0 +1,331 @@
+package data
+
+import (
+    "sort"
+)
+
+// A Traversal walks the graph from a set of vertices, one step at a time.
+// Each step returns a new traversal, so a traversal can be extended in different ways
+// and run more than once. Nothing is read until the traversal is run, and then each
+// vertex is found as it is needed rather than each step being run in full.
+//
+//    owners, err := g.V().HasClass("Person").Has("name", "Ann").Out("owns").In("likes").Dedup().Limit(10).ToList()
+type Traversal struct {
+    g *Graph
+    scan bool                    // whether the traversal is every vertex in the graph, without any steps
+    class *Class                 // the class the traversal is the vertices of, without any other steps
+    build func() vertexIterator  // creates the iterator over the vertices the traversal reaches
+    err *DataError               // the error found while building the traversal, if any
+}
+
+// V starts a traversal from the vertices with the given ids, or from every vertex in the
+// graph if no ids are given. Ids of vertices that do not exist are skipped.
+func (g *Graph) V(ids ...uint32) *Traversal {
+    Assert(nilGraph, g != nil)
+
+    if len(ids) == 0 {
+        return &Traversal{g: g, scan: true, build: func() vertexIterator {
+            return &storedVertices{g: g, ids: idRange(g.vertexStore.idStore.lastId)}
+        }}
+    }
+    ids = append([]uint32{}, ids...)
+    return &Traversal{g: g, build: func() vertexIterator {
+        return &storedVertices{g: g, ids: idList(ids)}
+    }}
+}
+
+// Returns a traversal that adds a step to this one.
+func (t *Traversal) then(step func(input vertexIterator) vertexIterator) *Traversal {
+    build := t.build
+    return &Traversal{g: t.g, err: t.err, build: func() vertexIterator {
+        return step(build())
+    }}
+}
+
+// Returns a traversal that keeps the vertices for which keep returns true.
+func (t *Traversal) filter(keep func(v *Vertex) (bool, *DataError)) *Traversal {
+    return t.then(func(input vertexIterator) vertexIterator {
+        return &filterIterator{input: input, keep: keep}
+    })
+}
+
+// Returns a traversal that fails with an error when it is run.
+func (t *Traversal) fail(err *DataError) *Traversal {
+    if t.err != nil {
+        return t
+    }
+    failed := *t
+    failed.err = err
+    return &failed
+}
+
+// HasClass keeps the vertices that belong to a class or one of its sub classes.
+// Starting from every vertex, only the vertices of the class are read, one at a time
+// from the class id indexes.
+func (t *Traversal) HasClass(name string) *Traversal {
+    class := t.g.C(name)
+    if class == nil {
+        return t.fail(dataError("There is no class named " + name + ".", nil, nil))
+    }
+    if t.scan {
+        g := t.g
+        return &Traversal{g: g, class: class, err: t.err, build: func() vertexIterator {
+            return &storedVertices{g: g, ids: classIds(class, g)}
+        }}
+    }
+    g := t.g
+    return t.filter(func(v *Vertex) (bool, *DataError) {
+        return class.hasId(v.Id, g)
+    })
+}
+
+// Has keeps the vertices with an attribute set to a value.
+// Starting from every vertex or from the vertices of a class, an index on the key that
+// covers them is used to find the vertices, if there is one when the traversal is run.
+func (t *Traversal) Has(key string, value Any) *Traversal {
+    indexKey, err := indexKeyOf(value)
+    if err != nil {
+        return t.fail(err)
+    }
+    filters := []attributeFilter{{key, value, indexKey}}
+    g := t.g
+    keep := func(v *Vertex) (bool, *DataError) {
+        return matchesAttributes(filters, &v.attributable, g)
+    }
+
+    class := t.class
+    if t.scan {
+        class = g.C("Vertex")
+    }
+    if class == nil {
+        return t.filter(keep)
+    }
+    build := t.build
+    return &Traversal{g: g, err: t.err, build: func() vertexIterator {
+        def, owner, err := class.findIndex(valueIndex, []string{key}, g)
+        if err != nil {
+            return &failedIterator{err}
+        } else if def == nil {
+            return &filterIterator{input: build(), keep: keep}
+        }
+        index, err := def.open(g)
+        if err != nil {
+            return &failedIterator{err}
+        }
+        ids := make([]uint32, 0)
+        for id := range index.find(indexKey) {
+            if holds, err := class.holds(owner, id, g); err != nil {
+                return &failedIterator{err}
+            } else if holds {
+                ids = append(ids, id)
+            }
+        }
+        sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+        return &storedVertices{g: g, ids: idList(ids)}
+    }}
+}
+
+// Out moves to the vertices that the edges with any of the labels, or any edges if no
+// labels are given, go to. A vertex is reached once for each edge that leads to it.
+func (t *Traversal) Out(labels ...string) *Traversal {
+    return t.adjacent(labels, true, false)
+}
+
+// In moves to the vertices that the edges with any of the labels, or any edges if no
+// labels are given, come from.
+func (t *Traversal) In(labels ...string) *Traversal {
+    return t.adjacent(labels, false, true)
+}
+
+// Both moves to the vertices at the other end of the edges with any of the labels, or of
+// any edges if no labels are given, in either direction.
+func (t *Traversal) Both(labels ...string) *Traversal {
+    return t.adjacent(labels, true, true)
+}
+
+// Returns a traversal that follows edges out of or into each vertex.
+func (t *Traversal) adjacent(labels []string, out bool, in bool) *Traversal {
+    g := t.g
+    labels = append([]string{}, labels...)
+    return t.then(func(input vertexIterator) vertexIterator {
+        return &adjacentIterator{g: g, input: input, labels: labels, out: out, in: in}
+    })
+}
+
+// Dedup leaves out the vertices that have already been reached.
+func (t *Traversal) Dedup() *Traversal {
+    return t.then(func(input vertexIterator) vertexIterator {
+        seen := make(map[uint32]bool)
+        return &filterIterator{input: input, keep: func(v *Vertex) (bool, *DataError) {
+            if seen[v.Id] {
+                return false, nil
+            }
+            seen[v.Id] = true
+            return true, nil
+        }}
+    })
+}
+
+// Limit stops the traversal after n vertices. The steps before it do no more work than
+// is needed to reach them.
+func (t *Traversal) Limit(n int) *Traversal {
+    return t.then(func(input vertexIterator) vertexIterator {
+        return &limitIterator{input: input, n: n}
+    })
+}
+
+// Iterator runs the traversal, returning an iterator over the vertices it reaches.
+func (t *Traversal) Iterator() *VertexIterator {
+    if t.err != nil {
+        return &VertexIterator{err: t.err}
+    }
+    return &VertexIterator{input: t.build()}
+}
+
+// ToList runs the traversal and returns the vertices it reaches.
+func (t *Traversal) ToList() ([]*Vertex, *DataError) {
+    vertices := make([]*Vertex, 0)
+    it := t.Iterator()
+    for it.Next() {
+        vertices = append(vertices, it.Vertex())
+    }
+    if err := it.Err(); err != nil {
+        return nil, err
+    }
+    return vertices, nil
+}
+
+// Count runs the traversal and returns the number of vertices it reaches.
+func (t *Traversal) Count() (int, *DataError) {
+    count := 0
+    it := t.Iterator()
+    for it.Next() {
+        count++
+    }
+    return count, it.Err()
+}
+
+// A vertexIterator produces the vertices of one step of a traversal.
+type vertexIterator interface {
+    // Returns the next vertex, or nil when there are no more.
+    next() (*Vertex, *DataError)
+}
+
+// Fails with an error found while starting a step.
+type failedIterator struct {
+    err *DataError
+}
+
+func (it *failedIterator) next() (*Vertex, *DataError) {
+    return nil, it.err
+}
+
+// Keeps the vertices of its input that pass a test.
+type filterIterator struct {
+    input vertexIterator
+    keep func(v *Vertex) (bool, *DataError)
+}
+
+func (it *filterIterator) next() (*Vertex, *DataError) {
+    for {
+        v, err := it.input.next()
+        if v == nil || err != nil {
+            return nil, err
+        }
+        ok, err := it.keep(v)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            return v, nil
+        }
+    }
+}
+
+// Visits the vertices at the other end of the edges of each vertex of its input, in
+// order of edge id.
+type adjacentIterator struct {
+    g *Graph
+    input vertexIterator
+    labels []string  // the labels of the edges to follow, or empty for any label
+    out, in bool     // the directions of the edges to follow
+    pending []uint32 // the ids of the vertices still to be visited for the current input
+}
+
+func (it *adjacentIterator) next() (*Vertex, *DataError) {
+    for {
+        for len(it.pending) > 0 {
+            id := it.pending[0]
+            it.pending = it.pending[1:]
+            v, err := it.g.vertexStore.Find(id)
+            if v != nil || err != nil {
+                return v, err
+            }
+        }
+        v, err := it.input.next()
+        if v == nil || err != nil {
+            return nil, err
+        }
+        if it.pending, err = it.neighbours(v); err != nil {
+            return nil, err
+        }
+    }
+}
+
+// Returns the ids of the vertices at the other end of the edges of a vertex.
+func (it *adjacentIterator) neighbours(v *Vertex) ([]uint32, *DataError) {
+    edges := make([]*Edge, 0)
+    add := func(m edgeMap) {
+        if len(it.labels) == 0 {
+            for _, list := range m {
+                for _, e := range list {
+                    edges = append(edges, e)
+                }
+            }
+            return
+        }
+        for _, label := range it.labels {
+            for _, e := range m.get(label) {
+                edges = append(edges, e)
+            }
+        }
+    }
+    if it.out {
+        m, err := v.Out(it.g)
+        if err != nil {
+            return nil, err
+        }
+        add(m)
+    }
+    if it.in {
+        m, err := v.In(it.g)
+        if err != nil {
+            return nil, err
+        }
+        add(m)
+    }
+    sort.SliceStable(edges, func(a, b int) bool { return edges[a].Id < edges[b].Id })
+
+    ids := make([]uint32, len(edges))
+    for n, e := range edges {
+        ids[n] = e.to
+        if e.to == v.Id && (!it.out || e.from != v.Id) {
+            ids[n] = e.from
+        }
+    }
+    return ids, nil
+}
+
+// Stops after a number of vertices of its input.
+type limitIterator struct {
+    input vertexIterator
+    n int // the number of vertices still to be returned
+}
+
+func (it *limitIterator) next() (*Vertex, *DataError) {
+    if it.n <= 0 {
+        return nil, nil
+    }
+    it.n--
+    return it.input.next()
+}
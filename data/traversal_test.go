@@ -0,0 +1,229 @@
+package data
+
+import(
+	"testing"
+	"fmt"
+)
+
+func TestTraversal (t *testing.T) {
+    _, g := newTestGraph(t, "traversal")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    employee := g.AddClass("Employee", person)
+    thing := g.AddClass("Thing", g.C("Vertex"))
+    ann, _ := g.AddVertexWith(person, map[string]Any{"name": "Ann"})
+    bob, _ := g.AddVertexWith(employee, map[string]Any{"name": "Bob"})
+    cat, _ := g.AddVertexWith(person, map[string]Any{"name": "Cat"})
+    car, _ := g.AddVertexWith(thing, map[string]Any{"name": "Car"})
+    boat, _ := g.AddVertexWith(thing, map[string]Any{"name": "Boat"})
+    g.AddEdge(ann, car, "owns")
+    g.AddEdge(ann, boat, "owns")
+    g.AddEdge(bob, car, "likes")
+    g.AddEdge(cat, car, "likes")
+    g.AddEdge(cat, boat, "likes")
+    g.AddEdge(bob, ann, "knows")
+    
+    names := func(vertices []*Vertex) string {
+        result := make([]Any, len(vertices))
+        for n, v := range vertices {
+            result[n], _ = v.Get("name", g)
+        }
+        return fmt.Sprint(result)
+    }
+    
+    tests := []struct {
+        name string
+        traversal *Traversal
+        expected string
+    }{
+        {"all", g.V(), `[Ann Bob Cat Car Boat]`},
+        {"ids", g.V(car.Id, 99, ann.Id), `[Car Ann]`},
+        {"class", g.V().HasClass("Person"), `[Ann Bob Cat]`},
+        {"filtered class", g.V(car.Id, bob.Id, ann.Id).HasClass("Person"), `[Bob Ann]`},
+        {"attribute", g.V().Has("name", "Cat"), `[Cat]`},
+        {"out", g.V().HasClass("Person").Has("name", "Ann").Out("owns"), `[Car Boat]`},
+        {"in", g.V().HasClass("Person").Has("name", "Ann").Out("owns").In("likes"), `[Bob Cat Cat]`},
+        {"dedup", g.V().HasClass("Person").Has("name", "Ann").Out("owns").In("likes").Dedup(), `[Bob Cat]`},
+        {"limit", g.V().HasClass("Person").Out().Limit(2), `[Car Boat]`},
+        {"labels", g.V(bob.Id).Out("knows", "likes"), `[Car Ann]`},
+        {"both", g.V(ann.Id).Both(), `[Car Boat Bob]`},
+        {"nothing", g.V().HasClass("Thing").Out(), `[]`},
+    }
+    for _, test := range tests {
+        vertices, err := test.traversal.ToList()
+        if err != nil {
+            t.Errorf("%s: %s", test.name, err)
+        } else if s := names(vertices); s != test.expected {
+            t.Errorf("%s: expected %s, got %s", test.name, test.expected, s)
+        }
+    }
+    
+    // a traversal reads only the vertices it needs, and can be extended and run again
+    owners := g.V().HasClass("Thing").In("owns")
+    before := g.reads()
+    if vertices, _ := owners.Limit(1).ToList(); names(vertices) != `[Ann]` {
+        t.Errorf("Expected the first owner to be Ann, got %s", names(vertices))
+    }
+    if reads := g.reads() - before; reads > 3 {
+        t.Errorf("Expected a limited traversal to read at most 3 records, read %d", reads)
+    }
+    if count, err := owners.Count(); err != nil || count != 2 {
+        t.Errorf("Expected 2 owners, got %d (%v)", count, err)
+    }
+    
+    // an index on the key is used to find the vertices of a class with a value,
+    // including an index created after the traversal
+    named := g.V().HasClass("Person").Has("name", "Cat")
+    if err := person.CreateIndex("name", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    before = g.reads()
+    if vertices, _ := named.ToList(); names(vertices) != `[Cat]` {
+        t.Errorf("Expected the indexed traversal to find Cat, got %s", names(vertices))
+    }
+    if reads := g.reads() - before; reads > 2 {
+        t.Errorf("Expected an indexed traversal to read at most 2 records, read %d", reads)
+    }
+    if vertices, _ := g.V().HasClass("Employee").Has("name", "Ann").ToList(); len(vertices) != 0 {
+        t.Errorf("Expected an index of a super class to leave out its other vertices, got %s", names(vertices))
+    }
+    
+    if _, err := g.V().HasClass("Nope").Out().ToList(); err == nil {
+        t.Error("Expected an error for an unknown class")
+    }
+    if _, err := g.V().Has("name", struct{}{}).Count(); err == nil {
+        t.Error("Expected an error for an unsupported value")
+    }
+    
+    it := g.V().HasClass("Employee").Iterator()
+    if !it.Next() || it.Vertex().Id != bob.Id || it.Next() || it.Err() != nil {
+        t.Error("Expected the iterator to return only Bob")
+    }
+}
+
+func TestIterators (t *testing.T) {
+    _, g := newTestGraph(t, "iterators")
+    
+    person := g.AddClass("Person", g.C("Vertex"))
+    employee := g.AddClass("Employee", person)
+    thing := g.AddClass("Thing", g.C("Vertex"))
+    ann, _ := g.AddVertex(employee)
+    bob, _ := g.AddVertex(person)
+    car, _ := g.AddVertex(thing)
+    cat, _ := g.AddVertex(employee)
+    dan, _ := g.AddVertex(person)
+    e1, _ := g.AddEdge(ann, car, "owns")
+    e2, _ := g.AddEdge(ann, bob, "knows")
+    e3, _ := g.AddEdge(cat, car, "likes")
+    e4, _ := g.AddEdge(dan, ann, "knows")
+    
+    vertexIds := func(it *VertexIterator) string {
+        ids := make([]uint32, 0)
+        for it.Next() {
+            ids = append(ids, it.Vertex().Id)
+        }
+        if err := it.Err(); err != nil {
+            t.Error(err)
+        }
+        return fmt.Sprint(ids)
+    }
+    edgeIds := func(it *EdgeIterator) string {
+        ids := make([]uint32, 0)
+        for it.Next() {
+            ids = append(ids, it.Edge().Id)
+        }
+        if err := it.Err(); err != nil {
+            t.Error(err)
+        }
+        return fmt.Sprint(ids)
+    }
+    check := func(name string, got string, expected ...uint32) {
+        if s := fmt.Sprint(expected); got != s {
+            t.Errorf("%s: expected %s, got %s", name, s, got)
+        }
+    }
+    
+    check("all vertices", vertexIds(g.Vertices()), ann.Id, bob.Id, car.Id, cat.Id, dan.Id)
+    check("class vertices", vertexIds(person.Vertices(g)), ann.Id, bob.Id, cat.Id, dan.Id)
+    check("sub class vertices", vertexIds(employee.Vertices(g)), ann.Id, cat.Id)
+    check("all edges", edgeIds(g.Edges()), e1.Id, e2.Id, e3.Id, e4.Id)
+    check("out edges", edgeIds(ann.OutEdges(g)), e2.Id, e1.Id)
+    check("in edges", edgeIds(ann.InEdges(g)), e4.Id)
+    check("no edges", edgeIds(bob.OutEdges(g)))
+    
+    // removed records are skipped, whether or not the removal has been written
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    g.RemoveVertex(bob)
+    g.RemoveEdge(e3)
+    check("vertices after removal", vertexIds(g.Vertices()), ann.Id, car.Id, cat.Id, dan.Id)
+    check("edges after removal", edgeIds(g.Edges()), e1.Id, e4.Id)
+    ann, _ = g.vertexStore.Find(ann.Id)
+    check("out edges after removal", edgeIds(ann.OutEdges(g)), e1.Id)
+    if err := g.Write(); err != nil {
+        t.Fatal(err.Trace())
+    }
+    check("written vertices after removal", vertexIds(g.Vertices()), ann.Id, car.Id, cat.Id, dan.Id)
+    check("written class after removal", vertexIds(person.Vertices(g)), ann.Id, cat.Id, dan.Id)
+    
+    // records removed while iterating are skipped too
+    it := g.Vertices()
+    it.Next()
+    g.RemoveVertex(car)
+    check("removed while iterating", vertexIds(it), cat.Id, dan.Id)
+    
+    // an iterator over the edges of a vertex stops with an error if edges are added or
+    // removed while it runs, since each edge leads to the next
+    chain := make([]*Edge, 4)
+    for n := range chain {
+        chain[n], _ = g.AddEdge(dan, cat, "knows")
+    }
+    dan, _ = g.vertexStore.Find(dan.Id)
+    check("chain", edgeIds(dan.OutEdges(g)), chain[3].Id, chain[2].Id, chain[1].Id, chain[0].Id, e4.Id)
+    modified := func(name string, it *EdgeIterator, change func()) {
+        it.Next()
+        change()
+        if it.Next() || it.Edge() != nil {
+            t.Errorf("%s: expected the iterator to stop", name)
+        }
+        if err := it.Err(); err == nil || err.Modification() == nil || err.Modification().Vertex != dan.Id {
+            t.Errorf("%s: expected a modification error for vertex %d, got %v", name, dan.Id, err)
+        }
+        if it.Next() {
+            t.Errorf("%s: expected the iterator to stay stopped", name)
+        }
+    }
+    modified("edge removed while iterating", dan.OutEdges(g), func() {
+        g.RemoveEdge(chain[2])
+    })
+    modified("edge added while iterating", dan.OutEdges(g), func() {
+        from, _ := g.vertexStore.Find(cat.Id)
+        g.AddEdge(from, ann, "likes")
+    })
+    
+    // as do the iterators taken before a failed query, which reads the graph again
+    if err := thing.CreateUniqueIndex("name", g); err != nil {
+        t.Fatal(err.Trace())
+    }
+    edges := dan.OutEdges(g)
+    edges.Next()
+    if _, err := g.Query(`create (a <Thing> {name: "boat"}); create (b <Thing> {name: "boat"})`, nil); err == nil {
+        t.Fatal("expected the query to fail")
+    }
+    if edges.Next() || edges.Err() == nil || edges.Err().Modification() == nil {
+        t.Errorf("expected an iterator taken before a failed query to stop, got %v", edges.Err())
+    }
+    
+    // iterators that are not changed while they run end without an error
+    dan, _ = g.vertexStore.Find(dan.Id)
+    check("chain after removal", edgeIds(dan.OutEdges(g)), chain[3].Id, chain[1].Id, chain[0].Id, e4.Id)
+    
+    // records are loaded one at a time
+    before := g.reads()
+    it = g.Vertices()
+    it.Next()
+    if reads := g.reads() - before; reads != 1 {
+        t.Errorf("Expected the first vertex to take 1 read, took %d", reads)
+    }
+}
@@ -19,6 +19,9 @@ func constructUint16IdStore(fileName string) (*uint16IdStore, *DataError) {
     } else {
         store.file = file
     }
+    if _, de := checkFileHeader(store.file, uint16IdFile); de != nil {
+        return nil, de
+    }
 
     store.lastId, _ = store.readLastId()
     store.ids = store.readIds()
@@ -33,20 +36,36 @@ func createUint16IdStore(fileName string) (*uint16IdStore, *DataError) {
     } else {
         store.file = file
     }
+    if de := writeFileHeader(store.file, uint16IdFile, 0); de != nil {
+        return nil, de
+    }
 
-    store.writeLastId()
+    if err := store.write(); err != nil {
+        return nil, err
+    }
     
     return store, nil
 }
 
-func (store *uint16IdStore) write() {
-    store.file.Truncate(int64(0))
-    store.writeLastId()
-    store.writeIds()
+// Writes the last id and the ids that are available again to the file.
+// Returns an error of type *DataError if they can not be written.
+func (store *uint16IdStore) write() *DataError {
+    bytes := make([]byte, 2 + 2 * len(store.ids))
+    util.PutUint16(bytes, store.lastId)
+    for idx, val := range store.ids {
+        util.PutUint16(bytes[2 + 2 * idx:], val)
+    }
+    if e := store.file.Truncate(int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for id store: " + store.file.Name() + ".", e, nil)
+    }
+    if _, e := store.file.WriteAt(bytes, int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for id store: " + store.file.Name() + ".", e, nil)
+    }
+    return nil
 }
 
 func (store *uint16IdStore) readLastId() (uint16, *DataError) {
-    readAt := int64(0)
+    readAt := int64(fileHeaderSize)
     b := make([]byte, 2)
     store.file.ReadAt(b, readAt)
     val, e := util.BytesToUint16(b)
@@ -56,14 +75,8 @@ func (store *uint16IdStore) readLastId() (uint16, *DataError) {
     return val, nil
 }
 
-func (store *uint16IdStore) writeLastId() {
-    writeAt := int64(0)
-    bytes, _ := util.Uint16ToBytes(store.lastId)
-    _, _ = store.file.WriteAt(bytes, writeAt) // Ignore the return?
-}
-
 func (store *uint16IdStore) readIds() []uint16 {
-    readAt := int64(2)
+    readAt := int64(fileHeaderSize + 2)
     b := make([]byte, 2)
     res := make([]uint16, 0)
     for _, e := store.file.ReadAt(b, readAt); e != io.EOF ; _, e = store.file.ReadAt(b, readAt){
@@ -74,16 +87,6 @@ func (store *uint16IdStore) readIds() []uint16 {
     return res
 }
 
-func (store *uint16IdStore) writeIds() {
-    var writeAt int64
-    var b []byte 
-    for idx, val := range store.ids {
-        writeAt = int64(2 + 2 * idx)
-        b, _ = util.Uint16ToBytes(val)
-        _, _ = store.file.WriteAt(b, writeAt)
-    }
-}
-
 func (store *uint16IdStore) nextId() uint16 {
     if len(store.ids) != 0 {
         id := store.ids[0]
@@ -19,6 +19,9 @@ func constructUint32IdStore(fileName string) (*uint32IdStore, *DataError) {
     } else {
         store.file = file
     }
+    if _, de := checkFileHeader(store.file, uint32IdFile); de != nil {
+        return nil, de
+    }
 
     store.lastId, _ = store.readLastId()
     store.ids = store.readIds()
@@ -33,20 +36,36 @@ func createUint32IdStore(fileName string) (*uint32IdStore, *DataError) {
     } else {
         store.file = file
     }
+    if de := writeFileHeader(store.file, uint32IdFile, 0); de != nil {
+        return nil, de
+    }
 
-    store.writeLastId()
+    if err := store.write(); err != nil {
+        return nil, err
+    }
     
     return store, nil
 }
 
-func (store *uint32IdStore) write() {
-    store.file.Truncate(int64(0))
-    store.writeLastId()
-    store.writeIds()
+// Writes the last id and the ids that are available again to the file.
+// Returns an error of type *DataError if they can not be written.
+func (store *uint32IdStore) write() *DataError {
+    bytes := make([]byte, 4 + 4 * len(store.ids))
+    util.PutUint32(bytes, store.lastId)
+    for idx, val := range store.ids {
+        util.PutUint32(bytes[4 + 4 * idx:], val)
+    }
+    if e := store.file.Truncate(int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for id store: " + store.file.Name() + ".", e, nil)
+    }
+    if _, e := store.file.WriteAt(bytes, int64(fileHeaderSize)); e != nil {
+        return dataError("Could not write file for id store: " + store.file.Name() + ".", e, nil)
+    }
+    return nil
 }
 
 func (store *uint32IdStore) readLastId() (uint32, *DataError) {
-    readAt := int64(0)
+    readAt := int64(fileHeaderSize)
     b := make([]byte, 4)
     store.file.ReadAt(b, readAt)
     val, e := util.BytesToUint32(b)
@@ -56,14 +75,8 @@ func (store *uint32IdStore) readLastId() (uint32, *DataError) {
     return val, nil
 }
 
-func (store *uint32IdStore) writeLastId() {
-    writeAt := int64(0)
-    bytes, _ := util.Uint32ToBytes(store.lastId)
-    _, _ = store.file.WriteAt(bytes, writeAt) // Ignore the return?
-}
-
 func (store *uint32IdStore) readIds() []uint32 {
-    readAt := int64(4)
+    readAt := int64(fileHeaderSize + 4)
     b := make([]byte, 4)
     res := make([]uint32, 0)
     for _, e := store.file.ReadAt(b, readAt); e != io.EOF ; _, e = store.file.ReadAt(b, readAt){
@@ -74,16 +87,6 @@ func (store *uint32IdStore) readIds() []uint32 {
     return res
 }
 
-func (store *uint32IdStore) writeIds() {
-    var writeAt int64
-    var b []byte 
-    for idx, val := range store.ids {
-        writeAt = int64(4 + 4 * idx)
-        b, _ = util.Uint32ToBytes(val)
-        _, _ = store.file.WriteAt(b, writeAt)
-    }
-}
-
 func (store *uint32IdStore) nextId() uint32 {
     if len(store.ids) != 0 {
         id := store.ids[0]
@@ -19,28 +19,42 @@ type Vertex struct {
 	in uint32 // Id of the first inbound edge of the vertex
 	outMap edgeMap // map stores outbound edges by label
 	inMap edgeMap // map stores inbound edges by label
+	deleting bool // whether the vertex is being removed from the graph
 	attributable
 }
 
+// Creates an existing vertex from byte data.
+// The vertex does not keep a reference to the slice, so the caller may reuse it.
 func constructVertex (id uint32, bytes []byte) *Vertex {
 	vertex := new(Vertex)
-	class := bytes[0]
-	out := bytes[1:5]
-	in := bytes[5:9]
-	attributes := bytes[9:13]
+	vertex.Id = id
+	vertex.owner = vertex
+	vertex.decode(bytes)
+	return vertex
+}
 
-	vertex.Id = id;
-	vertex.class = class;
-	vertex.out, _ = util.BytesToUint32(out)
-	vertex.in, _ = util.BytesToUint32(in)
-	vertex.firstAtt, _ = util.BytesToUint32(attributes)
+// Reads the stored fields of the vertex from b.
+func (v *Vertex) decode(b []byte) {
+	_ = b[vertexDataSize - 1] // bounds check once for the whole record
+	v.class = b[0]
+	v.out = util.Uint32(b[1:5])
+	v.in = util.Uint32(b[5:9])
+	v.firstAtt = util.Uint32(b[9:13])
+}
 
-	return vertex;
+// Encodes the vertex for storage into b, which must be at least vertexDataSize bytes long.
+func (v *Vertex) encode(b []byte) {
+	_ = b[vertexDataSize - 1]
+	b[0] = v.class
+	util.PutUint32(b[1:5], v.out)
+	util.PutUint32(b[5:9], v.in)
+	util.PutUint32(b[9:13], v.firstAtt)
 }
 
 func newVertex(class *Class) *Vertex {
     vertex := new(Vertex)
     vertex.class = class.Id
+    vertex.owner = vertex
     
     return vertex
 }
@@ -59,53 +73,68 @@ func (v *Vertex) ClassName(g *Graph) string {
     return name
 }
 
-func (v *Vertex) FirstOut(g *Graph) *Edge {
+func (v *Vertex) FirstOut(g *Graph) (*Edge, *DataError) {
 	Assert(nilVertex, v != nil)
     Assert(nilGraph, g != nil)
 	Assert(nilEdgeStore, g.edgeStore != nil)
 	
+	if v.out == uint32(0) {
+	    return nil, nil
+	}
 	return g.edgeStore.Find(v.out)
 }
 
-func (v *Vertex) Out(g *Graph) edgeMap {
+func (v *Vertex) Out(g *Graph) (edgeMap, *DataError) {
     if v.outMap == nil {
-        e := v.FirstOut(g)
+        e, err := v.FirstOut(g)
         m := make(edgeMap)
         for e != nil {
             m.add(e, g)
-            e = e.OutNext(g)
+            e, err = e.OutNext(g)
+        }
+        if err != nil {
+            return nil, err
         }
         v.outMap = m
     }
     
-    return v.outMap
+    return v.outMap, nil
 
 }
 
-func (v *Vertex) FirstIn(g *Graph) *Edge {
+func (v *Vertex) FirstIn(g *Graph) (*Edge, *DataError) {
 	Assert(nilVertex, v != nil)
     Assert(nilGraph, g != nil)
 	Assert(nilEdgeStore, g.edgeStore != nil)
 	
+	if v.in == uint32(0) {
+	    return nil, nil
+	}
 	return g.edgeStore.Find(v.in)
 }
 
-func (v *Vertex) In(g *Graph) edgeMap {
+func (v *Vertex) In(g *Graph) (edgeMap, *DataError) {
     if v.inMap == nil {
-        e := v.FirstIn(g)
+        e, err := v.FirstIn(g)
         m := make(edgeMap)
         for e != nil {
             m.add(e, g)
-            e = e.InNext(g)
+            e, err = e.InNext(g)
+        }
+        if err != nil {
+            return nil, err
         }
         v.inMap = m
     }
     
-    return v.inMap
+    return v.inMap, nil
 }
 
-func (v *Vertex) RemoveOutboundEdge(e *Edge, g *Graph) {
-    m := v.Out(g)
+func (v *Vertex) RemoveOutboundEdge(e *Edge, g *Graph) *DataError {
+    m, err := v.Out(g)
+    if err != nil {
+        return err
+    }
         if v.out == e.Id {
             v.out = e.outNext
             g.vertexStore.Track(v)
@@ -121,11 +150,17 @@ func (v *Vertex) RemoveOutboundEdge(e *Edge, g *Graph) {
                 }
             }
         }
+        degree := m.size()
         m.remove(e, g)
+        g.statsStore.outDegreeChanged(degree, m.size())
+        return nil
 }
 
-func (v *Vertex) RemoveInboundEdge(e *Edge, g *Graph) {
-    m := v.In(g)
+func (v *Vertex) RemoveInboundEdge(e *Edge, g *Graph) *DataError {
+    m, err := v.In(g)
+    if err != nil {
+        return err
+    }
         if v.in == e.Id {
             v.in = e.inNext
             g.vertexStore.Track(v)
@@ -135,25 +170,85 @@ func (v *Vertex) RemoveInboundEdge(e *Edge, g *Graph) {
                 for _, edge := range list {
                     if edge.inNext == e.Id {
                         edge.inNext = e.inNext
+                        g.edgeStore.Track(edge)
                         break InMapLoop
                     }
                 }
             }
         }
+        degree := m.size()
         m.remove(e, g)
+        g.statsStore.inDegreeChanged(degree, m.size())
+        return nil
 }
 
-func (v *Vertex) RemoveEdge(e *Edge, g *Graph) {
+func (v *Vertex) RemoveEdge(e *Edge, g *Graph) *DataError {
     if (e.from == v.Id) {
-        v.RemoveOutboundEdge(e, g)
+        if err := v.RemoveOutboundEdge(e, g); err != nil {
+            return err
+        }
     }
     if (e.to == v.Id) {
-        v.RemoveInboundEdge(e, g)
+        if err := v.RemoveInboundEdge(e, g); err != nil {
+            return err
+        }
     }
+    return nil
 }
 
 func (v *Vertex) track(g *Graph) {
     g.vertexStore.Track(v)
 }
 
+// Checks the change against the schema of the vertex's class and keeps the attribute
+// indexes of the class and its super classes up to date.
+// Returns an error caused by a *SchemaError if the change breaks the schema, or by a
+// *ConstraintError if a unique index already has the new value for another vertex,
+// in which case no index is changed.
+func (v *Vertex) attributeChanging(key string, old *Attribute, new *Attribute, g *Graph) *DataError {
+    if !v.deleting {
+        t := byte(0)
+        if new != nil {
+            t = new.t
+        }
+        if err := v.Class(g).checkAttribute(key, t, g); err != nil {
+            return err
+        }
+    }
+    
+    defs, err := g.indexStore.forVertex(v, key, g)
+    if err != nil {
+        return err
+    }
+    
+    // check every unique constraint before changing anything
+    if new != nil {
+        for _, def := range defs {
+            if !def.isUnique() {
+                continue
+            }
+            index, err := def.open(g)
+            if err != nil {
+                return err
+            }
+            value, err := new.indexKey(g)
+            if err != nil {
+                return err
+            }
+            for id := range index.find(value) {
+                if id != v.Id {
+                    return constraintError(g.classStore.Find(def.class), key, new, id, g)
+                }
+            }
+        }
+    }
+    
+    for _, def := range defs {
+        if err := def.change(v, key, old, new, g); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 
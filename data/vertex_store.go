@@ -2,6 +2,7 @@ package data
 
 import (
     "os" // file operations
+    "weak"
     
     "github.com/wardlem/graphlite/util" // for file permissions
 )
@@ -17,8 +18,12 @@ const (
 // vertices for the graph.
 type vertexStore struct {
     file *os.File
+    records *recordFile
     idStore *uint32IdStore
     tracking map[uint32]*Vertex
+    loaded map[uint32]weak.Pointer[Vertex] // the vertices handed out, so each id has one copy
+    swept int // the size of loaded when it was last swept
+    finds uint64 // the number of calls to Find, which query profiles count as reads
 }
 
 func constructVertexStore(g *Graph) (*vertexStore, *DataError){
@@ -32,8 +37,13 @@ func constructVertexStore(g *Graph) (*vertexStore, *DataError){
     } else {
         s.file = file;
     }
+    if h, de := checkFileHeader(s.file, vertexFile); de != nil {
+        return nil, de
+    } else {
+        s.records = newRecordFile(s.file, "vertex", fileHeaderSize, vertexDataSize, h.flags)
+    }
 
-    fileName = g.storePath("attribute.id")
+    fileName = g.storePath("vertex.id")
     
     idStore, de := constructUint32IdStore(fileName)
     if (de != nil){
@@ -42,6 +52,7 @@ func constructVertexStore(g *Graph) (*vertexStore, *DataError){
     s.idStore = idStore
     
     s.tracking = make(map[uint32]*Vertex, 0)
+    s.loaded = make(map[uint32]weak.Pointer[Vertex])
     
     return s, nil;
 }
@@ -56,6 +67,11 @@ func createVertexStore(g *Graph) (*vertexStore, *DataError){
     } else {
         s.file = file;
     }
+    flags := g.recordFlags()
+    if de := writeFileHeader(s.file, vertexFile, flags); de != nil {
+        return nil, de
+    }
+    s.records = newRecordFile(s.file, "vertex", fileHeaderSize, vertexDataSize, flags)
 
     
     fileName = g.storePath("vertex.id")
@@ -66,6 +82,7 @@ func createVertexStore(g *Graph) (*vertexStore, *DataError){
     }
     
     s.tracking = make(map[uint32]*Vertex, 0)
+    s.loaded = make(map[uint32]weak.Pointer[Vertex])
     
     return s, nil;
 }
@@ -77,41 +94,127 @@ func (s *vertexStore) Track (v *Vertex) {
     Assert(nilVertexTrackingMap, s.tracking != nil)
     
     s.tracking[v.Id] = v
+    s.remember(v)
+}
+
+// Keeps a vertex as the copy of it that Find returns, for as long as anything holds it,
+// so a change made through one reference to a vertex is seen through every other.
+// The copies nothing holds any more are swept out whenever the map doubles in size.
+func (s *vertexStore) remember(v *Vertex) {
+    s.loaded[v.Id] = weak.Make(v)
+    if len(s.loaded) > 2 * s.swept + 64 {
+        for id, p := range s.loaded {
+            if p.Value() == nil {
+                delete(s.loaded, id)
+            }
+        }
+        s.swept = len(s.loaded)
+    }
 }
 
-func (s *vertexStore) Find (id uint32) *Vertex {
+// Finds a vertex by id and returns it.
+// A vertex that is still held somewhere is returned as it is held, and others are read
+// from the file.
+// Returns nil if there is no such vertex, or an error of type *DataError if the
+// vertex could not be read or is corrupted.
+func (s *vertexStore) Find (id uint32) (*Vertex, *DataError) {
     Assert(nilVertexStore, s != nil)
     Assert(zeroVertexId, id != uint32(0))
     Assert(nilVertexTrackingMap, s.tracking != nil)
 
+    s.finds++
     if v, ok := s.tracking[id]; ok {
-        return v
+        if v.class == uint8(0) {
+            return nil, nil // removed since the store was last written
+        }
+        return v, nil
+    }
+    if v := s.loaded[id].Value(); v != nil {
+        if v.class == uint8(0) {
+            return nil, nil
+        }
+        return v, nil
     }
     
     // read the vertex from the file and return it
-    readAt := int64((id - 1) * vertexDataSize)
-    bytes := make([]byte, vertexDataSize)
-    _, e := s.file.ReadAt(bytes, readAt)
-    if (e != nil) {
-        return nil
+    bytes, err := s.records.read(uint64(id))
+    if err != nil || bytes == nil {
+        return nil, err
     }
     
-    return constructVertex(id, bytes)
+    v := constructVertex(id, bytes)
+    if v.class == uint8(0) {
+        return nil, nil // the vertex has been removed
+    }
+    s.remember(v)
+    return v, nil
     
 }
 
+// Puts a vertex back to the state it has in the file, dropping what it has cached, and
+// keeps it as the copy Find returns. A vertex that is not in the file is left removed.
+// Returns an error of type *DataError if the vertex could not be read or is corrupted.
+func (s *vertexStore) reload(v *Vertex) *DataError {
+    Assert(nilVertexStore, s != nil)
+    Assert(nilVertex, v != nil)
+
+    bytes, err := s.records.read(uint64(v.Id))
+    if err != nil {
+        return err
+    }
+    if bytes == nil {
+        v.class = uint8(0)
+    } else {
+        v.decode(bytes)
+    }
+    v.outMap, v.inMap, v.aMap = nil, nil, nil
+    v.deleting = false
+    s.remember(v)
+    return nil
+}
+
+// Returns the id to use for a new vertex.
+func (s *vertexStore) nextId() uint32 {
+    Assert(nilVertexStore, s != nil)
+    return s.idStore.nextId()
+}
+
+// Removes a vertex from the store.
+// The vertex's edges and attributes must already have been removed.
 func (s *vertexStore) Remove(v *Vertex, g *Graph) {
+    Assert(nilVertexStore, s != nil)
+    Assert(nilVertex, v != nil)
+    Assert(zeroVertexId, v.Id != uint32(0))
+    Assert(nilVertexTrackingMap, s.tracking != nil)
     
     s.idStore.addId(v.Id)
-    g.labelStore.removeLabel(v.Key())
+    v.class = uint8(0)
     
+    s.tracking[v.Id] = v
 }
 
-func (s *vertexStore) write() {
+// Writes tracked vertices to the file.
+func (s *vertexStore) write() *DataError {
+    Assert(nilVertexStore, s != nil)
+    Assert(nilVertexTrackingMap, s.tracking != nil)
+    
+    for id, v := range s.tracking {
+        if err := s.records.write(uint64(id), v); err != nil {
+            return err
+        }
+    }
     
+    if err := s.idStore.write(); err != nil {
+        return err
+    }
+    s.tracking = make(map[uint32]*Vertex, 0)
+    return nil
 }
 
 func (store *vertexStore) shutdown () {
+    if (store == nil){
+        return
+    }
     if (store.idStore != nil){
         store.idStore.shutdown()
     }
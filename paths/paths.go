@@ -0,0 +1,337 @@
+// Package paths finds the shortest paths between vertices of a graph.
+//
+// The vertices and edges of a graph are read as the search reaches them, so only what the
+// search has visited is held in memory, and only as ids and distances:
+//
+//     path, err := paths.Shortest(g, ann, bob, paths.Options{
+//         Algorithm: paths.Dijkstra,
+//         Labels: []string{"road"},
+//         Weight: "miles",
+//     })
+package paths
+
+import (
+    "container/heap"
+    "sort"
+
+    "github.com/wardlem/graphlite/data"
+)
+
+// An Algorithm is a way of searching for a shortest path.
+type Algorithm int
+
+const (
+    BFS Algorithm = iota // a breadth first search for the path with the fewest edges
+    Dijkstra             // Dijkstra's algorithm, for the path with the least weight
+    AStar                // A*, for the path with the least weight, guided by a heuristic
+)
+
+// A Direction says which way edges are followed.
+type Direction int
+
+const (
+    Out Direction = iota // from the vertex an edge goes from to the vertex it goes to
+    In                   // from the vertex an edge goes to to the vertex it comes from
+    Both                 // either way
+)
+
+// Options says how a shortest path is searched for. The zero value searches for the path
+// with the fewest outgoing edges of any label.
+type Options struct {
+    Algorithm Algorithm
+    Direction Direction
+    Labels []string // the labels of the edges to follow, or empty for any label
+
+    // The key of the edge attribute holding the weight of each edge, for Dijkstra and A*.
+    // Weights must be numbers and must not be negative. Edges without the attribute, or
+    // every edge if the key is "", have a weight of 1.
+    Weight string
+
+    // For A*, returns an estimate of the weight of the path from a vertex to the target.
+    // The path found is only the shortest if the estimate is never more than the weight
+    // of the shortest path. Estimates that are not consistent along an edge still find
+    // the shortest path, but vertices may be searched again when a lighter path to them
+    // turns up.
+    Heuristic func(v *data.Vertex) float64
+}
+
+// A Path is a sequence of vertices and the edges between them.
+// A path from a vertex to itself has the vertex and no edges.
+type Path struct {
+    Vertices []*data.Vertex
+    Edges []*data.Edge
+    Weight float64 // the total weight of the edges, or their number for a breadth first search
+}
+
+// Shortest finds the shortest path from one vertex to another, returning nil if there is
+// no path between them.
+func Shortest(g *data.Graph, from *data.Vertex, to *data.Vertex, opts Options) (*Path, *data.DataError) {
+    data.Assert("attempt to find a path in a nil graph", g != nil)
+    data.Assert("attempt to find a path between nil vertices", from != nil, to != nil)
+
+    if opts.Algorithm == AStar && opts.Heuristic == nil {
+        return nil, pathError("A* needs a heuristic.")
+    }
+    s := &search{g: g, opts: opts, target: to.Id, visited: make(map[uint32]*step)}
+    if len(opts.Labels) > 0 {
+        s.labels = make(map[string]bool, len(opts.Labels))
+        for _, l := range opts.Labels {
+            s.labels[l] = true
+        }
+    }
+
+    var found bool
+    var err *data.DataError
+    if opts.Algorithm == BFS {
+        found, err = s.breadthFirst(from)
+    } else {
+        found, err = s.leastWeight(from)
+    }
+    if err != nil || !found {
+        return nil, err
+    }
+    return s.path(from)
+}
+
+// Returns an error for a search that can not be made.
+func pathError(message string) *data.DataError {
+    return &data.DataError{Message: message}
+}
+
+// How the search reached a vertex.
+type step struct {
+    previous uint32  // the id of the vertex the search came from, or 0 for the start
+    edge uint32      // the id of the edge the search followed
+    weight float64   // the weight of the path to the vertex found so far
+    estimate float64 // the heuristic's estimate of the rest of the path, for A*
+    done bool        // whether the search has followed the edges of the vertex
+}
+
+// The state of a search for a path.
+type search struct {
+    g *data.Graph
+    opts Options
+    labels map[string]bool    // the labels of the edges to follow, or nil for any
+    target uint32
+    visited map[uint32]*step  // how the search reached each vertex it has reached
+}
+
+// Searches breadth first, so the target is reached by the fewest edges.
+func (s *search) breadthFirst(from *data.Vertex) (bool, *data.DataError) {
+    s.visited[from.Id] = &step{}
+    queue := []uint32{from.Id}
+    for len(queue) > 0 {
+        id := queue[0]
+        queue = queue[1:]
+        if id == s.target {
+            return true, nil
+        }
+        at := s.visited[id]
+        edges, err := s.edges(id, from)
+        if err != nil {
+            return false, err
+        }
+        for _, e := range edges {
+            next := s.other(e, id)
+            if s.visited[next] == nil {
+                s.visited[next] = &step{previous: id, edge: e.Id, weight: at.weight + 1}
+                queue = append(queue, next)
+            }
+        }
+    }
+    return false, nil
+}
+
+// Searches by Dijkstra's algorithm, or by A* if there is a heuristic, so the target is
+// reached by the least weight.
+func (s *search) leastWeight(from *data.Vertex) (bool, *data.DataError) {
+    estimate := func(id uint32) (float64, *data.DataError) {
+        if s.opts.Algorithm != AStar {
+            return 0, nil
+        }
+        v, err := s.g.FindVertex(id)
+        if v == nil || err != nil {
+            return 0, err
+        }
+        return s.opts.Heuristic(v), nil
+    }
+
+    s.visited[from.Id] = &step{}
+    queue := &frontier{}
+    heap.Push(queue, entry{id: from.Id})
+    for queue.Len() > 0 {
+        next := heap.Pop(queue).(entry)
+        at := s.visited[next.id]
+        if at.done || next.weight > at.weight {
+            continue // the vertex has since been reached by a lighter path
+        }
+        at.done = true
+        if next.id == s.target {
+            return true, nil
+        }
+        edges, err := s.edges(next.id, from)
+        if err != nil {
+            return false, err
+        }
+        for _, e := range edges {
+            w, err := s.weight(e)
+            if err != nil {
+                return false, err
+            }
+            id := s.other(e, next.id)
+            // a vertex already searched is searched again if it is reached by a lighter
+            // path, which A* can find after it when the heuristic is not consistent
+            reached := s.visited[id]
+            if reached != nil && reached.weight <= at.weight + w {
+                continue
+            }
+            h := 0.0
+            if reached != nil {
+                h = reached.estimate
+            } else if h, err = estimate(id); err != nil {
+                return false, err
+            }
+            s.visited[id] = &step{previous: next.id, edge: e.Id, weight: at.weight + w, estimate: h}
+            heap.Push(queue, entry{id: id, weight: at.weight + w, priority: at.weight + w + h, order: queue.pushed})
+        }
+    }
+    return false, nil
+}
+
+// Returns the edges to follow from a vertex, in order of id.
+func (s *search) edges(id uint32, from *data.Vertex) ([]*data.Edge, *data.DataError) {
+    v := from
+    if id != from.Id {
+        var err *data.DataError
+        if v, err = s.g.FindVertex(id); v == nil || err != nil {
+            return nil, err
+        }
+    }
+    edges := make([]*data.Edge, 0)
+    for _, d := range []Direction{Out, In} {
+        if s.opts.Direction != d && s.opts.Direction != Both {
+            continue
+        }
+        directed := v.Out
+        if d == In {
+            directed = v.In
+        }
+        m, err := directed(s.g)
+        if err != nil {
+            return nil, err
+        }
+        for label, list := range m {
+            if s.labels != nil && !s.labels[label] {
+                continue
+            }
+            for _, e := range list {
+                edges = append(edges, e)
+            }
+        }
+    }
+    sort.SliceStable(edges, func(a, b int) bool { return edges[a].Id < edges[b].Id })
+    return edges, nil
+}
+
+// Returns the id of the vertex at the other end of an edge from a vertex.
+func (s *search) other(e *data.Edge, id uint32) uint32 {
+    if e.FromId() == id && (s.opts.Direction != In || e.ToId() == id) {
+        return e.ToId()
+    }
+    return e.FromId()
+}
+
+// Returns the weight of an edge.
+func (s *search) weight(e *data.Edge) (float64, *data.DataError) {
+    if s.opts.Weight == "" {
+        return 1, nil
+    }
+    value, err := e.Get(s.opts.Weight, s.g)
+    if err != nil {
+        return 0, err
+    }
+    var w float64
+    switch value := value.(type) {
+    case nil:
+        return 1, nil
+    case int64:
+        w = float64(value)
+    case float64:
+        w = value
+    default:
+        return 0, pathError("The weight of an edge must be a number: " + s.opts.Weight + ".")
+    }
+    if w < 0 {
+        return 0, pathError("The weight of an edge must not be negative: " + s.opts.Weight + ".")
+    }
+    return w, nil
+}
+
+// Returns the path the search took to the target.
+func (s *search) path(from *data.Vertex) (*Path, *data.DataError) {
+    ids := []uint32{s.target}
+    for at := s.visited[s.target]; at.previous != 0; at = s.visited[at.previous] {
+        ids = append(ids, at.previous)
+    }
+    p := &Path{
+        Vertices: make([]*data.Vertex, len(ids)),
+        Edges: make([]*data.Edge, len(ids) - 1),
+        Weight: s.visited[s.target].weight,
+    }
+    for n := range ids {
+        id := ids[len(ids) - 1 - n]
+        v, err := s.g.FindVertex(id)
+        if err != nil {
+            return nil, err
+        }
+        p.Vertices[n] = v
+        if n == 0 {
+            continue
+        }
+        if p.Edges[n - 1], err = s.g.FindEdge(s.visited[id].edge); err != nil {
+            return nil, err
+        }
+    }
+    p.Vertices[0] = from
+    return p, nil
+}
+
+// A vertex waiting to be visited by a search for the least weight.
+type entry struct {
+    id uint32
+    weight float64   // the weight of the path to the vertex
+    priority float64 // the weight plus the estimate of the rest of the path
+    order int        // when the entry was added, so that ties are visited in order
+}
+
+// The vertices waiting to be visited, with the lowest priority first.
+type frontier struct {
+    entries []entry
+    pushed int // the number of entries added
+}
+
+func (f *frontier) Len() int {
+    return len(f.entries)
+}
+
+func (f *frontier) Less(a, b int) bool {
+    if f.entries[a].priority != f.entries[b].priority {
+        return f.entries[a].priority < f.entries[b].priority
+    }
+    return f.entries[a].order < f.entries[b].order
+}
+
+func (f *frontier) Swap(a, b int) {
+    f.entries[a], f.entries[b] = f.entries[b], f.entries[a]
+}
+
+func (f *frontier) Push(x interface{}) {
+    f.entries = append(f.entries, x.(entry))
+    f.pushed++
+}
+
+func (f *frontier) Pop() interface{} {
+    last := f.entries[len(f.entries) - 1]
+    f.entries = f.entries[:len(f.entries) - 1]
+    return last
+}
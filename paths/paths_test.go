@@ -0,0 +1,153 @@
+package paths
+
+import (
+    "fmt"
+    "math"
+    "testing"
+
+    "github.com/wardlem/graphlite/data"
+)
+
+// Creates a database with a graph for a test.
+// The database is destroyed when the test ends.
+func newTestGraph(t *testing.T) *data.Graph {
+    db, err := data.CreateDB(t.TempDir() + "/db")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    t.Cleanup(func() {
+        db.Destroy()
+    })
+    g, err := db.CreateGraph("paths")
+    if err != nil {
+        t.Fatal(err.Trace())
+    }
+    return g
+}
+
+func TestShortest (t *testing.T) {
+    g := newTestGraph(t)
+
+    city := g.AddClass("City", g.C("Vertex"))
+    vertices := make(map[string]*data.Vertex)
+    for n, name := range []string{"A", "C", "B", "D", "E", "F"} {
+        vertices[name], _ = g.AddVertexWith(city, map[string]data.Any{"name": name, "x": n})
+    }
+    road := func(from string, to string, miles data.Any) {
+        e, _ := g.AddEdge(vertices[from], vertices[to], "road")
+        if miles != nil {
+            e.Set("miles", miles, g)
+        }
+    }
+    road("A", "B", 4)
+    road("A", "C", 1)
+    road("C", "B", 1.0)
+    road("B", "D", 1)
+    road("C", "D", 5)
+    g.AddEdge(vertices["D"], vertices["E"], "flight")
+
+    // the heuristic is the distance along x, which no road is shorter than
+    target := vertices["D"]
+    heuristic := func(v *data.Vertex) float64 {
+        x, _ := v.Get("x", g)
+        tx, _ := target.Get("x", g)
+        return math.Abs(float64(x.(int64) - tx.(int64)))
+    }
+
+    tests := []struct {
+        from, to string
+        opts Options
+        expected string
+    }{
+        {"A", "D", Options{}, `[A B D] 2`},
+        {"A", "D", Options{Algorithm: Dijkstra, Weight: "miles"}, `[A C B D] 3`},
+        {"A", "D", Options{Algorithm: AStar, Weight: "miles", Heuristic: heuristic}, `[A C B D] 3`},
+        {"A", "D", Options{Algorithm: Dijkstra}, `[A B D] 2`},
+        {"A", "E", Options{Algorithm: Dijkstra, Weight: "miles"}, `[A C B D E] 4`},
+        {"A", "E", Options{Labels: []string{"road"}}, `none`},
+        {"A", "E", Options{Labels: []string{"road", "flight"}}, `[A B D E] 3`},
+        {"A", "F", Options{}, `none`},
+        {"A", "A", Options{}, `[A] 0`},
+        {"D", "A", Options{}, `none`},
+        {"D", "A", Options{Direction: In}, `[D B A] 2`},
+        {"E", "C", Options{Direction: Both}, `[E D C] 2`},
+        {"E", "C", Options{Algorithm: Dijkstra, Direction: Both, Weight: "miles"}, `[E D B C] 3`},
+    }
+    for _, test := range tests {
+        p, err := Shortest(g, vertices[test.from], vertices[test.to], test.opts)
+        if err != nil {
+            t.Errorf("%s to %s: %s", test.from, test.to, err)
+            continue
+        }
+        got := "none"
+        if p != nil {
+            names := make([]data.Any, len(p.Vertices))
+            for n, v := range p.Vertices {
+                names[n], _ = v.Get("name", g)
+                if n > 0 && !joins(p.Edges[n - 1], p.Vertices[n - 1], v) {
+                    t.Errorf("%s to %s: edge %d does not join its vertices", test.from, test.to, n - 1)
+                }
+            }
+            got = fmt.Sprint(names, " ", p.Weight)
+        }
+        if got != test.expected {
+            t.Errorf("%s to %s: expected %s, got %s", test.from, test.to, test.expected, got)
+        }
+    }
+
+    if _, err := Shortest(g, vertices["A"], vertices["D"], Options{Algorithm: AStar}); err == nil {
+        t.Error("Expected an error for A* without a heuristic")
+    }
+    road("E", "F", -1)
+    if _, err := Shortest(g, vertices["A"], vertices["F"], Options{Algorithm: Dijkstra, Weight: "miles"}); err == nil {
+        t.Error("Expected an error for a negative weight")
+    }
+    road("F", "A", "far")
+    if _, err := Shortest(g, vertices["F"], vertices["C"], Options{Algorithm: Dijkstra, Weight: "miles"}); err == nil {
+        t.Error("Expected an error for a weight that is not a number")
+    }
+}
+
+// Returns true if an edge goes between two vertices, in either direction.
+func joins(e *data.Edge, a *data.Vertex, b *data.Vertex) bool {
+    return e.FromId() == a.Id && e.ToId() == b.Id || e.FromId() == b.Id && e.ToId() == a.Id
+}
+
+// An estimate that is never too high but is not consistent reaches X by the heavier
+// path first, and A* must search X again once the lighter path through A turns up.
+func TestShortestInconsistentHeuristic (t *testing.T) {
+    g := newTestGraph(t)
+
+    vertices := make(map[string]*data.Vertex)
+    estimates := map[string]float64{"S": 0, "A": 4, "X": 0, "G": 0}
+    for _, name := range []string{"S", "A", "X", "G"} {
+        vertices[name], _ = g.AddVertexWith(g.C("Vertex"), map[string]data.Any{"name": name})
+    }
+    road := func(from string, to string, miles int) {
+        e, _ := g.AddEdge(vertices[from], vertices[to], "road")
+        e.Set("miles", miles, g)
+    }
+    road("S", "A", 1)
+    road("A", "X", 1)
+    road("S", "X", 3)
+    road("X", "G", 3)
+
+    heuristic := func(v *data.Vertex) float64 {
+        name, _ := v.Get("name", g)
+        return estimates[name.(string)]
+    }
+    p, err := Shortest(g, vertices["S"], vertices["G"], Options{Algorithm: AStar, Weight: "miles", Heuristic: heuristic})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p == nil {
+        t.Fatal("Expected a path from S to G")
+    }
+    names := make([]data.Any, len(p.Vertices))
+    for n, v := range p.Vertices {
+        names[n], _ = v.Get("name", g)
+    }
+    if got := fmt.Sprint(names, " ", p.Weight); got != `[S A X G] 5` {
+        t.Errorf("Expected [S A X G] 5, got %s", got)
+    }
+}
@@ -0,0 +1,508 @@
+package query
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// A Position is a place in the text of a query.
+type Position struct {
+    Offset int // the offset in bytes, starting at 0
+    Line int   // the line number, starting at 1
+    Column int // the column in characters, starting at 1
+}
+
+func (p Position) String() string {
+    return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// A Node is a part of a parsed query.
+type Node interface {
+    Pos() Position // where the node starts in the text of the query
+}
+
+// A Query is a parsed query: a list of statements that are run in order.
+type Query struct {
+    Mode Mode
+    Statements []Statement
+}
+
+// A Mode is what is done with a query.
+type Mode int
+
+const (
+    RunMode Mode = iota // the query is run and yields its rows
+    ExplainMode         // the query is planned but not run, and yields its plan
+    ProfileMode         // the query is run, and yields its plan with what each step did
+)
+
+// A Statement is one step of a query.
+type Statement interface {
+    Node
+    statementNode()
+}
+
+// A MatchStatement finds the vertices or edges that fit a pattern.
+//
+//     e = [owns] FROM Person{name: "Ann"} TO Asset
+type MatchStatement struct {
+    Start Position
+    Var *Ident      // the variable the matches are bound to, or nil
+    Pattern Pattern
+}
+
+// A YieldStatement produces the results of a query.
+// When it has aggregate functions or a group by clause, it yields a row for each group
+// of matches instead of for each match.
+//
+//     yield e, e.since
+//     yield p.name, count(a) group by p
+//     yield p order by p.age desc, p.name skip 20 limit 10
+type YieldStatement struct {
+    Start Position
+    Values []Expr
+    GroupBy []Expr       // the values matches are grouped by, or nil
+    OrderBy []*OrderKey  // the values rows are sorted by, or nil
+    Skip Expr            // the number of rows to skip, an integer literal or parameter, or nil
+    Limit Expr           // the most rows to yield, an integer literal or parameter, or nil
+}
+
+// A CreateStatement adds a vertex, or an edge between bound vertices.
+//
+//     create (p <Person> {name: "Ann"})
+//     create [e <owns> {since: 2010}] from (p) to (a)
+type CreateStatement struct {
+    Start Position
+    Pattern Pattern
+}
+
+// A MergeStatement matches a vertex or edge like a pattern, creating it if there is no
+// match.
+//
+//     merge (p <Person> {name: "Ann"})
+type MergeStatement struct {
+    Start Position
+    Pattern Pattern
+}
+
+// A SetStatement sets attributes of bound vertices and edges.
+//
+//     set p.age = 41, e.since = $year
+type SetStatement struct {
+    Start Position
+    Assignments []*Assignment
+}
+
+// An Assignment is one attribute and its value in a set statement.
+type Assignment struct {
+    Target *Property
+    Value Expr
+}
+
+// A RemoveStatement removes attributes from bound vertices and edges.
+//
+//     remove p.age, e.since
+type RemoveStatement struct {
+    Start Position
+    Properties []*Property
+}
+
+// A DeleteStatement removes bound vertices, along with their edges, and bound edges.
+//
+//     delete p, e
+type DeleteStatement struct {
+    Start Position
+    Vars []*Ident
+}
+
+// An OrderKey is a value rows are sorted by.
+type OrderKey struct {
+    Value Expr
+    Descending bool
+}
+
+func (s *MatchStatement) Pos() Position { return s.Start }
+func (s *YieldStatement) Pos() Position { return s.Start }
+func (s *CreateStatement) Pos() Position { return s.Start }
+func (s *MergeStatement) Pos() Position { return s.Start }
+func (s *SetStatement) Pos() Position { return s.Start }
+func (s *RemoveStatement) Pos() Position { return s.Start }
+func (s *DeleteStatement) Pos() Position { return s.Start }
+func (a *Assignment) Pos() Position { return a.Target.Pos() }
+
+func (k *OrderKey) Pos() Position { return k.Value.Pos() }
+
+func (*MatchStatement) statementNode() {}
+func (*YieldStatement) statementNode() {}
+func (*CreateStatement) statementNode() {}
+func (*MergeStatement) statementNode() {}
+func (*SetStatement) statementNode() {}
+func (*RemoveStatement) statementNode() {}
+func (*DeleteStatement) statementNode() {}
+
+// A Pattern describes the vertices or edges a statement matches.
+type Pattern interface {
+    Node
+    patternNode()
+}
+
+// A VertexPattern matches vertices by class and attributes.
+// It is written in parentheses, where an identifier is a variable and the class is in
+// angle brackets, or as just a class with optional attributes.
+//
+//     (p <Person> {name: "Ann"})
+//     <Person> {name: "Ann"}
+//     Person{name: "Ann"}
+type VertexPattern struct {
+    Start Position
+    Var *Ident                // the variable in the parentheses, or nil
+    Class *Ident              // the class the vertices belong to, or nil for any class
+    Attributes *AttributeMap  // the attributes the vertices must have, or nil
+}
+
+// An EdgePattern matches edges by label and attributes, and by the vertices they go
+// from and to.
+// When the label is in angle brackets it may follow a variable, and a length makes the
+// pattern match sequences of edges instead of a single edge.
+//
+//     [owns {since: 2010}] FROM Person TO Asset
+//     [e <owns>] FROM (p) TO (a)
+//     [knows *1..3] FROM (p) TO (q)
+type EdgePattern struct {
+    Start Position
+    Var *Ident                // the variable in the brackets, or nil
+    Label *Ident              // the label of the edges, or nil for any label
+    Length *Length            // the number of edges in a sequence, or nil for a single edge
+    Attributes *AttributeMap  // the attributes the edges must have, or nil
+    From *VertexPattern       // the vertices the edges go from, or nil for any vertex
+    To *VertexPattern         // the vertices the edges go to, or nil for any vertex
+}
+
+// A Length is the number of edges a variable-length edge pattern may match in a row.
+//
+//     *2  *1..3  *..3  *2..  *
+type Length struct {
+    Start Position
+    Min int
+    Max int // -1 if there is no maximum
+}
+
+// A PathPattern matches chains of vertices joined by edges. Each edge pattern in the
+// path goes from or to the vertex patterns on either side of it, so consecutive edges
+// share a vertex.
+//
+//     (p <Person>)-[works_at]->(c <Company>)-[located_in]->(city <City>)
+//     (a)<-[knows *1..2]-(b)
+type PathPattern struct {
+    Start Position
+    Vertices []*VertexPattern
+    Edges []*EdgePattern // Edges[n] joins Vertices[n] and Vertices[n + 1]
+}
+
+func (p *VertexPattern) Pos() Position { return p.Start }
+func (p *EdgePattern) Pos() Position { return p.Start }
+func (p *PathPattern) Pos() Position { return p.Start }
+func (l *Length) Pos() Position { return l.Start }
+
+func (*VertexPattern) patternNode() {}
+func (*EdgePattern) patternNode() {}
+func (*PathPattern) patternNode() {}
+
+// An AttributeMap lists attribute keys and the values they must have.
+//
+//     {name: "Ann", age: 40}
+type AttributeMap struct {
+    Start Position
+    Entries []*AttributeEntry
+}
+
+// An AttributeEntry is one key and value of an attribute map.
+type AttributeEntry struct {
+    Key *Ident
+    Value Expr
+}
+
+func (m *AttributeMap) Pos() Position { return m.Start }
+func (e *AttributeEntry) Pos() Position { return e.Key.Start }
+
+// An Expr is a value in a query.
+type Expr interface {
+    Node
+    exprNode()
+}
+
+// An Ident is a name: a variable, class, label, or attribute key.
+type Ident struct {
+    Start Position
+    Name string
+}
+
+// A Literal is a string, integer, real number, or boolean written in a query.
+// Its value is a string, int64, float64, or bool.
+type Literal struct {
+    Start Position
+    Value interface{}
+}
+
+// A Property is the value of an attribute of a bound vertex or edge.
+//
+//     e.since
+type Property struct {
+    Var *Ident
+    Key *Ident
+}
+
+// A Call is an aggregate function applied to a value over a group of matches.
+// The argument is nil for count(*), which counts the matches themselves.
+//
+//     count(a)  sum(a.value)  collect(a.name)
+type Call struct {
+    Start Position
+    Func *Ident
+    Arg Expr
+}
+
+// A Param is a value given to the query separately from its text.
+//
+//     $name
+type Param struct {
+    Start Position
+    Name string // the name without the "$"
+}
+
+func (e *Ident) Pos() Position { return e.Start }
+func (e *Literal) Pos() Position { return e.Start }
+func (e *Property) Pos() Position { return e.Var.Start }
+func (e *Param) Pos() Position { return e.Start }
+func (e *Call) Pos() Position { return e.Start }
+
+func (*Ident) exprNode() {}
+func (*Literal) exprNode() {}
+func (*Property) exprNode() {}
+func (*Param) exprNode() {}
+func (*Call) exprNode() {}
+
+// String returns the query in its canonical form, which parses to the same query.
+func (q *Query) String() string {
+    statements := make([]string, len(q.Statements))
+    for n, s := range q.Statements {
+        statements[n] = fmt.Sprint(s)
+    }
+    text := strings.Join(statements, "; ")
+    switch q.Mode {
+    case ExplainMode:
+        return "explain " + text
+    case ProfileMode:
+        return "profile " + text
+    }
+    return text
+}
+
+func (s *MatchStatement) String() string {
+    if s.Var == nil {
+        return fmt.Sprint(s.Pattern)
+    }
+    return s.Var.Name + " = " + fmt.Sprint(s.Pattern)
+}
+
+func (s *YieldStatement) String() string {
+    values := make([]string, len(s.Values))
+    for n, v := range s.Values {
+        values[n] = fmt.Sprint(v)
+    }
+    text := "yield " + strings.Join(values, ", ")
+    if s.GroupBy != nil {
+        keys := make([]string, len(s.GroupBy))
+        for n, k := range s.GroupBy {
+            keys[n] = fmt.Sprint(k)
+        }
+        text += " group by " + strings.Join(keys, ", ")
+    }
+    if s.OrderBy != nil {
+        keys := make([]string, len(s.OrderBy))
+        for n, k := range s.OrderBy {
+            keys[n] = k.String()
+        }
+        text += " order by " + strings.Join(keys, ", ")
+    }
+    if s.Skip != nil {
+        text += " skip " + fmt.Sprint(s.Skip)
+    }
+    if s.Limit != nil {
+        text += " limit " + fmt.Sprint(s.Limit)
+    }
+    return text
+}
+
+func (s *CreateStatement) String() string {
+    return "create " + fmt.Sprint(s.Pattern)
+}
+
+func (s *MergeStatement) String() string {
+    return "merge " + fmt.Sprint(s.Pattern)
+}
+
+func (s *SetStatement) String() string {
+    assignments := make([]string, len(s.Assignments))
+    for n, a := range s.Assignments {
+        assignments[n] = a.Target.String() + " = " + fmt.Sprint(a.Value)
+    }
+    return "set " + strings.Join(assignments, ", ")
+}
+
+func (s *RemoveStatement) String() string {
+    properties := make([]string, len(s.Properties))
+    for n, p := range s.Properties {
+        properties[n] = p.String()
+    }
+    return "remove " + strings.Join(properties, ", ")
+}
+
+func (s *DeleteStatement) String() string {
+    vars := make([]string, len(s.Vars))
+    for n, v := range s.Vars {
+        vars[n] = v.Name
+    }
+    return "delete " + strings.Join(vars, ", ")
+}
+
+func (k *OrderKey) String() string {
+    if k.Descending {
+        return fmt.Sprint(k.Value) + " desc"
+    }
+    return fmt.Sprint(k.Value)
+}
+
+func (p *VertexPattern) String() string {
+    parts := make([]string, 0, 3)
+    if p.Var != nil {
+        parts = append(parts, p.Var.Name)
+    }
+    if p.Class != nil {
+        parts = append(parts, "<" + p.Class.Name + ">")
+    }
+    if p.Attributes != nil {
+        parts = append(parts, p.Attributes.String())
+    }
+    return "(" + strings.Join(parts, " ") + ")"
+}
+
+func (p *EdgePattern) String() string {
+    s := p.brackets()
+    if p.From != nil {
+        s += " from " + p.From.String()
+    }
+    if p.To != nil {
+        s += " to " + p.To.String()
+    }
+    return s
+}
+
+// Returns the part of the pattern in square brackets.
+func (p *EdgePattern) brackets() string {
+    parts := make([]string, 0, 3)
+    switch {
+    case p.Var != nil:
+        parts = append(parts, p.Var.Name, "<" + p.Label.Name + ">")
+    case p.Label != nil:
+        parts = append(parts, p.Label.Name)
+    }
+    if p.Length != nil {
+        parts = append(parts, p.Length.String())
+    }
+    if p.Attributes != nil {
+        parts = append(parts, p.Attributes.String())
+    }
+    return "[" + strings.Join(parts, " ") + "]"
+}
+
+func (l *Length) String() string {
+    if l.Min == l.Max {
+        return "*" + strconv.Itoa(l.Min)
+    }
+    if l.Max == -1 {
+        return "*" + strconv.Itoa(l.Min) + ".."
+    }
+    return "*" + strconv.Itoa(l.Min) + ".." + strconv.Itoa(l.Max)
+}
+
+func (p *PathPattern) String() string {
+    s := p.Vertices[0].String()
+    for n, e := range p.Edges {
+        next := p.Vertices[n + 1]
+        if e.To == next {
+            s += "-" + e.brackets() + "->" + next.String()
+        } else {
+            s += "<-" + e.brackets() + "-" + next.String()
+        }
+    }
+    return s
+}
+
+func (m *AttributeMap) String() string {
+    entries := make([]string, len(m.Entries))
+    for n, e := range m.Entries {
+        entries[n] = e.Key.Name + ": " + fmt.Sprint(e.Value)
+    }
+    return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func (e *Ident) String() string {
+    return e.Name
+}
+
+func (e *Literal) String() string {
+    switch v := e.Value.(type) {
+    case string:
+        return quote(v)
+    case float64:
+        s := strconv.FormatFloat(v, 'g', -1, 64)
+        if !strings.ContainsAny(s, ".eE") {
+            s += ".0" // so it is read back as a real number
+        }
+        return s
+    }
+    return fmt.Sprint(e.Value)
+}
+
+func (e *Property) String() string {
+    return e.Var.Name + "." + e.Key.Name
+}
+
+func (e *Param) String() string {
+    return "$" + e.Name
+}
+
+func (e *Call) String() string {
+    if e.Arg == nil {
+        return e.Func.Name + "(*)"
+    }
+    return e.Func.Name + "(" + fmt.Sprint(e.Arg) + ")"
+}
+
+// Quotes a string with the escapes the lexer understands.
+func quote(s string) string {
+    return "\"" + strings.NewReplacer(
+        "\\", "\\\\",
+        "\"", "\\\"",
+        "\n", "\\n",
+        "\r", "\\r",
+        "\t", "\\t",
+    ).Replace(s) + "\""
+}
+
+// A SyntaxError describes why the text of a query could not be parsed.
+type SyntaxError struct {
+    Pos Position
+    Msg string
+}
+
+func (e *SyntaxError) Error() string {
+    return "syntax error at " + e.Pos.String() + ": " + e.Msg
+}
+
+// Creates a syntax error with a formatted message.
+func syntaxError(pos Position, format string, args ...interface{}) *SyntaxError {
+    return &SyntaxError{pos, fmt.Sprintf(format, args...)}
+}
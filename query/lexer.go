@@ -0,0 +1,260 @@
+package query
+
+import (
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// The kinds of token
+type tokenKind int
+
+const (
+    eofToken tokenKind = iota
+    identToken
+    keywordToken
+    stringToken
+    intToken
+    realToken
+    paramToken
+    punctToken
+)
+
+// The words that have a meaning of their own. Keywords are not case sensitive.
+// Where a name is expected rather than a keyword, as after "." or inside "<" and ">",
+// a keyword is taken as a name; see token.isWord.
+var keywords = map[string]bool{
+    "explain": true,
+    "profile": true,
+    "from": true,
+    "to": true,
+    "yield": true,
+    "create": true,
+    "merge": true,
+    "set": true,
+    "remove": true,
+    "delete": true,
+    "group": true,
+    "order": true,
+    "by": true,
+    "asc": true,
+    "desc": true,
+    "skip": true,
+    "limit": true,
+    "true": true,
+    "false": true,
+}
+
+// The punctuation of the language, longest first so that it is matched greedily.
+var punctuation = []string{
+    "->", "<-", "..",
+    "(", ")", "[", "]", "{", "}", "<", ">", ":", ",", ";", "=", ".", "-", "*",
+}
+
+// A token is a word, literal, or piece of punctuation in the text of a query.
+type token struct {
+    kind tokenKind
+    text string // the text of the token, unquoted for strings and without the "$" for parameters
+    pos Position
+}
+
+// Returns how the token is described in syntax errors.
+func (t token) String() string {
+    switch t.kind {
+    case eofToken:
+        return "end of query"
+    case stringToken:
+        return "string"
+    case paramToken:
+        return "\"$" + t.text + "\""
+    }
+    return "\"" + t.text + "\""
+}
+
+// Returns true if the token is the punctuation or keyword, which is given in lower case.
+func (t token) is(text string) bool {
+    switch t.kind {
+    case punctToken:
+        return t.text == text
+    case keywordToken:
+        return strings.ToLower(t.text) == text
+    }
+    return false
+}
+
+// Returns true if the token is a word, which can be used as a name where a keyword
+// would make no sense.
+func (t token) isWord() bool {
+    return t.kind == identToken || t.kind == keywordToken
+}
+
+// A lexer breaks the text of a query into tokens.
+type lexer struct {
+    text string
+    pos Position // the position of the next rune
+}
+
+// Breaks the text of a query into tokens, ending with an eofToken.
+// Returns a *SyntaxError if the text has a character or literal that is not allowed.
+func tokenize(text string) ([]token, error) {
+    l := &lexer{text: text, pos: Position{0, 1, 1}}
+    tokens := make([]token, 0)
+    for {
+        t, err := l.next()
+        if err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, t)
+        if t.kind == eofToken {
+            return tokens, nil
+        }
+    }
+}
+
+// Returns the next rune without consuming it, or -1 at the end of the text.
+func (l *lexer) peek() rune {
+    if l.pos.Offset >= len(l.text) {
+        return -1
+    }
+    r, _ := utf8.DecodeRuneInString(l.text[l.pos.Offset:])
+    return r
+}
+
+// Consumes the next rune.
+func (l *lexer) advance() {
+    r, size := utf8.DecodeRuneInString(l.text[l.pos.Offset:])
+    l.pos.Offset += size
+    if r == '\n' {
+        l.pos.Line++
+        l.pos.Column = 1
+    } else {
+        l.pos.Column++
+    }
+}
+
+// Skips white space and comments, which run from "//" to the end of the line.
+func (l *lexer) skipSpace() {
+    for {
+        r := l.peek()
+        switch {
+        case r != -1 && unicode.IsSpace(r):
+            l.advance()
+        case strings.HasPrefix(l.text[l.pos.Offset:], "//"):
+            for r = l.peek(); r != -1 && r != '\n'; r = l.peek() {
+                l.advance()
+            }
+        default:
+            return
+        }
+    }
+}
+
+// Reads the next token.
+func (l *lexer) next() (token, error) {
+    l.skipSpace()
+    start := l.pos
+    r := l.peek()
+    switch {
+    case r == -1:
+        return token{eofToken, "", start}, nil
+    case r == '_' || unicode.IsLetter(r):
+        for r = l.peek(); r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r); r = l.peek() {
+            l.advance()
+        }
+        word := l.text[start.Offset:l.pos.Offset]
+        if keywords[strings.ToLower(word)] {
+            return token{keywordToken, word, start}, nil
+        }
+        return token{identToken, word, start}, nil
+    case r >= '0' && r <= '9':
+        return l.number(start), nil
+    case r == '"':
+        return l.string(start)
+    case r == '$':
+        l.advance()
+        for r = l.peek(); r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r); r = l.peek() {
+            l.advance()
+        }
+        if l.pos.Offset == start.Offset + 1 {
+            return token{}, syntaxError(start, "expected parameter name after \"$\"")
+        }
+        return token{paramToken, l.text[start.Offset + 1:l.pos.Offset], start}, nil
+    }
+
+    for _, p := range punctuation {
+        if strings.HasPrefix(l.text[start.Offset:], p) {
+            for range p {
+                l.advance()
+            }
+            return token{punctToken, p, start}, nil
+        }
+    }
+    return token{}, syntaxError(start, "unexpected character %q", r)
+}
+
+// Reads an integer or real number.
+func (l *lexer) number(start Position) token {
+    digits := func() {
+        for r := l.peek(); r >= '0' && r <= '9'; r = l.peek() {
+            l.advance()
+        }
+    }
+    kind := intToken
+    digits()
+    // a fraction needs a digit after the point
+    rest := l.text[l.pos.Offset:]
+    if len(rest) > 1 && rest[0] == '.' && rest[1] >= '0' && rest[1] <= '9' {
+        kind = realToken
+        l.advance()
+        digits()
+    }
+    rest = l.text[l.pos.Offset:]
+    if len(rest) > 1 && (rest[0] == 'e' || rest[0] == 'E') {
+        n := 1
+        if rest[n] == '+' || rest[n] == '-' {
+            n++
+        }
+        if n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+            kind = realToken
+            for ; n > 0; n-- {
+                l.advance()
+            }
+            digits()
+        }
+    }
+    return token{kind, l.text[start.Offset:l.pos.Offset], start}
+}
+
+// Reads a double quoted string, which may contain the escapes \", \\, \n, \r, and \t.
+func (l *lexer) string(start Position) (token, error) {
+    l.advance() // the opening quote
+    var b strings.Builder
+    for {
+        r := l.peek()
+        switch r {
+        case -1, '\n':
+            return token{}, syntaxError(start, "string is not terminated")
+        case '"':
+            l.advance()
+            return token{stringToken, b.String(), start}, nil
+        case '\\':
+            escape := l.pos
+            l.advance()
+            switch e := l.peek(); e {
+            case '"', '\\':
+                b.WriteRune(e)
+            case 'n':
+                b.WriteRune('\n')
+            case 'r':
+                b.WriteRune('\r')
+            case 't':
+                b.WriteRune('\t')
+            default:
+                return token{}, syntaxError(escape, "unknown escape sequence in string")
+            }
+        default:
+            b.WriteRune(r)
+        }
+        l.advance()
+    }
+}
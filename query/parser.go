@@ -0,0 +1,646 @@
+// Package query parses the graphlite query language.
+//
+// A query is a list of statements separated by semicolons. Match statements find the
+// vertices or edges that fit a pattern and bind them to variables, and yield statements
+// produce the results:
+//
+//     e = [owns] FROM Person{name: "Ann"} TO Asset;
+//     yield e
+//
+// The grammar is described in GRAMMAR.md.
+package query
+
+import (
+    "strconv"
+    "strings"
+)
+
+// A parser builds the syntax tree of a query from its tokens.
+type parser struct {
+    tokens []token
+    pos int // the index of the current token
+}
+
+// Parse parses the text of a query.
+// Returns an error of type *SyntaxError, which has the position of the problem, if
+// the text is not a valid query.
+func Parse(text string) (*Query, error) {
+    tokens, err := tokenize(text)
+    if err != nil {
+        return nil, err
+    }
+    p := &parser{tokens: tokens}
+    return p.query()
+}
+
+// Returns the current token.
+func (p *parser) tok() token {
+    return p.tokens[p.pos]
+}
+
+// Returns the token after the current one.
+func (p *parser) peek() token {
+    if p.pos + 1 < len(p.tokens) {
+        return p.tokens[p.pos + 1]
+    }
+    return p.tokens[len(p.tokens) - 1]
+}
+
+// Moves to the next token and returns the one that was current.
+func (p *parser) advance() token {
+    t := p.tokens[p.pos]
+    if t.kind != eofToken {
+        p.pos++
+    }
+    return t
+}
+
+// Returns true if the current token is the keyword that starts a query or statement.
+// The same word followed by attributes or an edge is the name of a class instead, as
+// in Order{total: 5} or Set-[holds]->Item.
+func (p *parser) keyword(text string) bool {
+    return p.tok().is(text) && !p.continuesPattern()
+}
+
+// Returns true if the token after the current one continues a pattern.
+func (p *parser) continuesPattern() bool {
+    next := p.peek()
+    return next.is("{") || next.is("-") || next.is("<-")
+}
+
+// Consumes the current token if it is the punctuation or keyword.
+func (p *parser) accept(text string) bool {
+    if p.tok().is(text) {
+        p.advance()
+        return true
+    }
+    return false
+}
+
+// Consumes the current token, which must be the punctuation or keyword.
+func (p *parser) expect(text string, context string) (token, error) {
+    if !p.tok().is(text) {
+        return token{}, p.unexpected("\"" + text + "\" " + context)
+    }
+    return p.advance(), nil
+}
+
+// Returns the error for a current token that is not what was expected.
+func (p *parser) unexpected(expected string) error {
+    t := p.tok()
+    return syntaxError(t.pos, "expected %s, found %s", expected, t)
+}
+
+// query = [ "explain" | "profile" ] [ statement { ";" statement } [ ";" ] ] .
+func (p *parser) query() (*Query, error) {
+    q := &Query{Statements: make([]Statement, 0)}
+    if p.keyword("explain") {
+        p.advance()
+        q.Mode = ExplainMode
+    } else if p.keyword("profile") {
+        p.advance()
+        q.Mode = ProfileMode
+    }
+    for p.tok().kind != eofToken {
+        s, err := p.statement()
+        if err != nil {
+            return nil, err
+        }
+        q.Statements = append(q.Statements, s)
+        if !p.accept(";") && p.tok().kind != eofToken {
+            return nil, p.unexpected("\";\" after statement")
+        }
+    }
+    return q, nil
+}
+
+// statement = yield | create | merge | set | remove | delete | match .
+func (p *parser) statement() (Statement, error) {
+    switch t := p.tok(); {
+    case p.keyword("yield"):
+        return p.yield()
+    case p.keyword("create"):
+        p.advance()
+        pattern, err := p.pattern()
+        if err != nil {
+            return nil, err
+        }
+        return &CreateStatement{t.pos, pattern}, nil
+    case p.keyword("merge"):
+        p.advance()
+        pattern, err := p.pattern()
+        if err != nil {
+            return nil, err
+        }
+        return &MergeStatement{t.pos, pattern}, nil
+    case p.keyword("set"):
+        return p.set()
+    case p.keyword("remove"):
+        return p.remove()
+    case p.keyword("delete"):
+        return p.delete()
+    }
+    return p.match()
+}
+
+// set = "set" property "=" expression { "," property "=" expression } .
+func (p *parser) set() (*SetStatement, error) {
+    s := &SetStatement{Start: p.advance().pos}
+    for {
+        target, err := p.property()
+        if err != nil {
+            return nil, err
+        }
+        if _, err = p.expect("=", "after attribute"); err != nil {
+            return nil, err
+        }
+        value, err := p.expression()
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := value.(*Call); ok {
+            return nil, syntaxError(value.Pos(), "aggregate functions can only be used in yield statements")
+        }
+        s.Assignments = append(s.Assignments, &Assignment{target, value})
+        if !p.accept(",") {
+            return s, nil
+        }
+    }
+}
+
+// remove = "remove" property { "," property } .
+func (p *parser) remove() (*RemoveStatement, error) {
+    s := &RemoveStatement{Start: p.advance().pos}
+    for {
+        property, err := p.property()
+        if err != nil {
+            return nil, err
+        }
+        s.Properties = append(s.Properties, property)
+        if !p.accept(",") {
+            return s, nil
+        }
+    }
+}
+
+// delete = "delete" identifier { "," identifier } .
+func (p *parser) delete() (*DeleteStatement, error) {
+    s := &DeleteStatement{Start: p.advance().pos}
+    for {
+        if p.tok().kind != identToken {
+            return nil, p.unexpected("variable")
+        }
+        s.Vars = append(s.Vars, p.ident())
+        if !p.accept(",") {
+            return s, nil
+        }
+    }
+}
+
+// property = identifier "." name .
+func (p *parser) property() (*Property, error) {
+    if p.tok().kind != identToken {
+        return nil, p.unexpected("variable")
+    }
+    v := p.ident()
+    if _, err := p.expect(".", "after variable"); err != nil {
+        return nil, err
+    }
+    if !p.tok().isWord() {
+        return nil, p.unexpected("attribute key after \".\"")
+    }
+    return &Property{v, p.ident()}, nil
+}
+
+// yield = "yield" values [ "group" "by" values ] [ "order" "by" order { "," order } ]
+//         [ "skip" rows ] [ "limit" rows ] .
+func (p *parser) yield() (*YieldStatement, error) {
+    s := &YieldStatement{Start: p.advance().pos}
+    var err error
+    if s.Values, err = p.values(true); err != nil {
+        return nil, err
+    }
+    if p.accept("group") {
+        if _, err = p.expect("by", "after GROUP"); err != nil {
+            return nil, err
+        }
+        if s.GroupBy, err = p.values(false); err != nil {
+            return nil, err
+        }
+    }
+    if p.accept("order") {
+        if _, err = p.expect("by", "after ORDER"); err != nil {
+            return nil, err
+        }
+        for {
+            e, err := p.expression()
+            if err != nil {
+                return nil, err
+            }
+            k := &OrderKey{Value: e}
+            if p.accept("desc") {
+                k.Descending = true
+            } else {
+                p.accept("asc")
+            }
+            s.OrderBy = append(s.OrderBy, k)
+            if !p.accept(",") {
+                break
+            }
+        }
+    }
+    if p.accept("skip") {
+        if s.Skip, err = p.rows("SKIP"); err != nil {
+            return nil, err
+        }
+    }
+    if p.accept("limit") {
+        if s.Limit, err = p.rows("LIMIT"); err != nil {
+            return nil, err
+        }
+    }
+    return s, nil
+}
+
+// rows = integer | parameter .
+func (p *parser) rows(after string) (Expr, error) {
+    t := p.tok()
+    if t.kind != intToken && t.kind != paramToken {
+        return nil, p.unexpected("number of rows after " + after)
+    }
+    return p.value()
+}
+
+// values = expression { "," expression } .
+// Aggregate functions are only allowed if aggregates is true.
+func (p *parser) values(aggregates bool) ([]Expr, error) {
+    values := make([]Expr, 0)
+    for {
+        start := p.tok()
+        e, err := p.expression()
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := e.(*Call); ok && !aggregates {
+            return nil, syntaxError(start.pos, "can not group by an aggregate function")
+        }
+        values = append(values, e)
+        if !p.accept(",") {
+            return values, nil
+        }
+    }
+}
+
+// match = [ identifier "=" ] pattern .
+func (p *parser) match() (*MatchStatement, error) {
+    s := &MatchStatement{Start: p.tok().pos}
+    if p.tok().kind == keywordToken && !p.continuesPattern() {
+        return nil, p.unexpected("pattern")
+    }
+    if p.tok().kind == identToken && p.peek().is("=") {
+        s.Var = p.ident()
+        p.advance()
+    }
+    pattern, err := p.pattern()
+    if err != nil {
+        return nil, err
+    }
+    if _, ok := pattern.(*PathPattern); ok && s.Var != nil {
+        return nil, syntaxError(s.Var.Start, "a path can not be assigned to a variable")
+    }
+    s.Pattern = pattern
+    return s, nil
+}
+
+// pattern = edge | path .
+func (p *parser) pattern() (Pattern, error) {
+    if p.tok().is("[") {
+        return p.edge()
+    }
+    return p.path()
+}
+
+// edge = brackets [ "from" vertex ] [ "to" vertex ] .
+func (p *parser) edge() (*EdgePattern, error) {
+    e, err := p.brackets()
+    if err != nil {
+        return nil, err
+    }
+    if p.accept("from") {
+        if e.From, err = p.vertex("vertex after FROM"); err != nil {
+            return nil, err
+        }
+    }
+    if p.accept("to") {
+        if e.To, err = p.vertex("vertex after TO"); err != nil {
+            return nil, err
+        }
+    }
+    return e, nil
+}
+
+// brackets = "[" [ name | [ identifier ] label ] [ length ] [ attributes ] "]" .
+func (p *parser) brackets() (*EdgePattern, error) {
+    e := &EdgePattern{Start: p.advance().pos}
+    var err error
+    if p.tok().kind == identToken || p.tok().kind == keywordToken && !p.peek().is("<") {
+        e.Label = p.ident()
+    }
+    if p.tok().is("<") {
+        e.Var = e.Label
+        if e.Label, err = p.angled("label"); err != nil {
+            return nil, err
+        }
+    }
+    if p.tok().is("*") {
+        if e.Length, err = p.length(); err != nil {
+            return nil, err
+        }
+    }
+    if p.tok().is("{") {
+        if e.Attributes, err = p.attributes(); err != nil {
+            return nil, err
+        }
+    }
+    context := "to close edge"
+    if e.Label == nil && e.Length == nil && e.Attributes == nil {
+        context = "or edge label"
+    }
+    if _, err = p.expect("]", context); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// length = "*" [ integer ] [ ".." [ integer ] ] .
+func (p *parser) length() (*Length, error) {
+    l := &Length{Start: p.advance().pos, Min: 1, Max: -1}
+    var err error
+    exact := p.tok().kind == intToken
+    if exact {
+        if l.Min, err = p.count(); err != nil {
+            return nil, err
+        }
+        l.Max = l.Min
+    }
+    if p.accept("..") {
+        l.Max = -1
+        if p.tok().kind == intToken {
+            if l.Max, err = p.count(); err != nil {
+                return nil, err
+            }
+        }
+    } else if !exact {
+        return l, nil
+    }
+    if l.Max != -1 && l.Max < l.Min {
+        return nil, syntaxError(l.Start, "the length %s has a maximum below its minimum", l)
+    }
+    return l, nil
+}
+
+// Consumes the current token, which must be an integer, as a count of edges.
+func (p *parser) count() (int, error) {
+    t := p.advance()
+    n, err := strconv.ParseInt(t.text, 10, 32)
+    if err != nil {
+        return 0, syntaxError(t.pos, "integer %s is out of range", t.text)
+    }
+    return int(n), nil
+}
+
+// path = vertex { ( "-" brackets "->" | "<-" brackets "-" ) vertex } .
+func (p *parser) path() (Pattern, error) {
+    v, err := p.vertex("pattern")
+    if err != nil {
+        return nil, err
+    }
+    if !p.tok().is("-") && !p.tok().is("<-") {
+        return v, nil
+    }
+    path := &PathPattern{Start: v.Start, Vertices: []*VertexPattern{v}}
+    for p.tok().is("-") || p.tok().is("<-") {
+        out := p.advance().text == "-"
+        if !p.tok().is("[") {
+            return nil, p.unexpected("\"[\" to start edge")
+        }
+        e, err := p.brackets()
+        if err != nil {
+            return nil, err
+        }
+        closing := "-"
+        if out {
+            closing = "->"
+        }
+        if _, err = p.expect(closing, "after edge"); err != nil {
+            return nil, err
+        }
+        next, err := p.vertex("vertex after edge")
+        if err != nil {
+            return nil, err
+        }
+        if out {
+            e.From, e.To = v, next
+        } else {
+            e.From, e.To = next, v
+        }
+        path.Vertices = append(path.Vertices, next)
+        path.Edges = append(path.Edges, e)
+        v = next
+    }
+    return path, nil
+}
+
+// vertex = "(" [ identifier ] [ class ] [ attributes ] ")"
+//        | ( class | name ) [ attributes ] .
+func (p *parser) vertex(what string) (*VertexPattern, error) {
+    v := &VertexPattern{Start: p.tok().pos}
+    var err error
+    switch {
+    case p.accept("("):
+        if p.tok().kind == identToken {
+            v.Var = p.ident()
+        }
+        if p.tok().is("<") {
+            if v.Class, err = p.angled("class"); err != nil {
+                return nil, err
+            }
+        }
+        if p.tok().is("{") {
+            if v.Attributes, err = p.attributes(); err != nil {
+                return nil, err
+            }
+        }
+        if _, err = p.expect(")", "to close vertex"); err != nil {
+            return nil, err
+        }
+        return v, nil
+    case p.tok().is("<"):
+        if v.Class, err = p.angled("class"); err != nil {
+            return nil, err
+        }
+    case p.tok().isWord():
+        v.Class = p.ident()
+    default:
+        return nil, p.unexpected(what)
+    }
+    if p.tok().is("{") {
+        if v.Attributes, err = p.attributes(); err != nil {
+            return nil, err
+        }
+    }
+    return v, nil
+}
+
+// class = "<" name ">" .
+// label = "<" name ">" .
+func (p *parser) angled(what string) (*Ident, error) {
+    p.advance()
+    if !p.tok().isWord() {
+        return nil, p.unexpected(what + " name")
+    }
+    name := p.ident()
+    if _, err := p.expect(">", "to close " + what); err != nil {
+        return nil, err
+    }
+    return name, nil
+}
+
+// attributes = "{" [ entry { "," entry } [ "," ] ] "}" .
+// entry = name ":" value .
+func (p *parser) attributes() (*AttributeMap, error) {
+    m := &AttributeMap{Start: p.advance().pos}
+    for !p.tok().is("}") {
+        if !p.tok().isWord() {
+            return nil, p.unexpected("attribute key")
+        }
+        entry := &AttributeEntry{Key: p.ident()}
+        for _, other := range m.Entries {
+            if other.Key.Name == entry.Key.Name {
+                return nil, syntaxError(entry.Key.Start, "attribute %s is given more than once", entry.Key.Name)
+            }
+        }
+        if _, err := p.expect(":", "after attribute key"); err != nil {
+            return nil, err
+        }
+        value, err := p.value()
+        if err != nil {
+            return nil, err
+        }
+        entry.Value = value
+        m.Entries = append(m.Entries, entry)
+        if !p.accept(",") && !p.tok().is("}") {
+            return nil, p.unexpected("\",\" or \"}\" in attributes")
+        }
+    }
+    p.advance()
+    return m, nil
+}
+
+// The aggregate functions a query can call
+var aggregates = map[string]bool{
+    "count": true,
+    "sum": true,
+    "avg": true,
+    "min": true,
+    "max": true,
+    "collect": true,
+}
+
+// expression = call | identifier [ "." name ] | value .
+func (p *parser) expression() (Expr, error) {
+    if p.tok().kind != identToken {
+        return p.value()
+    }
+    if p.peek().is("(") {
+        return p.call()
+    }
+    v := p.ident()
+    if !p.accept(".") {
+        return v, nil
+    }
+    if !p.tok().isWord() {
+        return nil, p.unexpected("attribute key after \".\"")
+    }
+    return &Property{v, p.ident()}, nil
+}
+
+// call = identifier "(" ( "*" | expression ) ")" .
+// The identifier is the name of an aggregate function, and only count takes "*".
+func (p *parser) call() (*Call, error) {
+    c := &Call{Start: p.tok().pos, Func: p.ident()}
+    name := strings.ToLower(c.Func.Name)
+    if !aggregates[name] {
+        return nil, syntaxError(c.Start, "unknown function %s", c.Func.Name)
+    }
+    c.Func.Name = name
+    p.advance()
+    if p.tok().is("*") {
+        if name != "count" {
+            return nil, syntaxError(p.tok().pos, "only count can be applied to *")
+        }
+        p.advance()
+    } else {
+        arg, err := p.expression()
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := arg.(*Call); ok {
+            return nil, syntaxError(arg.Pos(), "aggregate functions can not be nested")
+        }
+        c.Arg = arg
+    }
+    if _, err := p.expect(")", "to close call"); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// value = string | [ "-" ] number | "true" | "false" | parameter .
+func (p *parser) value() (Expr, error) {
+    t := p.tok()
+    negative := p.accept("-")
+    n := p.tok()
+    switch {
+    case negative && n.kind != intToken && n.kind != realToken:
+        return nil, p.unexpected("number after \"-\"")
+    case n.kind == paramToken:
+        p.advance()
+        return &Param{t.pos, n.text}, nil
+    case n.kind == stringToken:
+        p.advance()
+        return &Literal{t.pos, n.text}, nil
+    case n.is("true"), n.is("false"):
+        p.advance()
+        return &Literal{t.pos, n.is("true")}, nil
+    case n.kind == intToken:
+        text := n.text
+        if negative {
+            text = "-" + text
+        }
+        i, e := strconv.ParseInt(text, 10, 64)
+        if e != nil {
+            return nil, syntaxError(t.pos, "integer %s is out of range", text)
+        }
+        p.advance()
+        return &Literal{t.pos, i}, nil
+    case n.kind == realToken:
+        f, e := strconv.ParseFloat(n.text, 64)
+        if e != nil {
+            return nil, syntaxError(t.pos, "number %s is out of range", n.text)
+        }
+        if negative {
+            f = -f
+        }
+        p.advance()
+        return &Literal{t.pos, f}, nil
+    }
+    return nil, p.unexpected("value")
+}
+
+// Consumes the current token, which must be an identifier, or a keyword where it is
+// used as a name.
+func (p *parser) ident() *Ident {
+    t := p.advance()
+    return &Ident{t.pos, t.text}
+}
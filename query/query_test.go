@@ -0,0 +1,270 @@
+package query
+
+import (
+    "testing"
+)
+
+// The constructs sketched in main/query.txt, with the canonical form each parses to.
+var parseTests = []struct {
+    text string
+    expected string
+}{
+    // () denotes a vertex
+    {`()`, `()`},
+    {`(p)`, `(p)`},
+    {`(p <Person>)`, `(p <Person>)`},
+    {`(<Person> {name: "Ann"})`, `(<Person> {name: "Ann"})`},
+    {`p = (p2 <Person>)`, `p = (p2 <Person>)`},
+
+    // [] denotes an edge
+    {`[]`, `[]`},
+    {`[owns]`, `[owns]`},
+    {`[owns] from Person`, `[owns] from (<Person>)`},
+    {`[owns] to Asset`, `[owns] to (<Asset>)`},
+    {`[] FROM (a) TO (b)`, `[] from (a) to (b)`},
+
+    // {} denotes an attribute map
+    {`Person{}`, `(<Person> {})`},
+    {`Person{name: "Ann", age: 40, height: 1.75, active: true, debt: -12, ratio: -0.5,}`,
+        `(<Person> {name: "Ann", age: 40, height: 1.75, active: true, debt: -12, ratio: -0.5})`},
+    {`[owns {since: 2010, shared: false}]`, `[owns {since: 2010, shared: false}]`},
+    {`Thing{note: "say \"hi\"\n\tthen \\ leave", big: 1e3, small: 2.5E-2}`,
+        `(<Thing> {note: "say \"hi\"\n\tthen \\ leave", big: 1000.0, small: 0.025})`},
+
+    // < > denotes a class
+    {`<Person>`, `(<Person>)`},
+    {`<Person>{name: "Ann"}`, `(<Person> {name: "Ann"})`},
+
+    // the example query
+    {"e = [owns] FROM ClassName{name: \"someName\"} TO OtherClass;\nyield e",
+        `e = [owns] from (<ClassName> {name: "someName"}) to (<OtherClass>); yield e`},
+
+    // yields, separators, keywords, and comments
+    {`yield e, e.since, "text", 3`, `yield e, e.since, "text", 3`},
+    {`e = [owns]; yield e;`, `e = [owns]; yield e`},
+    {`E = [owns] From Person To Asset; YIELD E`, `E = [owns] from (<Person>) to (<Asset>); yield E`},
+    {"// everything Ann owns\ne = [owns] from Person{name: \"Ann\"} // the owner\n; yield e",
+        `e = [owns] from (<Person> {name: "Ann"}); yield e`},
+    {`Person{name: $name, age: $_2}; yield $name`, `(<Person> {name: $name, age: $_2}); yield $name`},
+
+    // edges can bind variables and match sequences of edges
+    {`[e <owns>] from (p)`, `[e <owns>] from (p)`},
+    {`[<owns> {since: 2010}]`, `[owns {since: 2010}]`},
+    {`[knows*1..3] from (a)`, `[knows *1..3] from (a)`},
+    {`[knows *2]; [*]; [* {x: 1}]; [*..3]; [*0..]; [*2..2]`, `[knows *2]; [*1..]; [*1.. {x: 1}]; [*1..3]; [*0..]; [*2]`},
+
+    // paths chain vertices and edges
+    {`(p <Person>)-[works_at]->(c <Company>)-[located_in]->(city <City>)`,
+        `(p <Person>)-[works_at]->(c <Company>)-[located_in]->(city <City>)`},
+    {`Person{name: "Ann"} -[r <knows>]-> (b) <-[<owns> *1..2]- Asset`,
+        `(<Person> {name: "Ann"})-[r <knows>]->(b)<-[owns *1..2]-(<Asset>)`},
+    {`(a)-[]->(b)<-[]-(a); yield a, b`, `(a)-[]->(b)<-[]-(a); yield a, b`},
+
+    // aggregates and grouping
+    {`yield count(*), COUNT(a), sum(a.value), avg(a.value), min(a.value), max(a.value), collect(a.name)`,
+        `yield count(*), count(a), sum(a.value), avg(a.value), min(a.value), max(a.value), collect(a.name)`},
+    {`[owns] from (p) to (a); yield p.name, count(a) GROUP BY p`, `[owns] from (p) to (a); yield p.name, count(a) group by p`},
+    {`yield p.name, a.kind, count(*) group by p, a.kind`, `yield p.name, a.kind, count(*) group by p, a.kind`},
+
+    // ordering and paging
+    {`yield p order by p.age DESC, p.name asc, count(*) skip 10 limit $size`,
+        `yield p order by p.age desc, p.name, count(*) skip 10 limit $size`},
+    {`yield p.name, count(a) group by p order by count(a) desc limit 3`, `yield p.name, count(a) group by p order by count(a) desc limit 3`},
+    {`yield p skip $from`, `yield p skip $from`},
+
+    // mutations
+    {`CREATE (p <Person> {name: "Ann", age: $age})`, `create (p <Person> {name: "Ann", age: $age})`},
+    {`create [e <owns> {since: 2010}] from (p) to (a)`, `create [e <owns> {since: 2010}] from (p) to (a)`},
+    {`merge Person{name: "Ann"}; merge [knows] FROM (a) TO (b)`, `merge (<Person> {name: "Ann"}); merge [knows] from (a) to (b)`},
+    {`set p.age = 41, e.since = $year, p.nick = q.name`, `set p.age = 41, e.since = $year, p.nick = q.name`},
+    {`p = Person; remove p.age, p.nick; delete p, e`, `p = (<Person>); remove p.age, p.nick; delete p, e`},
+
+    // keywords are names where a name is expected
+    {`Order{total: 5, limit: 2, From: 1}`, `(<Order> {total: 5, limit: 2, From: 1})`},
+    {`(p <Group>); yield p.limit, p.desc order by p.order desc limit 3`,
+        `(p <Group>); yield p.limit, p.desc order by p.order desc limit 3`},
+    {`set p.set = 1, p.by = q.group; remove p.delete`, `set p.set = 1, p.by = q.group; remove p.delete`},
+    {`Set{size: 3}; Create-[<Merge>]->(x <Delete>); [limit] from Order to Asc`,
+        `(<Set> {size: 3}); (<Create>)-[Merge]->(x <Delete>); [limit] from (<Order>) to (<Asc>)`},
+    {`create Set{size: 3}; merge [e <skip>] from Explain`, `create (<Set> {size: 3}); merge [e <skip>] from (<Explain>)`},
+    {`Profile{x: 1}`, `(<Profile> {x: 1})`},
+
+    // plans
+    {`EXPLAIN p = Person; yield p`, `explain p = (<Person>); yield p`},
+    {`profile create (v)`, `profile create (v)`},
+    {``, ``},
+}
+
+func TestParse (t *testing.T) {
+    for _, test := range parseTests {
+        q, err := Parse(test.text)
+        if err != nil {
+            t.Errorf("%q: %s", test.text, err)
+            continue
+        }
+        if q.String() != test.expected {
+            t.Errorf("%q: expected %s, got %s", test.text, test.expected, q)
+            continue
+        }
+        // the canonical form parses to the same query
+        if again, err := Parse(q.String()); err != nil || again.String() != q.String() {
+            t.Errorf("%q: canonical form %s did not parse back to itself", test.text, q)
+        }
+    }
+}
+
+func TestParseTree (t *testing.T) {
+    text := "e = [owns] FROM ClassName{name: \"someName\"} TO OtherClass;\nyield e.since"
+    q, err := Parse(text)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(q.Statements) != 2 {
+        t.Fatalf("expected 2 statements, got %d", len(q.Statements))
+    }
+
+    match, ok := q.Statements[0].(*MatchStatement)
+    if !ok {
+        t.Fatalf("expected a match statement, got %T", q.Statements[0])
+    }
+    edge, ok := match.Pattern.(*EdgePattern)
+    if !ok {
+        t.Fatalf("expected an edge pattern, got %T", match.Pattern)
+    }
+    if match.Var.Name != "e" || edge.Label.Name != "owns" || edge.From.Class.Name != "ClassName" ||
+        edge.To.Class.Name != "OtherClass" || edge.To.Attributes != nil {
+        t.Errorf("wrong match statement: %s", match)
+    }
+    if value := edge.From.Attributes.Entries[0].Value.(*Literal).Value; value != "someName" {
+        t.Errorf("wrong attribute value: %v", value)
+    }
+
+    yield, ok := q.Statements[1].(*YieldStatement)
+    if !ok {
+        t.Fatalf("expected a yield statement, got %T", q.Statements[1])
+    }
+    if p, ok := yield.Values[0].(*Property); !ok || p.Var.Name != "e" || p.Key.Name != "since" {
+        t.Errorf("wrong yield statement: %s", yield)
+    }
+
+    // positions are lines and columns in characters
+    positions := []struct {
+        node Node
+        line, column int
+    }{
+        {match, 1, 1},
+        {edge, 1, 5},
+        {edge.Label, 1, 6},
+        {edge.From, 1, 17},
+        {edge.From.Attributes, 1, 26},
+        {edge.From.Attributes.Entries[0].Value, 1, 33},
+        {edge.To, 1, 48},
+        {yield, 2, 1},
+        {yield.Values[0], 2, 7},
+    }
+    for _, p := range positions {
+        if pos := p.node.Pos(); pos.Line != p.line || pos.Column != p.column {
+            t.Errorf("%s: expected position %d:%d, got %s", p.node, p.line, p.column, pos)
+        }
+    }
+    if offset := edge.To.Pos().Offset; text[offset:offset + 10] != "OtherClass" {
+        t.Errorf("wrong offset %d", offset)
+    }
+
+    // edges in a path go from and to the vertices around them, in the direction of the arrow
+    q, err = Parse(`(a)-[r <knows>]->(b)<-[owns *2..]-(c)`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path, ok := q.Statements[0].(*MatchStatement).Pattern.(*PathPattern)
+    if !ok || len(path.Vertices) != 3 || len(path.Edges) != 2 {
+        t.Fatalf("expected a path of 3 vertices, got %s", q)
+    }
+    a, b, c := path.Vertices[0], path.Vertices[1], path.Vertices[2]
+    if knows := path.Edges[0]; knows.From != a || knows.To != b || knows.Var.Name != "r" || knows.Label.Name != "knows" {
+        t.Errorf("wrong first edge: %s", knows)
+    }
+    if owns := path.Edges[1]; owns.From != c || owns.To != b || owns.Length.Min != 2 || owns.Length.Max != -1 {
+        t.Errorf("wrong second edge: %s", owns)
+    }
+}
+
+func TestSyntaxErrors (t *testing.T) {
+    tests := []struct {
+        text string
+        expected string
+    }{
+        {`[owns`, `syntax error at 1:6: expected "]" to close edge, found end of query`},
+        {`[owns] FROM`, `syntax error at 1:12: expected vertex after FROM, found end of query`},
+        {`[owns] TO ;`, `syntax error at 1:11: expected vertex after TO, found ";"`},
+        {`(p <Person)`, `syntax error at 1:11: expected ">" to close class, found ")"`},
+        {`(p <>)`, `syntax error at 1:5: expected class name, found ">"`},
+        {`(p {name: "Ann"}`, `syntax error at 1:17: expected ")" to close vertex, found end of query`},
+        {`Person{name "Ann"}`, `syntax error at 1:13: expected ":" after attribute key, found string`},
+        {`Person{name: "Ann" age: 4}`, `syntax error at 1:20: expected "," or "}" in attributes, found "age"`},
+        {`Person{name: "Ann", name: "Bob"}`, `syntax error at 1:21: attribute name is given more than once`},
+        {`Person{name: Ann}`, `syntax error at 1:14: expected value, found "Ann"`},
+        {`Person{age: -"old"}`, `syntax error at 1:14: expected number after "-", found string`},
+        {`Person{age: 99999999999999999999}`, `syntax error at 1:13: integer 99999999999999999999 is out of range`},
+        {`Person{from 1}`, `syntax error at 1:13: expected ":" after attribute key, found "1"`},
+        {"Person{name: \"Ann}", `syntax error at 1:14: string is not terminated`},
+        {`Person{name: "A\qnn"}`, `syntax error at 1:16: unknown escape sequence in string`},
+        {`e = [owns] yield e`, `syntax error at 1:12: expected ";" after statement, found "yield"`},
+        {`yield`, `syntax error at 1:6: expected value, found end of query`},
+        {`yield e.`, `syntax error at 1:9: expected attribute key after ".", found end of query`},
+        {"e = [owns];\n  yield e @", `syntax error at 2:11: unexpected character '@'`},
+        {`Person{name: $}`, `syntax error at 1:14: expected parameter name after "$"`},
+        {`Person{name: -$name}`, `syntax error at 1:15: expected number after "-", found "$name"`},
+        {`= [owns]`, `syntax error at 1:1: expected pattern, found "="`},
+        {`[owns from]`, `syntax error at 1:7: expected "]" to close edge, found "from"`},
+        {`[;]`, `syntax error at 1:2: expected "]" or edge label, found ";"`},
+        {`[e <>]`, `syntax error at 1:5: expected label name, found ">"`},
+        {`[e <owns]`, `syntax error at 1:9: expected ">" to close label, found "]"`},
+        {`[knows *3..1]`, `syntax error at 1:8: the length *3..1 has a maximum below its minimum`},
+        {`[knows *1..x]`, `syntax error at 1:12: expected "]" to close edge, found "x"`},
+        {`[knows *99999999999]`, `syntax error at 1:9: integer 99999999999 is out of range`},
+        {`(a)-(b)`, `syntax error at 1:5: expected "[" to start edge, found "("`},
+        {`(a)-[knows]-(b)`, `syntax error at 1:12: expected "->" after edge, found "-"`},
+        {`(a)<-[knows]->(b)`, `syntax error at 1:13: expected "-" after edge, found "->"`},
+        {`(a)-[knows]->`, `syntax error at 1:14: expected vertex after edge, found end of query`},
+        {`p = (a)-[knows]->(b)`, `syntax error at 1:1: a path can not be assigned to a variable`},
+        {`yield total(a)`, `syntax error at 1:7: unknown function total`},
+        {`yield sum(*)`, `syntax error at 1:11: only count can be applied to *`},
+        {`yield count(max(a))`, `syntax error at 1:13: aggregate functions can not be nested`},
+        {`yield count(a`, `syntax error at 1:14: expected ")" to close call, found end of query`},
+        {`yield a group p`, `syntax error at 1:15: expected "by" after GROUP, found "p"`},
+        {`yield count(a) group by count(a)`, `syntax error at 1:25: can not group by an aggregate function`},
+        {`yield p order p.age`, `syntax error at 1:15: expected "by" after ORDER, found "p"`},
+        {`yield p order by p.age up`, `syntax error at 1:24: expected ";" after statement, found "up"`},
+        {`yield p limit -1`, `syntax error at 1:15: expected number of rows after LIMIT, found "-"`},
+        {`yield p skip "a"`, `syntax error at 1:14: expected number of rows after SKIP, found string`},
+        {`yield p limit 1 skip 1`, `syntax error at 1:17: expected ";" after statement, found "skip"`},
+        {`create`, `syntax error at 1:7: expected pattern, found end of query`},
+        {`p = Person; explain yield p`, `syntax error at 1:13: expected pattern, found "explain"`},
+        {`explain profile yield 1`, `syntax error at 1:9: expected pattern, found "profile"`},
+        {`set p = 1`, `syntax error at 1:7: expected "." after variable, found "="`},
+        {`set p.age 1`, `syntax error at 1:11: expected "=" after attribute, found "1"`},
+        {`set p.age = count(p)`, `syntax error at 1:13: aggregate functions can only be used in yield statements`},
+        {`set 1`, `syntax error at 1:5: expected variable, found "1"`},
+        {`remove p.`, `syntax error at 1:10: expected attribute key after ".", found end of query`},
+        {`delete p.age`, `syntax error at 1:9: expected ";" after statement, found "."`},
+        {`delete`, `syntax error at 1:7: expected variable, found end of query`},
+        {`order by p`, `syntax error at 1:1: expected pattern, found "order"`},
+        {`yield limit`, `syntax error at 1:7: expected value, found "limit"`},
+        {`delete set`, `syntax error at 1:8: expected variable, found "set"`},
+        {`[set <owns>]`, `syntax error at 1:2: expected "]" or edge label, found "set"`},
+    }
+    for _, test := range tests {
+        _, err := Parse(test.text)
+        if err == nil {
+            t.Errorf("%q: expected an error", test.text)
+            continue
+        }
+        if _, ok := err.(*SyntaxError); !ok {
+            t.Errorf("%q: expected a *SyntaxError, got %T", test.text, err)
+        }
+        if err.Error() != test.expected {
+            t.Errorf("%q:\nexpected %s\n     got %s", test.text, test.expected, err)
+        }
+    }
+}
@@ -1,49 +1,89 @@
 package util
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"math"
 )
 
+var errShortBuffer = errors.New("buffer too short for conversion")
+
+// The Put and plain conversion functions below work directly on caller supplied
+// buffers and do not allocate. They panic if the buffer is too short, so they are
+// meant for fixed size records where the length is already known.
+
+// PutUint64 encodes n into the first 8 bytes of b.
+func PutUint64(b []byte, n uint64) {
+	binary.LittleEndian.PutUint64(b, n)
+}
+
+// Uint64 decodes the first 8 bytes of b.
+func Uint64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+// PutUint32 encodes n into the first 4 bytes of b.
+func PutUint32(b []byte, n uint32) {
+	binary.LittleEndian.PutUint32(b, n)
+}
+
+// Uint32 decodes the first 4 bytes of b.
+func Uint32(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
+
+// PutUint16 encodes n into the first 2 bytes of b.
+func PutUint16(b []byte, n uint16) {
+	binary.LittleEndian.PutUint16(b, n)
+}
+
+// Uint16 decodes the first 2 bytes of b.
+func Uint16(b []byte) uint16 {
+	return binary.LittleEndian.Uint16(b)
+}
+
+// PutFloat64 encodes f into the first 8 bytes of b.
+func PutFloat64(b []byte, f float64) {
+	binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+}
 
 func BytesToUint64(b []byte) (res uint64, err error) {
-	buf := bytes.NewReader(b)
-	err = binary.Read(buf, binary.LittleEndian, &res)
-	return
+	if len(b) < 8 {
+		return 0, errShortBuffer
+	}
+	return Uint64(b), nil
 }
 
 func Uint64ToBytes(n uint64) (res []byte, err error) {
-	buf := new (bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, n)
-	res = buf.Bytes()
+	res = make([]byte, 8)
+	PutUint64(res, n)
 	return
 }
 
 func BytesToUint32(b []byte) (res uint32, err error) {
-	buf := bytes.NewReader(b)
-	err = binary.Read(buf, binary.LittleEndian, &res)
-	return
+	if len(b) < 4 {
+		return 0, errShortBuffer
+	}
+	return Uint32(b), nil
 }
 
 func Uint32ToBytes(n uint32) (res []byte, err error) {
-	buf := new (bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, n)
-	res = buf.Bytes()
+	res = make([]byte, 4)
+	PutUint32(res, n)
 	return
 }
 
 
 func BytesToUint16(b []byte) (res uint16, err error){
-	buf := bytes.NewReader(b)
-	err = binary.Read(buf, binary.LittleEndian, &res)
-	return
+	if len(b) < 2 {
+		return 0, errShortBuffer
+	}
+	return Uint16(b), nil
 }
 
 func Uint16ToBytes(n uint16) (res []byte, err error) {
-	buf := new (bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, n)
-	res = buf.Bytes()
+	res = make([]byte, 2)
+	PutUint16(res, n)
 	return
 }
 
@@ -54,8 +94,7 @@ func BytesToFloat64(b []byte) float64 {
 }
 
 func Float64ToBytes(f float64) []byte {
-	bits := math.Float64bits(f)
 	bytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(bytes, bits)
+	PutFloat64(bytes, f)
 	return bytes
 }